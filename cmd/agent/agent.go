@@ -1,9 +1,12 @@
 package agent
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/digitalocean/do-dcgm-exporter/pkg"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
@@ -14,10 +17,8 @@ var (
 	dcgmExporterVersion string
 	// buildDate is the date when the binary was build
 	buildDate string
-	// showDebugLogs is a flag to enable debug logs
-	showDebugLogs bool
-	// additionalFieldsPath is the path to a file containing additional DCGM fields to monitor
-	additionalFieldsPath string
+	// agentOptions are the user-provided settings of the agent, set via flags
+	agentOptions pkg.Options
 
 	rootCommand = &cobra.Command{
 		Use:     "do-dcgm-exporter",
@@ -28,11 +29,11 @@ var (
 			return cmd.ParseFlags(args)
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if showDebugLogs {
-				logrus.SetLevel(logrus.DebugLevel)
+			if err := pkg.ConfigureLogging(agentOptions.LogFormat, agentOptions.LogLevel, agentOptions.Debug); err != nil {
+				return err
 			}
 
-			agent, err := pkg.NewGPUMetricsAgent(additionalFieldsPath, showDebugLogs)
+			agent, err := pkg.NewGPUMetricsAgent(agentOptions)
 			if err != nil {
 				return err
 			}
@@ -50,17 +51,276 @@ var (
 
 func init() {
 	rootCommand.Flags().BoolVar(
-		&showDebugLogs,
+		&agentOptions.Debug,
 		"debug",
 		false,
-		"show debug logs")
+		"show debug logs, a shorthand for --log-level debug")
+
+	rootCommand.Flags().StringVar(
+		&agentOptions.LogFormat,
+		"log-format",
+		pkg.LogFormatText,
+		fmt.Sprintf("Format of the logs: %s. journald logs natively to the journal, with the log level as priority and the fields as journal fields", strings.Join(pkg.LogFormats, ", ")))
+
+	rootCommand.Flags().StringVar(
+		&agentOptions.LogLevel,
+		"log-level",
+		"info",
+		"Minimum level of the logs: trace, debug, info, warning, error")
 
 	rootCommand.Flags().StringVar(
-		&additionalFieldsPath,
+		&agentOptions.AdditionalFieldsPath,
 		"collectors", // compatibility with dcgm-exporter
 		"",
 		"Path to the file, that contains additional DCGM fields to collect. These are fields beyond the default fields that are always collected")
 
+	rootCommand.Flags().BoolVar(
+		&agentOptions.ProcessAttribution,
+		"process-attribution",
+		false,
+		"Label GPU metrics with the systemd unit, container_id and container_name of the processes holding the GPU open. Requires permissions to read /proc/<pid>/fd of all processes")
+
+	// the following flags have the same names as the dcgm-exporter flags
+	rootCommand.Flags().BoolVar(
+		&agentOptions.Kubernetes,
+		"kubernetes",
+		false,
+		"Label GPU metrics with the pod, namespace and container the GPU is allocated to, obtained from the kubelet pod-resources API")
+
+	rootCommand.Flags().StringVar(
+		&agentOptions.KubernetesGPUIdType,
+		"kubernetes-gpu-id-type",
+		"uid",
+		"Type of GPU id the kubelet device plugin reports GPUs with. One of: uid, device-name")
+
+	rootCommand.Flags().StringVar(
+		&agentOptions.PodResourcesKubeletSocket,
+		"pod-resources-kubelet-socket",
+		pkg.DefaultPodResourcesKubeletSocket,
+		"Path to the kubelet pod-resources API socket")
+
+	rootCommand.Flags().StringSliceVar(
+		&agentOptions.NvidiaResourceNames,
+		"nvidia-resource-names",
+		nil,
+		"Comma-separated list of additional Kubernetes resource names that map to GPUs, besides nvidia.com/gpu")
+
+	rootCommand.Flags().StringVar(
+		&agentOptions.HPCJobMappingDir,
+		"hpc-job-mapping-dir",
+		"",
+		"Directory containing one file per GPU index listing the HPC jobs using the GPU. Adds the hpc_job label to GPU metrics")
+
+	rootCommand.Flags().BoolVar(
+		&agentOptions.DropletMetadata,
+		"droplet-metadata",
+		false,
+		"Fetch the droplet metadata from the metadata service and export it as do_droplet_info metric")
+
+	rootCommand.Flags().StringSliceVar(
+		&agentOptions.DropletMetadataLabels,
+		"droplet-metadata-labels",
+		nil,
+		fmt.Sprintf("Comma-separated list of droplet metadata labels added to every exported series. Requires --droplet-metadata. Supported: %s", strings.Join(pkg.DropletMetadataLabels, ", ")))
+
+	rootCommand.Flags().DurationVar(
+		&agentOptions.DropletMetadataRefreshInterval,
+		"droplet-metadata-refresh-interval",
+		10*time.Minute,
+		"How often the droplet metadata is refreshed")
+
+	rootCommand.Flags().IntVar(
+		&agentOptions.ExpectedNVLinks,
+		"expected-nvlinks",
+		0,
+		"Number of NVLinks expected to be up per GPU. GPUs with fewer active NVLinks are reported as degraded. If 0, derived from the GPU model (e.g. 18 for H100 SXM)")
+
+	rootCommand.Flags().StringSliceVar(
+		&agentOptions.GPUs,
+		"gpus",
+		nil,
+		"Comma-separated list of GPUs to watch, by index, UUID (GPU-...) or PCI bus id (e.g. 00000000:2A:00.0). All GPUs if empty")
+
+	rootCommand.Flags().StringSliceVar(
+		&agentOptions.ExcludeGPUs,
+		"exclude-gpus",
+		nil,
+		"Comma-separated list of GPUs not to watch, by index, UUID (GPU-...) or PCI bus id, e.g. a GPU dedicated to a display or passed through to a VM")
+
+	rootCommand.Flags().StringSliceVar(
+		&agentOptions.NVSwitches,
+		"nvswitches",
+		nil,
+		"Comma-separated list of NVSwitches to watch, by index. All NVSwitches if empty")
+
+	rootCommand.Flags().StringSliceVar(
+		&agentOptions.ExcludeNVSwitches,
+		"exclude-nvswitches",
+		nil,
+		"Comma-separated list of NVSwitches not to watch, by index")
+
+	rootCommand.Flags().StringSliceVar(
+		&agentOptions.NVLinks,
+		"nvlinks",
+		nil,
+		"Comma-separated list of NVSwitch links to watch, by <NVSwitch index>/<link index> (e.g. 0/3), or by link index on all NVSwitches. All links if empty")
+
+	rootCommand.Flags().StringSliceVar(
+		&agentOptions.ExcludeNVLinks,
+		"exclude-nvlinks",
+		nil,
+		"Comma-separated list of NVSwitch links not to watch, by <NVSwitch index>/<link index> (e.g. 0/3), or by link index on all NVSwitches")
+
+	rootCommand.Flags().StringVar(
+		&agentOptions.APIAddress,
+		"api-address",
+		"",
+		"Address of the API server serving operational endpoints (e.g. POST /diag), e.g. localhost:9402. Disabled if empty")
+
+	rootCommand.Flags().StringVar(
+		&agentOptions.APITokenFile,
+		"api-token-file",
+		"",
+		"Path to the file containing the bearer token required by the API server")
+
+	rootCommand.Flags().StringArrayVar(
+		&agentOptions.SampleStats,
+		"sample-stats",
+		nil,
+		"GPU field sampled every --sample-interval, exported as statistics of its samples per collection window, e.g. DCGM_FI_DEV_POWER_USAGE=max,avg,p95 exports DCGM_FI_DEV_POWER_USAGE_max, _avg and _p95. Statistics: min, max, avg, p<percentile>. Defaults to min,max,avg. Repeatable")
+
+	rootCommand.Flags().DurationVar(
+		&agentOptions.SampleInterval,
+		"sample-interval",
+		pkg.DefaultSampleInterval,
+		"How often the fields of --sample-stats are sampled by DCGM. At least 100ms, and shorter than the collection interval (20s)")
+
+	rootCommand.Flags().DurationVar(
+		&agentOptions.RediscoveryInterval,
+		"rediscovery-interval",
+		pkg.DefaultRediscoveryInterval,
+		"How often the GPUs, MIG instances, NVSwitches and NVLinks are re-discovered, to notice hot-added, lost or reconfigured hardware without a restart. Disabled if 0")
+
+	rootCommand.Flags().DurationVar(
+		&agentOptions.DiagInterval,
+		"diag-interval",
+		0,
+		"How often a quick DCGM diagnostic (level 1) is run in the background, e.g. 24h. Only runs while all GPUs are idle. Disabled if 0")
+
+	rootCommand.Flags().DurationVar(
+		&agentOptions.DiagIdleLookback,
+		"diag-idle-lookback",
+		10*time.Minute,
+		"How long all GPUs must have been idle (DCGM_FI_PROF_GR_ENGINE_ACTIVE < 1%, DCGM_FI_DEV_FB_USED_PERCENT < 5%) before a scheduled diagnostic runs")
+
+	rootCommand.Flags().StringVar(
+		&agentOptions.SimulateScenario,
+		"simulate",
+		"",
+		"Path to a scenario file of simulated GPUs, MIG instances, NVSwitches and field values. Replaces DCGM to run the agent without GPUs, e.g. for testing")
+
+	rootCommand.Flags().StringSliceVar(
+		&agentOptions.Addresses,
+		"address", // compatibility with dcgm-exporter
+		[]string{pkg.DefaultAddress},
+		"Addresses the /metrics endpoint listens on, repeatable or comma-separated. Use the VPC interface (e.g. 10.116.0.2:9401) to be scraped from other droplets, or :9401 to listen on all interfaces")
+
+	rootCommand.Flags().StringVar(
+		&agentOptions.WebConfigFile,
+		"web-config-file", // compatibility with dcgm-exporter
+		"",
+		"Path to the exporter-toolkit web config file, configuring TLS, basic auth users and client certificates of the /metrics endpoint. See https://github.com/prometheus/exporter-toolkit/blob/master/docs/web-configuration.md")
+
+	rootCommand.Flags().BoolVar(
+		&agentOptions.WebSystemdSocket,
+		"web-systemd-socket", // compatibility with dcgm-exporter
+		false,
+		"Serve /metrics on the sockets passed by systemd socket activation, instead of listening on --address")
+
+	rootCommand.Flags().StringVar(
+		&agentOptions.DebugAddress,
+		"debug-listen",
+		"",
+		"Address of the debug server serving pprof (/debug/pprof/), expvar (/debug/vars) and the internal state (/debug/state), e.g. 127.0.0.1:6060. Disabled if empty. Only loopback addresses are allowed, as the endpoints are not authenticated")
+
+	rootCommand.Flags().BoolVar(
+		&agentOptions.DebugAllowRemote,
+		"debug-listen-allow-remote",
+		false,
+		"Allow the debug server to listen on a non-loopback address. The debug endpoints expose the internal state of the agent without authentication")
+
+	rootCommand.Flags().StringVar(
+		&agentOptions.PushURL,
+		"push-url",
+		pkg.DefaultPushURL,
+		"URL the metrics are pushed to. Defaults to the DO proxy reachable from droplets. Use https:// to push via TLS")
+
+	rootCommand.Flags().StringVar(
+		&agentOptions.PushCAFile,
+		"push-ca-file",
+		"",
+		"Path to the PEM encoded CA certificates verifying the push server. The system CAs are used if empty")
+
+	rootCommand.Flags().StringVar(
+		&agentOptions.PushClientCertFile,
+		"push-client-cert-file",
+		"",
+		"Path to the PEM encoded client certificate authenticating the agent to the push server (mTLS). Requires --push-client-key-file")
+
+	rootCommand.Flags().StringVar(
+		&agentOptions.PushClientKeyFile,
+		"push-client-key-file",
+		"",
+		"Path to the PEM encoded key of the client certificate")
+
+	rootCommand.Flags().StringVar(
+		&agentOptions.PushServerName,
+		"push-server-name",
+		"",
+		"Server name (SNI) used to verify the push server. Derived from --push-url if empty")
+
+	rootCommand.Flags().StringVar(
+		&agentOptions.PushBearerTokenFile,
+		"push-bearer-token-file",
+		"",
+		"Path to the file containing the bearer token the pushes are authenticated with. Re-read when it changes")
+
+	rootCommand.Flags().StringVar(
+		&agentOptions.PushBasicAuthFile,
+		"push-basic-auth-file",
+		"",
+		"Path to the file containing \"username:password\" the pushes are authenticated with. Re-read when it changes")
+
+	rootCommand.Flags().StringArrayVar(
+		&agentOptions.PushHeaders,
+		"push-header",
+		nil,
+		"Static header added to the pushes, as \"Name: value\". Can be repeated")
+
+	rootCommand.Flags().IntVar(
+		&agentOptions.PushQueueSize,
+		"push-queue-size",
+		10,
+		"Number of collected metric batches queued to be pushed. The batches are pushed one at a time, in the order they were collected")
+
+	rootCommand.Flags().StringVar(
+		&agentOptions.PushQueueOverflow,
+		"push-queue-overflow",
+		pkg.PushOverflowDropOldest,
+		fmt.Sprintf("Which batches are dropped if the push queue is full. One of: %s", strings.Join(pkg.PushOverflowPolicies, ", ")))
+
+	rootCommand.Flags().StringVar(
+		&agentOptions.PushSpoolDir,
+		"push-spool-dir",
+		"",
+		"Directory the metrics that could not be pushed on shutdown are persisted to, and pushed from after the next start, e.g. /var/lib/do-dcgm-exporter/spool. The metrics are dropped if empty")
+
+	rootCommand.Flags().DurationVar(
+		&agentOptions.ShutdownGracePeriod,
+		"shutdown-grace-period",
+		10*time.Second,
+		"How long the agent takes to stop collecting, push the queued metrics and disconnect from DCGM on shutdown at most")
+
 }
 
 func NewCommandStartAgent() *cobra.Command {
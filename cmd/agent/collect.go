@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"errors"
+	"os"
+
+	"github.com/digitalocean/do-dcgm-exporter/pkg"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// collectOnce must be set, as continuous collection is what the root command does
+	collectOnce bool
+	// collectFormat is the output format of the collected metrics: prom, json, openmetrics
+	collectFormat string
+	// collectPush pushes the collected metrics to the DO proxy once
+	collectPush bool
+
+	// collectAgentFlags are the flags of the root command, that change which metrics are collected and how they are labeled, and where they are pushed to
+	collectAgentFlags = []string{
+		"debug",
+		"log-format",
+		"log-level",
+		"collectors",
+		"process-attribution",
+		"kubernetes",
+		"kubernetes-gpu-id-type",
+		"pod-resources-kubelet-socket",
+		"nvidia-resource-names",
+		"hpc-job-mapping-dir",
+		"droplet-metadata",
+		"droplet-metadata-labels",
+		"expected-nvlinks",
+		"gpus",
+		"exclude-gpus",
+		"nvswitches",
+		"exclude-nvswitches",
+		"nvlinks",
+		"exclude-nvlinks",
+		"sample-stats",
+		"sample-interval",
+		"simulate",
+		"push-url",
+		"push-ca-file",
+		"push-client-cert-file",
+		"push-client-key-file",
+		"push-server-name",
+		"push-bearer-token-file",
+		"push-basic-auth-file",
+		"push-header",
+	}
+
+	collectCmd = &cobra.Command{
+		Use:     "collect",
+		Short:   "collect the metrics once and print them",
+		Long:    "collect the metrics of all collectors once, without waiting for the collect interval, print them to stdout, and optionally push them to the DO proxy",
+		Example: "do-dcgm-exporter collect --once --format json --collectors /etc/do-dcgm-exporter/collectors.csv",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !collectOnce {
+				return errors.New("collect requires --once. Run do-dcgm-exporter without a command to collect continuously")
+			}
+			if err := pkg.ValidateCollectFormat(collectFormat); err != nil {
+				return err
+			}
+
+			// keep stdout clean for the metrics
+			logrus.SetOutput(os.Stderr)
+			if err := pkg.ConfigureLogging(agentOptions.LogFormat, agentOptions.LogLevel, agentOptions.Debug); err != nil {
+				return err
+			}
+
+			agent, err := pkg.NewGPUMetricsAgent(agentOptions)
+			if err != nil {
+				return err
+			}
+
+			return agent.CollectOnce(os.Stdout, collectFormat, collectPush)
+		},
+		SilenceUsage: true,
+	}
+)
+
+func init() {
+	collectCmd.Flags().BoolVar(&collectOnce, "once", false, "Collect the metrics once and exit. Required")
+	collectCmd.Flags().StringVar(&collectFormat, "format", pkg.CollectFormatProm, "Output format: prom (as pushed to the DO proxy), json, openmetrics")
+	collectCmd.Flags().BoolVar(&collectPush, "push", false, "Push the collected metrics to the DO proxy (or --push-url) once")
+
+	for _, name := range collectAgentFlags {
+		collectCmd.Flags().AddFlag(rootCommand.Flags().Lookup(name))
+	}
+
+	rootCommand.AddCommand(collectCmd)
+}
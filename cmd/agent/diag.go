@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/digitalocean/do-dcgm-exporter/pkg"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// diagLevel is the level of the DCGM diagnostic: 1 (quick), 2 (medium), 3 (long)
+	diagLevel int
+	// diagGPUs are the GPUs to run the diagnostic on. All GPUs if empty
+	diagGPUs []uint
+	// diagOutput is the output format of the diagnostic report: table, json
+	diagOutput string
+
+	diagCmd = &cobra.Command{
+		Use:     "diag",
+		Short:   "run a DCGM diagnostic on the GPUs",
+		Long:    "run a DCGM diagnostic on the GPUs via the nv-hostengine, and print the results",
+		Example: "do-dcgm-exporter diag --level 1 --gpus 0,1 --output json",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := pkg.ValidateDiagLevel(diagLevel); err != nil {
+				return err
+			}
+			if diagOutput != "table" && diagOutput != "json" {
+				return fmt.Errorf("unsupported output %q, must be one of: table, json", diagOutput)
+			}
+
+			// keep stdout clean for the report
+			logrus.SetOutput(os.Stderr)
+
+			agent, err := pkg.NewGPUMetricsAgent(pkg.Options{SimulateScenario: agentOptions.SimulateScenario})
+			if err != nil {
+				return err
+			}
+
+			report, err := agent.RunDiag(diagLevel, diagGPUs)
+			if err != nil {
+				return err
+			}
+
+			if diagOutput == "json" {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				err = encoder.Encode(report)
+			} else {
+				err = report.WriteTable(os.Stdout)
+			}
+			if err != nil {
+				return err
+			}
+
+			if !report.Passed {
+				return fmt.Errorf("diagnostic level %d failed", diagLevel)
+			}
+			return nil
+		},
+		SilenceUsage: true,
+	}
+)
+
+func init() {
+	diagCmd.Flags().IntVar(&diagLevel, "level", 1, "Diagnostic level: 1 (quick), 2 (medium), 3 (long)")
+	diagCmd.Flags().UintSliceVar(&diagGPUs, "gpus", nil, "Comma-separated list of GPU ids to run the diagnostic on. All GPUs if empty")
+	diagCmd.Flags().StringVarP(&diagOutput, "output", "o", "table", "Output format: table, json")
+	diagCmd.Flags().AddFlag(rootCommand.Flags().Lookup("simulate"))
+
+	rootCommand.AddCommand(diagCmd)
+}
@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/digitalocean/do-dcgm-exporter/pkg"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// discoverOutput is the output format of the discovery: table, json
+	discoverOutput string
+	// discoverCollectorsFile is the collectors file with additional fields, to include them in the watched fields
+	discoverCollectorsFile string
+
+	discoverCmd = &cobra.Command{
+		Use:     "discover",
+		Short:   "print the GPUs, MIG instances, NVSwitches, NVLinks and CPUs discovered via DCGM",
+		Long:    "print the GPUs, MIG instances, NVSwitches, NVLinks and CPUs discovered via the nv-hostengine, whether they are excluded by the selection, the supported profiling metric groups, and the fields watched for each entity group",
+		Example: "do-dcgm-exporter discover --output json",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if discoverOutput != "table" && discoverOutput != "json" {
+				return fmt.Errorf("unsupported output %q, must be one of: table, json", discoverOutput)
+			}
+
+			// keep stdout clean for the discovery
+			logrus.SetOutput(os.Stderr)
+
+			agent, err := pkg.NewGPUMetricsAgent(pkg.Options{
+				AdditionalFieldsPath: discoverCollectorsFile,
+				SimulateScenario:     agentOptions.SimulateScenario,
+				GPUs:                 agentOptions.GPUs,
+				ExcludeGPUs:          agentOptions.ExcludeGPUs,
+				NVSwitches:           agentOptions.NVSwitches,
+				ExcludeNVSwitches:    agentOptions.ExcludeNVSwitches,
+				NVLinks:              agentOptions.NVLinks,
+				ExcludeNVLinks:       agentOptions.ExcludeNVLinks,
+			})
+			if err != nil {
+				return err
+			}
+
+			discovery, err := agent.Discover()
+			if err != nil {
+				return err
+			}
+
+			if discoverOutput == "json" {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(discovery)
+			}
+			return discovery.WriteTable(os.Stdout)
+		},
+		SilenceUsage: true,
+	}
+)
+
+func init() {
+	discoverCmd.Flags().StringVarP(&discoverOutput, "output", "o", "table", "Output format: table, json")
+	discoverCmd.Flags().StringVar(&discoverCollectorsFile, "collectors", "", "Path to the collectors file with additional fields, as passed to the agent")
+	discoverCmd.Flags().AddFlag(rootCommand.Flags().Lookup("simulate"))
+	// the entities excluded by the selection are listed as excluded
+	for _, name := range []string{"gpus", "exclude-gpus", "nvswitches", "exclude-nvswitches", "nvlinks", "exclude-nvlinks"} {
+		discoverCmd.Flags().AddFlag(rootCommand.Flags().Lookup(name))
+	}
+
+	rootCommand.AddCommand(discoverCmd)
+}
@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/digitalocean/do-dcgm-exporter/pkg"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// fieldsGrep is the case-insensitive regular expression the listed field names must match
+	fieldsGrep string
+
+	fieldsCmd = &cobra.Command{
+		Use:   "fields",
+		Short: "list and validate DCGM fields",
+		Long:  "list the DCGM fields, and validate collectors files (--collectors). Works without GPUs, using the field table embedded into the binary",
+	}
+
+	fieldsListCmd = &cobra.Command{
+		Use:     "list",
+		Short:   "list the DCGM fields",
+		Long:    "list the name, id, type and entity level of the DCGM fields, and whether the field is collected by default",
+		Example: "do-dcgm-exporter fields list --grep nvlink",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fields, err := pkg.ListFields(fieldsGrep)
+			if err != nil {
+				return err
+			}
+
+			tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintf(tw, "NAME\tID\tTYPE\tENTITY\tDEFAULT\n")
+			for _, field := range fields {
+				fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%t\n", field.Name, field.ID, field.Type, field.EntityLevel, field.Default)
+			}
+			return tw.Flush()
+		},
+		SilenceUsage: true,
+	}
+
+	fieldsValidateCmd = &cobra.Command{
+		Use:     "validate <file>",
+		Short:   "validate a collectors file",
+		Long:    "validate a collectors file (--collectors) without connecting to DCGM, using the field types of the embedded field table. Fails on errors, but not on warnings",
+		Example: "do-dcgm-exporter fields validate /etc/do-dcgm-exporter/collectors.csv",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			problems, err := pkg.ValidateCollectorsFile(args[0])
+			if err != nil {
+				return err
+			}
+
+			errorCount := 0
+			for _, problem := range problems {
+				fmt.Println(problem.String())
+				if problem.Severity == pkg.FieldProblemError {
+					errorCount++
+				}
+			}
+
+			if errorCount > 0 {
+				return fmt.Errorf("%s: %d error(s)", args[0], errorCount)
+			}
+
+			fmt.Printf("%s: OK (%d warning(s))\n", args[0], len(problems))
+			return nil
+		},
+		SilenceUsage: true,
+	}
+)
+
+func init() {
+	fieldsListCmd.Flags().StringVar(&fieldsGrep, "grep", "", "Only list fields whose name matches the case-insensitive regular expression")
+
+	fieldsCmd.AddCommand(fieldsListCmd)
+	fieldsCmd.AddCommand(fieldsValidateCmd)
+	rootCommand.AddCommand(fieldsCmd)
+}
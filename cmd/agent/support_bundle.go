@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"os"
+
+	"github.com/digitalocean/do-dcgm-exporter/pkg"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var (
+	// supportBundleOutput is the path of the support bundle
+	supportBundleOutput string
+
+	supportBundleCmd = &cobra.Command{
+		Use:   "support-bundle",
+		Short: "write a support bundle for GPU tickets",
+		Long: `write a gzipped tarball with the agent version and config (secrets redacted), a metrics snapshot, the discovered devices,
+the nv-hostengine introspection, the recent pushes and errors of the running agent, the systemd unit status and logs, nvidia-smi -q and dcgmi discovery -l.
+Pass the same flags as the running agent, to resolve the same config. Works without DCGM, the failures are included in the bundle instead.`,
+		Example: "do-dcgm-exporter support-bundle -o bundle.tar.gz --api-address localhost:9402 --api-token-file /etc/do-dcgm-exporter/api-token",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := pkg.ConfigureLogging(agentOptions.LogFormat, agentOptions.LogLevel, agentOptions.Debug); err != nil {
+				return err
+			}
+
+			agent, err := pkg.NewGPUMetricsAgent(agentOptions)
+			if err != nil {
+				return err
+			}
+
+			f, err := os.OpenFile(supportBundleOutput, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return errors.Wrap(err, "failed to create the support bundle")
+			}
+			defer f.Close()
+
+			if err := agent.WriteSupportBundle(f, versionInfo()); err != nil {
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return errors.Wrap(err, "failed to write the support bundle")
+			}
+
+			logrus.Infof("Support bundle written to %s", supportBundleOutput)
+			return nil
+		},
+		SilenceUsage: true,
+	}
+)
+
+func init() {
+	supportBundleCmd.Flags().StringVarP(&supportBundleOutput, "output", "o", "do-dcgm-exporter-support-bundle.tar.gz", "Path of the support bundle")
+
+	// all flags of the agent, to resolve the config of the running agent
+	rootCommand.Flags().VisitAll(func(flag *pflag.Flag) {
+		supportBundleCmd.Flags().AddFlag(flag)
+	})
+
+	rootCommand.AddCommand(supportBundleCmd)
+}
@@ -14,7 +14,16 @@ var (
 		Long:    "show the version of the DigitalOcean GPU Metrics Agent",
 		Example: "doGPUMetricsAgent version",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			fmt.Printf(`DigitalOcean GPU Metrics Agent:
+			fmt.Print(versionInfo())
+
+			return nil
+		},
+	}
+)
+
+// versionInfo returns the version info printed by the version command
+func versionInfo() string {
+	return fmt.Sprintf(`DigitalOcean GPU Metrics Agent:
 		version                     : %s
 		dcgm-exporter version       : %s
 		build date                  : %s
@@ -22,11 +31,7 @@ var (
 		go compiler                 : %s
 		platform                    : %s/%s
 `, version, dcgmExporterVersion, buildDate, runtime.Version(), runtime.Compiler, runtime.GOOS, runtime.GOARCH)
-
-			return nil
-		},
-	}
-)
+}
 
 func init() {
 	rootCommand.AddCommand(versionCmd)
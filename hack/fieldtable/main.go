@@ -0,0 +1,76 @@
+// fieldtable prints the DCGM field table embedded into the agent (pkg/dcgm_fields.csv), from the field constants of go-dcgm.
+// - the field metadata (type, entity level) is read from the DCGM library, hence, requires DCGM installed (but no GPU)
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+)
+
+// entityLevels are the names of the entity levels used in the field table
+var entityLevels = map[dcgm.Field_Entity_Group]string{
+	dcgm.FE_NONE:     "global",
+	dcgm.FE_GPU:      "gpu",
+	dcgm.FE_VGPU:     "vgpu",
+	dcgm.FE_SWITCH:   "switch",
+	dcgm.FE_GPU_I:    "gpu_i",
+	dcgm.FE_GPU_CI:   "gpu_ci",
+	dcgm.FE_LINK:     "link",
+	dcgm.FE_CPU:      "cpu",
+	dcgm.FE_CPU_CORE: "cpu_core",
+}
+
+// placeholders are the names in dcgm.DCGM_FI that are no fields
+var placeholders = map[string]bool{
+	"DCGM_FI_UNKNOWN":                 true,
+	"DCGM_FI_MAX_FIELDS":              true,
+	"DCGM_FI_INTERNAL_FIELDS_0_START": true,
+	"DCGM_FI_INTERNAL_FIELDS_0_END":   true,
+}
+
+func main() {
+	// the embedded hostengine loads the DCGM library, the field metadata is static and doesn't require GPUs
+	cleanup, err := dcgm.Init(dcgm.Embedded)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load DCGM: %s\n", err)
+		os.Exit(1)
+	}
+	defer cleanup()
+
+	dcgm.FieldsInit()
+	defer dcgm.FieldsTerm()
+
+	names := make([]string, 0, len(dcgm.DCGM_FI))
+	for name := range dcgm.DCGM_FI {
+		// DcgmFieldGetById returns no metadata for placeholders (e.g. DCGM_FI_MAX_FIELDS), which go-dcgm doesn't handle
+		if !strings.HasPrefix(name, "DCGM_FI_") || placeholders[name] {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		if dcgm.DCGM_FI[names[i]] != dcgm.DCGM_FI[names[j]] {
+			return dcgm.DCGM_FI[names[i]] < dcgm.DCGM_FI[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	fmt.Println("# The DCGM fields known to the agent: name, id, type, entity level")
+	fmt.Println("# - type: DCGM field type (d: double, i: int64, s: string, b: binary, t: timestamp)")
+	fmt.Println("# - entity level: the entity the field is watched for (global, gpu, vgpu, switch, gpu_i, gpu_ci, link, cpu, cpu_core)")
+	fmt.Println("# Regenerate after updating go-dcgm, on a host with DCGM installed, with: make fields")
+
+	for _, name := range names {
+		meta := dcgm.FieldGetById(dcgm.DCGM_FI[name])
+		level, known := entityLevels[meta.EntityLevel]
+		if meta.FieldType == 0 || !known {
+			fmt.Fprintf(os.Stderr, "DCGM has no metadata for field %s (%d)\n", name, dcgm.DCGM_FI[name])
+			os.Exit(1)
+		}
+		fmt.Printf("%s,%d,%c,%s\n", name, dcgm.DCGM_FI[name], meta.FieldType, level)
+	}
+}
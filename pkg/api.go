@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/do-dcgm-exporter/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+	Operational endpoints (e.g. POST /diag) are served by a separate API server on its own address, not exposed with /metrics.
+	Every request to the API server requires the bearer token from the configured token file.
+*/
+
+// apiServer serves the operational endpoints of the agent, authenticated with a bearer token
+type apiServer struct {
+	tokenFile string
+	server    *server.Server
+}
+
+// newAPIServer creates an apiServer listening on address, authenticating requests with the token in tokenFile
+func newAPIServer(address, tokenFile string) (*apiServer, error) {
+	if tokenFile == "" {
+		return nil, errors.New("the API server requires a token file")
+	}
+
+	if _, err := readAPIToken(tokenFile); err != nil {
+		return nil, err
+	}
+
+	// no write timeout, as diagnostics run for minutes
+	return &apiServer{
+		tokenFile: tokenFile,
+		server: server.New(server.Options{
+			Name:              "api",
+			Addresses:         []string{address},
+			ReadHeaderTimeout: 10 * time.Second,
+		}),
+	}, nil
+}
+
+// readAPIToken reads the bearer token from the token file
+func readAPIToken(tokenFile string) (string, error) {
+	data, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read API token file")
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errors.Errorf("API token file %q is empty", tokenFile)
+	}
+
+	return token, nil
+}
+
+// Handle registers the handler for the pattern (e.g. "POST /diag"), requiring authentication
+func (s *apiServer) Handle(pattern string, handler http.HandlerFunc) {
+	s.server.Handle(pattern, s.authenticate(handler))
+}
+
+// authenticate rejects requests without the bearer token
+// - the token file is read on every request, so the token can be rotated without restarting the agent
+func (s *apiServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := readAPIToken(s.tokenFile)
+		if err != nil {
+			logrus.Errorf("API: %s", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		provided, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,282 @@
+package pkg
+
+import (
+	"cmp"
+	"encoding/json"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// unitAttribute is the label holding the systemd unit (service or scope) of a process holding a GPU open
+	unitAttribute = "unit"
+	// containerIDAttribute is the label holding the id of the container of a process holding a GPU open
+	containerIDAttribute = "container_id"
+	// containerNameAttribute is the label holding the name of the container of a process holding a GPU open
+	containerNameAttribute = "container_name"
+
+	// procDir is the location of procfs relative to the host root
+	procDir = "proc"
+	// dockerContainersDir is the location of the docker container state relative to the host root
+	dockerContainersDir = "var/lib/docker/containers"
+)
+
+var (
+	// gpuDeviceFileRegex matches the device files of GPUs, but not of /dev/nvidiactl, /dev/nvidia-uvm, ...
+	gpuDeviceFileRegex = regexp.MustCompile(`^/dev/(nvidia[0-9]+)$`)
+	// containerScopeRegex matches systemd scopes created by container runtimes, e.g. docker-<id>.scope or cri-containerd-<id>.scope
+	containerScopeRegex = regexp.MustCompile(`^(?:docker|cri-containerd|containerd|crio|libpod)-([0-9a-f]{64})\.scope$`)
+	// containerIDRegex matches a plain container id used as cgroup directory name with the cgroupfs driver, e.g. /docker/<id>
+	containerIDRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// hostFS is the read-only view on the host filesystem needed to find the processes holding GPUs open.
+// - all paths are relative to the host root, e.g. "proc/1/cgroup"
+type hostFS interface {
+	ReadDir(name string) ([]fs.DirEntry, error)
+	ReadFile(name string) ([]byte, error)
+	Readlink(name string) (string, error)
+}
+
+// osFS is a hostFS backed by the operating system
+type osFS struct {
+	root string
+}
+
+func (o osFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(filepath.Join(o.root, name))
+}
+
+func (o osFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(o.root, name))
+}
+
+func (o osFS) Readlink(name string) (string, error) {
+	return os.Readlink(filepath.Join(o.root, name))
+}
+
+// gpuHolder is a systemd unit or container with at least one process holding a GPU device file open
+type gpuHolder struct {
+	Unit          string
+	ContainerID   string
+	ContainerName string
+}
+
+// gpuProcessMapper is a dcgmexporter.Transform that attributes GPU metrics to the systemd units and docker/containerd containers
+// holding the GPU open. It is the equivalent of the dcgm-exporter PodMapper for droplets without Kubernetes.
+// - scans /proc/*/fd for open /dev/nvidiaN device files, and /proc/<pid>/cgroup to find the unit or container of the process
+// - metrics of a GPU held by multiple units or containers are duplicated, one per holder (like the dcgm-exporter HPC job mapping)
+// - if /proc can't be listed (e.g. a hardened unit with ProtectProc), the failure is logged rate-limited and the metrics are
+// exported without attribution
+type gpuProcessMapper struct {
+	fs       hostFS
+	failures *failureLog
+}
+
+// newGPUProcessMapper creates a gpuProcessMapper scanning the filesystem mounted at root
+func newGPUProcessMapper(root string) *gpuProcessMapper {
+	logrus.Infof("GPU process attribution is enabled, scanning %q", path.Join(root, procDir))
+	return &gpuProcessMapper{
+		fs:       osFS{root: root},
+		failures: newGPUProcessMapperFailureLog(),
+	}
+}
+
+// newGPUProcessMapperFailureLog creates the log of the failures to list the processes
+func newGPUProcessMapperFailureLog() *failureLog {
+	return newFailureLog("GPU process attribution (exporting metrics without the unit and container labels)", logrus.Fields{}, failureLogInterval)
+}
+
+func (p *gpuProcessMapper) Name() string {
+	return "gpuProcessMapper"
+}
+
+func (p *gpuProcessMapper) Process(metrics dcgmexporter.MetricsByCounter, _ dcgmexporter.SystemInfo) error {
+	holders, err := p.gpuHolders()
+	p.failures.observe(err)
+	if err != nil {
+		return nil
+	}
+
+	logrus.Debugf("GPU to unit/container mapping: %+v", holders)
+
+	for counter := range metrics {
+		var modifiedMetrics []dcgmexporter.Metric
+		for _, metric := range metrics[counter] {
+			gpuHolders, exists := holders[metric.GPUDevice]
+			if !exists {
+				modifiedMetrics = append(modifiedMetrics, metric)
+				continue
+			}
+
+			for _, holder := range gpuHolders {
+				modifiedMetric := metric
+				modifiedMetric.Attributes = maps.Clone(metric.Attributes)
+				if modifiedMetric.Attributes == nil {
+					modifiedMetric.Attributes = map[string]string{}
+				}
+
+				modifiedMetric.Attributes[unitAttribute] = holder.Unit
+				if holder.ContainerID != "" {
+					modifiedMetric.Attributes[containerIDAttribute] = holder.ContainerID
+				}
+				if holder.ContainerName != "" {
+					modifiedMetric.Attributes[containerNameAttribute] = holder.ContainerName
+				}
+
+				modifiedMetrics = append(modifiedMetrics, modifiedMetric)
+			}
+		}
+		metrics[counter] = modifiedMetrics
+	}
+
+	return nil
+}
+
+// gpuHolders returns the units and containers holding each GPU device open, keyed by device name (e.g. nvidia0)
+func (p *gpuProcessMapper) gpuHolders() (map[string][]gpuHolder, error) {
+	entries, err := p.fs.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+
+	holderSets := map[string]map[gpuHolder]struct{}{}
+	containerNames := map[string]string{}
+
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		pidDir := path.Join(procDir, entry.Name())
+
+		devices := p.openGPUDevices(pidDir)
+		if len(devices) == 0 {
+			continue
+		}
+
+		cgroup, err := p.fs.ReadFile(path.Join(pidDir, "cgroup"))
+		if err != nil {
+			// the process exited in the meantime
+			continue
+		}
+
+		holder := parseCgroup(string(cgroup))
+		if holder.ContainerID != "" {
+			name, ok := containerNames[holder.ContainerID]
+			if !ok {
+				name = p.dockerContainerName(holder.ContainerID)
+				containerNames[holder.ContainerID] = name
+			}
+			holder.ContainerName = name
+		}
+
+		for _, device := range devices {
+			if _, exists := holderSets[device]; !exists {
+				holderSets[device] = map[gpuHolder]struct{}{}
+			}
+			holderSets[device][holder] = struct{}{}
+		}
+	}
+
+	holders := make(map[string][]gpuHolder, len(holderSets))
+	for device, set := range holderSets {
+		holders[device] = slices.SortedFunc(maps.Keys(set), func(a, b gpuHolder) int {
+			return cmp.Or(strings.Compare(a.Unit, b.Unit), strings.Compare(a.ContainerID, b.ContainerID))
+		})
+	}
+
+	return holders, nil
+}
+
+// openGPUDevices returns the GPU devices (e.g. nvidia0) the process has open file descriptors for
+// - reading the file descriptors of processes of other users requires root (or CAP_SYS_PTRACE), such processes are skipped
+func (p *gpuProcessMapper) openGPUDevices(pidDir string) []string {
+	fdDir := path.Join(pidDir, "fd")
+
+	fds, err := p.fs.ReadDir(fdDir)
+	if err != nil {
+		return nil
+	}
+
+	var devices []string
+	for _, fd := range fds {
+		target, err := p.fs.Readlink(path.Join(fdDir, fd.Name()))
+		if err != nil {
+			continue
+		}
+
+		match := gpuDeviceFileRegex.FindStringSubmatch(target)
+		if match == nil || slices.Contains(devices, match[1]) {
+			continue
+		}
+		devices = append(devices, match[1])
+	}
+
+	return devices
+}
+
+// dockerContainerName looks up the name of a docker container from its on-disk state. Returns an empty string for
+// containers not managed by docker
+func (p *gpuProcessMapper) dockerContainerName(containerID string) string {
+	data, err := p.fs.ReadFile(path.Join(dockerContainersDir, containerID, "config.v2.json"))
+	if err != nil {
+		return ""
+	}
+
+	var config struct {
+		Name string `json:"Name"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		logrus.Debugf("failed to parse docker config of container %s: %s", containerID, err)
+		return ""
+	}
+
+	return strings.TrimPrefix(config.Name, "/")
+}
+
+// parseCgroup extracts the systemd unit and the container id from the content of /proc/<pid>/cgroup
+// - for cgroup v2, the unified hierarchy "0::/system.slice/docker-<id>.scope" is used
+// - for cgroup v1, the hierarchy of the systemd controller "1:name=systemd:/system.slice/foo.service" is used
+func parseCgroup(content string) gpuHolder {
+	var cgroupPath string
+	for _, line := range strings.Split(strings.TrimSpace(content), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+
+		if parts[0] == "0" && parts[1] == "" {
+			cgroupPath = parts[2]
+			break
+		}
+
+		if parts[1] == "name=systemd" {
+			cgroupPath = parts[2]
+		}
+	}
+
+	var holder gpuHolder
+	for _, component := range strings.Split(cgroupPath, "/") {
+		if strings.HasSuffix(component, ".service") || strings.HasSuffix(component, ".scope") {
+			holder.Unit = component
+		}
+
+		if match := containerScopeRegex.FindStringSubmatch(component); match != nil {
+			holder.ContainerID = match[1]
+		} else if containerIDRegex.MatchString(component) {
+			holder.ContainerID = component
+		}
+	}
+
+	return holder
+}
@@ -0,0 +1,171 @@
+package pkg
+
+import (
+	"fmt"
+	"io/fs"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+)
+
+const (
+	testContainerID      = "3f4e5d6c7b8a99887766554433221100ffeeddccbbaa00112233445566778899"
+	testContainerdTaskID = "aa4e5d6c7b8a99887766554433221100ffeeddccbbaa00112233445566778899"
+)
+
+// fixtureFS is a hostFS backed by an in-memory fixture tree. Symlinks (e.g. /proc/<pid>/fd/<n>) are kept in a separate map.
+type fixtureFS struct {
+	fstest.MapFS
+	links map[string]string
+}
+
+func (f fixtureFS) Readlink(name string) (string, error) {
+	target, ok := f.links[name]
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrNotExist}
+	}
+	return target, nil
+}
+
+// newFixtureFS creates a /proc tree with
+// - pid 100: a systemd service holding nvidia0 open
+// - pid 200: a docker container holding nvidia0 and nvidia1 open
+// - pid 300: a containerd task (no docker state) holding nvidia1 open, with cgroup v1
+// - pid 400: a process only holding nvidiactl and nvidia-uvm open
+func newFixtureFS() fixtureFS {
+	return fixtureFS{
+		MapFS: fstest.MapFS{
+			"proc/100/fd/0":   {},
+			"proc/100/fd/3":   {},
+			"proc/100/cgroup": {Data: []byte("0::/system.slice/training.service\n")},
+			"proc/200/fd/4":   {},
+			"proc/200/fd/5":   {},
+			"proc/200/fd/6":   {},
+			"proc/200/cgroup": {Data: []byte(fmt.Sprintf("0::/system.slice/docker-%s.scope\n", testContainerID))},
+			"proc/300/fd/7":   {},
+			"proc/300/cgroup": {Data: []byte(fmt.Sprintf("12:memory:/foo\n1:name=systemd:/system.slice/containerd.service/cri-containerd-%s.scope\n", testContainerdTaskID))},
+			"proc/400/fd/1":   {},
+			"proc/400/fd/2":   {},
+			"proc/400/cgroup": {Data: []byte("0::/user.slice/user-1000.slice/session-1.scope\n")},
+			"proc/self/fd/0":  {},
+			"proc/meminfo":    {Data: []byte("MemTotal: 1 kB\n")},
+			"var/lib/docker/containers/" + testContainerID + "/config.v2.json": {Data: []byte(`{"ID":"` + testContainerID + `","Name":"/vllm"}`)},
+		},
+		links: map[string]string{
+			"proc/100/fd/0": "/dev/null",
+			"proc/100/fd/3": "/dev/nvidia0",
+			"proc/200/fd/4": "/dev/nvidia0",
+			"proc/200/fd/5": "/dev/nvidia1",
+			"proc/200/fd/6": "/dev/nvidia1",
+			"proc/300/fd/7": "/dev/nvidia1",
+			"proc/400/fd/1": "/dev/nvidiactl",
+			"proc/400/fd/2": "/dev/nvidia-uvm",
+		},
+	}
+}
+
+func TestGPUHolders(t *testing.T) {
+	mapper := &gpuProcessMapper{fs: newFixtureFS()}
+
+	holders, err := mapper.gpuHolders()
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	expected := map[string][]gpuHolder{
+		"nvidia0": {
+			{Unit: fmt.Sprintf("docker-%s.scope", testContainerID), ContainerID: testContainerID, ContainerName: "vllm"},
+			{Unit: "training.service"},
+		},
+		"nvidia1": {
+			{Unit: fmt.Sprintf("cri-containerd-%s.scope", testContainerdTaskID), ContainerID: testContainerdTaskID},
+			{Unit: fmt.Sprintf("docker-%s.scope", testContainerID), ContainerID: testContainerID, ContainerName: "vllm"},
+		},
+	}
+
+	if !reflect.DeepEqual(holders, expected) {
+		t.Errorf("expected holders %+v, but got: %+v", expected, holders)
+	}
+}
+
+func TestGPUProcessMapperProcess(t *testing.T) {
+	mapper := &gpuProcessMapper{fs: newFixtureFS(), failures: newGPUProcessMapperFailureLog()}
+
+	counter := dcgmexporter.Counter{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge"}
+	metrics := dcgmexporter.MetricsByCounter{
+		counter: {
+			{Counter: counter, Value: "40", GPU: "0", GPUDevice: "nvidia0", Attributes: map[string]string{}},
+			{Counter: counter, Value: "41", GPU: "1", GPUDevice: "nvidia1", Attributes: map[string]string{}},
+			{Counter: counter, Value: "42", GPU: "2", GPUDevice: "nvidia2", Attributes: map[string]string{}},
+		},
+	}
+
+	if err := mapper.Process(metrics, dcgmexporter.SystemInfo{}); err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	var got []map[string]string
+	for _, metric := range metrics[counter] {
+		got = append(got, metric.Attributes)
+	}
+
+	expected := []map[string]string{
+		{unitAttribute: fmt.Sprintf("docker-%s.scope", testContainerID), containerIDAttribute: testContainerID, containerNameAttribute: "vllm"},
+		{unitAttribute: "training.service"},
+		{unitAttribute: fmt.Sprintf("cri-containerd-%s.scope", testContainerdTaskID), containerIDAttribute: testContainerdTaskID},
+		{unitAttribute: fmt.Sprintf("docker-%s.scope", testContainerID), containerIDAttribute: testContainerID, containerNameAttribute: "vllm"},
+		{},
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected attributes %+v, but got: %+v", expected, got)
+	}
+}
+
+func TestGPUProcessMapperProcessWithoutProc(t *testing.T) {
+	mapper := &gpuProcessMapper{fs: fixtureFS{MapFS: fstest.MapFS{}}, failures: newGPUProcessMapperFailureLog()}
+
+	counter := dcgmexporter.Counter{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge"}
+	metrics := dcgmexporter.MetricsByCounter{
+		counter: {
+			{Counter: counter, Value: "40", GPU: "0", GPUDevice: "nvidia0", Attributes: map[string]string{}},
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := mapper.Process(metrics, dcgmexporter.SystemInfo{}); err != nil {
+			t.Fatalf("expected no error, but got: %s", err.Error())
+		}
+	}
+
+	if len(metrics[counter]) != 1 || len(metrics[counter][0].Attributes) != 0 {
+		t.Errorf("expected the metrics to be exported without attribution, but got: %+v", metrics[counter])
+	}
+	if mapper.failures.attempts != 2 {
+		t.Errorf("expected 2 failed attempts, but got: %d", mapper.failures.attempts)
+	}
+}
+
+func TestParseCgroup(t *testing.T) {
+	var tests = []struct {
+		name     string
+		content  string
+		expected gpuHolder
+	}{
+		{"cgroup v2 service", "0::/system.slice/ollama.service\n", gpuHolder{Unit: "ollama.service"}},
+		{"cgroup v2 docker scope", fmt.Sprintf("0::/system.slice/docker-%s.scope\n", testContainerID), gpuHolder{Unit: fmt.Sprintf("docker-%s.scope", testContainerID), ContainerID: testContainerID}},
+		{"cgroup v1 cgroupfs driver", fmt.Sprintf("4:devices:/docker/%s\n1:name=systemd:/docker/%s\n", testContainerID, testContainerID), gpuHolder{ContainerID: testContainerID}},
+		{"no cgroup", "", gpuHolder{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			holder := parseCgroup(tt.content)
+			if holder != tt.expected {
+				t.Errorf("expected %+v, but got: %+v", tt.expected, holder)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package httpclient
 
 import (
+	"crypto/tls"
 	"net"
 	"net/http"
 	"time"
@@ -15,12 +16,19 @@ type HTTPClient interface {
 
 // NewHTTP creates a new HTTP client with the provided timeout
 func NewHTTP(timeout time.Duration) *http.Client {
+	return NewTLSHTTP(timeout, nil)
+}
+
+// NewTLSHTTP creates a new HTTP client with the provided timeout, connecting to HTTPS servers with the provided TLS config
+// - the default TLS config (system CAs, no client certificate) is used if tlsConfig is nil
+func NewTLSHTTP(timeout time.Duration, tlsConfig *tls.Config) *http.Client {
 	return &http.Client{
 		Timeout: timeout,
 		Transport: &http.Transport{
 			DialContext: (&net.Dialer{
 				Timeout: timeout,
 			}).DialContext,
+			TLSClientConfig:       tlsConfig,
 			TLSHandshakeTimeout:   timeout,
 			ResponseHeaderTimeout: timeout,
 			DisableKeepAlives:     true,
@@ -0,0 +1,23 @@
+package pkg
+
+import "time"
+
+// clock is the source of time of the agent
+// - replaced in tests, to control when the pipeline collects metrics
+type clock interface {
+	Now() time.Time
+	// NewTicker returns a channel delivering a tick every d, and a function stopping the ticker
+	NewTicker(d time.Duration) (<-chan time.Time, func())
+}
+
+// realClock is the clock of the operating system
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	t := time.NewTicker(d)
+	return t.C, t.Stop
+}
@@ -0,0 +1,178 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// output formats of a one-shot collection
+	// - prom: the prometheus plaintext format, exactly as pushed to the DO proxy
+	// - openmetrics: the OpenMetrics text format
+	// - json: the metric families as JSON
+	CollectFormatProm        = "prom"
+	CollectFormatOpenMetrics = "openmetrics"
+	CollectFormatJSON        = "json"
+)
+
+// jsonMetricFamily is a metric family in the json format of a one-shot collection
+type jsonMetricFamily struct {
+	Name    string       `json:"name"`
+	Help    string       `json:"help"`
+	Type    string       `json:"type"`
+	Metrics []jsonMetric `json:"metrics"`
+}
+
+// jsonMetric is a series in the json format of a one-shot collection
+// - the value is a string like in the Prometheus HTTP API, as JSON numbers can't be NaN or Inf
+type jsonMetric struct {
+	Labels map[string]string `json:"labels"`
+	Value  string            `json:"value"`
+}
+
+// ValidateCollectFormat returns an error, if the format isn't a supported output format of a one-shot collection
+func ValidateCollectFormat(format string) error {
+	switch format {
+	case CollectFormatProm, CollectFormatOpenMetrics, CollectFormatJSON:
+		return nil
+	}
+	return errors.Errorf("unsupported format %q, must be one of: %s, %s, %s", format, CollectFormatProm, CollectFormatOpenMetrics, CollectFormatJSON)
+}
+
+// CollectOnce collects the metrics of the pipeline and the registry once, writes them to w in the format, and pushes them to the DO proxy if push is set
+// - unlike Run, doesn't wait for the collect interval, but forces DCGM to update the watched fields
+func (a GPUMetricsAgent) CollectOnce(w io.Writer, format string, push bool) error {
+	if err := ValidateCollectFormat(format); err != nil {
+		return err
+	}
+
+	c, cleanup, err := a.newCollection()
+	defer cleanup()
+	if err != nil {
+		return err
+	}
+
+	if a.dropletMetadata != nil {
+		if err := a.dropletMetadata.refresh(); err != nil {
+			logrus.Warnf("Failed to fetch droplet metadata: %s", err)
+		}
+	}
+
+	if err := a.provider.UpdateAllFields(); err != nil {
+		return errors.Wrap(err, "failed to update the watched fields")
+	}
+
+	rendered, err := c.pipeline.collect()
+	if err != nil {
+		return errors.Wrap(err, "failed to collect metrics")
+	}
+
+	registryMetrics, err := c.gatherRegistry()
+	if err != nil {
+		return err
+	}
+	rendered = append(rendered, registryMetrics)
+
+	if err := writeMetrics(w, format, rendered); err != nil {
+		return err
+	}
+
+	if push {
+		if err := a.forwardMetricsToProxy(context.Background(), bytes.NewBufferString(strings.Join(rendered, ""))); err != nil {
+			return err
+		}
+		logrus.Info("Successfully forwarded metrics")
+	}
+
+	return nil
+}
+
+// writeMetrics writes the rendered prometheus plaintext metrics in the format
+// - every rendered string is parsed separately, as the same metric family can be rendered by several collectors (e.g. for GPUs and NVSwitches)
+func writeMetrics(w io.Writer, format string, rendered []string) error {
+	if format == CollectFormatProm {
+		_, err := io.WriteString(w, strings.Join(rendered, ""))
+		return err
+	}
+
+	families := map[string]*dto.MetricFamily{}
+	for _, metrics := range rendered {
+		var parser expfmt.TextParser
+		parsed, err := parser.TextToMetricFamilies(strings.NewReader(metrics))
+		if err != nil {
+			return errors.Wrap(err, "failed to parse the collected metrics")
+		}
+
+		for name, family := range parsed {
+			if existing, exists := families[name]; exists {
+				existing.Metric = append(existing.Metric, family.Metric...)
+				continue
+			}
+			families[name] = family
+		}
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if format == CollectFormatOpenMetrics {
+		for _, name := range names {
+			if _, err := expfmt.MetricFamilyToOpenMetrics(w, families[name]); err != nil {
+				return errors.Wrapf(err, "failed to write metric family %s", name)
+			}
+		}
+		_, err := expfmt.FinalizeOpenMetrics(w)
+		return err
+	}
+
+	jsonFamilies := []jsonMetricFamily{}
+	for _, name := range names {
+		family := families[name]
+		jsonFamily := jsonMetricFamily{
+			Name:    name,
+			Help:    family.GetHelp(),
+			Type:    strings.ToLower(family.GetType().String()),
+			Metrics: []jsonMetric{},
+		}
+
+		for _, metric := range family.Metric {
+			var value float64
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				value = metric.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				value = metric.GetGauge().GetValue()
+			case dto.MetricType_UNTYPED:
+				value = metric.GetUntyped().GetValue()
+			default:
+				return fmt.Errorf("unsupported type %s of metric family %s", family.GetType(), name)
+			}
+
+			labels := map[string]string{}
+			for _, label := range metric.Label {
+				labels[label.GetName()] = label.GetValue()
+			}
+			jsonFamily.Metrics = append(jsonFamily.Metrics, jsonMetric{Labels: labels, Value: strconv.FormatFloat(value, 'g', -1, 64)})
+		}
+
+		jsonFamilies = append(jsonFamilies, jsonFamily)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(jsonFamilies)
+}
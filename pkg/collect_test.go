@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testRendered are the metrics rendered by a GPU collector, a NVSwitch collector and the registry, where two collectors render the same metric family
+var testRendered = []string{
+	`# HELP DCGM_FI_DEV_GPU_TEMP GPU temperature (in C).
+# TYPE DCGM_FI_DEV_GPU_TEMP gauge
+DCGM_FI_DEV_GPU_TEMP{gpu="0",UUID="GPU-0",pci_bus_id="00000000:0F:00.0",device="nvidia0",modelName="NVIDIA H100 80GB HBM3",Hostname="gpu-droplet"} 34
+`,
+	`# HELP DCGM_FI_DEV_GPU_TEMP GPU temperature (in C).
+# TYPE DCGM_FI_DEV_GPU_TEMP gauge
+DCGM_FI_DEV_GPU_TEMP{nvswitch="0",Hostname="gpu-droplet"} 41
+`,
+	`# HELP do_dcgm_diag_scheduled_runs_total Number of scheduled DCGM diagnostic runs, by result (passed, failed, error).
+# TYPE do_dcgm_diag_scheduled_runs_total counter
+do_dcgm_diag_scheduled_runs_total{Hostname="gpu-droplet",result="passed"} 2
+`,
+}
+
+func TestValidateCollectFormat(t *testing.T) {
+	for format, valid := range map[string]bool{"prom": true, "openmetrics": true, "json": true, "text": false, "": false} {
+		if err := ValidateCollectFormat(format); (err == nil) != valid {
+			t.Errorf("expected format %q to be valid=%t, but got error: %v", format, valid, err)
+		}
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	t.Run("prom", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := writeMetrics(&out, CollectFormatProm, testRendered); err != nil {
+			t.Fatalf("expected no error, but got: %s", err.Error())
+		}
+		if expected := strings.Join(testRendered, ""); out.String() != expected {
+			t.Errorf("expected the metrics as pushed %q, but got: %q", expected, out.String())
+		}
+	})
+
+	t.Run("openmetrics", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := writeMetrics(&out, CollectFormatOpenMetrics, testRendered); err != nil {
+			t.Fatalf("expected no error, but got: %s", err.Error())
+		}
+
+		for _, line := range []string{
+			"# TYPE DCGM_FI_DEV_GPU_TEMP gauge",
+			`DCGM_FI_DEV_GPU_TEMP{nvswitch="0",Hostname="gpu-droplet"} 41.0`,
+			"# TYPE do_dcgm_diag_scheduled_runs counter",
+			"# EOF",
+		} {
+			if !strings.Contains(out.String(), line) {
+				t.Errorf("expected output to contain %q, but got: %s", line, out.String())
+			}
+		}
+		if strings.Count(out.String(), "# TYPE DCGM_FI_DEV_GPU_TEMP") != 1 {
+			t.Errorf("expected the metric family to be merged, but got: %s", out.String())
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := writeMetrics(&out, CollectFormatJSON, testRendered); err != nil {
+			t.Fatalf("expected no error, but got: %s", err.Error())
+		}
+
+		var families []jsonMetricFamily
+		if err := json.Unmarshal(out.Bytes(), &families); err != nil {
+			t.Fatalf("expected no error, but got: %s", err.Error())
+		}
+
+		var got []string
+		for _, family := range families {
+			for _, metric := range family.Metrics {
+				got = append(got, family.Name+"/"+family.Type+"/"+metric.Labels["gpu"]+metric.Labels["nvswitch"]+"="+metric.Value)
+			}
+		}
+		expected := []string{"DCGM_FI_DEV_GPU_TEMP/gauge/0=34", "DCGM_FI_DEV_GPU_TEMP/gauge/0=41", "do_dcgm_diag_scheduled_runs_total/counter/=2"}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected %v, but got: %v", expected, got)
+		}
+	})
+
+	t.Run("invalid metrics", func(t *testing.T) {
+		if err := writeMetrics(&bytes.Buffer{}, CollectFormatJSON, []string{"DCGM_FI_DEV_GPU_TEMP{gpu=0} 34\n"}); err == nil {
+			t.Errorf("expected an error for metrics that can't be parsed")
+		}
+	})
+}
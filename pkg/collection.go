@@ -0,0 +1,244 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// collection is everything the agent collects metrics from, set up on a connection to the nv-hostengine
+// - shared by the long-running agent (Run) and the one-shot collection (CollectOnce)
+type collection struct {
+	hostname string
+	// counters are the DCGM fields watched by the pipeline
+	counters []dcgmexporter.Counter
+	// pipeline collects the metrics of the regular collectors {GPU Collector, NVLink Collector, NVSwitch Collector}
+	pipeline *metricsPipeline
+	// registry collects the metrics of the special collectors {xid_collector, clock_events_collector} and the collectors added by the agent
+	registry *dcgmexporter.Registry
+	// diagnostics runs DCGM diagnostics on demand via the existing connection. Owned by the agent
+	diagnostics *diagnostics
+	// scheduler runs scheduled diagnostics. Nil if disabled
+	scheduler *diagScheduler
+}
+
+// newCollection connects to the nv-hostengine, and sets up the pipeline and the registry
+// - the returned cleanup function is never nil, and must be called even on error
+func (a GPUMetricsAgent) newCollection() (*collection, func(), error) {
+	var cleanups []func()
+	cleanup := func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+	}
+
+	dcgmCleanup, err := a.provider.Connect(a.DcgmExporterConfig)
+	cleanups = append(cleanups, dcgmCleanup)
+	if err != nil {
+		return nil, cleanup, err
+	}
+
+	logrus.Info("DCGM initialized successfully!")
+
+	fillProfilingConfigMetricGroups(a.provider, a.DcgmExporterConfig)
+
+	a.logCollectorsFileProblems()
+
+	cs, err := getCounters(a.DcgmExporterConfig)
+	if err != nil {
+		return nil, cleanup, fmt.Errorf("failed to collect DCGM fields/counters to watch: %s", err.Error())
+	}
+
+	groups, err := getEntityGroups(a.provider, cs, a.DcgmExporterConfig, a.selection)
+	if err != nil {
+		return nil, cleanup, err
+	}
+
+	a.logTransformationDiagnostics()
+	transformations := a.getTransformations()
+
+	// observe the GPU activity of the pipeline metrics, to run scheduled diagnostics only while all GPUs are idle
+	// - must observe the metrics before any transformation duplicates them
+	var activityTracker *gpuActivityTracker
+	if a.diagScheduler != nil {
+		activityTracker = newGPUActivityTracker(a.Options.DiagIdleLookback)
+		activityTracker.now = a.clock.Now
+		transformations = append([]dcgmexporter.Transform{activityTracker}, transformations...)
+	}
+
+	hostname, err := dcgmexporter.GetHostname(a.DcgmExporterConfig)
+	if err != nil {
+		return nil, cleanup, err
+	}
+
+	// the pipeline has reference to all required dcgm-exporter collectors (depends on the counters/watched fields, but typically GPU Collector, NVLink Collector, NVSwitch Collector)
+	pipeline, pipelineCleanup, err := newMetricsPipeline(a.provider,
+		a.DcgmExporterConfig,
+		cs.DCGMCounters,
+		hostname,
+		groups,
+		transformations,
+	)
+	cleanups = append(cleanups, pipelineCleanup)
+	if err != nil {
+		return nil, cleanup, errors.Wrap(err, "failed to create metrics pipeline")
+	}
+	pipeline.clock = a.clock
+
+	// the registry is a wrapper for the two special collectors {xid_collector, clock_events_collector}.
+	// - exposes a Gather() function that call GetMetrics() on both collectors and then aggregates the results
+	// - calling Gather() is the mechanism how we obtain the metrics for DCGM_EXP_XID_ERRORS_COUNT and DCGM_EXP_CLOCK_EVENTS_COUNT
+	// - the XID and clock_events collectors are registered in a nested registry, that applies the same transformations as the pipeline
+	cRegistry := dcgmexporter.NewRegistry()
+	cleanups = append(cleanups, cRegistry.Cleanup)
+
+	expRegistry, err := a.newGPURegistry(cs, groups, hostname)
+	if err != nil {
+		return nil, cleanup, err
+	}
+
+	gpuSystemInfo := groups[dcgm.FE_GPU]
+	gpuCollector := &transformingCollector{
+		registry:        expRegistry,
+		sysInfo:         gpuSystemInfo.SystemInfo,
+		transformations: transformations,
+	}
+	cRegistry.Register(gpuCollector)
+
+	// export the GPU topology and NVLink state
+	// - exports prometheus metrics: do_dcgm_gpu_p2p_link, do_dcgm_gpu_cpu_affinity_info, do_dcgm_gpu_nvlinks_active, do_dcgm_gpu_nvlinks_expected, do_dcgm_gpu_nvlink_degraded
+	topology := newTopologyCollector(a.provider, hostname, a.root, a.Options.ExpectedNVLinks)
+	topology.selection = a.selection
+	cRegistry.Register(topology)
+
+	// run DCGM diagnostics on demand, and export the results of the last run
+	// - exports prometheus metrics: do_dcgm_diag_test_passed, do_dcgm_diag_software_test_passed, do_dcgm_diag_last_run_timestamp_seconds
+	// - the diagnostics are owned by the agent, and only registered here
+	diagnostics := a.diagnostics
+	cRegistry.Register(diagnostics)
+
+	// run a quick diagnostic on a schedule, while all GPUs are idle
+	// - exports prometheus metrics: do_dcgm_diag_scheduled_runs_total, do_dcgm_diag_scheduled_skipped_total, do_dcgm_diag_scheduled_last_run_timestamp_seconds
+	// - the scheduler is owned by the agent, and observes the GPU activity of this collection
+	scheduler := a.diagScheduler
+	if scheduler != nil && activityTracker != nil {
+		scheduler.attach(activityTracker, hostname, a.clock)
+		cRegistry.Register(scheduler)
+	}
+
+	// re-discover the entities periodically, and rebuild the collectors of changed entities
+	// - exports prometheus metric: do_dcgm_gpu_present
+	if a.Options.RediscoveryInterval > 0 {
+		reconciler := a.newDiscoveryReconciler(cs, groups, hostname, pipeline, gpuCollector, topology)
+		pipeline.rediscover = reconciler.reconcile
+		cRegistry.Register(reconciler)
+	}
+
+	// export the do_droplet_info metric
+	if a.dropletMetadata != nil {
+		cRegistry.Register(a.dropletMetadata)
+	}
+
+	// diagnostics run via this connection from now on, until the agent disconnects them (see run)
+	diagnostics.connect(a.provider, hostname)
+
+	return &collection{
+		hostname:    hostname,
+		counters:    cs.DCGMCounters,
+		pipeline:    pipeline,
+		registry:    cRegistry,
+		diagnostics: diagnostics,
+		scheduler:   scheduler,
+	}, cleanup, nil
+}
+
+// gatherRegistry gathers the metrics of the registry, rendered into prometheus plaintext format
+func (c *collection) gatherRegistry() (string, error) {
+	metrics, err := c.registry.Gather()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to gather metrics from the registry(XID Collector, clock_events collector)")
+	}
+
+	return renderRegistryMetrics(metrics)
+}
+
+// renderRegistryMetrics renders the metrics of the registry into prometheus plaintext format
+// - metric families without any GPU metric (e.g. do_droplet_info) are rendered without GPU labels
+func renderRegistryMetrics(metrics dcgmexporter.MetricsByCounter) (string, error) {
+	gpuMetrics := dcgmexporter.MetricsByCounter{}
+	hostMetrics := dcgmexporter.MetricsByCounter{}
+	for counter, counterMetrics := range metrics {
+		if slices.ContainsFunc(counterMetrics, func(m dcgmexporter.Metric) bool { return m.GPU != "" || m.GPUUUID != "" }) {
+			gpuMetrics[counter] = counterMetrics
+		} else {
+			hostMetrics[counter] = counterMetrics
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := getExpMetricTemplate().Execute(&buf, gpuMetrics); err != nil {
+		return "", errors.Wrap(err, "failed to template metrics from the registry(XID Collector, clock_events collector) into prometheus plaintext format")
+	}
+	if err := getHostMetricTemplate().Execute(&buf, hostMetrics); err != nil {
+		return "", errors.Wrap(err, "failed to template host metrics from the registry into prometheus plaintext format")
+	}
+
+	return buf.String(), nil
+}
+
+// logCollectorsFileProblems logs the problems of the additional fields, e.g. deprecated or duplicate fields, which are otherwise only reported by the fields validate command
+// - connected to DCGM, the types of the fields are checked as well
+func (a GPUMetricsAgent) logCollectorsFileProblems() {
+	if a.Options.AdditionalFieldsPath == "" {
+		return
+	}
+
+	problems, err := validateCollectorsFile(a.Options.AdditionalFieldsPath, a.provider.FieldMeta)
+	if err != nil {
+		// reported by getCounters
+		return
+	}
+	for _, problem := range problems {
+		logrus.WithField(logFieldField, problem.Field).Warnf("Collectors file %s: %s", a.Options.AdditionalFieldsPath, problem)
+	}
+}
+
+// newGPURegistry creates the registry of the special collectors of the GPUs {xid_collector, clock_events_collector}
+// - recreated by the discoveryReconciler when the GPUs changed
+func (a GPUMetricsAgent) newGPURegistry(cs *dcgmexporter.CounterSet, groups entityGroups, hostname string) (*dcgmexporter.Registry, error) {
+	registry := dcgmexporter.NewRegistry()
+
+	// enable XID error collector via the registry
+	// - exports prometheus metric: DCGM_EXP_XID_ERRORS_COUNT
+	if err := enableDCGMExpXIDErrorsCountCollector(a.provider, cs, groups, hostname, a.DcgmExporterConfig, registry); err != nil {
+		registry.Cleanup()
+		return nil, err
+	}
+
+	// enable collection of clock throttling reasons by resolving bitmask of dcgm field https://docs.nvidia.com/datacenter/dcgm/latest/dcgm-api/dcgm-api-field-ids.html#c.DCGM_FI_DEV_CLOCK_THROTTLE_REASONS
+	// - exports prometheus metric: DCGM_EXP_CLOCK_EVENTS_COUNT
+	if err := enableDCGMExpClockEventsCount(a.provider, cs, groups, hostname, a.DcgmExporterConfig, registry); err != nil {
+		registry.Cleanup()
+		return nil, err
+	}
+
+	// export statistics of the samples of the sampled fields per collection window
+	// - exports prometheus metrics: <field>_min, <field>_max, <field>_avg, <field>_p<percentile>
+	if item, exists := groups[dcgm.FE_GPU]; exists && len(a.sampledFields) > 0 {
+		window := time.Duration(a.DcgmExporterConfig.CollectInterval) * time.Millisecond
+		collector, err := newSampleStatsCollector(a.provider, a.sampledFields, item, hostname, a.Options.SampleInterval, window, a.clock.Now())
+		if err != nil {
+			registry.Cleanup()
+			return nil, err
+		}
+		registry.Register(collector)
+	}
+
+	return registry, nil
+}
@@ -0,0 +1,193 @@
+package pkg
+
+import (
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"github.com/digitalocean/do-dcgm-exporter/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+	The debug server serves the runtime profiles and the internal state of the running agent, to investigate e.g. memory growth in production.
+	- GET /debug/pprof/ serves the net/http/pprof profiles (heap, goroutine, CPU profile, trace)
+	- GET /debug/vars serves the expvar variables, including the memory statistics and the counters of the agent
+	- GET /debug/state serves the internal state of the agent as JSON
+	The debug server is disabled by default. The endpoints are not authenticated, hence it only listens on loopback addresses, unless explicitly allowed.
+*/
+
+// debugCounters are the counters of the agent since it started, served on /debug/vars and /debug/state
+var debugCounters = expvar.NewMap("do_dcgm_exporter")
+
+const (
+	// counterCollections is the number of collections of the pipeline, including failed collections
+	counterCollections = "collections_total"
+	// counterFailedCollections is the number of collections of the pipeline that failed
+	counterFailedCollections = "failed_collections_total"
+	// counterPushes is the number of pushes, including failed pushes
+	counterPushes = "pushes_total"
+	// counterFailedPushes is the number of pushes that failed
+	counterFailedPushes = "failed_pushes_total"
+	// counterPushedBytes is the number of bytes pushed, including failed pushes
+	counterPushedBytes = "pushed_bytes_total"
+	// counterReloads is the number of reloads on SIGHUP
+	counterReloads = "reloads_total"
+)
+
+// validateDebugAddress returns an error if the debug server would listen on a non-loopback address, unless allowed
+func validateDebugAddress(address string, allowRemote bool) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return errors.Wrapf(err, "invalid debug listen address %q", address)
+	}
+
+	if allowRemote || host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+
+	return errors.Errorf("debug listen address %q is not a loopback address (e.g. 127.0.0.1:6060). The debug endpoints are not authenticated, use --debug-listen-allow-remote to listen on it anyway", address)
+}
+
+// DebugState is the internal state of the running agent
+type DebugState struct {
+	Time       time.Time        `json:"time"`
+	Goroutines int              `json:"goroutines"`
+	Memory     DebugMemoryState `json:"memory"`
+	// Counters are the counters of the agent since it started
+	Counters map[string]int64 `json:"counters"`
+	// Connected is whether the agent is connected to DCGM
+	Connected bool `json:"connected"`
+	// Ready is whether the agent collected since it (re)connected to DCGM
+	Ready          bool      `json:"ready"`
+	LastCollection time.Time `json:"last_collection"`
+	// Fields are the DCGM fields watched by the pipeline
+	Fields []string `json:"fields"`
+	// MetricsBytes is the size of the latest metrics of the pipeline, stored to be served on /metrics
+	MetricsBytes int             `json:"metrics_bytes"`
+	PushQueue    DebugQueueState `json:"push_queue"`
+	// LastPush is the latest push, including its error if it failed
+	LastPush *PushRecord `json:"last_push,omitempty"`
+	// LastErrors are the recent errors logged by the agent
+	LastErrors []LogRecord `json:"last_errors"`
+}
+
+// DebugMemoryState are the memory statistics of the Go runtime
+type DebugMemoryState struct {
+	HeapAllocBytes uint64 `json:"heap_alloc_bytes"`
+	HeapInuseBytes uint64 `json:"heap_inuse_bytes"`
+	HeapObjects    uint64 `json:"heap_objects"`
+	SysBytes       uint64 `json:"sys_bytes"`
+	NumGC          uint32 `json:"num_gc"`
+}
+
+// DebugQueueState is the state of the push queue
+type DebugQueueState struct {
+	Size    int    `json:"size"`
+	Policy  string `json:"policy"`
+	Depth   int    `json:"depth"`
+	Bytes   int    `json:"bytes"`
+	Dropped int    `json:"dropped"`
+}
+
+// debugState returns the internal state of the agent
+func (a GPUMetricsAgent) debugState(store *metricsStore) DebugState {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	state := DebugState{
+		Time:       a.clock.Now(),
+		Goroutines: runtime.NumGoroutine(),
+		Memory: DebugMemoryState{
+			HeapAllocBytes: mem.HeapAlloc,
+			HeapInuseBytes: mem.HeapInuse,
+			HeapObjects:    mem.HeapObjects,
+			SysBytes:       mem.Sys,
+			NumGC:          mem.NumGC,
+		},
+		Counters:   map[string]int64{},
+		Fields:     []string{},
+		LastErrors: []LogRecord{},
+	}
+
+	debugCounters.Do(func(kv expvar.KeyValue) {
+		if counter, ok := kv.Value.(*expvar.Int); ok {
+			state.Counters[kv.Key] = counter.Value()
+		}
+	})
+
+	store.mtx.RLock()
+	state.Connected = store.collection != nil
+	state.Ready = store.ready
+	state.LastCollection = store.lastCollection
+	state.MetricsBytes = len(store.metrics)
+	if store.collection != nil {
+		for _, counter := range store.collection.counters {
+			state.Fields = append(state.Fields, counter.FieldName)
+		}
+	}
+	queue := store.queue
+	store.mtx.RUnlock()
+
+	if queue != nil {
+		state.PushQueue = queue.state()
+	}
+
+	history := a.history.snapshot()
+	if len(history.Pushes) > 0 {
+		state.LastPush = &history.Pushes[len(history.Pushes)-1]
+	}
+	for _, record := range history.Logs {
+		if record.Level == logrus.ErrorLevel.String() {
+			state.LastErrors = append(state.LastErrors, record)
+		}
+	}
+
+	return state
+}
+
+// handleDebugState serves the internal state of the agent as JSON
+func (a GPUMetricsAgent) handleDebugState(store *metricsStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(a.debugState(store)); err != nil {
+			logrus.Debugf("Failed to write debug state: %s", err)
+		}
+	}
+}
+
+// newDebugServer creates the server of the debug endpoints. Nil if disabled
+// - no write timeout, as CPU profiles and traces are recorded for the requested duration
+func (a GPUMetricsAgent) newDebugServer(store *metricsStore) *server.Server {
+	if a.Options.DebugAddress == "" {
+		return nil
+	}
+
+	srv := server.New(server.Options{
+		Name:              "debug",
+		Addresses:         []string{a.Options.DebugAddress},
+		ReadHeaderTimeout: 10 * time.Second,
+	})
+
+	srv.HandleFunc("GET /{$}", handleIndex("/debug/pprof/", "/debug/vars", "/debug/state"))
+	srv.HandleFunc("GET /debug/pprof/", pprof.Index)
+	srv.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	srv.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	srv.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	srv.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	srv.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	srv.Handle("GET /debug/vars", expvar.Handler())
+	srv.HandleFunc("GET /debug/state", a.handleDebugState(store))
+
+	return srv
+}
@@ -0,0 +1,109 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/sirupsen/logrus"
+)
+
+func TestValidateDebugAddress(t *testing.T) {
+	var tests = []struct {
+		address     string
+		allowRemote bool
+		expectError bool
+	}{
+		{"127.0.0.1:6060", false, false},
+		{"localhost:6060", false, false},
+		{"[::1]:6060", false, false},
+		{":6060", false, true},
+		{"0.0.0.0:6060", false, true},
+		{"10.116.0.2:6060", false, true},
+		{"10.116.0.2:6060", true, false},
+		{"6060", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := validateDebugAddress(tt.address, tt.allowRemote)
+			if tt.expectError && err == nil {
+				t.Errorf("expected an error, but got none")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("expected no error, but got: %s", err.Error())
+			}
+		})
+	}
+
+	if _, err := NewGPUMetricsAgent(Options{DebugAddress: "0.0.0.0:6060"}); err == nil {
+		t.Errorf("expected an error for a debug server listening on all interfaces, but got none")
+	}
+}
+
+func TestDebugState(t *testing.T) {
+	agent, err := NewGPUMetricsAgent(Options{})
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	clock := newTickingClock()
+	agent.clock = clock
+
+	store := newMetricsStore(clock, time.Minute)
+	store.setCollection(&collection{counters: []dcgmexporter.Counter{{FieldName: "DCGM_FI_DEV_GPU_UTIL"}, {FieldName: "DCGM_FI_DEV_FB_USED"}}})
+	store.update("DCGM_FI_DEV_GPU_UTIL 1\n")
+
+	queue := newPushQueue(2, PushOverflowDropOldest)
+	for _, batch := range []string{"a", "bb", "ccc"} {
+		queue.enqueue([]byte(batch))
+	}
+	store.setQueue(queue)
+
+	agent.history.recordPush(clock.Now(), 3, errors.New("connection refused"))
+	if err := agent.history.Fire(&logrus.Entry{Level: logrus.ErrorLevel, Message: "push failed"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.history.Fire(&logrus.Entry{Level: logrus.WarnLevel, Message: "queue full"}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	agent.handleDebugState(store)(w, httptest.NewRequest("GET", "/debug/state", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, but got: %d", http.StatusOK, w.Code)
+	}
+
+	var state DebugState
+	if err := json.Unmarshal(w.Body.Bytes(), &state); err != nil {
+		t.Fatalf("expected valid JSON, but got: %s", err.Error())
+	}
+
+	if !state.Connected || !state.Ready || !state.LastCollection.Equal(clock.Now()) {
+		t.Errorf("expected the agent to be connected and ready, but got: connected %v, ready %v, last collection %s", state.Connected, state.Ready, state.LastCollection)
+	}
+	if len(state.Fields) != 2 || state.Fields[0] != "DCGM_FI_DEV_GPU_UTIL" {
+		t.Errorf("expected the watched fields, but got: %v", state.Fields)
+	}
+	if state.MetricsBytes != len("DCGM_FI_DEV_GPU_UTIL 1\n") {
+		t.Errorf("expected the size of the stored metrics, but got: %d", state.MetricsBytes)
+	}
+	if expected := (DebugQueueState{Size: 2, Policy: PushOverflowDropOldest, Depth: 2, Bytes: 5, Dropped: 1}); state.PushQueue != expected {
+		t.Errorf("expected push queue %+v, but got: %+v", expected, state.PushQueue)
+	}
+	if state.LastPush == nil || state.LastPush.Error != "connection refused" {
+		t.Errorf("expected the failed push, but got: %+v", state.LastPush)
+	}
+	if len(state.LastErrors) != 1 || state.LastErrors[0].Message != "push failed" {
+		t.Errorf("expected only the logged error, but got: %+v", state.LastErrors)
+	}
+	if state.Goroutines == 0 || state.Memory.HeapAllocBytes == 0 {
+		t.Errorf("expected runtime statistics, but got: %d goroutines, %+v", state.Goroutines, state.Memory)
+	}
+	if state.Counters[counterCollections] == 0 || state.Counters[counterFailedPushes] == 0 {
+		t.Errorf("expected the counters, but got: %v", state.Counters)
+	}
+}
@@ -0,0 +1,426 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// status of a DCGM diagnostic test, as reported by go-dcgm
+	diagStatusPass    = "pass"
+	diagStatusFail    = "fail"
+	diagStatusWarn    = "warn"
+	diagStatusSkipped = "skipped"
+	diagStatusNotRun  = "notrun"
+
+	// attributes of the diagnostic metrics
+	diagTestAttribute  = "test"
+	diagLevelAttribute = "level"
+)
+
+// counters of the diagnostic metrics
+// - added by the agent, hence, like the dcgm-exporter added counters, use ids outside the range of dcgm fields
+var (
+	diagTestPassedCounter = dcgmexporter.Counter{
+		FieldID:   dcgm.Short(9110),
+		FieldName: "do_dcgm_diag_test_passed",
+		PromType:  "gauge",
+		Help:      "Result of the GPU test of the last DCGM diagnostic run. 1 if passed, 0 if failed or warned.",
+	}
+	diagSoftwareTestPassedCounter = dcgmexporter.Counter{
+		FieldID:   dcgm.Short(9115),
+		FieldName: "do_dcgm_diag_software_test_passed",
+		PromType:  "gauge",
+		Help:      "Result of the software test of the last DCGM diagnostic run, which tests the host rather than a GPU. 1 if passed, 0 if failed or warned.",
+	}
+	diagLastRunCounter = dcgmexporter.Counter{
+		FieldID:   dcgm.Short(9111),
+		FieldName: "do_dcgm_diag_last_run_timestamp_seconds",
+		PromType:  "gauge",
+		Help:      "Unix timestamp of the start of the last DCGM diagnostic run.",
+	}
+)
+
+// errDiagRunning is returned when a DCGM diagnostic is requested while another one is still running
+var errDiagRunning = errors.New("a DCGM diagnostic is already running")
+
+// errDiagNotConnected is returned when a DCGM diagnostic is requested while the agent is not connected to DCGM, e.g. while reloading
+var errDiagNotConnected = errors.New("not connected to DCGM")
+
+// DiagTestResult is the result of a single test of a DCGM diagnostic
+type DiagTestResult struct {
+	Test         string `json:"test"`
+	Status       string `json:"status"`
+	Info         string `json:"info,omitempty"`
+	ErrorCode    uint   `json:"error_code,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+}
+
+// DiagGPUResult are the test results of a single GPU
+type DiagGPUResult struct {
+	GPU      uint             `json:"gpu"`
+	UUID     string           `json:"uuid,omitempty"`
+	PCIBusID string           `json:"pci_bus_id,omitempty"`
+	Model    string           `json:"model,omitempty"`
+	Tests    []DiagTestResult `json:"tests"`
+}
+
+// DiagReport is the result of a DCGM diagnostic run
+type DiagReport struct {
+	Level     int       `json:"level"`
+	GPUs      []uint    `json:"gpus,omitempty"`
+	StartTime time.Time `json:"start_time"`
+	// Duration is the duration of the run in seconds
+	Duration float64          `json:"duration_seconds"`
+	Passed   bool             `json:"passed"`
+	Software []DiagTestResult `json:"software"`
+	PerGPU   []DiagGPUResult  `json:"per_gpu"`
+}
+
+// ValidateDiagLevel returns an error for diagnostic levels other than 1 (quick), 2 (medium) and 3 (long)
+func ValidateDiagLevel(level int) error {
+	switch dcgm.DiagType(level) {
+	case dcgm.DiagQuick, dcgm.DiagMedium, dcgm.DiagLong:
+		return nil
+	}
+	return errors.Errorf("unsupported diagnostic level %d, must be one of: 1 (quick), 2 (medium), 3 (long)", level)
+}
+
+// RunDiag connects to the hostengine, runs the DCGM diagnostic of the level on the GPUs (all GPUs, if empty) and returns the results
+func (a GPUMetricsAgent) RunDiag(level int, gpus []uint) (*DiagReport, error) {
+	if err := ValidateDiagLevel(level); err != nil {
+		return nil, err
+	}
+
+	cleanup, err := a.provider.Connect(a.DcgmExporterConfig)
+	defer cleanup()
+	if err != nil {
+		return nil, err
+	}
+
+	return runDiag(a.provider, level, gpus)
+}
+
+// runDiag runs the DCGM diagnostic of the level on the GPUs (all GPUs, if empty) via an existing connection of the provider
+func runDiag(provider dcgmProvider, level int, gpus []uint) (*DiagReport, error) {
+	logrus.Infof("Running DCGM diagnostic level %d", level)
+
+	start := time.Now()
+	results, err := provider.RunDiag(level, gpus)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to run DCGM diagnostic level %d", level)
+	}
+
+	report := newDiagReport(level, gpus, results, start, time.Now())
+
+	// the results only carry the DCGM GPU id, which may change across reboots
+	for i := range report.PerGPU {
+		device, err := provider.GetDeviceInfo(report.PerGPU[i].GPU)
+		if err != nil {
+			logrus.Warnf("Failed to get the device info of GPU %d tested by the DCGM diagnostic: %s", report.PerGPU[i].GPU, err)
+			continue
+		}
+		report.PerGPU[i].UUID = device.UUID
+		report.PerGPU[i].PCIBusID = device.PCI.BusID
+		report.PerGPU[i].Model = device.Identifiers.Model
+	}
+
+	logrus.Infof("DCGM diagnostic level %d finished after %.0fs, passed: %t", level, report.Duration, report.Passed)
+
+	return report, nil
+}
+
+// newDiagReport converts the results of go-dcgm into a DiagReport
+// - tests that were not run, or are unknown to go-dcgm (no name), are omitted
+func newDiagReport(level int, gpus []uint, results dcgm.DiagResults, start time.Time, end time.Time) *DiagReport {
+	report := &DiagReport{
+		Level:     level,
+		GPUs:      gpus,
+		StartTime: start,
+		Duration:  end.Sub(start).Seconds(),
+		Passed:    true,
+		Software:  []DiagTestResult{},
+		PerGPU:    []DiagGPUResult{},
+	}
+
+	convert := func(results []dcgm.DiagResult) []DiagTestResult {
+		tests := []DiagTestResult{}
+		for _, result := range results {
+			if result.TestName == "" || result.Status == diagStatusNotRun || result.Status == "" {
+				continue
+			}
+			if result.Status == diagStatusFail {
+				report.Passed = false
+			}
+			tests = append(tests, DiagTestResult{
+				Test:         result.TestName,
+				Status:       result.Status,
+				Info:         strings.TrimSpace(result.TestOutput),
+				ErrorCode:    result.ErrorCode,
+				ErrorMessage: strings.TrimSpace(result.ErrorMessage),
+			})
+		}
+		return tests
+	}
+
+	report.Software = convert(results.Software)
+	for _, gpuResult := range results.PerGpu {
+		report.PerGPU = append(report.PerGPU, DiagGPUResult{
+			GPU:   gpuResult.GPU,
+			Tests: convert(gpuResult.DiagResults),
+		})
+	}
+
+	return report
+}
+
+// WriteTable writes the report as human-readable table
+func (r *DiagReport) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "GPU\tTEST\tSTATUS\tMESSAGE\n")
+	for _, test := range r.Software {
+		fmt.Fprintf(tw, "-\t%s\t%s\t%s\n", test.Test, test.Status, test.ErrorMessage)
+	}
+	for _, gpu := range r.PerGPU {
+		for _, test := range gpu.Tests {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", gpu.GPU, test.Test, test.Status, test.ErrorMessage)
+		}
+	}
+
+	result := "PASSED"
+	if !r.Passed {
+		result = "FAILED"
+	}
+	fmt.Fprintf(tw, "\nDiagnostic level %d %s (%.0fs)\n", r.Level, result, r.Duration)
+
+	return tw.Flush()
+}
+
+// diagnostics runs DCGM diagnostics within the running agent, and keeps the last report
+// - is a dcgmexporter.Collector exporting the results of the last report as metrics
+// - only one diagnostic runs at a time
+// - owned by the agent, so that the last report survives reloads. Diagnostics only run while a collection is connected to DCGM
+type diagnostics struct {
+	// run runs the diagnostic via the connection of the provider. Replaced in tests
+	run func(provider dcgmProvider, level int, gpus []uint) (*DiagReport, error)
+
+	running sync.Mutex
+	// inFlight are the running diagnostics, which are waited for before disconnecting from DCGM
+	inFlight sync.WaitGroup
+
+	mtx      sync.RWMutex
+	last     *DiagReport
+	hostname string
+	// provider is the provider of the connected collection. Nil while not connected
+	provider dcgmProvider
+	// runs is the number of running diagnostics
+	runs int
+}
+
+// newDiagnostics creates diagnostics running the DCGM diagnostics via the connection of the current collection
+func newDiagnostics() *diagnostics {
+	return &diagnostics{run: runDiag}
+}
+
+// connect allows diagnostics to run via the provider, once a collection connected to DCGM
+func (d *diagnostics) connect(provider dcgmProvider, hostname string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.provider = provider
+	d.hostname = hostname
+}
+
+// disconnect rejects new diagnostics, and waits for the running diagnostic to finish before the collection disconnects from DCGM
+// - a running DCGM diagnostic can't be cancelled, and takes minutes at level 3
+// - waits until the deadline, or without limit if zero. Returns an error if the diagnostic is still running at the deadline
+func (d *diagnostics) disconnect(deadline time.Time) error {
+	d.mtx.Lock()
+	d.provider = nil
+	runs := d.runs
+	d.mtx.Unlock()
+
+	if runs > 0 {
+		logrus.Info("Waiting for the running DCGM diagnostic to finish before disconnecting from DCGM")
+	}
+
+	if deadline.IsZero() {
+		d.inFlight.Wait()
+		return nil
+	}
+	return dcgmexporter.WaitWithTimeout(&d.inFlight, time.Until(deadline))
+}
+
+// Run runs the diagnostic, and caches the report
+// - returns errDiagRunning if another diagnostic is running, and errDiagNotConnected while not connected to DCGM
+func (d *diagnostics) Run(level int, gpus []uint) (*DiagReport, error) {
+	if err := ValidateDiagLevel(level); err != nil {
+		return nil, err
+	}
+
+	if !d.running.TryLock() {
+		return nil, errDiagRunning
+	}
+	defer d.running.Unlock()
+
+	d.mtx.Lock()
+	provider := d.provider
+	if provider == nil {
+		d.mtx.Unlock()
+		return nil, errDiagNotConnected
+	}
+	d.runs++
+	d.inFlight.Add(1)
+	d.mtx.Unlock()
+
+	defer func() {
+		d.mtx.Lock()
+		d.runs--
+		d.mtx.Unlock()
+		d.inFlight.Done()
+	}()
+
+	report, err := d.run(provider, level, gpus)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.last = report
+
+	return report, nil
+}
+
+// Last returns the report of the last diagnostic run, or nil if no diagnostic has been run
+func (d *diagnostics) Last() *DiagReport {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	return d.last
+}
+
+// handleDiag runs a diagnostic via POST /diag?level=1&gpus=0,1 and responds with the report as json
+func (d *diagnostics) handleDiag(w http.ResponseWriter, r *http.Request) {
+	level := int(dcgm.DiagQuick)
+	if value := r.URL.Query().Get("level"); value != "" {
+		var err error
+		if level, err = strconv.Atoi(value); err != nil {
+			http.Error(w, fmt.Sprintf("invalid level %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var gpus []uint
+	if value := r.URL.Query().Get("gpus"); value != "" {
+		for _, gpu := range strings.Split(value, ",") {
+			id, err := strconv.ParseUint(strings.TrimSpace(gpu), 10, 32)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid GPU %q", gpu), http.StatusBadRequest)
+				return
+			}
+			gpus = append(gpus, uint(id))
+		}
+	}
+
+	if err := ValidateDiagLevel(level); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := d.Run(level, gpus)
+	switch {
+	case errors.Is(err, errDiagRunning):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errDiagNotConnected):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		logrus.Errorf("DCGM diagnostic failed: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logrus.Errorf("Failed to write diagnostic report: %s", err)
+	}
+}
+
+// GetMetrics returns the results of the last diagnostic run
+// - the software tests and the last run are host-level, the GPU tests are labeled with the tested GPU
+// - skipped tests are omitted
+func (d *diagnostics) GetMetrics() (dcgmexporter.MetricsByCounter, error) {
+	d.mtx.RLock()
+	report := d.last
+	hostname := d.hostname
+	d.mtx.RUnlock()
+
+	if report == nil {
+		return dcgmexporter.MetricsByCounter{}, nil
+	}
+
+	level := fmt.Sprintf("%d", report.Level)
+	metrics := dcgmexporter.MetricsByCounter{
+		diagLastRunCounter: {
+			{
+				Counter:    diagLastRunCounter,
+				Value:      fmt.Sprintf("%d", report.StartTime.Unix()),
+				Hostname:   hostname,
+				Attributes: map[string]string{diagLevelAttribute: level},
+			},
+		},
+	}
+
+	passed := func(test DiagTestResult) string {
+		if test.Status == diagStatusPass {
+			return "1"
+		}
+		return "0"
+	}
+
+	for _, test := range report.Software {
+		if test.Status == diagStatusSkipped {
+			continue
+		}
+		metrics[diagSoftwareTestPassedCounter] = append(metrics[diagSoftwareTestPassedCounter], dcgmexporter.Metric{
+			Counter:  diagSoftwareTestPassedCounter,
+			Value:    passed(test),
+			Hostname: hostname,
+			Attributes: map[string]string{
+				diagTestAttribute:  test.Test,
+				diagLevelAttribute: level,
+			},
+		})
+	}
+
+	for _, gpu := range report.PerGPU {
+		device := dcgm.Device{GPU: gpu.GPU, UUID: gpu.UUID, PCI: dcgm.PCIInfo{BusID: gpu.PCIBusID}, Identifiers: dcgm.DeviceIdentifiers{Model: gpu.Model}}
+		for _, test := range gpu.Tests {
+			if test.Status == diagStatusSkipped {
+				continue
+			}
+			metrics[diagTestPassedCounter] = append(metrics[diagTestPassedCounter], newGPUMetric(diagTestPassedCounter, device, hostname, passed(test), map[string]string{
+				diagTestAttribute:  test.Test,
+				diagLevelAttribute: level,
+			}))
+		}
+	}
+
+	return metrics, nil
+}
+
+func (d *diagnostics) Cleanup() {}
@@ -0,0 +1,387 @@
+package pkg
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// diagScheduleCheckInterval is how often the scheduler checks whether a scheduled diagnostic is due and the GPUs are idle
+	diagScheduleCheckInterval = time.Minute
+	// defaultDiagIdleLookback is how long all GPUs must have been idle before a scheduled diagnostic runs, if not configured otherwise
+	defaultDiagIdleLookback = 10 * time.Minute
+
+	// a GPU is idle, if the graphics engine is less than 1% active, and less than 5% of the frame buffer is used (both fields range from 0.0 to 1.0)
+	// - the frame buffer threshold tolerates the memory reserved by the driver, and processes that keep a context open without running kernels are not idle
+	idleGrEngineActiveThreshold = 0.01
+	idleFbUsedPercentThreshold  = 0.05
+
+	// field names of the metrics used to decide whether a GPU is idle
+	grEngineActiveFieldName = "DCGM_FI_PROF_GR_ENGINE_ACTIVE"
+	fbUsedPercentFieldName  = "DCGM_FI_DEV_FB_USED_PERCENT"
+
+	// attributes of the scheduled diagnostic metrics
+	diagResultAttribute = "result"
+	diagReasonAttribute = "reason"
+	// diagGPUAttribute is the GPU of a test result. The metrics of the scheduled diagnostics are host metrics, without the GPU labels
+	diagGPUAttribute = "gpu"
+
+	// events of the scheduled diagnostics, logged in the logFieldEvent field
+	eventDiagTestFailed = "diag_test_failed"
+	eventDiagError      = "diag_error"
+)
+
+// counters of the scheduled diagnostic metrics
+// - added by the agent, hence, like the dcgm-exporter added counters, use ids outside the range of dcgm fields
+var (
+	diagScheduledRunsCounter = dcgmexporter.Counter{
+		FieldID:   dcgm.Short(9112),
+		FieldName: "do_dcgm_diag_scheduled_runs_total",
+		PromType:  "counter",
+		Help:      "Number of scheduled DCGM diagnostic runs, by result (passed, failed, error).",
+	}
+	diagScheduledSkippedCounter = dcgmexporter.Counter{
+		FieldID:   dcgm.Short(9113),
+		FieldName: "do_dcgm_diag_scheduled_skipped_total",
+		PromType:  "counter",
+		Help:      "Number of due scheduled DCGM diagnostic runs that were postponed, by reason (busy, running).",
+	}
+	diagScheduledLastRunCounter = dcgmexporter.Counter{
+		FieldID:   dcgm.Short(9114),
+		FieldName: "do_dcgm_diag_scheduled_last_run_timestamp_seconds",
+		PromType:  "gauge",
+		Help:      "Unix timestamp of the last scheduled DCGM diagnostic run.",
+	}
+	diagScheduledTestResultsCounter = dcgmexporter.Counter{
+		FieldID:   dcgm.Short(9116),
+		FieldName: "do_dcgm_diag_scheduled_test_results_total",
+		PromType:  "counter",
+		Help:      "Number of results of the tests of scheduled DCGM diagnostic runs, by test, result (pass, fail, warn, skipped, notrun) and gpu (unset for software tests).",
+	}
+)
+
+// diagTestResultKey identifies the results of a test of the scheduled diagnostics
+// - gpu is empty for software tests
+type diagTestResultKey struct {
+	test   string
+	result string
+	gpu    string
+}
+
+// gpuActivitySample is the activity of a GPU at a point in time
+type gpuActivitySample struct {
+	time           time.Time
+	grEngineActive float64
+	fbUsedPercent  float64
+}
+
+// gpuActivityTracker keeps the activity of every GPU over a lookback window, observed from the collected GPU metrics
+// - is a dcgmexporter.Transform that doesn't modify the metrics, to observe the metrics of the pipeline
+type gpuActivityTracker struct {
+	lookback time.Duration
+	now      func() time.Time
+
+	mtx sync.Mutex
+	// since is the time of the first observation
+	since   time.Time
+	samples map[string][]gpuActivitySample
+}
+
+// newGPUActivityTracker creates a gpuActivityTracker keeping the activity over the lookback window
+func newGPUActivityTracker(lookback time.Duration) *gpuActivityTracker {
+	return &gpuActivityTracker{
+		lookback: lookback,
+		now:      time.Now,
+		samples:  map[string][]gpuActivitySample{},
+	}
+}
+
+func (t *gpuActivityTracker) Name() string {
+	return "gpuActivityTracker"
+}
+
+// Process records the activity of every GPU
+// - for MIG instances, the most active instance of a GPU is recorded
+func (t *gpuActivityTracker) Process(metrics dcgmexporter.MetricsByCounter, _ dcgmexporter.SystemInfo) error {
+	now := t.now()
+	observed := map[string]*gpuActivitySample{}
+
+	for counter, counterMetrics := range metrics {
+		if counter.FieldName != grEngineActiveFieldName && counter.FieldName != fbUsedPercentFieldName {
+			continue
+		}
+
+		for _, metric := range counterMetrics {
+			value, err := strconv.ParseFloat(metric.Value, 64)
+			if err != nil {
+				continue
+			}
+
+			sample, exists := observed[metric.GPU]
+			if !exists {
+				sample = &gpuActivitySample{time: now}
+				observed[metric.GPU] = sample
+			}
+
+			if counter.FieldName == grEngineActiveFieldName {
+				sample.grEngineActive = max(sample.grEngineActive, value)
+			} else {
+				sample.fbUsedPercent = max(sample.fbUsedPercent, value)
+			}
+		}
+	}
+
+	if len(observed) == 0 {
+		return nil
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.since.IsZero() {
+		t.since = now
+	}
+
+	for gpu, sample := range observed {
+		t.samples[gpu] = append(t.samples[gpu], *sample)
+	}
+
+	// drop samples outside the lookback window
+	for gpu, samples := range t.samples {
+		i := 0
+		for i < len(samples) && now.Sub(samples[i].time) > t.lookback {
+			i++
+		}
+		t.samples[gpu] = samples[i:]
+	}
+
+	return nil
+}
+
+// idle returns whether all GPUs have been idle over the whole lookback window, otherwise the reason why not
+func (t *gpuActivityTracker) idle() (bool, string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	now := t.now()
+	if t.since.IsZero() || now.Sub(t.since) < t.lookback {
+		return false, fmt.Sprintf("GPU activity observed for less than %s", t.lookback)
+	}
+
+	for gpu, samples := range t.samples {
+		recent := false
+		for _, sample := range samples {
+			if now.Sub(sample.time) > t.lookback {
+				continue
+			}
+			recent = true
+
+			if sample.grEngineActive >= idleGrEngineActiveThreshold || sample.fbUsedPercent >= idleFbUsedPercentThreshold {
+				return false, fmt.Sprintf("GPU %s was active %s ago", gpu, now.Sub(sample.time).Round(time.Second))
+			}
+		}
+
+		if !recent {
+			return false, fmt.Sprintf("no recent activity of GPU %s observed", gpu)
+		}
+	}
+
+	return true, ""
+}
+
+// diagScheduler runs a quick DCGM diagnostic (level 1) on all GPUs every interval, but only while all GPUs have been idle for the lookback window
+// - a due diagnostic is postponed until the GPUs are idle
+// - is a dcgmexporter.Collector exporting the number of scheduled runs and postponements
+// - the results of the tests are exported as well, so that failed tests reach the pushed metrics, not only the logs
+// - owned by the agent, so that the schedule survives reloads. The activity tracker is attached by every collection
+type diagScheduler struct {
+	diagnostics *diagnostics
+	interval    time.Duration
+
+	mtx         sync.Mutex
+	tracker     *gpuActivityTracker
+	hostname    string
+	clock       clock
+	lastRun     time.Time
+	runs        map[string]int
+	skipped     map[string]int
+	testResults map[diagTestResultKey]int
+}
+
+// newDiagScheduler creates a diagScheduler running the diagnostics every interval
+func newDiagScheduler(diagnostics *diagnostics, interval time.Duration) *diagScheduler {
+	return &diagScheduler{
+		diagnostics: diagnostics,
+		interval:    interval,
+		clock:       realClock{},
+		runs:        map[string]int{},
+		skipped:     map[string]int{},
+		testResults: map[diagTestResultKey]int{},
+	}
+}
+
+// attach attaches the activity tracker of a collection, which decides whether all GPUs are idle
+func (s *diagScheduler) attach(tracker *gpuActivityTracker, hostname string, clock clock) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.tracker = tracker
+	s.hostname = hostname
+	s.clock = clock
+}
+
+// Run checks every diagScheduleCheckInterval whether a diagnostic is due, until stop is closed
+func (s *diagScheduler) Run(stop chan interface{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	// the first diagnostic is due one interval after the start of the agent, not after a reload
+	s.mtx.Lock()
+	if s.lastRun.IsZero() {
+		s.lastRun = s.clock.Now()
+	}
+	logrus.Infof("Scheduled diagnostics: running DCGM diagnostic level 1 every %s while all GPUs are idle for %s, next at %s",
+		s.interval, s.tracker.lookback, s.lastRun.Add(s.interval).Format(time.RFC3339))
+	ticks, stopTicker := s.clock.NewTicker(diagScheduleCheckInterval)
+	s.mtx.Unlock()
+	defer stopTicker()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticks:
+			s.check()
+		}
+	}
+}
+
+// check runs the diagnostic, if it is due and all GPUs are idle
+func (s *diagScheduler) check() {
+	s.mtx.Lock()
+	due := s.clock.Now().Sub(s.lastRun) >= s.interval
+	tracker := s.tracker
+	s.mtx.Unlock()
+
+	if !due {
+		return
+	}
+
+	if idle, reason := tracker.idle(); !idle {
+		logrus.Debugf("Scheduled diagnostic postponed: %s", reason)
+		s.record(s.skipped, "busy", false)
+		return
+	}
+
+	report, err := s.diagnostics.Run(int(dcgm.DiagQuick), nil)
+	switch {
+	case errors.Is(err, errDiagRunning):
+		s.record(s.skipped, "running", false)
+	case errors.Is(err, errDiagNotConnected):
+		// reloading, checked again by the next collection
+	case err != nil:
+		logrus.WithField(logFieldEvent, eventDiagError).Errorf("Scheduled diagnostic failed: %s", err)
+		s.record(s.runs, "error", true)
+	case !report.Passed:
+		logFailedDiagTests(report)
+		s.recordTestResults(report)
+		s.record(s.runs, "failed", true)
+	default:
+		s.recordTestResults(report)
+		s.record(s.runs, "passed", true)
+	}
+}
+
+// recordTestResults counts the results of the tests of the report
+func (s *diagScheduler) recordTestResults(report *DiagReport) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, test := range report.Software {
+		s.testResults[diagTestResultKey{test: test.Test, result: test.Status}]++
+	}
+	for _, gpu := range report.PerGPU {
+		for _, test := range gpu.Tests {
+			s.testResults[diagTestResultKey{test: test.Test, result: test.Status, gpu: strconv.FormatUint(uint64(gpu.GPU), 10)}]++
+		}
+	}
+}
+
+// logFailedDiagTests logs every failed test of the report as event, with the GPU of the test
+func logFailedDiagTests(report *DiagReport) {
+	for _, test := range report.Software {
+		if test.Status == diagStatusFail {
+			logrus.WithField(logFieldEvent, eventDiagTestFailed).Errorf("Scheduled diagnostic level %d: software test %q failed: %s", report.Level, test.Test, test.ErrorMessage)
+		}
+	}
+	for _, gpu := range report.PerGPU {
+		for _, test := range gpu.Tests {
+			if test.Status == diagStatusFail {
+				logrus.WithFields(logrus.Fields{logFieldEvent: eventDiagTestFailed, logFieldGPU: gpu.GPU}).
+					Errorf("Scheduled diagnostic level %d: test %q failed on GPU %d (%s): %s", report.Level, test.Test, gpu.GPU, gpu.UUID, test.ErrorMessage)
+			}
+		}
+	}
+}
+
+// record increments the count of the result, and resets the schedule if the diagnostic ran
+func (s *diagScheduler) record(counts map[string]int, result string, ran bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	counts[result]++
+	if ran {
+		s.lastRun = s.clock.Now()
+	}
+}
+
+// GetMetrics returns the number of scheduled runs and postponements, and the time of the last scheduled run
+func (s *diagScheduler) GetMetrics() (dcgmexporter.MetricsByCounter, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	metrics := dcgmexporter.MetricsByCounter{}
+
+	newMetric := func(counter dcgmexporter.Counter, value string, attributes map[string]string) {
+		metrics[counter] = append(metrics[counter], dcgmexporter.Metric{
+			Counter:    counter,
+			Value:      value,
+			Hostname:   s.hostname,
+			Attributes: attributes,
+		})
+	}
+
+	for _, result := range []string{"passed", "failed", "error"} {
+		newMetric(diagScheduledRunsCounter, fmt.Sprintf("%d", s.runs[result]), map[string]string{diagResultAttribute: result})
+	}
+	for _, reason := range []string{"busy", "running"} {
+		newMetric(diagScheduledSkippedCounter, fmt.Sprintf("%d", s.skipped[reason]), map[string]string{diagReasonAttribute: reason})
+	}
+	if len(s.runs) > 0 {
+		newMetric(diagScheduledLastRunCounter, fmt.Sprintf("%d", s.lastRun.Unix()), map[string]string{})
+	}
+
+	keys := slices.SortedFunc(maps.Keys(s.testResults), func(a, b diagTestResultKey) int {
+		return cmp.Or(cmp.Compare(a.gpu, b.gpu), cmp.Compare(a.test, b.test), cmp.Compare(a.result, b.result))
+	})
+	for _, key := range keys {
+		attributes := map[string]string{diagTestAttribute: key.test, diagResultAttribute: key.result}
+		if key.gpu != "" {
+			attributes[diagGPUAttribute] = key.gpu
+		}
+		newMetric(diagScheduledTestResultsCounter, fmt.Sprintf("%d", s.testResults[key]), attributes)
+	}
+
+	return metrics, nil
+}
+
+func (s *diagScheduler) Cleanup() {}
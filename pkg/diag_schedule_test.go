@@ -0,0 +1,312 @@
+package pkg
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+)
+
+// fakeClock is a manually advanced clock
+type fakeClock struct {
+	now time.Time
+	// ticks are delivered to every ticker of the clock
+	ticks chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(_ time.Duration) (<-chan time.Time, func()) {
+	return c.ticks, func() {}
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// activityMetrics returns the metrics of two GPUs with the graphics engine activity and frame buffer usage of GPU 1
+func activityMetrics(grEngineActive, fbUsedPercent string) dcgmexporter.MetricsByCounter {
+	grEngineActiveCounter := dcgmexporter.Counter{FieldID: 1001, FieldName: grEngineActiveFieldName, PromType: "gauge"}
+	fbUsedPercentCounter := dcgmexporter.Counter{FieldID: 254, FieldName: fbUsedPercentFieldName, PromType: "gauge"}
+
+	return dcgmexporter.MetricsByCounter{
+		grEngineActiveCounter: {
+			{Counter: grEngineActiveCounter, GPU: "0", Value: "0.000000"},
+			{Counter: grEngineActiveCounter, GPU: "1", Value: grEngineActive},
+		},
+		fbUsedPercentCounter: {
+			{Counter: fbUsedPercentCounter, GPU: "0", Value: "0.010000"},
+			{Counter: fbUsedPercentCounter, GPU: "1", Value: fbUsedPercent},
+		},
+	}
+}
+
+func TestGPUActivityTracker(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	tracker := newGPUActivityTracker(time.Minute)
+	tracker.now = clock.Now
+
+	observe := func(grEngineActive, fbUsedPercent string) {
+		if err := tracker.Process(activityMetrics(grEngineActive, fbUsedPercent), dcgmexporter.SystemInfo{}); err != nil {
+			t.Fatalf("expected no error, but got: %s", err.Error())
+		}
+		clock.Advance(20 * time.Second)
+	}
+
+	var tests = []struct {
+		name           string
+		grEngineActive string
+		fbUsedPercent  string
+		expected       bool
+	}{
+		{"not observed for the whole lookback", "0", "0", false},
+		{"idle, but not observed for the whole lookback", "0", "0", false},
+		{"idle for the whole lookback", "0", "0", true},
+		{"graphics engine active", "0.5", "0", false},
+		{"active within the lookback", "0", "0", false},
+		{"frame buffer used within the lookback", "0", "0.8", false},
+		{"frame buffer used within the lookback", "0", "0", false},
+		{"frame buffer used within the lookback", "0", "0", false},
+		{"idle again for the whole lookback", "0", "0", true},
+	}
+
+	for _, tt := range tests {
+		observe(tt.grEngineActive, tt.fbUsedPercent)
+		if idle, reason := tracker.idle(); idle != tt.expected {
+			t.Errorf("%s: expected idle to be %t, but got: %t (%s)", tt.name, tt.expected, idle, reason)
+		}
+	}
+}
+
+func TestDiagScheduler(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	tracker := newGPUActivityTracker(time.Minute)
+	tracker.now = clock.Now
+
+	var runs []int
+	d := newConnectedDiagnostics(func(level int, gpus []uint) (*DiagReport, error) {
+		runs = append(runs, level)
+		return &DiagReport{Level: level, Passed: len(runs) == 1}, nil
+	})
+
+	scheduler := newDiagScheduler(d, time.Hour)
+	scheduler.attach(tracker, "gpu-droplet", clock)
+	scheduler.lastRun = clock.Now()
+
+	// observe collects the GPU activity every 20s for the duration
+	observe := func(duration time.Duration, grEngineActive, fbUsedPercent string) {
+		for elapsed := time.Duration(0); elapsed < duration; elapsed += 20 * time.Second {
+			clock.Advance(20 * time.Second)
+			if err := tracker.Process(activityMetrics(grEngineActive, fbUsedPercent), dcgmexporter.SystemInfo{}); err != nil {
+				t.Fatalf("expected no error, but got: %s", err.Error())
+			}
+		}
+	}
+
+	// a customer workload is running when the first diagnostic is due
+	observe(time.Hour, "0.9", "0.7")
+	scheduler.check()
+	if len(runs) != 0 {
+		t.Fatalf("expected no diagnostic while a GPU is busy, but got: %v", runs)
+	}
+
+	// the workload finished
+	observe(80*time.Second, "0", "0")
+	scheduler.check()
+	if !reflect.DeepEqual(runs, []int{1}) {
+		t.Fatalf("expected a level 1 diagnostic once the GPUs are idle, but got: %v", runs)
+	}
+
+	// the next diagnostic is only due one interval later
+	observe(30*time.Minute, "0", "0")
+	scheduler.check()
+	observe(30*time.Minute, "0", "0")
+	scheduler.check()
+	if !reflect.DeepEqual(runs, []int{1, 1}) {
+		t.Fatalf("expected a second diagnostic after the interval, but got: %v", runs)
+	}
+
+	metrics, err := scheduler.GetMetrics()
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	got := map[string]string{}
+	for _, counter := range []dcgmexporter.Counter{diagScheduledRunsCounter, diagScheduledSkippedCounter} {
+		for _, metric := range metrics[counter] {
+			got[metric.Attributes[diagResultAttribute]+metric.Attributes[diagReasonAttribute]] = metric.Value
+		}
+	}
+	expected := map[string]string{"passed": "1", "failed": "1", "error": "0", "busy": "1", "running": "0"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, but got: %v", expected, got)
+	}
+
+	if value := metrics[diagScheduledLastRunCounter][0].Value; value != "1700007280" {
+		t.Errorf("expected last run timestamp 1700007280, but got: %s", value)
+	}
+}
+
+func TestDiagSchedulerAcrossReloads(t *testing.T) {
+	hook := recordLogs(t)
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+
+	var runs int
+	d := newConnectedDiagnostics(func(level int, gpus []uint) (*DiagReport, error) {
+		runs++
+		return &DiagReport{Level: level, Passed: false, PerGPU: []DiagGPUResult{
+			{GPU: 1, UUID: "GPU-1", Tests: []DiagTestResult{{Test: "PCIe", Status: diagStatusFail, ErrorMessage: "PCIe replay count violation"}}},
+		}}, nil
+	})
+	scheduler := newDiagScheduler(d, time.Hour)
+
+	// reload starts a collection with a new activity tracker, and runs the scheduler until the next reload
+	reload := func() *gpuActivityTracker {
+		tracker := newGPUActivityTracker(time.Minute)
+		tracker.now = clock.Now
+		scheduler.attach(tracker, "gpu-droplet", clock)
+
+		var wg sync.WaitGroup
+		stop := make(chan interface{})
+		close(stop)
+		wg.Add(1)
+		scheduler.Run(stop, &wg)
+		return tracker
+	}
+
+	// the agent reloads every 40 minutes, more often than the interval
+	reload()
+	clock.Advance(40 * time.Minute)
+	reload()
+	clock.Advance(20 * time.Minute)
+	tracker := reload()
+
+	for elapsed := time.Duration(0); elapsed < 80*time.Second; elapsed += 20 * time.Second {
+		clock.Advance(20 * time.Second)
+		if err := tracker.Process(activityMetrics("0", "0"), dcgmexporter.SystemInfo{}); err != nil {
+			t.Fatalf("expected no error, but got: %s", err.Error())
+		}
+	}
+	scheduler.check()
+	if runs != 1 {
+		t.Fatalf("expected the diagnostic to be due one interval after the start across reloads, but got %d runs", runs)
+	}
+
+	var events []string
+	for _, entry := range hook.entries {
+		if event, exists := entry.Data[logFieldEvent]; exists {
+			events = append(events, fmt.Sprintf("%s/%v", event, entry.Data[logFieldGPU]))
+		}
+	}
+	if expected := []string{eventDiagTestFailed + "/1"}; !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected the events %v, but got: %v", expected, events)
+	}
+
+	metrics, err := scheduler.GetMetrics()
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	rendered, err := renderRegistryMetrics(metrics)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	for _, expected := range []string{
+		`do_dcgm_diag_scheduled_runs_total{Hostname="gpu-droplet",result="failed"} 1`,
+		`do_dcgm_diag_scheduled_test_results_total{Hostname="gpu-droplet",gpu="1",result="fail",test="PCIe"} 1`,
+	} {
+		if !strings.Contains(rendered, expected) {
+			t.Errorf("expected the metrics to contain %s, but got:\n%s", expected, rendered)
+		}
+	}
+}
+
+func TestDiagSchedulerTestResults(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	d := newConnectedDiagnostics(func(level int, gpus []uint) (*DiagReport, error) {
+		return &DiagReport{Level: level, Passed: false,
+			Software: []DiagTestResult{{Test: "Denylist", Status: diagStatusPass}},
+			PerGPU: []DiagGPUResult{
+				{GPU: 0, Tests: []DiagTestResult{{Test: "PCIe", Status: diagStatusPass}, {Test: "Memory", Status: diagStatusSkipped}}},
+				{GPU: 1, Tests: []DiagTestResult{{Test: "PCIe", Status: diagStatusFail}, {Test: "Memory", Status: diagStatusPass}}},
+			},
+		}, nil
+	})
+
+	tracker := newGPUActivityTracker(time.Minute)
+	tracker.now = clock.Now
+	scheduler := newDiagScheduler(d, time.Hour)
+	scheduler.attach(tracker, "gpu-droplet", clock)
+
+	// two scheduled runs of idle GPUs
+	for run := 0; run < 2; run++ {
+		scheduler.lastRun = clock.Now()
+		for elapsed := time.Duration(0); elapsed < time.Hour; elapsed += 20 * time.Second {
+			clock.Advance(20 * time.Second)
+			if err := tracker.Process(activityMetrics("0", "0"), dcgmexporter.SystemInfo{}); err != nil {
+				t.Fatalf("expected no error, but got: %s", err.Error())
+			}
+		}
+		scheduler.check()
+	}
+
+	metrics, err := scheduler.GetMetrics()
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	var got []string
+	for _, metric := range metrics[diagScheduledTestResultsCounter] {
+		got = append(got, fmt.Sprintf("%s/%s/%s=%s", metric.Attributes[diagGPUAttribute], metric.Attributes[diagTestAttribute], metric.Attributes[diagResultAttribute], metric.Value))
+	}
+	expected := []string{"/Denylist/pass=2", "0/Memory/skipped=2", "0/PCIe/pass=2", "1/Memory/pass=2", "1/PCIe/fail=2"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the test results %v, but got: %v", expected, got)
+	}
+}
+
+func TestDiagSchedulerRunTicks(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0), ticks: make(chan time.Time)}
+	runs := make(chan int, 1)
+	d := newConnectedDiagnostics(func(level int, gpus []uint) (*DiagReport, error) {
+		runs <- level
+		return &DiagReport{Level: level, Passed: true}, nil
+	})
+
+	tracker := newGPUActivityTracker(time.Minute)
+	tracker.now = clock.Now
+	scheduler := newDiagScheduler(d, time.Hour)
+	scheduler.attach(tracker, "gpu-droplet", clock)
+	scheduler.lastRun = clock.Now()
+
+	for elapsed := time.Duration(0); elapsed < time.Hour; elapsed += 20 * time.Second {
+		clock.Advance(20 * time.Second)
+		if err := tracker.Process(activityMetrics("0", "0"), dcgmexporter.SystemInfo{}); err != nil {
+			t.Fatalf("expected no error, but got: %s", err.Error())
+		}
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan interface{})
+	wg.Add(1)
+	go scheduler.Run(stop, &wg)
+
+	// the check is driven by the ticks of the clock
+	clock.ticks <- clock.Now()
+	select {
+	case level := <-runs:
+		if level != 1 {
+			t.Errorf("expected a level 1 diagnostic, but got: %d", level)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a diagnostic on the tick of the clock")
+	}
+
+	close(stop)
+	wg.Wait()
+}
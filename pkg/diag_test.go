@@ -0,0 +1,301 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/pkg/errors"
+)
+
+var testDiagResults = dcgm.DiagResults{
+	Software: []dcgm.DiagResult{
+		{Status: diagStatusPass, TestName: "presence of drivers on the denylist (e.g. nouveau)"},
+		{Status: diagStatusSkipped, TestName: "inforom corruption"},
+	},
+	PerGpu: []dcgm.GpuResult{
+		{GPU: 0, DiagResults: []dcgm.DiagResult{
+			{Status: diagStatusPass, TestName: "PCIe"},
+			{Status: diagStatusNotRun, TestName: "Memtest"},
+			{Status: diagStatusPass, TestName: ""},
+		}},
+		{GPU: 1, DiagResults: []dcgm.DiagResult{
+			{Status: diagStatusFail, TestName: "PCIe", ErrorCode: 37, ErrorMessage: "PCIe replay count violation\n"},
+		}},
+	},
+}
+
+// newConnectedDiagnostics creates diagnostics running the diagnostic by run, connected to DCGM
+func newConnectedDiagnostics(run func(level int, gpus []uint) (*DiagReport, error)) *diagnostics {
+	d := newDiagnostics()
+	d.run = func(_ dcgmProvider, level int, gpus []uint) (*DiagReport, error) {
+		return run(level, gpus)
+	}
+	d.connect(&recordingProvider{}, "gpu-droplet")
+	return d
+}
+
+func TestNewDiagReport(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	report := newDiagReport(1, nil, testDiagResults, start, start.Add(90*time.Second))
+
+	expected := &DiagReport{
+		Level:     1,
+		StartTime: start,
+		Duration:  90,
+		Passed:    false,
+		Software: []DiagTestResult{
+			{Test: "presence of drivers on the denylist (e.g. nouveau)", Status: diagStatusPass},
+			{Test: "inforom corruption", Status: diagStatusSkipped},
+		},
+		PerGPU: []DiagGPUResult{
+			{GPU: 0, Tests: []DiagTestResult{{Test: "PCIe", Status: diagStatusPass}}},
+			{GPU: 1, Tests: []DiagTestResult{{Test: "PCIe", Status: diagStatusFail, ErrorCode: 37, ErrorMessage: "PCIe replay count violation"}}},
+		},
+	}
+
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("expected report %+v, but got: %+v", expected, report)
+	}
+
+	var table bytes.Buffer
+	if err := report.WriteTable(&table); err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	for _, line := range []string{"1    PCIe", "PCIe replay count violation", "Diagnostic level 1 FAILED (90s)"} {
+		if !strings.Contains(table.String(), line) {
+			t.Errorf("expected table to contain %q, but got: %s", line, table.String())
+		}
+	}
+}
+
+func TestValidateDiagLevel(t *testing.T) {
+	for level, valid := range map[int]bool{0: false, 1: true, 2: true, 3: true, 4: false} {
+		if err := ValidateDiagLevel(level); (err == nil) != valid {
+			t.Errorf("expected level %d to be valid=%t, but got error: %v", level, valid, err)
+		}
+	}
+}
+
+func TestDiagnosticsMetrics(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	d := newConnectedDiagnostics(func(level int, gpus []uint) (*DiagReport, error) {
+		return newDiagReport(level, gpus, testDiagResults, start, start), nil
+	})
+
+	metrics, err := d.GetMetrics()
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	if len(metrics) != 0 {
+		t.Errorf("expected no metrics before the first run, but got: %+v", metrics)
+	}
+
+	if _, err := d.Run(2, nil); err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	metrics, err = d.GetMetrics()
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	var got []string
+	for _, counter := range []dcgmexporter.Counter{diagSoftwareTestPassedCounter, diagTestPassedCounter} {
+		for _, metric := range metrics[counter] {
+			got = append(got, metric.GPU+"/"+metric.Attributes[diagTestAttribute]+"/"+metric.Attributes[diagLevelAttribute]+"="+metric.Value)
+		}
+	}
+	expected := []string{"/presence of drivers on the denylist (e.g. nouveau)/2=1", "0/PCIe/2=1", "1/PCIe/2=0"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, but got: %v", expected, got)
+	}
+
+	if value := metrics[diagLastRunCounter][0].Value; value != "1700000000" {
+		t.Errorf("expected last run timestamp 1700000000, but got: %s", value)
+	}
+}
+
+func TestDiagnosticsMetricsLabels(t *testing.T) {
+	provider, err := loadSimulatedProvider(testScenario)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	d := newDiagnostics()
+	d.connect(provider, "gpu-droplet")
+
+	report, err := d.Run(2, nil)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	if report.PerGPU[1].UUID != "GPU-7c4b2a1d-8e3f-4a9b-b0c1-3d2e1f0a9b81" || report.PerGPU[1].PCIBusID != "00000000:2A:00.0" {
+		t.Errorf("expected the report to identify the tested GPU, but got: %+v", report.PerGPU[1])
+	}
+
+	metrics, err := d.GetMetrics()
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	rendered, err := renderRegistryMetrics(metrics)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	for _, expected := range []string{
+		`do_dcgm_diag_test_passed{gpu="1",UUID="GPU-7c4b2a1d-8e3f-4a9b-b0c1-3d2e1f0a9b81",pci_bus_id="00000000:2A:00.0",device="nvidia1",modelName="NVIDIA H100 80GB HBM3",Hostname="gpu-droplet",level="2",test="pcie"} 1`,
+		`do_dcgm_diag_software_test_passed{Hostname="gpu-droplet",level="2",test="software"} 1`,
+		`do_dcgm_diag_last_run_timestamp_seconds{Hostname="gpu-droplet",level="2"} `,
+	} {
+		if !strings.Contains(rendered, expected) {
+			t.Errorf("expected the metrics to contain %s, but got:\n%s", expected, rendered)
+		}
+	}
+	if strings.Contains(rendered, `gpu=""`) {
+		t.Errorf("expected no metric with an empty gpu label, but got:\n%s", rendered)
+	}
+}
+
+func TestDiagnosticsDisconnect(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	d := newConnectedDiagnostics(func(level int, gpus []uint) (*DiagReport, error) {
+		close(started)
+		<-release
+		return &DiagReport{Level: level, Passed: true}, nil
+	})
+
+	done := make(chan error)
+	go func() {
+		_, err := d.Run(3, nil)
+		done <- err
+	}()
+	<-started
+
+	// a shutdown does not disconnect from DCGM while the diagnostic runs
+	if err := d.disconnect(time.Now().Add(10 * time.Millisecond)); err == nil {
+		t.Errorf("expected an error while the diagnostic is running")
+	}
+	if _, err := d.Run(1, nil); !errors.Is(err, errDiagRunning) {
+		t.Errorf("expected %q, but got: %v", errDiagRunning, err)
+	}
+
+	// a reload waits for the diagnostic to finish
+	disconnected := make(chan error)
+	go func() {
+		disconnected <- d.disconnect(time.Time{})
+	}()
+	select {
+	case err := <-disconnected:
+		t.Fatalf("expected to wait for the running diagnostic, but got: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("expected no error, but got: %s", err.Error())
+	}
+	if err := <-disconnected; err != nil {
+		t.Errorf("expected no error, but got: %s", err.Error())
+	}
+
+	if _, err := d.Run(1, nil); !errors.Is(err, errDiagNotConnected) {
+		t.Errorf("expected %q while disconnected, but got: %v", errDiagNotConnected, err)
+	}
+
+	// the last report survives the reload
+	d.connect(&recordingProvider{}, "gpu-droplet")
+	if d.Last() == nil || d.Last().Level != 3 {
+		t.Errorf("expected the report of the last run to be kept, but got: %+v", d.Last())
+	}
+}
+
+func TestDiagAPI(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	api, err := newAPIServer("localhost:0", tokenFile)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	// the first run blocks until released, to test concurrent runs
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var once sync.Once
+	d := newConnectedDiagnostics(func(level int, gpus []uint) (*DiagReport, error) {
+		once.Do(func() {
+			close(started)
+			<-release
+		})
+		return &DiagReport{Level: level, GPUs: gpus, Passed: true}, nil
+	})
+	api.Handle("POST /diag", d.handleDiag)
+
+	server := httptest.NewServer(api.server)
+	t.Cleanup(server.Close)
+
+	post := func(query, token string) *http.Response {
+		req, err := http.NewRequest("POST", server.URL+"/diag"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	if resp := post("", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status %d without token, but got: %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	if resp := post("", "wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status %d with wrong token, but got: %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	if resp := post("?level=4", "secret"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d for invalid level, but got: %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	first := make(chan *http.Response)
+	go func() {
+		first <- post("?level=2&gpus=0,1", "secret")
+	}()
+	<-started
+
+	if resp := post("", "secret"); resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected status %d while a diagnostic is running, but got: %d", http.StatusConflict, resp.StatusCode)
+	}
+
+	close(release)
+	resp := <-first
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, but got: %d", http.StatusOK, resp.StatusCode)
+	}
+
+	var report DiagReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	if report.Level != 2 || !reflect.DeepEqual(report.GPUs, []uint{0, 1}) {
+		t.Errorf("expected level 2 on GPUs [0 1], but got: level %d on GPUs %v", report.Level, report.GPUs)
+	}
+	if d.Last() == nil || d.Last().Level != 2 {
+		t.Errorf("expected the report to be cached, but got: %+v", d.Last())
+	}
+}
@@ -0,0 +1,361 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/sirupsen/logrus"
+)
+
+// linkStateNames are the names of the NVLink states
+var linkStateNames = map[dcgm.Link_State]string{
+	dcgm.LS_NOT_SUPPORTED: "not supported",
+	dcgm.LS_DISABLED:      "disabled",
+	dcgm.LS_DOWN:          "down",
+	dcgm.LS_UP:            "up",
+}
+
+// Discovery is the result of the device discovery of the agent, i.e. the entities the agent watches fields for
+// - the entities excluded by the selection (--gpus, --nvswitches, --nvlinks and their --exclude-* flags) are listed as excluded
+type Discovery struct {
+	GPUs     []DiscoveredGPU    `json:"gpus"`
+	Switches []DiscoveredSwitch `json:"switches"`
+	NVLinks  []DiscoveredNVLink `json:"nvlinks"`
+	CPUs     []DiscoveredCPU    `json:"cpus"`
+	// EntityGroups are the entity groups of the dcgm-exporter (GPU, NvSwitch, NvLink, CPU, CPU Core) with the fields watched for each
+	EntityGroups []DiscoveredEntityGroup `json:"entity_groups"`
+}
+
+// DiscoveredGPU is a GPU discovered via DCGM
+type DiscoveredGPU struct {
+	GPU        uint   `json:"gpu"`
+	UUID       string `json:"uuid"`
+	PCIBusID   string `json:"pci_bus_id"`
+	Model      string `json:"model"`
+	MigEnabled bool   `json:"mig_enabled"`
+	// Excluded is true, if the GPU is not watched due to the selection
+	Excluded     bool                    `json:"excluded,omitempty"`
+	GPUInstances []DiscoveredGPUInstance `json:"gpu_instances,omitempty"`
+	MetricGroups []DiscoveredMetricGroup `json:"profiling_metric_groups,omitempty"`
+}
+
+// DiscoveredGPUInstance is a MIG GPU instance
+type DiscoveredGPUInstance struct {
+	// ID is the NVML instance id, EntityID the DCGM entity id
+	ID               uint                        `json:"id"`
+	EntityID         uint                        `json:"entity_id"`
+	Profile          string                      `json:"profile"`
+	ComputeInstances []DiscoveredComputeInstance `json:"compute_instances,omitempty"`
+}
+
+// DiscoveredComputeInstance is a compute instance of a MIG GPU instance
+type DiscoveredComputeInstance struct {
+	ID       uint   `json:"id"`
+	EntityID uint   `json:"entity_id"`
+	Profile  string `json:"profile"`
+}
+
+// DiscoveredMetricGroup is a group of profiling fields the GPU can watch concurrently
+type DiscoveredMetricGroup struct {
+	Major  uint     `json:"major"`
+	Minor  uint     `json:"minor"`
+	Fields []string `json:"fields"`
+	// Watched are the fields of the group the agent watches
+	Watched []string `json:"watched"`
+}
+
+// DiscoveredSwitch is a NVSwitch discovered via DCGM
+type DiscoveredSwitch struct {
+	Switch uint `json:"switch"`
+	Links  int  `json:"links"`
+	// Excluded is true, if the NVSwitch is not watched due to the selection
+	Excluded bool `json:"excluded,omitempty"`
+}
+
+// DiscoveredNVLink is a NVLink of a GPU or NVSwitch
+type DiscoveredNVLink struct {
+	// Parent is the entity group of the link's parent: GPU or NvSwitch
+	Parent   string `json:"parent"`
+	ParentID uint   `json:"parent_id"`
+	Index    uint   `json:"index"`
+	State    string `json:"state"`
+	// Excluded is true, if the NVLink is not watched due to the selection, or its GPU or NVSwitch is excluded
+	Excluded bool `json:"excluded,omitempty"`
+}
+
+// DiscoveredCPU is a CPU discovered via DCGM
+type DiscoveredCPU struct {
+	CPU   uint   `json:"cpu"`
+	Cores []uint `json:"cores"`
+}
+
+// DiscoveredEntityGroup is an entity group of the dcgm-exporter
+type DiscoveredEntityGroup struct {
+	Name string `json:"name"`
+	// Error is why no entities were discovered, e.g. "no switches to monitor"
+	Error string `json:"error,omitempty"`
+	// WatchedFields are the fields the agent watches for the entities of the group
+	WatchedFields []string `json:"watched_fields"`
+}
+
+// Discover discovers the GPUs, MIG instances, NVSwitches, NVLinks and CPUs via the nv-hostengine, like the agent does at startup
+func (a GPUMetricsAgent) Discover() (*Discovery, error) {
+	cleanup, err := a.provider.Connect(a.DcgmExporterConfig)
+	defer cleanup()
+	if err != nil {
+		return nil, err
+	}
+
+	fillProfilingConfigMetricGroups(a.provider, a.DcgmExporterConfig)
+
+	cs, err := getCounters(a.DcgmExporterConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect DCGM fields/counters to watch: %s", err.Error())
+	}
+
+	// like dcgmexporter.FieldEntityGroupTypeSystemInfo.Load, but also discovers the entities of groups without watched fields
+	systemInfos := map[dcgm.Field_Entity_Group]*dcgmexporter.SystemInfo{}
+	systemInfoErrors := map[dcgm.Field_Entity_Group]error{}
+	watched := map[dcgm.Field_Entity_Group][]dcgm.Short{}
+	for _, egt := range dcgmexporter.FieldEntityGroupTypeToMonitor {
+		watched[egt] = a.provider.NewDeviceFields(cs.DCGMCounters, egt)
+
+		sysInfo, err := a.provider.GetSystemInfo(a.DcgmExporterConfig, egt)
+		if err != nil {
+			systemInfoErrors[egt] = err
+			continue
+		}
+		systemInfos[egt] = sysInfo
+	}
+
+	links, err := a.provider.GetNvLinkLinkStatus()
+	if err != nil {
+		logrus.Warnf("Failed to get the NVLink states: %s", err)
+	}
+
+	metricGroups := map[uint][]dcgm.MetricGroup{}
+	if sysInfo, exists := systemInfos[dcgm.FE_GPU]; exists {
+		for i := uint(0); i < sysInfo.GPUCount; i++ {
+			gpu := sysInfo.GPUs[i].DeviceInfo.GPU
+			groups, err := a.provider.GetSupportedMetricGroups(gpu)
+			if err != nil {
+				logrus.WithField(logFieldGPU, gpu).Infof("No profiling metric groups supported by GPU %d: %s", gpu, err)
+				continue
+			}
+			metricGroups[gpu] = groups
+		}
+	}
+
+	return newDiscovery(systemInfos, systemInfoErrors, links, metricGroups, watched, cs.DCGMCounters, a.selection), nil
+}
+
+// newDiscovery creates the Discovery from the system info of every entity group, marking the entities not selected as excluded
+func newDiscovery(
+	systemInfos map[dcgm.Field_Entity_Group]*dcgmexporter.SystemInfo,
+	systemInfoErrors map[dcgm.Field_Entity_Group]error,
+	links []dcgm.NvLinkStatus,
+	metricGroups map[uint][]dcgm.MetricGroup,
+	watched map[dcgm.Field_Entity_Group][]dcgm.Short,
+	counters []dcgmexporter.Counter,
+	selection *deviceSelection,
+) *Discovery {
+	// resolve field names from the counters, and the embedded field table for fields that aren't watched
+	fieldNames := map[dcgm.Short]string{}
+	if fields, err := loadFields(); err == nil {
+		for _, field := range fields {
+			fieldNames[field.ID] = field.Name
+		}
+	}
+	for _, counter := range counters {
+		fieldNames[counter.FieldID] = counter.FieldName
+	}
+	fieldName := func(id dcgm.Short) string {
+		if name, exists := fieldNames[id]; exists {
+			return name
+		}
+		return fmt.Sprintf("%d", id)
+	}
+
+	watchedGPUFields := map[dcgm.Short]bool{}
+	for _, id := range watched[dcgm.FE_GPU] {
+		watchedGPUFields[id] = true
+	}
+
+	discovery := &Discovery{}
+
+	excludedGPUs := map[uint]bool{}
+	if sysInfo, exists := systemInfos[dcgm.FE_GPU]; exists {
+		for i := uint(0); i < sysInfo.GPUCount; i++ {
+			info := sysInfo.GPUs[i]
+			gpu := DiscoveredGPU{
+				GPU:        info.DeviceInfo.GPU,
+				UUID:       info.DeviceInfo.UUID,
+				PCIBusID:   info.DeviceInfo.PCI.BusID,
+				Model:      info.DeviceInfo.Identifiers.Model,
+				MigEnabled: info.MigEnabled,
+				Excluded:   !selection.selectsGPU(info.DeviceInfo),
+			}
+			excludedGPUs[gpu.GPU] = gpu.Excluded
+
+			for _, instance := range info.GPUInstances {
+				gpuInstance := DiscoveredGPUInstance{
+					ID:       instance.Info.NvmlInstanceId,
+					EntityID: instance.EntityId,
+					Profile:  instance.ProfileName,
+				}
+				for _, computeInstance := range instance.ComputeInstances {
+					gpuInstance.ComputeInstances = append(gpuInstance.ComputeInstances, DiscoveredComputeInstance{
+						ID:       computeInstance.InstanceInfo.NvmlComputeInstanceId,
+						EntityID: computeInstance.EntityId,
+						Profile:  computeInstance.ProfileName,
+					})
+				}
+				gpu.GPUInstances = append(gpu.GPUInstances, gpuInstance)
+			}
+
+			for _, group := range metricGroups[gpu.GPU] {
+				metricGroup := DiscoveredMetricGroup{Major: group.Major, Minor: group.Minor, Fields: []string{}, Watched: []string{}}
+				for _, id := range group.FieldIds {
+					metricGroup.Fields = append(metricGroup.Fields, fieldName(dcgm.Short(id)))
+					if watchedGPUFields[dcgm.Short(id)] {
+						metricGroup.Watched = append(metricGroup.Watched, fieldName(dcgm.Short(id)))
+					}
+				}
+				gpu.MetricGroups = append(gpu.MetricGroups, metricGroup)
+			}
+
+			discovery.GPUs = append(discovery.GPUs, gpu)
+		}
+	}
+
+	if sysInfo, exists := systemInfos[dcgm.FE_SWITCH]; exists {
+		for _, sw := range sysInfo.Switches {
+			discovery.Switches = append(discovery.Switches, DiscoveredSwitch{Switch: sw.EntityId, Links: len(sw.NvLinks), Excluded: !selection.selectsSwitch(sw.EntityId)})
+		}
+	}
+
+	for _, link := range links {
+		state, known := linkStateNames[link.State]
+		if !known {
+			state = fmt.Sprintf("%d", link.State)
+		}
+		excluded := excludedGPUs[link.ParentId]
+		if link.ParentType == dcgm.FE_SWITCH {
+			excluded = !selection.selectsLink(link.ParentId, link.Index)
+		}
+		discovery.NVLinks = append(discovery.NVLinks, DiscoveredNVLink{
+			Parent:   link.ParentType.String(),
+			ParentID: link.ParentId,
+			Index:    link.Index,
+			State:    state,
+			Excluded: excluded,
+		})
+	}
+
+	if sysInfo, exists := systemInfos[dcgm.FE_CPU]; exists {
+		for _, cpu := range sysInfo.CPUs {
+			discovery.CPUs = append(discovery.CPUs, DiscoveredCPU{CPU: cpu.EntityId, Cores: cpu.Cores})
+		}
+	}
+
+	for _, egt := range dcgmexporter.FieldEntityGroupTypeToMonitor {
+		group := DiscoveredEntityGroup{Name: egt.String(), WatchedFields: []string{}}
+		if err, exists := systemInfoErrors[egt]; exists {
+			group.Error = err.Error()
+		}
+		for _, id := range watched[egt] {
+			group.WatchedFields = append(group.WatchedFields, fieldName(id))
+		}
+		slices.Sort(group.WatchedFields)
+		discovery.EntityGroups = append(discovery.EntityGroups, group)
+	}
+
+	return discovery
+}
+
+// WriteTable writes the discovery as human-readable tables
+func (d *Discovery) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "GPU\tUUID\tPCI BUS ID\tMODEL\tMIG\tWATCHED\n")
+	for _, gpu := range d.GPUs {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%t\t%s\n", gpu.GPU, gpu.UUID, gpu.PCIBusID, gpu.Model, gpu.MigEnabled, watchedName(gpu.Excluded))
+	}
+
+	if d.hasGPUInstances() {
+		fmt.Fprintf(tw, "\nGPU\tGPU INSTANCE\tCOMPUTE INSTANCE\tPROFILE\n")
+		for _, gpu := range d.GPUs {
+			for _, instance := range gpu.GPUInstances {
+				fmt.Fprintf(tw, "%d\t%d\t-\t%s\n", gpu.GPU, instance.ID, instance.Profile)
+				for _, computeInstance := range instance.ComputeInstances {
+					fmt.Fprintf(tw, "%d\t%d\t%d\t%s\n", gpu.GPU, instance.ID, computeInstance.ID, computeInstance.Profile)
+				}
+			}
+		}
+	}
+
+	if len(d.Switches) > 0 {
+		fmt.Fprintf(tw, "\nSWITCH\tLINKS\tWATCHED\n")
+		for _, sw := range d.Switches {
+			fmt.Fprintf(tw, "%d\t%d\t%s\n", sw.Switch, sw.Links, watchedName(sw.Excluded))
+		}
+	}
+
+	if len(d.NVLinks) > 0 {
+		fmt.Fprintf(tw, "\nPARENT\tID\tLINK\tSTATE\tWATCHED\n")
+		for _, link := range d.NVLinks {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", link.Parent, link.ParentID, link.Index, link.State, watchedName(link.Excluded))
+		}
+	}
+
+	if len(d.CPUs) > 0 {
+		fmt.Fprintf(tw, "\nCPU\tCORES\n")
+		for _, cpu := range d.CPUs {
+			fmt.Fprintf(tw, "%d\t%d\n", cpu.CPU, len(cpu.Cores))
+		}
+	}
+
+	fmt.Fprintf(tw, "\nGPU\tPROFILING METRIC GROUP\tFIELDS\tWATCHED\n")
+	for _, gpu := range d.GPUs {
+		for _, group := range gpu.MetricGroups {
+			fmt.Fprintf(tw, "%d\t%d.%d\t%d\t%s\n", gpu.GPU, group.Major, group.Minor, len(group.Fields), strings.Join(group.Watched, ","))
+		}
+	}
+
+	fmt.Fprintf(tw, "\nENTITY GROUP\tWATCHED FIELDS\n")
+	for _, group := range d.EntityGroups {
+		fields := strings.Join(group.WatchedFields, ",")
+		if fields == "" {
+			fields = "-"
+		}
+		if group.Error != "" {
+			fields = fmt.Sprintf("%s (not discovered: %s)", fields, group.Error)
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", group.Name, fields)
+	}
+
+	return tw.Flush()
+}
+
+// watchedName returns "excluded" for entities excluded by the selection, "yes" otherwise
+func watchedName(excluded bool) string {
+	if excluded {
+		return "excluded"
+	}
+	return "yes"
+}
+
+// hasGPUInstances returns whether any GPU has MIG instances
+func (d *Discovery) hasGPUInstances() bool {
+	for _, gpu := range d.GPUs {
+		if len(gpu.GPUInstances) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+)
+
+func TestNewDiscovery(t *testing.T) {
+	gpuSystemInfo := &dcgmexporter.SystemInfo{GPUCount: 2}
+	gpuSystemInfo.GPUs[0] = dcgmexporter.GPUInfo{
+		DeviceInfo: dcgm.Device{GPU: 0, UUID: "GPU-0", PCI: dcgm.PCIInfo{BusID: "00000000:0F:00.0"}, Identifiers: dcgm.DeviceIdentifiers{Model: "NVIDIA H100 80GB HBM3"}},
+	}
+	gpuSystemInfo.GPUs[1] = dcgmexporter.GPUInfo{
+		DeviceInfo: dcgm.Device{GPU: 1, UUID: "GPU-1", PCI: dcgm.PCIInfo{BusID: "00000000:10:00.0"}, Identifiers: dcgm.DeviceIdentifiers{Model: "NVIDIA H100 80GB HBM3"}},
+		MigEnabled: true,
+		GPUInstances: []dcgmexporter.GPUInstanceInfo{{
+			Info:        dcgm.MigEntityInfo{NvmlInstanceId: 1},
+			ProfileName: "3g.40gb",
+			EntityId:    7,
+			ComputeInstances: []dcgmexporter.ComputeInstanceInfo{
+				{InstanceInfo: dcgm.MigEntityInfo{NvmlComputeInstanceId: 0}, ProfileName: "3c.3g.40gb", EntityId: 14},
+			},
+		}},
+	}
+
+	systemInfos := map[dcgm.Field_Entity_Group]*dcgmexporter.SystemInfo{
+		dcgm.FE_GPU:    gpuSystemInfo,
+		dcgm.FE_SWITCH: {Switches: []dcgmexporter.SwitchInfo{{EntityId: 0, NvLinks: make([]dcgm.NvLinkStatus, 2)}}},
+	}
+	systemInfoErrors := map[dcgm.Field_Entity_Group]error{
+		dcgm.FE_CPU: errors.New("no CPUs to monitor"),
+	}
+	links := []dcgm.NvLinkStatus{
+		{ParentId: 0, ParentType: dcgm.FE_GPU, Index: 0, State: dcgm.LS_UP},
+		{ParentId: 0, ParentType: dcgm.FE_SWITCH, Index: 1, State: dcgm.LS_DOWN},
+	}
+	metricGroups := map[uint][]dcgm.MetricGroup{
+		0: {{Major: 1, Minor: 0, FieldIds: []uint{1001, 1002, 1040}}},
+	}
+	watched := map[dcgm.Field_Entity_Group][]dcgm.Short{
+		dcgm.FE_GPU: {150, 1001},
+	}
+	counters := []dcgmexporter.Counter{
+		{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP"},
+		{FieldID: 1001, FieldName: "DCGM_FI_PROF_GR_ENGINE_ACTIVE"},
+	}
+
+	discovery := newDiscovery(systemInfos, systemInfoErrors, links, metricGroups, watched, counters, nil)
+
+	expectedGPUs := []DiscoveredGPU{
+		{
+			GPU: 0, UUID: "GPU-0", PCIBusID: "00000000:0F:00.0", Model: "NVIDIA H100 80GB HBM3",
+			MetricGroups: []DiscoveredMetricGroup{{
+				Major:   1,
+				Fields:  []string{"DCGM_FI_PROF_GR_ENGINE_ACTIVE", "DCGM_FI_PROF_SM_ACTIVE", "DCGM_FI_PROF_NVLINK_L0_TX_BYTES"},
+				Watched: []string{"DCGM_FI_PROF_GR_ENGINE_ACTIVE"},
+			}},
+		},
+		{
+			GPU: 1, UUID: "GPU-1", PCIBusID: "00000000:10:00.0", Model: "NVIDIA H100 80GB HBM3", MigEnabled: true,
+			GPUInstances: []DiscoveredGPUInstance{{
+				ID: 1, EntityID: 7, Profile: "3g.40gb",
+				ComputeInstances: []DiscoveredComputeInstance{{ID: 0, EntityID: 14, Profile: "3c.3g.40gb"}},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(discovery.GPUs, expectedGPUs) {
+		t.Errorf("expected GPUs %+v, but got: %+v", expectedGPUs, discovery.GPUs)
+	}
+
+	if expected := []DiscoveredSwitch{{Switch: 0, Links: 2}}; !reflect.DeepEqual(discovery.Switches, expected) {
+		t.Errorf("expected switches %+v, but got: %+v", expected, discovery.Switches)
+	}
+
+	expectedLinks := []DiscoveredNVLink{
+		{Parent: "GPU", ParentID: 0, Index: 0, State: "up"},
+		{Parent: "NvSwitch", ParentID: 0, Index: 1, State: "down"},
+	}
+	if !reflect.DeepEqual(discovery.NVLinks, expectedLinks) {
+		t.Errorf("expected NVLinks %+v, but got: %+v", expectedLinks, discovery.NVLinks)
+	}
+
+	if len(discovery.CPUs) != 0 {
+		t.Errorf("expected no CPUs, but got: %+v", discovery.CPUs)
+	}
+
+	expectedGroups := map[string]DiscoveredEntityGroup{
+		"GPU": {Name: "GPU", WatchedFields: []string{"DCGM_FI_DEV_GPU_TEMP", "DCGM_FI_PROF_GR_ENGINE_ACTIVE"}},
+		"CPU": {Name: "CPU", Error: "no CPUs to monitor", WatchedFields: []string{}},
+	}
+	for _, group := range discovery.EntityGroups {
+		if expected, exists := expectedGroups[group.Name]; exists && !reflect.DeepEqual(group, expected) {
+			t.Errorf("expected entity group %+v, but got: %+v", expected, group)
+		}
+	}
+
+	var table bytes.Buffer
+	if err := discovery.WriteTable(&table); err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	for _, line := range []string{"1    1             0                 3c.3g.40gb", "NvSwitch  0   1     down", "CPU           - (not discovered: no CPUs to monitor)"} {
+		if !strings.Contains(table.String(), line) {
+			t.Errorf("expected table to contain %q, but got: %s", line, table.String())
+		}
+	}
+}
+
+func TestNewDiscoverySelection(t *testing.T) {
+	gpuSystemInfo := &dcgmexporter.SystemInfo{GPUCount: 2}
+	gpuSystemInfo.GPUs[0] = dcgmexporter.GPUInfo{DeviceInfo: dcgm.Device{GPU: 0, UUID: "GPU-0"}}
+	gpuSystemInfo.GPUs[1] = dcgmexporter.GPUInfo{DeviceInfo: dcgm.Device{GPU: 1, UUID: "GPU-1"}}
+
+	systemInfos := map[dcgm.Field_Entity_Group]*dcgmexporter.SystemInfo{
+		dcgm.FE_GPU:    gpuSystemInfo,
+		dcgm.FE_SWITCH: {Switches: []dcgmexporter.SwitchInfo{{EntityId: 0}, {EntityId: 1}}},
+	}
+	links := []dcgm.NvLinkStatus{
+		{ParentId: 0, ParentType: dcgm.FE_GPU, Index: 0, State: dcgm.LS_UP},
+		{ParentId: 1, ParentType: dcgm.FE_GPU, Index: 0, State: dcgm.LS_UP},
+		{ParentId: 0, ParentType: dcgm.FE_SWITCH, Index: 0, State: dcgm.LS_UP},
+		{ParentId: 0, ParentType: dcgm.FE_SWITCH, Index: 1, State: dcgm.LS_UP},
+		{ParentId: 1, ParentType: dcgm.FE_SWITCH, Index: 0, State: dcgm.LS_UP},
+	}
+
+	selection, err := newDeviceSelection(Options{ExcludeGPUs: []string{"GPU-1"}, ExcludeNVSwitches: []string{"1"}, ExcludeNVLinks: []string{"0/1"}})
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	discovery := newDiscovery(systemInfos, nil, links, nil, nil, nil, selection)
+
+	var got []string
+	for _, gpu := range discovery.GPUs {
+		got = append(got, fmt.Sprintf("GPU %d %t", gpu.GPU, gpu.Excluded))
+	}
+	for _, sw := range discovery.Switches {
+		got = append(got, fmt.Sprintf("NvSwitch %d %t", sw.Switch, sw.Excluded))
+	}
+	for _, link := range discovery.NVLinks {
+		got = append(got, fmt.Sprintf("%s %d link %d %t", link.Parent, link.ParentID, link.Index, link.Excluded))
+	}
+
+	// the links of an excluded GPU or NVSwitch are excluded as well
+	expected := []string{
+		"GPU 0 false",
+		"GPU 1 true",
+		"NvSwitch 0 false",
+		"NvSwitch 1 true",
+		"GPU 0 link 0 false",
+		"GPU 1 link 0 true",
+		"NvSwitch 0 link 0 false",
+		"NvSwitch 0 link 1 true",
+		"NvSwitch 1 link 0 true",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, but got: %v", expected, got)
+	}
+
+	var table bytes.Buffer
+	if err := discovery.WriteTable(&table); err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	if !strings.Contains(table.String(), "NvSwitch  0   1     up     excluded") {
+		t.Errorf("expected table to list the excluded NVLink, but got: %s", table.String())
+	}
+}
@@ -0,0 +1,221 @@
+package pkg
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/do-dcgm-exporter/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+	The metrics server and the API server are started once by Run, and keep serving across SIGHUP reloads.
+	Hence, the endpoints read from a metricsStore, which holds the collection and the push queue of the current run, and its latest metrics:
+	- GET /metrics serves the latest metrics of the pipeline, the metrics of the registry, and the request metrics of the server
+	- GET /health is OK while the pipeline collected recently, like the systemd watchdog
+	- GET /ready is OK once the current run collected, and not while the agent (re)connects to DCGM
+*/
+
+// metricsStore holds the collection and the push queue of the current run, and the latest metrics collected by its pipeline
+type metricsStore struct {
+	clock clock
+	// maxAge is how old the latest collection may be for the agent to be healthy
+	maxAge time.Duration
+
+	// mtx is held for reading while the registry is gathered, so that the collection is not cleaned up during a scrape
+	mtx            sync.RWMutex
+	collection     *collection
+	queue          *pushQueue
+	metrics        string
+	lastCollection time.Time
+	// ready is whether the current collection collected metrics
+	ready bool
+}
+
+func newMetricsStore(clock clock, maxAge time.Duration) *metricsStore {
+	return &metricsStore{
+		clock:  clock,
+		maxAge: maxAge,
+	}
+}
+
+// setCollection sets the collection of the current run, or nil before it is cleaned up
+// - waits for the scrapes gathering the registry of the previous collection
+func (s *metricsStore) setCollection(c *collection) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.collection = c
+	s.ready = false
+	if c == nil {
+		s.metrics = ""
+	}
+}
+
+// setQueue sets the push queue of the current run, or nil once it is flushed
+func (s *metricsStore) setQueue(q *pushQueue) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.queue = q
+}
+
+// current returns the collection of the current run, or nil if there is none
+func (s *metricsStore) current() *collection {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.collection
+}
+
+// update stores the latest metrics of the pipeline
+// - the pipeline sends empty metrics if the collection failed
+func (s *metricsStore) update(metrics string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.metrics = metrics
+	debugCounters.Add(counterCollections, 1)
+	if metrics == "" {
+		debugCounters.Add(counterFailedCollections, 1)
+	} else {
+		s.lastCollection = s.clock.Now()
+		s.ready = true
+	}
+}
+
+// handleMetrics serves the latest metrics of the pipeline and the metrics of the registry, followed by the request metrics of the server
+func (s *metricsStore) handleMetrics(srv *server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		s.mtx.RLock()
+		defer s.mtx.RUnlock()
+
+		var registryMetrics string
+		if s.collection != nil {
+			var err error
+			registryMetrics, err = s.collection.gatherRegistry()
+			if err != nil {
+				logrus.Error(err.Error())
+				http.Error(w, "failed to gather metrics", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if _, err := w.Write([]byte(s.metrics + registryMetrics)); err != nil {
+			logrus.Debugf("Failed to write metrics: %s", err)
+			return
+		}
+		if err := srv.WriteMetrics(w); err != nil {
+			logrus.Debugf("Failed to write request metrics: %s", err)
+		}
+	}
+}
+
+// handleHealth serves OK while the pipeline collected within maxAge
+func (s *metricsStore) handleHealth(w http.ResponseWriter, _ *http.Request) {
+	s.mtx.RLock()
+	healthy := !s.lastCollection.IsZero() && s.clock.Now().Sub(s.lastCollection) <= s.maxAge
+	s.mtx.RUnlock()
+
+	writeStatus(w, healthy)
+}
+
+// handleReady serves OK once the current collection collected metrics
+func (s *metricsStore) handleReady(w http.ResponseWriter, _ *http.Request) {
+	s.mtx.RLock()
+	ready := s.ready
+	s.mtx.RUnlock()
+
+	writeStatus(w, ready)
+}
+
+// handleDiag runs DCGM diagnostics via the current collection
+func (s *metricsStore) handleDiag(w http.ResponseWriter, r *http.Request) {
+	c := s.current()
+	if c == nil {
+		http.Error(w, "not connected to DCGM", http.StatusServiceUnavailable)
+		return
+	}
+	c.diagnostics.handleDiag(w, r)
+}
+
+// writeStatus writes OK, or KO with status 503, like the health endpoint of the dcgm-exporter
+func writeStatus(w http.ResponseWriter, ok bool) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("KO"))
+		return
+	}
+	_, _ = w.Write([]byte("OK"))
+}
+
+// handleIndex serves an HTML page linking the endpoints
+func handleIndex(endpoints ...string) http.HandlerFunc {
+	var links strings.Builder
+	for _, endpoint := range endpoints {
+		links.WriteString(`<p><a href=".` + endpoint + `">` + endpoint + "</a></p>\n")
+	}
+
+	page := "<html>\n<head><title>DO DCGM Exporter</title></head>\n<body>\n<h1>DO DCGM Exporter</h1>\n" + links.String() + "</body>\n</html>\n"
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		_, _ = w.Write([]byte(page))
+	}
+}
+
+// newMetricsServer creates the server of the /metrics endpoint
+// - the timeouts are the ones of the dcgm-exporter metrics server
+func (a GPUMetricsAgent) newMetricsServer(store *metricsStore) *server.Server {
+	srv := server.New(server.Options{
+		Name:              "metrics",
+		Addresses:         a.Options.Addresses,
+		SystemdSocket:     a.Options.WebSystemdSocket,
+		WebConfigFile:     a.Options.WebConfigFile,
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+	})
+
+	srv.HandleFunc("GET /{$}", handleIndex("/metrics", "/health", "/ready"))
+	srv.HandleFunc("GET /metrics", store.handleMetrics(srv))
+	srv.HandleFunc("GET /health", store.handleHealth)
+	srv.HandleFunc("GET /ready", store.handleReady)
+
+	return srv
+}
+
+// newAgentAPIServer creates the API server of the operational endpoints. Nil if disabled
+func (a GPUMetricsAgent) newAgentAPIServer(store *metricsStore) (*apiServer, error) {
+	if a.Options.APIAddress == "" {
+		return nil, nil
+	}
+
+	api, err := newAPIServer(a.Options.APIAddress, a.Options.APITokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	api.Handle("POST /diag", store.handleDiag)
+	api.Handle("GET /history", a.history.handleHistory)
+	api.Handle("GET /config", a.handleConfig)
+
+	return api, nil
+}
+
+// handleConfig serves the resolved options of the agent and the dcgm-exporter, with secrets redacted
+func (a GPUMetricsAgent) handleConfig(w http.ResponseWriter, _ *http.Request) {
+	config, err := a.supportBundleConfig()
+	if err != nil {
+		logrus.Errorf("API: failed to marshal config: %s", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(config)
+}
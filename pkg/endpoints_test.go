@@ -0,0 +1,90 @@
+package pkg
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsStoreHealth(t *testing.T) {
+	clock := newTickingClock()
+	store := newMetricsStore(clock, time.Minute)
+
+	status := func(handler http.HandlerFunc) int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/", nil))
+		return w.Code
+	}
+
+	var tests = []struct {
+		name           string
+		action         func()
+		expectedHealth int
+		expectedReady  int
+	}{
+		{"before the first collection", func() {}, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"collection failed", func() { store.update("") }, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"collected", func() { store.update("DCGM_FI_DEV_GPU_UTIL 1\n") }, http.StatusOK, http.StatusOK},
+		{"reconnecting", func() { store.setCollection(nil) }, http.StatusOK, http.StatusServiceUnavailable},
+		{"no recent collection", func() { clock.now = clock.now.Add(2 * time.Minute) }, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"collected after reconnecting", func() { store.update("DCGM_FI_DEV_GPU_UTIL 1\n") }, http.StatusOK, http.StatusOK},
+	}
+
+	// the steps depend on each other, and run in order
+	for _, tt := range tests {
+		tt.action()
+		if got := status(store.handleHealth); got != tt.expectedHealth {
+			t.Errorf("%s: expected /health status %d, but got: %d", tt.name, tt.expectedHealth, got)
+		}
+		if got := status(store.handleReady); got != tt.expectedReady {
+			t.Errorf("%s: expected /ready status %d, but got: %d", tt.name, tt.expectedReady, got)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	store.handleDiag(w, httptest.NewRequest("POST", "/diag", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d for diagnostics without collection, but got: %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+func TestRunListenError(t *testing.T) {
+	used, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer used.Close()
+
+	agent, err := NewGPUMetricsAgent(Options{SimulateScenario: testScenario, Addresses: []string{used.Addr().String()}})
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	provider := &recordingProvider{dcgmProvider: agent.provider}
+	agent.provider = provider
+	agent.signals = make(chan os.Signal, 1)
+	agent.root = t.TempDir()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- agent.Run()
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), used.Addr().String()) {
+			t.Errorf("expected an error listening on %s, but got: %v", used.Addr(), err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the agent to return the listen error")
+	}
+
+	provider.mtx.Lock()
+	defer provider.mtx.Unlock()
+	if len(provider.events) != 0 {
+		t.Errorf("expected the agent not to connect to DCGM, but got: %q", provider.events)
+	}
+}
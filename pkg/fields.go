@@ -0,0 +1,314 @@
+package pkg
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/pkg/errors"
+)
+
+/*
+	The field metadata (type, entity level) is resolved by dcgm.FieldGetById, which requires the DCGM library.
+	To list and validate fields on hosts without GPUs (e.g. when writing a collectors file), the agent embeds a copy of the field table.
+	The table is generated from the field constants of go-dcgm and the metadata of the DCGM library with `make fields`.
+
+	Once connected, the metadata is resolved via the dcgmProvider instead, e.g. to check the types of the fields of a collectors file at startup.
+*/
+
+//go:embed dcgm_fields.csv
+var dcgmFieldsCSV string
+
+const (
+	// severity of a problem found in a collectors file
+	// - errors make the agent fail at startup, or the field can't be exported
+	// - warnings are ignored by the agent, or might not work on all GPUs
+	FieldProblemError   = "error"
+	FieldProblemWarning = "warning"
+)
+
+// fieldTypeNames are the names of the DCGM field types
+var fieldTypeNames = map[uint]string{
+	dcgm.DCGM_FT_DOUBLE:    "double",
+	dcgm.DCGM_FT_INT64:     "int64",
+	dcgm.DCGM_FT_STRING:    "string",
+	dcgm.DCGM_FT_BINARY:    "binary",
+	dcgm.DCGM_FT_TIMESTAMP: "timestamp",
+}
+
+// fieldEntityLevels are the names of the entity levels of the field table and the scripted values of the simulator
+var fieldEntityLevels = map[string]dcgm.Field_Entity_Group{
+	"global":   dcgm.FE_NONE,
+	"gpu":      dcgm.FE_GPU,
+	"vgpu":     dcgm.FE_VGPU,
+	"switch":   dcgm.FE_SWITCH,
+	"gpu_i":    dcgm.FE_GPU_I,
+	"gpu_ci":   dcgm.FE_GPU_CI,
+	"link":     dcgm.FE_LINK,
+	"cpu":      dcgm.FE_CPU,
+	"cpu_core": dcgm.FE_CPU_CORE,
+}
+
+// promMetricTypes are the Prometheus metric types supported in collectors files
+// copied from: https://github.com/NVIDIA/dcgm-exporter/blob/402a10fd8bb4a36be7cc5b2c703cf8f1322d1ef0/pkg/dcgmexporter/types.go#L125
+// - reason: not exported
+var promMetricTypes = map[string]bool{
+	"gauge":     true,
+	"counter":   true,
+	"histogram": true,
+	"summary":   true,
+	"label":     true,
+}
+
+// profilingGroups are the groups of profiling fields that DCGM can watch concurrently on current datacenter GPUs (e.g. A100, H100).
+// Watching fields of different groups requires DCGM to multiplex the profiling counters, or fails on some GPUs.
+// - see: https://docs.nvidia.com/datacenter/dcgm/latest/user-guide/feature-overview.html#multiplexing-of-profiling-counters
+// - the default counters use the "general" group
+var profilingGroups = []struct {
+	name     string
+	min, max dcgm.Short
+}{
+	{"general", 1001, 1016},
+	{"media engine", 1017, 1033},
+	{"per-link NVLink", 1040, 1075},
+}
+
+// Field is a DCGM field of the embedded field table
+type Field struct {
+	Name string
+	ID   dcgm.Short
+	// Type is the DCGM field type: double, int64, string, binary or timestamp
+	Type string
+	// EntityLevel is the entity the field is watched for: global, gpu, switch, link, cpu, cpu_core, ...
+	EntityLevel string
+	// Default is true, if the agent collects the field by default
+	Default bool
+}
+
+// fieldMeta is the metadata of a DCGM field, resolved via the dcgmProvider
+type fieldMeta struct {
+	// Type is the DCGM field type: double, int64, string, binary or timestamp
+	Type string
+	// EntityLevel is the entity group the field is watched for
+	EntityLevel dcgm.Field_Entity_Group
+}
+
+// fieldMetaFunc resolves the metadata of a field, false if unknown
+type fieldMetaFunc func(field dcgm.Short) (fieldMeta, bool)
+
+// FieldProblem is a problem of a field in a collectors file
+type FieldProblem struct {
+	Line     int
+	Field    string
+	Severity string
+	Message  string
+}
+
+func (p FieldProblem) String() string {
+	return fmt.Sprintf("line %d: %s: %s: %s", p.Line, p.Severity, p.Field, p.Message)
+}
+
+// loadFields parses the embedded field table once
+var loadFields = sync.OnceValues(func() ([]Field, error) {
+	r := csv.NewReader(strings.NewReader(dcgmFieldsCSV))
+	r.Comment = '#'
+	r.FieldsPerRecord = 4
+
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse the embedded DCGM field table")
+	}
+
+	fields := make([]Field, 0, len(records))
+	for _, record := range records {
+		id, err := strconv.ParseUint(record[1], 10, 16)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid id of field %s in the embedded DCGM field table", record[0])
+		}
+
+		if len(record[2]) != 1 {
+			return nil, errors.Errorf("invalid type %q of field %s in the embedded DCGM field table", record[2], record[0])
+		}
+		fieldType, known := fieldTypeNames[uint(record[2][0])]
+		if !known {
+			return nil, errors.Errorf("invalid type %q of field %s in the embedded DCGM field table", record[2], record[0])
+		}
+		if _, known := fieldEntityLevels[record[3]]; !known {
+			return nil, errors.Errorf("invalid entity level %q of field %s in the embedded DCGM field table", record[3], record[0])
+		}
+
+		_, isDefault := defaultCounters[dcgm.Short(id)]
+		fields = append(fields, Field{
+			Name:        record[0],
+			ID:          dcgm.Short(id),
+			Type:        fieldType,
+			EntityLevel: record[3],
+			Default:     isDefault,
+		})
+	}
+
+	return fields, nil
+})
+
+// ListFields returns the DCGM fields, whose name matches the pattern (a case-insensitive regular expression). All fields if the pattern is empty
+func ListFields(pattern string) ([]Field, error) {
+	fields, err := loadFields()
+	if err != nil {
+		return nil, err
+	}
+
+	if pattern == "" {
+		return fields, nil
+	}
+
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid pattern")
+	}
+
+	var matching []Field
+	for _, field := range fields {
+		if re.MatchString(field.Name) {
+			matching = append(matching, field)
+		}
+	}
+	return matching, nil
+}
+
+// tableFieldMeta resolves the metadata of a field from the embedded field table
+func tableFieldMeta(field dcgm.Short) (fieldMeta, bool) {
+	fields, err := loadFields()
+	if err != nil {
+		return fieldMeta{}, false
+	}
+
+	for _, f := range fields {
+		if f.ID == field {
+			return fieldMeta{Type: f.Type, EntityLevel: fieldEntityLevels[f.EntityLevel]}, true
+		}
+	}
+	return fieldMeta{}, false
+}
+
+// ValidateCollectorsFile validates a collectors file (as passed with --collectors) without connecting to DCGM
+// - the types of the fields are taken from the embedded field table
+func ValidateCollectorsFile(path string) ([]FieldProblem, error) {
+	return validateCollectorsFile(path, tableFieldMeta)
+}
+
+// validateCollectorsFile validates a collectors file, checking the types of the fields if their metadata is resolved (meta is not nil)
+func validateCollectorsFile(path string, meta fieldMetaFunc) ([]FieldProblem, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return validateCollectors(f, meta)
+}
+
+// validateCollectors validates the records of a collectors file "<field name>, <prometheus type>, <help>", reporting
+// - malformed records, unknown field names and unknown Prometheus types
+// - type mismatches, e.g. string fields exported as gauge. Only if meta is not nil
+// - fields collected twice, or already collected by default
+// - profiling fields of different profiling groups than the default profiling fields
+func validateCollectors(r io.Reader, meta fieldMetaFunc) ([]FieldProblem, error) {
+	fields, err := loadFields()
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]Field, len(fields))
+	for _, field := range fields {
+		byName[field.Name] = field
+	}
+
+	// like the dcgm-exporter parser
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+
+	var problems []FieldProblem
+	report := func(line int, field, severity, format string, args ...interface{}) {
+		problems = append(problems, FieldProblem{Line: line, Field: field, Severity: severity, Message: fmt.Sprintf(format, args...)})
+	}
+
+	seen := map[string]int{}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse collectors file")
+		}
+
+		line, _ := reader.FieldPos(0)
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+
+		if len(record) != 3 {
+			report(line, record[0], FieldProblemError, "malformed record, expected 3 fields (name, prometheus type, help), but got %d", len(record))
+			continue
+		}
+		name, promType := record[0], record[1]
+
+		if previous, exists := seen[name]; exists {
+			report(line, name, FieldProblemWarning, "duplicate of line %d, ignored", previous)
+			continue
+		}
+		seen[name] = line
+
+		if !promMetricTypes[promType] {
+			report(line, name, FieldProblemError, "unknown Prometheus type %q, must be one of: gauge, counter, histogram, summary, label", promType)
+		}
+
+		field, known := byName[name]
+		if !known {
+			if _, err := dcgmexporter.IdentifyMetricType(name); err == nil {
+				// metrics added by the dcgm-exporter, e.g. DCGM_EXP_XID_ERRORS_COUNT
+				continue
+			}
+			if _, old := dcgm.OLD_DCGM_FI[name]; old {
+				report(line, name, FieldProblemWarning, "deprecated field name")
+				continue
+			}
+			report(line, name, FieldProblemError, "unknown DCGM field")
+			continue
+		}
+
+		if field.Default {
+			report(line, name, FieldProblemWarning, "already collected by default, ignored")
+			continue
+		}
+
+		if meta != nil {
+			if m, known := meta(field.ID); known {
+				switch {
+				case m.Type == "binary":
+					report(line, name, FieldProblemError, "binary field can't be exported")
+				case m.Type == "string" && promType != "label":
+					report(line, name, FieldProblemError, "string field must be exported as label, not %s", promType)
+				}
+			}
+		}
+
+		for _, group := range profilingGroups[1:] {
+			if field.ID >= group.min && field.ID <= group.max {
+				report(line, name, FieldProblemWarning, "%s profiling field can't be watched together with the default (general) profiling fields on most GPUs. DCGM multiplexes them, or skips the field", group.name)
+			}
+		}
+	}
+
+	return problems, nil
+}
@@ -0,0 +1,162 @@
+package pkg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+)
+
+func TestFieldTable(t *testing.T) {
+	fields, err := ListFields("")
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	byID := map[dcgm.Short]Field{}
+	for _, field := range fields {
+		if id, exists := dcgm.DCGM_FI[field.Name]; !exists || id != field.ID {
+			t.Errorf("expected field %s to have the go-dcgm id %d, but got: %d", field.Name, id, field.ID)
+		}
+		if field.Type == "" || field.EntityLevel == "" {
+			t.Errorf("expected field %s to have a type and entity level, but got: %+v", field.Name, field)
+		}
+		byID[field.ID] = field
+	}
+
+	// every default counter must be in the table
+	for id, counter := range defaultCounters {
+		if field, exists := byID[id]; !exists || !field.Default {
+			t.Errorf("expected default counter %s to be a default field, but got: %+v", counter.FieldName, field)
+		}
+	}
+}
+
+func TestListFieldsGrep(t *testing.T) {
+	fields, err := ListFields("gpu_temp$")
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	expected := []Field{{Name: "DCGM_FI_DEV_GPU_TEMP", ID: 150, Type: "int64", EntityLevel: "gpu", Default: true}}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("expected %+v, but got: %+v", expected, fields)
+	}
+
+	if _, err := ListFields("("); err == nil {
+		t.Errorf("expected an error for an invalid pattern")
+	}
+}
+
+func TestTableFieldMeta(t *testing.T) {
+	var tests = []struct {
+		field    string
+		expected fieldMeta
+	}{
+		{"DCGM_FI_DRIVER_VERSION", fieldMeta{Type: "string", EntityLevel: dcgm.FE_NONE}},
+		{"DCGM_FI_DEV_GPU_TEMP", fieldMeta{Type: "int64", EntityLevel: dcgm.FE_GPU}},
+		{"DCGM_FI_DEV_POWER_USAGE", fieldMeta{Type: "double", EntityLevel: dcgm.FE_GPU}},
+		{"DCGM_FI_DEV_SUPPORTED_CLOCKS", fieldMeta{Type: "binary", EntityLevel: dcgm.FE_GPU}},
+		{"DCGM_FI_DEV_NVSWITCH_TEMPERATURE_CURRENT", fieldMeta{Type: "int64", EntityLevel: dcgm.FE_SWITCH}},
+		{"DCGM_FI_DEV_NVSWITCH_LINK_STATUS", fieldMeta{Type: "int64", EntityLevel: dcgm.FE_LINK}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			meta, known := tableFieldMeta(dcgm.DCGM_FI[tt.field])
+			if !known || meta != tt.expected {
+				t.Errorf("expected %+v, but got: %+v (known: %t)", tt.expected, meta, known)
+			}
+		})
+	}
+
+	if _, known := tableFieldMeta(dcgm.Short(9999)); known {
+		t.Errorf("expected an unknown field not to be known")
+	}
+}
+
+func TestValidateCollectors(t *testing.T) {
+	collectors := `# additional fields
+DCGM_FI_DEV_GPU_UTIL, gauge, GPU utilization (in %).
+DCGM_FI_DEV_GPU_TEMP, gauge, GPU temperature (in C).
+DCGM_FI_DEV_NAME, gauge, GPU name.
+DCGM_FI_DEV_VBIOS_VERSION, label, VBIOS version.
+DCGM_FI_DEV_GPU_UTLI, gauge, Typo.
+DCGM_FI_DEV_GPU_UTIL, gauge, Duplicate.
+DCGM_FI_DEV_MEM_COPY_UTIL, gague, Memory utilization (in %).
+DCGM_FI_PROF_NVLINK_L0_TX_BYTES, counter, NVLink link 0 bytes.
+DCGM_FI_PROF_PIPE_INT_ACTIVE, gauge, Integer pipe active.
+DCGM_FI_DEV_SUPPORTED_CLOCKS, label, Supported clocks.
+DCGM_FI_DEV_ENC_UTIL
+DCGM_EXP_XID_ERRORS_COUNT, gauge, XID errors.
+`
+
+	// the metadata as resolved via DCGM
+	meta := func(field dcgm.Short) (fieldMeta, bool) {
+		switch field {
+		case dcgm.DCGM_FI["DCGM_FI_DEV_NAME"], dcgm.DCGM_FI["DCGM_FI_DEV_VBIOS_VERSION"]:
+			return fieldMeta{Type: "string", EntityLevel: dcgm.FE_GPU}, true
+		case dcgm.DCGM_FI["DCGM_FI_DEV_SUPPORTED_CLOCKS"]:
+			return fieldMeta{Type: "binary", EntityLevel: dcgm.FE_GPU}, true
+		}
+		return fieldMeta{Type: "int64", EntityLevel: dcgm.FE_GPU}, true
+	}
+
+	var tests = []struct {
+		name     string
+		meta     fieldMetaFunc
+		expected []string
+	}{
+		{"connected to DCGM", meta, []string{
+			"warning DCGM_FI_DEV_GPU_TEMP",
+			"error DCGM_FI_DEV_NAME",
+			"error DCGM_FI_DEV_GPU_UTLI",
+			"warning DCGM_FI_DEV_GPU_UTIL",
+			"error DCGM_FI_DEV_MEM_COPY_UTIL",
+			"warning DCGM_FI_PROF_NVLINK_L0_TX_BYTES",
+			"error DCGM_FI_DEV_SUPPORTED_CLOCKS",
+			"error DCGM_FI_DEV_ENC_UTIL",
+		}},
+		{"embedded field table", tableFieldMeta, []string{
+			"warning DCGM_FI_DEV_GPU_TEMP",
+			"error DCGM_FI_DEV_NAME",
+			"error DCGM_FI_DEV_GPU_UTLI",
+			"warning DCGM_FI_DEV_GPU_UTIL",
+			"error DCGM_FI_DEV_MEM_COPY_UTIL",
+			"warning DCGM_FI_PROF_NVLINK_L0_TX_BYTES",
+			"error DCGM_FI_DEV_SUPPORTED_CLOCKS",
+			"error DCGM_FI_DEV_ENC_UTIL",
+		}},
+		// the type mismatches of DCGM_FI_DEV_NAME and DCGM_FI_DEV_SUPPORTED_CLOCKS are unknown
+		{"without metadata", nil, []string{
+			"warning DCGM_FI_DEV_GPU_TEMP",
+			"error DCGM_FI_DEV_GPU_UTLI",
+			"warning DCGM_FI_DEV_GPU_UTIL",
+			"error DCGM_FI_DEV_MEM_COPY_UTIL",
+			"warning DCGM_FI_PROF_NVLINK_L0_TX_BYTES",
+			"error DCGM_FI_DEV_ENC_UTIL",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems, err := validateCollectors(strings.NewReader(collectors), tt.meta)
+			if err != nil {
+				t.Fatalf("expected no error, but got: %s", err.Error())
+			}
+
+			var got []string
+			for _, problem := range problems {
+				got = append(got, strings.Join([]string{problem.Severity, problem.Field}, " "))
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected problems %v, but got: %v", tt.expected, problems)
+			}
+
+			if problems[0].Line != 3 {
+				t.Errorf("expected the first problem in line 3, but got: %d", problems[0].Line)
+			}
+		})
+	}
+}
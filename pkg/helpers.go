@@ -71,22 +71,46 @@ func getCounters(config *dcgmexporter.Config) (*dcgmexporter.CounterSet, error)
 	return &counterSet, nil
 }
 
-// getFieldEntityGroupTypeSystemInfo creates a mapping {dcgm.FIELD_ENTITY_GROUP{FE_GPU,FE_SWITCH,FE_LINK} -> (system_info such as GPUs on the system, field_ids to watch for that group extracted from counters)}
-// - under the hood, discovers the available hardware  (GPUs, NVLinks, NVSwitches, CPUs) to obtain the system info.
-// - adapted from: https://github.com/NVIDIA/dcgm-exporter/blob/b4552f0bb78fe5b2cd7a17d048ee49abc1c2d926/pkg/cmd/app.go#L413
-func getFieldEntityGroupTypeSystemInfo(cs *dcgmexporter.CounterSet, config *dcgmexporter.Config) *dcgmexporter.FieldEntityGroupTypeSystemInfo {
-	fieldEntityGroupTypeSystemInfo := dcgmexporter.NewEntityGroupTypeSystemInfo(cs.DCGMCounters, config)
+// entityGroups maps the entity group types {FE_GPU,FE_SWITCH,FE_LINK,FE_CPU,FE_CPU_CORE} to their system info (e.g. the GPUs on the system), and the field ids to watch for the group
+// - like dcgmexporter.FieldEntityGroupTypeSystemInfo, which can only be loaded via the go-dcgm bindings, as its items are unexported
+type entityGroups map[dcgm.Field_Entity_Group]dcgmexporter.FieldEntityGroupTypeSystemInfoItem
+
+// getEntityGroups discovers the available hardware (GPUs, NVLinks, NVSwitches, CPUs) of the entity group types with fields to watch
+// - the entities not selected are removed. A selector matching no entity is an error
+// - adapted from: https://github.com/NVIDIA/dcgm-exporter/blob/402a10fd8bb4a36be7cc5b2c703cf8f1322d1ef0/pkg/dcgmexporter/field_entity_group_system_info.go#L66
+func getEntityGroups(provider dcgmProvider, cs *dcgmexporter.CounterSet, config *dcgmexporter.Config, selection *deviceSelection) (entityGroups, error) {
+	groups := entityGroups{}
+	matched := map[string]bool{}
 
 	for _, egt := range dcgmexporter.FieldEntityGroupTypeToMonitor {
-		// Discovers physical devices (GPUs, NVLinks, NVSwitches, CPUs) using dcgm_exporter.system_info -> dcgm
-		// - uses system_info from dcgm_exporter that cannot be mocked due to unexported fields
-		err := fieldEntityGroupTypeSystemInfo.Load(egt)
+		deviceFields := provider.NewDeviceFields(cs.DCGMCounters, egt)
+
+		// Typically we are not watching any fields in the CPU groups
+		// - INFO[0001] Not collecting CPU metrics: no fields to watch
+		if !dcgmexporter.ShouldMonitorDeviceType(deviceFields, egt) {
+			logrus.Infof("Not collecting %s metrics: no fields to watch", egt.String())
+			continue
+		}
+
+		sysInfo, err := provider.GetSystemInfo(config, egt)
 		if err != nil {
-			// Typically errors indicate that we are not watching any fields in the CPU groups
-			// - INFO[0001] Not collecting CPU metrics; no fields to watch for device type: 7
-			// - INFO[0001] Not collecting CPU Core metrics; no fields to watch for device type: 8
 			logrus.Infof("Not collecting %s metrics: %s", egt.String(), err)
+			continue
+		}
+
+		if selection != nil {
+			selection.apply(sysInfo, matched)
+			if describeEntities(*sysInfo) == "" {
+				logrus.Infof("Not collecting %s metrics: no entities selected", egt.String())
+				continue
+			}
+		}
+
+		groups[egt] = dcgmexporter.FieldEntityGroupTypeSystemInfoItem{
+			SystemInfo:   *sysInfo,
+			DeviceFields: deviceFields,
 		}
 	}
-	return fieldEntityGroupTypeSystemInfo
+
+	return groups, selection.check(matched)
 }
@@ -1,9 +1,13 @@
 package pkg
 
 import (
+	"bufio"
 	"fmt"
+	"maps"
 	"os"
 	"os/signal"
+	"path"
+	"strconv"
 
 	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
 	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
@@ -20,10 +24,10 @@ import (
 // - fields with IDs 1001 - 1033 are general profiling fields
 // - fields with IDS 1040 - 1075 are NVLink profiling fields
 // - For more information, see: https://docs.nvidia.com/datacenter/dcgm/latest/user-guide/feature-overview.html#multiplexing-of-profiling-counters
-// - copied from: https://github.com/NVIDIA/dcgm-exporter/blob/b4552f0bb78fe5b2cd7a17d048ee49abc1c2d926/pkg/cmd/app.go#L481
-func fillProfilingConfigMetricGroups(config *dcgmexporter.Config) {
+// - adapted from: https://github.com/NVIDIA/dcgm-exporter/blob/b4552f0bb78fe5b2cd7a17d048ee49abc1c2d926/pkg/cmd/app.go#L481
+func fillProfilingConfigMetricGroups(provider dcgmProvider, config *dcgmexporter.Config) {
 	var groups []dcgm.MetricGroup
-	groups, err := dcgm.GetSupportedMetricGroups(0)
+	groups, err := provider.GetSupportedMetricGroups(0)
 	if err != nil {
 		config.CollectDCP = false
 		logrus.Info("Not collecting DCP metrics: ", err)
@@ -34,15 +38,15 @@ func fillProfilingConfigMetricGroups(config *dcgmexporter.Config) {
 }
 
 // enableDCGMExpXIDErrorsCountCollector instantiates the special XID error collector
-// - copied from: https://github.com/NVIDIA/dcgm-exporter/blob/b4552f0bb78fe5b2cd7a17d048ee49abc1c2d926/pkg/cmd/app.go#L395
-func enableDCGMExpXIDErrorsCountCollector(cs *dcgmexporter.CounterSet, fieldEntityGroupTypeSystemInfo *dcgmexporter.FieldEntityGroupTypeSystemInfo, hostname string, config *dcgmexporter.Config, cRegistry *dcgmexporter.Registry) error {
+// - adapted from: https://github.com/NVIDIA/dcgm-exporter/blob/b4552f0bb78fe5b2cd7a17d048ee49abc1c2d926/pkg/cmd/app.go#L395
+func enableDCGMExpXIDErrorsCountCollector(provider dcgmProvider, cs *dcgmexporter.CounterSet, groups entityGroups, hostname string, config *dcgmexporter.Config, cRegistry *dcgmexporter.Registry) error {
 	if dcgmexporter.IsDCGMExpXIDErrorsCountEnabled(cs.ExporterCounters) {
-		item, exists := fieldEntityGroupTypeSystemInfo.Get(dcgm.FE_GPU)
+		item, exists := groups[dcgm.FE_GPU]
 		if !exists {
 			return fmt.Errorf("%s collector cannot be initialized", dcgmexporter.DCGMXIDErrorsCount.String())
 		}
 
-		xidCollector, err := dcgmexporter.NewXIDCollector(cs.ExporterCounters, hostname, config, item)
+		xidCollector, err := provider.NewXIDCollector(cs.ExporterCounters, hostname, config, item)
 		if err != nil {
 			return errors.Wrap(err, "failed to instantiate XID collector")
 		}
@@ -55,14 +59,14 @@ func enableDCGMExpXIDErrorsCountCollector(cs *dcgmexporter.CounterSet, fieldEnti
 }
 
 // enableDCGMExpClockEventsCount instantiates the special clock_events collector
-// - copied from: https://github.com/NVIDIA/dcgm-exporter/blob/b4552f0bb78fe5b2cd7a17d048ee49abc1c2d926/pkg/cmd/app.go#L377
-func enableDCGMExpClockEventsCount(cs *dcgmexporter.CounterSet, fieldEntityGroupTypeSystemInfo *dcgmexporter.FieldEntityGroupTypeSystemInfo, hostname string, config *dcgmexporter.Config, cRegistry *dcgmexporter.Registry) error {
+// - adapted from: https://github.com/NVIDIA/dcgm-exporter/blob/b4552f0bb78fe5b2cd7a17d048ee49abc1c2d926/pkg/cmd/app.go#L377
+func enableDCGMExpClockEventsCount(provider dcgmProvider, cs *dcgmexporter.CounterSet, groups entityGroups, hostname string, config *dcgmexporter.Config, cRegistry *dcgmexporter.Registry) error {
 	if dcgmexporter.IsDCGMExpClockEventsCountEnabled(cs.ExporterCounters) {
-		item, exists := fieldEntityGroupTypeSystemInfo.Get(dcgm.FE_GPU)
+		item, exists := groups[dcgm.FE_GPU]
 		if !exists {
 			return fmt.Errorf("%s collector cannot be initialized", dcgmexporter.DCGMClockEventsCount.String())
 		}
-		clocksThrottleReasonsCollector, err := dcgmexporter.NewClockEventsCollector(
+		clocksThrottleReasonsCollector, err := provider.NewClockEventsCollector(
 			cs.ExporterCounters, hostname, config, item)
 		if err != nil {
 			return errors.Wrap(err, "failed to instantiate clock events collector")
@@ -83,3 +87,147 @@ func newOSWatcher(sigs ...os.Signal) chan os.Signal {
 
 	return sigChan
 }
+
+// hpcJobAttribute is the label holding the HPC job using a GPU
+// - copied from: https://github.com/NVIDIA/dcgm-exporter/blob/402a10fd8bb4a36be7cc5b2c703cf8f1322d1ef0/pkg/dcgmexporter/types.go#L45
+const hpcJobAttribute = "hpc_job"
+
+// hpcMapper is a transformation adding the hpc_job label to GPU metrics. The jobs using a GPU are read from the file named like the
+// GPU index in the job mapping directory, which is maintained by the job scheduler (e.g. a Slurm prolog/epilog script).
+// - copied from: https://github.com/NVIDIA/dcgm-exporter/blob/402a10fd8bb4a36be7cc5b2c703cf8f1322d1ef0/pkg/dcgmexporter/hpc.go
+// - reason: not exported
+type hpcMapper struct {
+	jobMappingDir string
+}
+
+func newHPCMapper(jobMappingDir string) *hpcMapper {
+	logrus.Infof("HPC job mapping is enabled and watch for the %q directory", jobMappingDir)
+	return &hpcMapper{
+		jobMappingDir: jobMappingDir,
+	}
+}
+
+func (p *hpcMapper) Name() string {
+	return "hpcMapper"
+}
+
+func (p *hpcMapper) Process(metrics dcgmexporter.MetricsByCounter, sysInfo dcgmexporter.SystemInfo) error {
+	_, err := os.Stat(p.jobMappingDir)
+	if err != nil {
+		logrus.WithError(err).Warnf("Unable to access HPC job mapping file directory '%s' - directory not found. Ignoring.", p.jobMappingDir)
+		return nil
+	}
+
+	gpuFiles, err := getGPUFiles(p.jobMappingDir)
+	if err != nil {
+		return err
+	}
+
+	gpuToJobMap := make(map[string][]string)
+
+	logrus.Debugf("HPC job mapping files: %#v", gpuFiles)
+
+	for _, gpuFileName := range gpuFiles {
+		jobs, err := readJobsFile(path.Join(p.jobMappingDir, gpuFileName))
+		if err != nil {
+			return err
+		}
+
+		if _, exist := gpuToJobMap[gpuFileName]; !exist {
+			gpuToJobMap[gpuFileName] = []string{}
+		}
+		gpuToJobMap[gpuFileName] = append(gpuToJobMap[gpuFileName], jobs...)
+	}
+
+	logrus.Debugf("GPU to job mapping: %+v", gpuToJobMap)
+
+	for counter := range metrics {
+		var modifiedMetrics []dcgmexporter.Metric
+		for _, metric := range metrics[counter] {
+			jobs, exists := gpuToJobMap[metric.GPU]
+			if exists {
+				for _, job := range jobs {
+					modifiedMetric := metric
+					modifiedMetric.Attributes = maps.Clone(metric.Attributes)
+					if modifiedMetric.Attributes == nil {
+						modifiedMetric.Attributes = map[string]string{}
+					}
+					modifiedMetric.Attributes[hpcJobAttribute] = job
+					modifiedMetrics = append(modifiedMetrics, modifiedMetric)
+				}
+			} else {
+				modifiedMetrics = append(modifiedMetrics, metric)
+			}
+		}
+		metrics[counter] = modifiedMetrics
+	}
+
+	return nil
+}
+
+// readJobsFile reads the jobs from a job mapping file, one job per line
+// - copied from: https://github.com/NVIDIA/dcgm-exporter/blob/402a10fd8bb4a36be7cc5b2c703cf8f1322d1ef0/pkg/dcgmexporter/hpc.go#L98
+func readJobsFile(path string) ([]string, error) {
+	var jobs []string
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed for close the file: %s", file.Name())
+		}
+	}(file)
+
+	// Example of the expected file format:
+	// job1
+	// job2
+	// job3
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		jobs = append(jobs, scanner.Text())
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// getGPUFiles returns the job mapping files, which are named like the GPU index
+// - copied from: https://github.com/NVIDIA/dcgm-exporter/blob/402a10fd8bb4a36be7cc5b2c703cf8f1322d1ef0/pkg/dcgmexporter/hpc.go#L131
+func getGPUFiles(dirPath string) ([]string, error) {
+	files, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Debugf("hpc mapper: %d files in the %q found", len(files), dirPath)
+
+	var mappingFiles []string
+
+	for _, file := range files {
+		finfo, err := file.Info()
+		if err != nil {
+			logrus.Warnf("HPC mapper: can not get file info for the %s file.", file.Name())
+			continue // Skip files that we can't read
+		}
+
+		if finfo.IsDir() {
+			logrus.Debugf("HPC mapper: the %q file is directory", file.Name())
+			continue // Skip directories
+		}
+
+		_, err = strconv.Atoi(file.Name())
+		if err != nil {
+			logrus.Debugf("HPC mapper: file %q name doesn't match with GPU ID convention", file.Name())
+			continue
+		}
+		mappingFiles = append(mappingFiles, file.Name())
+	}
+
+	return mappingFiles, nil
+}
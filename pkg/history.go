@@ -0,0 +1,115 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// historySize is the number of pushes and log entries kept in the history
+const historySize = 100
+
+// PushRecord is a push of metrics to the DO proxy
+type PushRecord struct {
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration_seconds"`
+	Bytes    int       `json:"bytes"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// LogRecord is a warning or error logged by the agent
+type LogRecord struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+// History are the recent pushes to the DO proxy and the recent warnings and errors of the running agent
+type History struct {
+	Pushes []PushRecord `json:"pushes"`
+	Logs   []LogRecord  `json:"logs"`
+}
+
+// history keeps the last historySize pushes and log entries in memory, to be included in support bundles
+// - is a logrus.Hook recording warnings and errors
+type history struct {
+	mtx    sync.Mutex
+	pushes []PushRecord
+	logs   []LogRecord
+}
+
+// newHistory creates an empty history
+func newHistory() *history {
+	return &history{}
+}
+
+// recordPush records a push that started at start, with the error of the push if it failed
+func (h *history) recordPush(start time.Time, bytes int, err error) {
+	debugCounters.Add(counterPushes, 1)
+	debugCounters.Add(counterPushedBytes, int64(bytes))
+	if err != nil {
+		debugCounters.Add(counterFailedPushes, 1)
+	}
+
+	record := PushRecord{
+		Time:     start,
+		Duration: time.Since(start).Seconds(),
+		Bytes:    bytes,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.pushes = appendRing(h.pushes, record)
+}
+
+func (h *history) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel}
+}
+
+// Fire records the log entry
+func (h *history) Fire(entry *logrus.Entry) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.logs = appendRing(h.logs, LogRecord{
+		Time:    entry.Time,
+		Level:   entry.Level.String(),
+		Message: entry.Message,
+	})
+	return nil
+}
+
+// snapshot returns a copy of the history
+func (h *history) snapshot() History {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	return History{
+		Pushes: append([]PushRecord{}, h.pushes...),
+		Logs:   append([]LogRecord{}, h.logs...),
+	}
+}
+
+// handleHistory serves the history as JSON
+func (h *history) handleHistory(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.snapshot()); err != nil {
+		logrus.Debugf("API: failed to write history: %s", err)
+	}
+}
+
+// appendRing appends the record, dropping the oldest records beyond historySize
+func appendRing[T any](records []T, record T) []T {
+	records = append(records, record)
+	if len(records) > historySize {
+		records = records[len(records)-historySize:]
+	}
+	return records
+}
@@ -0,0 +1,452 @@
+package pkg
+
+import (
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	httpclient "github.com/digitalocean/do-dcgm-exporter/pkg/client"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata/integration")
+
+// tickingClock is a clock that only ticks when told to, implementing clock
+type tickingClock struct {
+	mtx     sync.Mutex
+	now     time.Time
+	tickers map[chan time.Time]bool
+}
+
+func newTickingClock() *tickingClock {
+	return &tickingClock{
+		now:     time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC),
+		tickers: map[chan time.Time]bool{},
+	}
+}
+
+func (c *tickingClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+func (c *tickingClock) NewTicker(_ time.Duration) (<-chan time.Time, func()) {
+	ticks := make(chan time.Time)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.tickers[ticks] = true
+
+	return ticks, func() {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		delete(c.tickers, ticks)
+	}
+}
+
+// tick advances the clock by d, and delivers a tick to every ticker
+// - waits for a ticker to be started, as the pipeline starts its ticker asynchronously
+func (c *tickingClock) tick(t *testing.T, d time.Duration) {
+	timeout := time.After(10 * time.Second)
+	for {
+		c.mtx.Lock()
+		c.now = c.now.Add(d)
+		now := c.now
+		var tickers []chan time.Time
+		for ticker := range c.tickers {
+			tickers = append(tickers, ticker)
+		}
+		c.mtx.Unlock()
+
+		if len(tickers) > 0 {
+			for _, ticker := range tickers {
+				select {
+				case ticker <- now:
+				case <-timeout:
+					t.Fatalf("expected the tick to be received")
+				}
+			}
+			return
+		}
+
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("expected a ticker to be started")
+		}
+	}
+}
+
+// recordingProvider is a dcgmProvider recording the connections to DCGM, and collections while disconnected
+type recordingProvider struct {
+	dcgmProvider
+
+	mtx       sync.Mutex
+	connected bool
+	events    []string
+}
+
+func (p *recordingProvider) record(event string, connected bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.connected = connected
+	p.events = append(p.events, event)
+}
+
+func (p *recordingProvider) checkConnected() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if !p.connected {
+		p.events = append(p.events, "collect while disconnected")
+	}
+}
+
+// waitForEvents waits for the events to have been recorded
+func (p *recordingProvider) waitForEvents(t *testing.T, events ...string) {
+	timeout := time.After(10 * time.Second)
+	for {
+		p.mtx.Lock()
+		recorded := slices.Clone(p.events)
+		p.mtx.Unlock()
+
+		if reflect.DeepEqual(recorded, events) {
+			return
+		}
+
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("expected events %v, but got: %v", events, recorded)
+		}
+	}
+}
+
+func (p *recordingProvider) Connect(config *dcgmexporter.Config) (func(), error) {
+	cleanup, err := p.dcgmProvider.Connect(config)
+	p.record("connect", true)
+	return func() {
+		cleanup()
+		p.record("disconnect", false)
+	}, err
+}
+
+func (p *recordingProvider) NewCollector(counters []dcgmexporter.Counter, hostname string, config *dcgmexporter.Config, item dcgmexporter.FieldEntityGroupTypeSystemInfoItem) (entityCollector, func(), error) {
+	collector, cleanup, err := p.dcgmProvider.NewCollector(counters, hostname, config, item)
+	if err != nil {
+		return nil, cleanup, err
+	}
+	return recordingCollector{collector, p}, cleanup, nil
+}
+
+func (p *recordingProvider) NewXIDCollector(counters []dcgmexporter.Counter, hostname string, config *dcgmexporter.Config, item dcgmexporter.FieldEntityGroupTypeSystemInfoItem) (dcgmexporter.Collector, error) {
+	collector, err := p.dcgmProvider.NewXIDCollector(counters, hostname, config, item)
+	if err != nil {
+		return nil, err
+	}
+	return recordingExpCollector{collector, p}, nil
+}
+
+func (p *recordingProvider) NewClockEventsCollector(counters []dcgmexporter.Counter, hostname string, config *dcgmexporter.Config, item dcgmexporter.FieldEntityGroupTypeSystemInfoItem) (dcgmexporter.Collector, error) {
+	collector, err := p.dcgmProvider.NewClockEventsCollector(counters, hostname, config, item)
+	if err != nil {
+		return nil, err
+	}
+	return recordingExpCollector{collector, p}, nil
+}
+
+// recordingCollector is an entityCollector recording collections while disconnected
+type recordingCollector struct {
+	entityCollector
+	provider *recordingProvider
+}
+
+func (c recordingCollector) GetMetrics() (dcgmexporter.MetricsByCounter, error) {
+	c.provider.checkConnected()
+	return c.entityCollector.GetMetrics()
+}
+
+// recordingExpCollector is a dcgmexporter.Collector recording collections while disconnected
+type recordingExpCollector struct {
+	dcgmexporter.Collector
+	provider *recordingProvider
+}
+
+func (c recordingExpCollector) GetMetrics() (dcgmexporter.MetricsByCounter, error) {
+	c.provider.checkConnected()
+	return c.Collector.GetMetrics()
+}
+
+// withoutRequestMetrics drops the request metrics of the metrics server, which are only served on /metrics
+func withoutRequestMetrics(metrics string) string {
+	var lines []string
+	for _, line := range strings.Split(metrics, "\n") {
+		name := strings.TrimPrefix(strings.TrimPrefix(line, "# HELP "), "# TYPE ")
+		if !strings.HasPrefix(name, "do_dcgm_exporter_http_") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// normalizeMetrics sorts the metric families of prometheus plaintext metrics, which are rendered in random order, and drops blank lines
+func normalizeMetrics(metrics string) string {
+	var families []string
+	var family []string
+	for _, line := range strings.Split(metrics, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "# HELP ") && len(family) > 0 {
+			families = append(families, strings.Join(family, "\n"))
+			family = nil
+		}
+		family = append(family, line)
+	}
+	if len(family) > 0 {
+		families = append(families, strings.Join(family, "\n"))
+	}
+
+	slices.Sort(families)
+	return strings.Join(families, "\n") + "\n"
+}
+
+// assertGolden compares the metrics with the golden file testdata/integration/<name>, or updates the golden file with -update
+func assertGolden(t *testing.T, name string, metrics string) {
+	t.Helper()
+
+	path := filepath.Join("testdata", "integration", name)
+	if *update {
+		if err := os.WriteFile(path, []byte(metrics), 0644); err != nil {
+			t.Fatalf("expected no error, but got: %s", err.Error())
+		}
+		return
+	}
+
+	golden, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	if metrics != string(golden) {
+		t.Errorf("expected the metrics of the golden file %s (update with -update), but got:\n%s", path, metrics)
+	}
+}
+
+// freeAddress returns a local address that is free to listen on
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestIntegration(t *testing.T) {
+	t.Setenv("NODE_NAME", "gpu-droplet")
+
+	fieldsFile := filepath.Join(t.TempDir(), "fields.csv")
+	if err := os.WriteFile(fieldsFile, []byte("# no additional fields\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the proxy standing in for http://169.254.169.254/v1/gpu_metrics
+	pushes := make(chan string, 10)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/gpu_metrics" {
+			t.Errorf("expected POST /v1/gpu_metrics, but got: %s %s", r.Method, r.URL.Path)
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("expected no error, but got: %s", err.Error())
+		}
+		pushes <- string(body)
+	}))
+	t.Cleanup(proxy.Close)
+
+	agent, err := NewGPUMetricsAgent(Options{SimulateScenario: testScenario, AdditionalFieldsPath: fieldsFile})
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	clock := newTickingClock()
+	provider := &recordingProvider{dcgmProvider: agent.provider}
+	agent.ProxyClient = httpclient.NewHTTP(5 * time.Second)
+	agent.proxyURL = proxy.URL + "/v1/gpu_metrics"
+	agent.clock = clock
+	agent.signals = make(chan os.Signal, 1)
+	agent.provider = provider
+	agent.root = t.TempDir()
+	agent.Options.Addresses = []string{freeAddress(t)}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- agent.Run()
+	}()
+
+	// collect returns the metrics pushed after the next tick
+	collect := func() string {
+		clock.tick(t, 20*time.Second)
+		select {
+		case push := <-pushes:
+			return normalizeMetrics(push)
+		case err := <-done:
+			t.Fatalf("expected the agent to keep running, but it returned: %v", err)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("expected metrics to be pushed")
+		}
+		return ""
+	}
+
+	// the pushes play the scripted values, including the XID error and the clock events
+	var push string
+	for _, name := range []string{"push-1.prom", "push-2.prom", "push-3.prom"} {
+		push = collect()
+		assertGolden(t, name, push)
+	}
+
+	// /metrics serves the metrics of the last push
+	metricsURL := "http://" + agent.Options.Addresses[0] + "/metrics"
+	var scraped string
+	timeout := time.After(10 * time.Second)
+	for scraped != push {
+		resp, err := http.Get(metricsURL)
+		if err != nil {
+			t.Fatalf("expected no error, but got: %s", err.Error())
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("expected no error, but got: %s", err.Error())
+		}
+		scraped = normalizeMetrics(withoutRequestMetrics(string(body)))
+
+		select {
+		case <-timeout:
+			t.Fatalf("expected /metrics to serve the metrics of the last push, but got:\n%s", scraped)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// SIGHUP reloads the additional fields, and restarts the collection from scratch
+	if err := os.WriteFile(fieldsFile, []byte("DCGM_FI_DEV_MEM_COPY_UTIL, gauge, Memory utilization (in %).\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	agent.signals <- syscall.SIGHUP
+	provider.waitForEvents(t, "connect", "disconnect", "connect")
+	assertGolden(t, "push-reload.prom", collect())
+
+	agent.signals <- syscall.SIGTERM
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected the agent to terminate without error, but got: %s", err.Error())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the agent to terminate on SIGTERM")
+	}
+
+	// everything is stopped before disconnecting from DCGM, and the reload disconnects before connecting again
+	provider.waitForEvents(t, "connect", "disconnect", "connect", "disconnect")
+
+	if _, err := http.Get(metricsURL); err == nil {
+		t.Errorf("expected the metrics server to be stopped")
+	}
+}
+
+func TestShutdownPersistsToSpool(t *testing.T) {
+	t.Setenv("NODE_NAME", "gpu-droplet")
+	spoolDir := t.TempDir()
+
+	// newAgent creates an agent pushing to the proxy, and runs it until it returned
+	newAgent := func(proxy *httptest.Server) (*GPUMetricsAgent, *tickingClock, chan error) {
+		agent, err := NewGPUMetricsAgent(Options{SimulateScenario: testScenario, PushSpoolDir: spoolDir, ShutdownGracePeriod: 200 * time.Millisecond})
+		if err != nil {
+			t.Fatalf("expected no error, but got: %s", err.Error())
+		}
+
+		clock := newTickingClock()
+		agent.ProxyClient = httpclient.NewHTTP(5 * time.Second)
+		agent.proxyURL = proxy.URL + "/v1/gpu_metrics"
+		agent.clock = clock
+		agent.signals = make(chan os.Signal, 1)
+		agent.root = t.TempDir()
+		agent.Options.Addresses = []string{freeAddress(t)}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- agent.Run()
+		}()
+		return agent, clock, done
+	}
+
+	terminate := func(agent *GPUMetricsAgent, done chan error) {
+		agent.signals <- syscall.SIGTERM
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("expected the agent to terminate without error, but got: %s", err.Error())
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("expected the agent to terminate within the grace period")
+		}
+	}
+
+	// the push hangs, and is aborted when the grace period expired
+	hanging := make(chan string, 10)
+	release := make(chan interface{})
+	hangingProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		hanging <- string(body)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(hangingProxy.Close)
+	t.Cleanup(func() { close(release) })
+
+	agent, clock, done := newAgent(hangingProxy)
+	clock.tick(t, 20*time.Second)
+	var persisted string
+	select {
+	case persisted = <-hanging:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected metrics to be pushed")
+	}
+	terminate(agent, done)
+
+	// the next start pushes the persisted metrics first, without waiting for a collection
+	pushes := make(chan string, 10)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		pushes <- string(body)
+	}))
+	t.Cleanup(proxy.Close)
+
+	agent, _, done = newAgent(proxy)
+	select {
+	case push := <-pushes:
+		if push != persisted {
+			t.Errorf("expected the persisted metrics to be pushed, but got:\n%s", push)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the persisted metrics to be pushed")
+	}
+	terminate(agent, done)
+
+	if entries, _ := os.ReadDir(spoolDir); len(entries) != 0 {
+		t.Errorf("expected the spool to be empty after pushing the persisted metrics, but got %d files", len(entries))
+	}
+}
@@ -0,0 +1,213 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/journal"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+	The agent logs via logrus, configured by ConfigureLogging:
+	- text (default) or json to stderr, or natively to journald with a priority and the fields as journal fields
+	- the log level, with --debug as a shorthand for --log-level debug
+	Log entries about a GPU, a DCGM field or a push carry the same structured fields (logField*).
+	Failures that repeat every collection interval (e.g. pushes while the proxy is down) are logged by a failureLog,
+	which logs the first failure, then a summary at most every failureLogInterval, and the recovery.
+*/
+
+const (
+	// LogFormatText logs human readable lines to stderr
+	LogFormatText = "text"
+	// LogFormatJSON logs a JSON object per line to stderr
+	LogFormatJSON = "json"
+	// LogFormatJournald logs natively to journald
+	LogFormatJournald = "journald"
+
+	// syslogIdentifier is the SYSLOG_IDENTIFIER of the journal entries
+	syslogIdentifier = "do-dcgm-exporter"
+
+	// failureLogInterval is how often a repeating failure is logged
+	failureLogInterval = 5 * time.Minute
+)
+
+// LogFormats are the supported log formats
+var LogFormats = []string{LogFormatText, LogFormatJSON, LogFormatJournald}
+
+// the structured fields of log entries, used across the agent
+const (
+	// logFieldGPU is the GPU ID of the entry
+	logFieldGPU = "gpu"
+	// logFieldField is the name of the DCGM field of the entry
+	logFieldField = "field"
+	// logFieldSink is where metrics are sent to, e.g. "push"
+	logFieldSink = "sink"
+	// logFieldAttempt is the number of consecutive attempts that failed
+	logFieldAttempt = "attempt"
+	// logFieldEvent is the hardware event of the entry, e.g. "gpu_lost"
+	logFieldEvent = "event"
+)
+
+// ConfigureLogging configures the format and the level of the logs
+// - debug is a shorthand for level "debug", and takes precedence
+func ConfigureLogging(format, level string, debug bool) error {
+	lvl := logrus.InfoLevel
+	if level != "" {
+		var err error
+		if lvl, err = logrus.ParseLevel(level); err != nil {
+			return errors.Wrapf(err, "invalid log level %q", level)
+		}
+	}
+	if debug {
+		lvl = logrus.DebugLevel
+	}
+
+	switch format {
+	case "", LogFormatText:
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	case LogFormatJSON:
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	case LogFormatJournald:
+		if !journal.Enabled() {
+			return errors.New("cannot log to journald: the journal socket is not available")
+		}
+		logrus.AddHook(newJournaldHook(journal.Send))
+		logrus.SetOutput(io.Discard)
+	default:
+		return errors.Errorf("unsupported log format %q, must be one of: %s", format, strings.Join(LogFormats, ", "))
+	}
+
+	logrus.SetLevel(lvl)
+	return nil
+}
+
+// journaldHook sends every log entry to journald, with its priority and its fields as journal fields
+type journaldHook struct {
+	send func(message string, priority journal.Priority, vars map[string]string) error
+}
+
+func newJournaldHook(send func(message string, priority journal.Priority, vars map[string]string) error) *journaldHook {
+	return &journaldHook{send: send}
+}
+
+func (h *journaldHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *journaldHook) Fire(entry *logrus.Entry) error {
+	vars := map[string]string{
+		"SYSLOG_IDENTIFIER": syslogIdentifier,
+	}
+	for key, value := range entry.Data {
+		vars[journalFieldName(key)] = fmt.Sprint(value)
+	}
+
+	if err := h.send(entry.Message, journalPriority(entry.Level), vars); err != nil {
+		// the journal is not available, keep the entry on stderr
+		_, _ = fmt.Fprintf(os.Stderr, "%s: %s\n", entry.Level, entry.Message)
+	}
+	return nil
+}
+
+// journalPriority maps the logrus level to the syslog priority of journald
+func journalPriority(level logrus.Level) journal.Priority {
+	switch level {
+	case logrus.PanicLevel:
+		return journal.PriEmerg
+	case logrus.FatalLevel:
+		return journal.PriCrit
+	case logrus.ErrorLevel:
+		return journal.PriErr
+	case logrus.WarnLevel:
+		return journal.PriWarning
+	case logrus.InfoLevel:
+		return journal.PriInfo
+	default:
+		return journal.PriDebug
+	}
+}
+
+// invalidJournalFieldChars are the characters not allowed in journal field names
+var invalidJournalFieldChars = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// journalFieldName converts the logrus field name to a journal field name, which only consists of uppercase letters, digits and underscores
+// - must not start with an underscore, which is reserved for trusted fields set by journald
+func journalFieldName(key string) string {
+	name := invalidJournalFieldChars.ReplaceAllString(strings.ToUpper(key), "_")
+	name = strings.TrimLeft(name, "_")
+	if name == "" {
+		return "FIELD"
+	}
+	return name
+}
+
+// failureLog logs a repeating failure (e.g. failing pushes) rate-limited
+// - the first failure is logged, then a summary at most every interval, and the recovery
+type failureLog struct {
+	// name is what is failing, e.g. "push"
+	name string
+	// fields are added to every entry
+	fields   logrus.Fields
+	interval time.Duration
+	now      func() time.Time
+
+	mtx       sync.Mutex
+	attempts  int
+	since     time.Time
+	lastLog   time.Time
+	lastError string
+}
+
+func newFailureLog(name string, fields logrus.Fields, interval time.Duration) *failureLog {
+	return &failureLog{
+		name:     name,
+		fields:   fields,
+		interval: interval,
+		now:      time.Now,
+	}
+}
+
+// observe records the result of an attempt, and logs the failure or the recovery if due
+func (l *failureLog) observe(err error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := l.now()
+	if err == nil {
+		if l.attempts > 0 {
+			l.entry().Infof("%s recovered after failing for %s, %d attempts", l.name, now.Sub(l.since).Round(time.Second), l.attempts)
+		}
+		l.attempts = 0
+		return
+	}
+
+	l.attempts++
+	l.lastError = err.Error()
+
+	if l.attempts == 1 {
+		l.since = now
+		l.lastLog = now
+		l.entry().Errorf("%s failed: %s", l.name, l.lastError)
+		return
+	}
+
+	if now.Sub(l.lastLog) < l.interval {
+		l.entry().Debugf("%s failed: %s", l.name, l.lastError)
+		return
+	}
+
+	l.lastLog = now
+	l.entry().Errorf("%s failing for %s, %d attempts, last error: %s", l.name, now.Sub(l.since).Round(time.Second), l.attempts, l.lastError)
+}
+
+// entry returns a log entry with the fields of the failure, and the number of attempts
+func (l *failureLog) entry() *logrus.Entry {
+	return logrus.WithFields(l.fields).WithField(logFieldAttempt, l.attempts)
+}
@@ -0,0 +1,178 @@
+package pkg
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/journal"
+	"github.com/sirupsen/logrus"
+)
+
+// recordingHook records the log entries, implementing logrus.Hook
+type recordingHook struct {
+	entries []*logrus.Entry
+}
+
+func (h *recordingHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *recordingHook) Fire(entry *logrus.Entry) error {
+	h.entries = append(h.entries, entry)
+	return nil
+}
+
+// recordLogs records the log entries of the test, at debug level
+func recordLogs(t *testing.T) *recordingHook {
+	hook := &recordingHook{}
+	logger := logrus.StandardLogger()
+	hooks := logger.ReplaceHooks(logrus.LevelHooks{})
+	level := logger.GetLevel()
+	logger.AddHook(hook)
+	logger.SetLevel(logrus.DebugLevel)
+	t.Cleanup(func() {
+		logger.ReplaceHooks(hooks)
+		logger.SetLevel(level)
+	})
+	return hook
+}
+
+func TestConfigureLogging(t *testing.T) {
+	logger := logrus.StandardLogger()
+	level, formatter := logger.GetLevel(), logger.Formatter
+	t.Cleanup(func() {
+		logger.SetLevel(level)
+		logger.SetFormatter(formatter)
+	})
+
+	var tests = []struct {
+		format        string
+		level         string
+		debug         bool
+		expectError   bool
+		expectedLevel logrus.Level
+	}{
+		{"", "", false, false, logrus.InfoLevel},
+		{LogFormatJSON, "warning", false, false, logrus.WarnLevel},
+		{LogFormatText, "warning", true, false, logrus.DebugLevel},
+		{LogFormatText, "verbose", false, true, 0},
+		{"xml", "", false, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format+"/"+tt.level, func(t *testing.T) {
+			err := ConfigureLogging(tt.format, tt.level, tt.debug)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("expected an error, but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, but got: %s", err.Error())
+			}
+			if got := logger.GetLevel(); got != tt.expectedLevel {
+				t.Errorf("expected level %s, but got: %s", tt.expectedLevel, got)
+			}
+		})
+	}
+}
+
+func TestJournaldHook(t *testing.T) {
+	type sent struct {
+		message  string
+		priority journal.Priority
+		vars     map[string]string
+	}
+	var got []sent
+	hook := newJournaldHook(func(message string, priority journal.Priority, vars map[string]string) error {
+		got = append(got, sent{message, priority, vars})
+		return nil
+	})
+
+	entry := logrus.WithFields(logrus.Fields{logFieldGPU: 1, logFieldSink: "push", "_pid": 1, "kube-pod": "trainer"})
+	entry.Level = logrus.WarnLevel
+	entry.Message = "NVLink mesh of GPU 1 is degraded"
+	if err := hook.Fire(entry); err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	expected := []sent{{
+		message:  "NVLink mesh of GPU 1 is degraded",
+		priority: journal.PriWarning,
+		vars: map[string]string{
+			"SYSLOG_IDENTIFIER": "do-dcgm-exporter",
+			"GPU":               "1",
+			"SINK":              "push",
+			"PID":               "1",
+			"KUBE_POD":          "trainer",
+		},
+	}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %+v, but got: %+v", expected, got)
+	}
+
+	var priorities = []struct {
+		level    logrus.Level
+		expected journal.Priority
+	}{
+		{logrus.ErrorLevel, journal.PriErr},
+		{logrus.InfoLevel, journal.PriInfo},
+		{logrus.DebugLevel, journal.PriDebug},
+	}
+	for _, p := range priorities {
+		if got := journalPriority(p.level); got != p.expected {
+			t.Errorf("expected priority %d for %s, but got: %d", p.expected, p.level, got)
+		}
+	}
+}
+
+func TestFailureLog(t *testing.T) {
+	hook := recordLogs(t)
+
+	now := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+	l := newFailureLog("push", logrus.Fields{logFieldSink: "push"}, 5*time.Minute)
+	l.now = func() time.Time { return now }
+
+	var tests = []struct {
+		name     string
+		advance  time.Duration
+		err      error
+		expected string
+		level    logrus.Level
+	}{
+		{"first failure", 0, errors.New("connection refused"), "push failed: connection refused", logrus.ErrorLevel},
+		{"repeated failure", 20 * time.Second, errors.New("connection refused"), "push failed: connection refused", logrus.DebugLevel},
+		{"summary", 280 * time.Second, errors.New("timeout"), "push failing for 5m0s, 3 attempts, last error: timeout", logrus.ErrorLevel},
+		{"repeated failure after the summary", 20 * time.Second, errors.New("timeout"), "push failed: timeout", logrus.DebugLevel},
+		{"recovered", 20 * time.Second, nil, "push recovered after failing for 5m40s, 4 attempts", logrus.InfoLevel},
+		{"success", 20 * time.Second, nil, "", 0},
+		{"failure after recovering", 20 * time.Second, errors.New("connection refused"), "push failed: connection refused", logrus.ErrorLevel},
+	}
+
+	// the steps depend on each other, and run in order
+	for _, tt := range tests {
+		hook.entries = nil
+		now = now.Add(tt.advance)
+		l.observe(tt.err)
+
+		if tt.expected == "" {
+			if len(hook.entries) != 0 {
+				t.Errorf("%s: expected no log entry, but got: %q", tt.name, hook.entries[0].Message)
+			}
+			continue
+		}
+		if len(hook.entries) != 1 {
+			t.Fatalf("%s: expected one log entry, but got %d", tt.name, len(hook.entries))
+		}
+		entry := hook.entries[0]
+		if entry.Message != tt.expected || entry.Level != tt.level {
+			t.Errorf("%s: expected %s %q, but got: %s %q", tt.name, tt.level, tt.expected, entry.Level, entry.Message)
+		}
+		if entry.Data[logFieldSink] != "push" || entry.Data[logFieldAttempt] == nil {
+			t.Errorf("%s: expected the sink and attempt fields, but got: %v", tt.name, entry.Data)
+		}
+	}
+}
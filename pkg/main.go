@@ -2,15 +2,18 @@ package pkg
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
 	"sync"
 	"syscall"
 	"text/template"
 	"time"
 
 	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
-	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
 	httpclient "github.com/digitalocean/do-dcgm-exporter/pkg/client"
+	"github.com/digitalocean/do-dcgm-exporter/pkg/server"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -30,12 +33,13 @@ import (
 */
 
 const (
+	// defaultShutdownGracePeriod is how long the agent takes to shut down at most, if not configured
+	defaultShutdownGracePeriod = 10 * time.Second
+
 	// internalProxyURL is the address of the DO proxy serving an endpoint to receive GPU metrics
 	internalProxyURL = "http://169.254.169.254"
 	// internalProxyPort is the port of the DO proxy serving an endpoint to receive GPU metrics
 	internalProxyPort = 80
-	// internalProxyPath is the API path of the DO proxy serving an endpoint to receive GPU metrics
-	internalProxyPath = "v1/gpu_metrics"
 )
 
 // expMetricsFormat is the go template to render prometheus plaintext format metrics from dcgm_exporter "MetricsByCounter" format
@@ -60,25 +64,108 @@ var expMetricsFormat = `
 {{- end }}
 {{ end }}`
 
+// hostMetricsFormat is the go template to render metrics of the registry that belong to no GPU (e.g. do_droplet_info) in prometheus plaintext format
+// - like expMetricsFormat, but without the GPU labels
+var hostMetricsFormat = `
+{{- range $counter, $metrics := . -}}
+# HELP {{ $counter.FieldName }} {{ $counter.Help }}
+# TYPE {{ $counter.FieldName }} {{ $counter.PromType }}
+{{- range $metric := $metrics }}
+{{ $separator := "" }}{{ $counter.FieldName }}{ {{- if $metric.Hostname }}Hostname="{{ $metric.Hostname }}"{{ $separator = "," }}{{end}}
+
+{{- range $k, $v := $metric.Labels -}}
+	{{ $separator }}{{ $k }}="{{ $v }}"{{ $separator = "," }}
+{{- end -}}
+{{- range $k, $v := $metric.Attributes -}}
+	{{ $separator }}{{ $k }}="{{ $v }}"{{ $separator = "," }}
+{{- end -}}
+
+} {{ $metric.Value -}}
+{{- end }}
+{{ end }}`
+
 // getExpMetricTemplate is the go template to render plaintext prometheus formatted metrics
 var getExpMetricTemplate = sync.OnceValue(func() *template.Template {
 	return template.Must(template.New("expMetrics").Parse(expMetricsFormat))
 })
 
+// getHostMetricTemplate is the go template to render plaintext prometheus formatted metrics without GPU labels
+var getHostMetricTemplate = sync.OnceValue(func() *template.Template {
+	return template.Must(template.New("hostMetrics").Parse(hostMetricsFormat))
+})
+
 // NewGPUMetricsAgent creates and returns a new GPUMetricsAgent
-func NewGPUMetricsAgent(additionalFieldsPath string, showDebugLogs bool) (*GPUMetricsAgent, error) {
-	proxyClient := httpclient.NewHTTP(5 * time.Second)
+func NewGPUMetricsAgent(options Options) (*GPUMetricsAgent, error) {
+	if options.PushURL == "" {
+		options.PushURL = DefaultPushURL
+	}
+
+	if err := validatePushOptions(options); err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := newPushTLSConfig(options)
+	if err != nil {
+		return nil, err
+	}
+
+	pushAuth, err := newPushAuth(options)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyClient := httpclient.NewTLSHTTP(5*time.Second, tlsConfig)
+
+	selection, err := newDeviceSelection(options)
+	if err != nil {
+		return nil, err
+	}
+
+	sampledFields, err := parseSampledFields(options.SampleStats)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(options.Addresses) == 0 {
+		options.Addresses = []string{DefaultAddress}
+	}
+
+	if err := validateWebConfigFile(options.WebConfigFile); err != nil {
+		return nil, err
+	}
+
+	if options.Kubernetes {
+		if err := validateKubernetesGPUIdType(options.KubernetesGPUIdType); err != nil {
+			return nil, err
+		}
+
+		if options.PodResourcesKubeletSocket == "" {
+			options.PodResourcesKubeletSocket = DefaultPodResourcesKubeletSocket
+		}
+	}
 
 	dcgmExporterConfig := dcgmexporter.Config{
 		// additional fields that can be configured by the user. But can;t overwrite default fields
-		CollectorsFile: additionalFieldsPath,
-		Address:        ":9401",
+		CollectorsFile: options.AdditionalFieldsPath,
+		// the additional fields are only read from the CollectorsFile. Any other value than "none" reads them from a Kubernetes ConfigMap,
+		// and terminates the process if not running in a Kubernetes cluster
+		ConfigMapData: "none",
 		// how often the value of watched fields is read via dcgm (unit in milliseconds)
 		CollectInterval: 20000, // every 20s
-		Kubernetes:      false,
-		CollectDCP:      true, // we want to collect profiling metrics
-		UseRemoteHE:     true, // always use pre-installed standalone dcgm to allow customers to run their own dcgm-exporter
-		RemoteHEInfo:    "localhost:5555",
+		// the Kubernetes pod mapping and HPC job mapping are applied by the agent (see getTransformations) to the metrics of both the pipeline and the registry.
+		// Hence, they are disabled here, and only the settings used by the dcgmexporter.PodMapper are configured.
+		Kubernetes:                false,
+		KubernetesGPUIdType:       dcgmexporter.KubernetesGPUIDType(options.KubernetesGPUIdType),
+		PodResourcesKubeletSocket: options.PodResourcesKubeletSocket,
+		NvidiaResourceNames:       options.NvidiaResourceNames,
+		CollectDCP:                true, // we want to collect profiling metrics
+		UseRemoteHE:               true, // always use pre-installed standalone dcgm to allow customers to run their own dcgm-exporter
+		RemoteHEInfo:              "localhost:5555",
+		// all entities are discovered (Flex), the --gpus, --nvswitches and --nvlinks selection is applied afterwards (see selection.go)
+		// - the selection removes the entities not selected from the discovered system info, and the collectors only watch the fields
+		// of the entities in the system info (dcgmexporter.GetMonitoredEntities). Hence, DCGM doesn't watch fields of excluded entities
+		// - MajorRange/MinorRange can't express the selection: they are fixed DCGM ids resolved once, while the selectors are
+		// UUIDs or PCI bus ids resolved on every discovery, and with MIG they would watch the GPU instances of all GPUs
 		GPUDevices: dcgmexporter.DeviceOptions{
 			Flex: true,
 		},
@@ -88,7 +175,7 @@ func NewGPUMetricsAgent(additionalFieldsPath string, showDebugLogs bool) (*GPUMe
 		CPUDevices: dcgmexporter.DeviceOptions{
 			Flex: true,
 		},
-		Debug: showDebugLogs,
+		Debug: options.Debug,
 		// the time window for the dcgm-exporters clock_events_collector exposing clock throttling reasons via the DCGM_EXP_CLOCK_EVENTS_COUNT metric
 		// configured to be equivalent to the collection interval
 		ClockEventsCountWindowSize: int((20 * time.Second).Milliseconds()),
@@ -97,77 +184,218 @@ func NewGPUMetricsAgent(additionalFieldsPath string, showDebugLogs bool) (*GPUMe
 		XIDCountWindowSize: int((20 * time.Second).Milliseconds()),
 	}
 
-	return &GPUMetricsAgent{
+	agent := &GPUMetricsAgent{
 		ProxyClient:        proxyClient,
 		DcgmExporterConfig: &dcgmExporterConfig,
-	}, nil
-}
+		Options:            options,
+		provider:           dcgmLibProvider{},
+		history:            newHistory(),
+		diagnostics:        newDiagnostics(),
+		notifier:           newSystemdNotifier(),
+		proxyURL:           options.PushURL,
+		pushAuth:           pushAuth,
+		selection:          selection,
+		sampledFields:      sampledFields,
+		clock:              realClock{},
+		root:               "/",
+	}
 
-func (a GPUMetricsAgent) Run() error {
-restart:
+	if options.SimulateScenario != "" {
+		provider, err := loadSimulatedProvider(options.SimulateScenario)
+		if err != nil {
+			return nil, err
+		}
+		agent.provider = provider
+	}
 
-	cleanup, err := connectToRemoteDCGM(a.DcgmExporterConfig)
-	defer func(clean func()) {
-		if clean != nil {
-			clean()
+	if options.DebugAddress != "" {
+		if err := validateDebugAddress(options.DebugAddress, options.DebugAllowRemote); err != nil {
+			return nil, err
 		}
-	}(cleanup)
+	}
 
-	if err != nil {
-		return errors.Wrap(err, "failed to connect to remote dcgm (nv-hostengine)")
+	if options.APIAddress != "" && options.APITokenFile == "" {
+		return nil, errors.New("the API server requires a token file")
+	}
+
+	if options.PushQueueSize <= 0 {
+		agent.Options.PushQueueSize = defaultPushQueueSize
 	}
 
-	dcgm.FieldsInit()
-	defer dcgm.FieldsTerm()
+	if options.PushQueueOverflow == "" {
+		agent.Options.PushQueueOverflow = PushOverflowDropOldest
+	} else if err := validatePushOverflowPolicy(options.PushQueueOverflow); err != nil {
+		return nil, err
+	}
 
-	logrus.Info("DCGM initialized successfully!")
+	if options.ShutdownGracePeriod <= 0 {
+		agent.Options.ShutdownGracePeriod = defaultShutdownGracePeriod
+	}
 
-	fillProfilingConfigMetricGroups(a.DcgmExporterConfig)
+	if options.SampleInterval <= 0 {
+		agent.Options.SampleInterval = DefaultSampleInterval
+	} else if collectInterval := time.Duration(dcgmExporterConfig.CollectInterval) * time.Millisecond; options.SampleInterval < minSampleInterval || options.SampleInterval >= collectInterval {
+		return nil, errors.Errorf("the sample interval must be at least %s and shorter than the collection interval (%s), but got: %s", minSampleInterval, collectInterval, options.SampleInterval)
+	}
 
-	cs, err := getCounters(a.DcgmExporterConfig)
-	if err != nil {
-		return fmt.Errorf("failed to collect DCGM fields/counters to watch: %s", err.Error())
+	if options.PushSpoolDir != "" {
+		spool, err := newSpool(options.PushSpoolDir)
+		if err != nil {
+			return nil, err
+		}
+		agent.spool = spool
+	}
+
+	if options.DiagInterval > 0 && options.DiagIdleLookback <= 0 {
+		agent.Options.DiagIdleLookback = defaultDiagIdleLookback
+	}
+
+	if options.DiagInterval > 0 {
+		agent.diagScheduler = newDiagScheduler(agent.diagnostics, options.DiagInterval)
 	}
 
-	fieldEntityGroupTypeSystemInfo := getFieldEntityGroupTypeSystemInfo(cs, a.DcgmExporterConfig)
+	if len(options.DropletMetadataLabels) > 0 && !options.DropletMetadata {
+		return nil, errors.New("droplet metadata labels require droplet metadata to be enabled")
+	}
+
+	if options.DropletMetadata {
+		dropletMetadata, err := newDropletMetadataEnricher(
+			httpclient.NewHTTP(5*time.Second),
+			fmt.Sprintf("%s:%d", internalProxyURL, internalProxyPort),
+			options.DropletMetadataLabels,
+			options.DropletMetadataRefreshInterval,
+		)
+		if err != nil {
+			return nil, err
+		}
+		agent.dropletMetadata = dropletMetadata
+	}
+
+	return agent, nil
+}
+
+func (a GPUMetricsAgent) Run() error {
+	// keep the recent warnings and errors for support bundles
+	logrus.AddHook(a.history)
+
+	// report the permissions missing for the enabled features, as the agent runs unprivileged
+	a.logPermissions()
+
+	// the GPU models and utilization must not leak publicly
+	a.warnPublicMetrics()
 
-	hostname, err := dcgmexporter.GetHostname(a.DcgmExporterConfig)
+	// watch the OS signals before starting anything, so that no signal terminates the process before it's handled
+	sigs := a.signals
+	if sigs == nil {
+		sigs = newOSWatcher(syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP)
+		defer signal.Stop(sigs)
+	}
+
+	// the endpoints are served across reloads, from the collection of the current run
+	store := newMetricsStore(a.clock, watchdogCollectIntervals*time.Duration(a.DcgmExporterConfig.CollectInterval)*time.Millisecond)
+	servers := []*server.Server{a.newMetricsServer(store)}
+	api, err := a.newAgentAPIServer(store)
 	if err != nil {
 		return err
 	}
+	if api != nil {
+		servers = append(servers, api.server)
+	}
+	if debug := a.newDebugServer(store); debug != nil {
+		servers = append(servers, debug)
+	}
 
-	// the pipeline has reference to all required dcgm-exporter collectors (depends on the counters/watched fields, but typically GPU Collector, NVLink Collector, NVSwitch Collector)
-	pipeline, cleanup, err := dcgmexporter.NewMetricsPipeline(a.DcgmExporterConfig,
-		cs.DCGMCounters,
-		hostname,
-		dcgmexporter.NewDCGMCollector,
-		fieldEntityGroupTypeSystemInfo,
-	)
-	defer cleanup()
-	if err != nil {
-		return errors.Wrap(err, "failed to create metrics pipeline")
+	// listen before connecting to DCGM, so that an address in use fails the start
+	// - the servers are stopped after the last run cleaned up
+	var serversWg sync.WaitGroup
+	stopServers := make(chan interface{})
+	serverErrs := make(chan error, len(servers))
+	defer func() {
+		close(stopServers)
+		serversWg.Wait()
+	}()
+	for _, srv := range servers {
+		if err := srv.Listen(); err != nil {
+			return err
+		}
+
+		serversWg.Add(1)
+		go func(srv *server.Server) {
+			defer serversWg.Done()
+			if err := srv.Serve(stopServers); err != nil {
+				serverErrs <- err
+			}
+		}(srv)
 	}
 
-	// the registry is a wrapper for the two special collectors {xid_collector, clock_events_collector}.
-	// - exposes a Gather() function that call GetMetrics() on both collectors and then aggregates the results
-	// - calling Gather() is the mechanism how we obtain the metrics for DCGM_EXP_XID_ERRORS_COUNT and DCGM_EXP_CLOCK_EVENTS_COUNT
-	cRegistry := dcgmexporter.NewRegistry()
+	for {
+		sig, err := a.run(sigs, store, serverErrs)
+		if err != nil {
+			return err
+		}
+
+		if sig != syscall.SIGHUP {
+			return nil
+		}
 
-	// enable XID error collector via the registry
-	// - exports prometheus metric: DCGM_EXP_XID_ERRORS_COUNT
-	if err := enableDCGMExpXIDErrorsCountCollector(cs, fieldEntityGroupTypeSystemInfo, hostname, a.DcgmExporterConfig, cRegistry); err != nil {
-		return err
+		logrus.Info("Reloading on SIGHUP")
+		debugCounters.Add(counterReloads, 1)
 	}
+}
 
-	// enable collection of clock throttling reasons by resolving bitmask of dcgm field https://docs.nvidia.com/datacenter/dcgm/latest/dcgm-api/dcgm-api-field-ids.html#c.DCGM_FI_DEV_CLOCK_THROTTLE_REASONS
-	// - exports prometheus metric: DCGM_EXP_CLOCK_EVENTS_COUNT
-	if err := enableDCGMExpClockEventsCount(cs, fieldEntityGroupTypeSystemInfo, hostname, a.DcgmExporterConfig, cRegistry); err != nil {
-		return err
+// persistUnflushed persists the metrics the queue could not push on shutdown to the spool, or drops them if no spool is configured
+// - logs what was flushed and what was dropped
+func (a GPUMetricsAgent) persistUnflushed(queue *pushQueue) {
+	flushed, unflushed, dropped, droppedClosed := queue.flushResult()
+
+	persisted := 0
+	if a.spool != nil && len(unflushed) > 0 {
+		var err error
+		persisted, err = a.spool.persist(unflushed, time.Now().UnixNano())
+		if err != nil {
+			logrus.Error(err.Error())
+		}
 	}
 
+	logrus.Infof("Push queue shut down: %d batches flushed, %d persisted to the spool, %d dropped (%d by the overflow policy, %d queued after closing the queue)",
+		flushed, persisted, len(unflushed)-persisted+dropped+droppedClosed, dropped, droppedClosed)
+}
+
+// run collects and pushes metrics until a signal is delivered, and returns the signal
+// - everything started by run is stopped and cleaned up before it returns, so that a reload starts from scratch
+// - returns the error of a server failing while running
+func (a GPUMetricsAgent) run(sigs chan os.Signal, store *metricsStore, serverErrs chan error) (os.Signal, error) {
+	a.notifier.connecting()
+
+	// the deadline of the shutdown, zero while running or reloading
+	var deadline time.Time
+	// stillRunning is true, if the pipeline or the forwarder didn't stop within the grace period on shutdown
+	var stillRunning bool
+
+	c, collectionCleanup, err := a.newCollection()
 	defer func() {
-		cRegistry.Cleanup()
+		// the endpoints must not use the collection anymore once it is cleaned up
+		store.setCollection(nil)
+
+		// a running diagnostic must not lose its connection to DCGM. On reload, it's waited for. On shutdown, until the grace period ended
+		if err := a.diagnostics.disconnect(deadline); err != nil {
+			logrus.Warnf("The DCGM diagnostic is still running after the grace period, exiting without disconnecting from DCGM: %s", err)
+			return
+		}
+
+		// the pipeline or the forwarder might be within a call to DCGM, which must not use the released watches and handles
+		if stillRunning {
+			logrus.Warn("The collection is still running after the grace period, exiting without disconnecting from DCGM")
+			return
+		}
+
+		logrus.Info("Releasing DCGM field watches and groups")
+		collectionCleanup()
 	}()
+	if err != nil {
+		return nil, err
+	}
+	store.setCollection(c)
 
 	// channel with 10 plaintext prometheus metrics buffered to be consumed by a reader
 	metricsChannel := make(chan string, 10)
@@ -175,97 +403,166 @@ restart:
 	var wg sync.WaitGroup
 	stop := make(chan interface{})
 
-	// add to wait-group for pipeline
-	wg.Add(1)
+	// periodically refresh the droplet metadata
+	if a.dropletMetadata != nil {
+		wg.Add(1)
+		go a.dropletMetadata.Run(stop, &wg)
+	}
+
+	if c.scheduler != nil {
+		wg.Add(1)
+		go c.scheduler.Run(stop, &wg)
+	}
+
+	// add to the pipeline's own wait-group, so the forwarder can push the collection in flight once the pipeline stopped
+	var pipelineWg sync.WaitGroup
+	pipelineWg.Add(1)
 
 	// run the pipeline, invoking all regular collectors {GPU Collector, NVLink Collector, NVSwitch Collector}
 	// - each collector returns a slice of metrics for each counter (map[Counter][]Metric).
+	// - the pipeline applies the transformations (e.g. GPU process attribution) to the GPU metrics
 	// - the pipeline then converts those to the prometheus plain-text format.
 	// - the pipeline aggregates the prometheus plain-text metrics of all collectors and sends it out via the metricsChannel
-	go pipeline.Run(metricsChannel, stop, &wg)
+	go c.pipeline.Run(metricsChannel, stop, &pipelineWg)
+
+	// push the metrics to internal DO systems by a single worker, in the order they were collected
+	// - not added to the wait-group, as the queued metrics are flushed after everything else stopped
+	queue := newPushQueue(a.Options.PushQueueSize, a.Options.PushQueueOverflow)
+	defer queue.close(0)
+	store.setQueue(queue)
+	queueDone := make(chan interface{})
+
+	// push the metrics persisted on the last shutdown first
+	if a.spool != nil {
+		batches, err := a.spool.replay()
+		if err != nil {
+			logrus.Error(err.Error())
+		}
+		if len(batches) > 0 {
+			logrus.Infof("Pushing %d batches persisted in the push spool", len(batches))
+		}
+		for _, batch := range batches {
+			queue.enqueue(batch)
+		}
+	}
 
-	// channel with 10 plaintext prometheus metrics buffered to be consumed by the metrics server
-	// - fed from the actual metrics channel
-	metricsServerChannel := make(chan string, 10)
+	go queue.Run(func(ctx context.Context, batch []byte) error {
+		start := a.clock.Now()
+		err := a.forwardMetricsToProxy(ctx, bytes.NewBuffer(batch))
+		a.history.recordPush(start, len(batch), err)
+		a.notifier.pushed(err)
+		return err
+	}, queueDone)
+
+	// forward gathers the registry, appends its metrics to the metrics of the pipeline, and queues them to be pushed
+	forward := func(plaintextMetrics string) {
+		metricsBuffer := bytes.Buffer{}
+		metricsBuffer.Write([]byte(plaintextMetrics))
+
+		// serve the metrics on /metrics
+		store.update(plaintextMetrics)
+
+		// the pipeline sends on the metrics channel every config.CollectInterval(20s) seconds - that's the same timeframe as the XID + clock_events collector window
+		// Hence, we can from the registry and get accurate metrics over the last time window
+		// - the metrics of the pipeline are pushed even if the registry fails
+		registryMetrics, err := c.gatherRegistry()
+		if err != nil {
+			logrus.Errorf("Pushing the metrics without the metrics of the registry: %s", err)
+		}
+
+		// append metrics to buffer
+		metricsBuffer.WriteString(registryMetrics)
+
+		// finally queue the metrics to be sent to internal DO systems
+		if metricsBuffer.Len() > 0 {
+			queue.enqueue(metricsBuffer.Bytes())
+		}
+
+		// the pipeline sends empty metrics if the collection failed
+		if plaintextMetrics != "" {
+			a.notifier.collected()
+		}
+	}
 
 	// Continuously read from the pipeline + registry to forward metrics to the DO proxy
 	//  - IDEA: instead of passing though the metricsChannel directly to the MetricServer, we already read from it here
 	//  - Reason: to push metrics to the rmetdataproxy, we need to have access to the metrics gathered by both the pipeline and the registry
-	//  - Next: Forward the exact same metrics to the metric server to expose on /metrics for customers to query (just like the dcgm-exporter does)
+	//  - Next: Store the exact same metrics to expose on /metrics for customers to query (just like the dcgm-exporter does)
+	//  - added to the wait-group, as it gathers the registry, which must not happen after the cleanup disconnected from DCGM
+	//  - on stop, waits for the pipeline to have stopped, and forwards the collections still buffered in the metricsChannel
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		for {
 			select {
 			case <-stop:
+				pipelineWg.Wait()
+				for len(metricsChannel) > 0 {
+					forward(<-metricsChannel)
+				}
 				return
 			case plaintextMetrics := <-metricsChannel:
-				metricsBuffer := bytes.Buffer{}
-				metricsBuffer.Write([]byte(plaintextMetrics))
-
-				// forward metrics to the dcgm-exporter's metrics server
-				metricsServerChannel <- plaintextMetrics
-
-				// the pipeline sends on the metrics channel every config.CollectInterval(20s) seconds - that's the same timeframe as the XID + clock_events collector window
-				// Hence, we can from the registry and get accurate metrics over the last time window
-				metrics, err := cRegistry.Gather()
-				if err != nil {
-					logrus.Error("failed to gather metrics from the registry(XID Collector, clock_events collector)")
-					continue
-				}
-
-				var tmpBuffer bytes.Buffer
-
-				tmpl := getExpMetricTemplate()
-				if err := tmpl.Execute(&tmpBuffer, metrics); err != nil {
-					logrus.Error("failed to template metrics from the registry(XID Collector, clock_events collector) into prometheus plaintext format")
-					continue
-				}
-
-				// append metrics to buffer
-				metricsBuffer.Write(tmpBuffer.Bytes())
-
-				// finally send the metrics to internal DO systems
-				go func(buf bytes.Buffer) {
-					if err := a.forwardMetricsToProxy(&buf); err != nil {
-						logrus.Error(err.Error())
-						return
-					}
-
-					logrus.Debug("Successfully forwarded metrics")
-				}(metricsBuffer)
+				forward(plaintextMetrics)
 			}
 		}
 	}()
 
-	// serve a /metrics endpoint just like the dcgm-exporter does
-	// - stores duplicate metrics data in plaintext, but that's fine
-	// - every time the endpoint is hit, reads from the pre-gather metrics consumed from metricsServerChannel, but also invokes the registry (hence there is additional overhead)
-	server, cleanup, err := dcgmexporter.NewMetricsServer(a.DcgmExporterConfig, metricsServerChannel, cRegistry)
-	defer cleanup()
-	if err != nil {
-		return err
+	// ping the systemd watchdog while the pipeline collects, if enabled in the unit (WatchdogSec=)
+	if interval := a.notifier.watchdogInterval(); interval > 0 {
+		maxAge := watchdogCollectIntervals * time.Duration(a.DcgmExporterConfig.CollectInterval) * time.Millisecond
+		wg.Add(1)
+		go a.notifier.RunWatchdog(a.clock, interval, maxAge, stop, &wg)
 	}
 
-	// add to wait-group for metrics server
-	wg.Add(1)
-	go server.Run(stop, &wg)
+	// wait before terminating: wait for one of the OS signals to be delivered to the process, or a server to fail
+	var sig os.Signal
+	var serverErr error
+	select {
+	case sig = <-sigs:
+		logrus.Infof("Received %s, shutting down within %s", sig, a.Options.ShutdownGracePeriod)
+	case serverErr = <-serverErrs:
+		logrus.Errorf("%s, shutting down within %s", serverErr, a.Options.ShutdownGracePeriod)
+	}
 
-	sigs := newOSWatcher(syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP)
+	if sig == syscall.SIGHUP {
+		a.notifier.reloading()
+	} else {
+		a.notifier.stopping()
+	}
 
-	// wait before terminating: wait for one of the OS signals to be delivered to the process
-	sig := <-sigs
+	// shut down within the grace period
+	// - the real time is used, as the shutdown must be bounded even with a fake clock
+	// - a running diagnostic is only bounded by the grace period on shutdown, on reload it's waited for (see the deferred cleanup)
+	shutdownDeadline := time.Now().Add(a.Options.ShutdownGracePeriod)
+	if sig != syscall.SIGHUP {
+		deadline = shutdownDeadline
+	}
 
-	// signal termination to {pipeline, metrics server}
+	// signal termination to {pipeline, forwarder}
+	// - the pipeline stops collecting, and the forwarder queues the collections still buffered
 	close(stop)
 
-	// wait for {pipeline, metrics server} to have terminated, or 2 seconds, whatever comes earlier
-	err = dcgmexporter.WaitWithTimeout(&wg, time.Second*2)
-	if err != nil {
-		return err
+	// wait for {pipeline, forwarder} to have terminated, or the grace period, whatever comes earlier
+	// - only then, the collection is cleaned up (deferred), disconnecting from DCGM
+	// - on reload, it's waited for after the grace period, as the collection is set up again with a new connection to DCGM
+	// - on shutdown, the collection isn't cleaned up after the grace period. Not an error, as the agent is exiting anyway
+	if err := dcgmexporter.WaitWithTimeout(&wg, time.Until(shutdownDeadline)); err != nil {
+		if sig == syscall.SIGHUP {
+			logrus.Warnf("Not everything stopped within the grace period, waiting for it before reloading: %s", err)
+			wg.Wait()
+		} else {
+			logrus.Warnf("Not everything stopped within the grace period: %s", err)
+			stillRunning = true
+		}
 	}
 
-	if sig == syscall.SIGHUP {
-		goto restart
-	}
+	// flush the queued metrics, as nothing is queued anymore
+	// - bounded by the grace period, after which the push in flight is aborted
+	// - the metrics that could not be pushed are persisted to the spool, if configured
+	queue.close(time.Until(shutdownDeadline))
+	<-queueDone
+	a.persistUnflushed(queue)
+	store.setQueue(nil)
 
-	return nil
+	return sig, serverErr
 }
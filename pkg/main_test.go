@@ -0,0 +1,76 @@
+package pkg
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	httpclient "github.com/digitalocean/do-dcgm-exporter/pkg/client"
+)
+
+func TestRunSimulated(t *testing.T) {
+	agent, err := NewGPUMetricsAgent(Options{SimulateScenario: testScenario})
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	pushes := make(chan string, 100)
+	agent.ProxyClient = &httpclient.FakeHTTPClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case pushes <- string(body):
+		default:
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(""))}, nil
+	}}
+	agent.DcgmExporterConfig.Address = "localhost:0"
+	agent.DcgmExporterConfig.CollectInterval = 50
+
+	done := make(chan error, 1)
+	go func() {
+		done <- agent.Run()
+	}()
+
+	// the pushes play the scripted values, until the last value is repeated
+	expected := []string{
+		`DCGM_FI_DEV_GPU_TEMP{gpu="0",UUID="GPU-5a3e1f0c-6d2b-4b8e-9f3a-2c1d0e9b8a70",pci_bus_id="00000000:18:00.0"`,
+		`DCGM_FI_DEV_NVSWITCH_TEMPERATURE_CURRENT{nvswitch="0"`,
+		`do_dcgm_gpu_nvlinks_active{gpu="1"`,
+	}
+	timeout := time.After(10 * time.Second)
+	var push string
+	for !strings.Contains(push, `GPU_I_PROFILE="3g.40gb",GPU_I_ID="1",Hostname=`) || !strings.Contains(push, "} 41\n") {
+		select {
+		case push = <-pushes:
+		case err := <-done:
+			t.Fatalf("expected the agent to keep running, but it returned: %v", err)
+		case <-timeout:
+			t.Fatalf("expected a push with the last scripted values, but got: %s", push)
+		}
+	}
+	for _, line := range expected {
+		if !strings.Contains(push, line) {
+			t.Errorf("expected the push to contain %q, but got: %s", line, push)
+		}
+	}
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected the agent to terminate without error, but got: %s", err.Error())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the agent to terminate on SIGTERM")
+	}
+}
@@ -0,0 +1,242 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	httpclient "github.com/digitalocean/do-dcgm-exporter/pkg/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// dropletMetadataPath is the API path of the droplet metadata service, relative to the internal proxy URL
+	dropletMetadataPath = "metadata/v1.json"
+
+	// defaultDropletMetadataRefreshInterval is how often the metadata is refreshed, if not configured otherwise
+	defaultDropletMetadataRefreshInterval = 10 * time.Minute
+	// dropletMetadataRetryInterval is how often the metadata is fetched again after a failure
+	dropletMetadataRetryInterval = 30 * time.Second
+
+	// metadata labels that can be added to exported series
+	dropletIDLabel = "droplet_id"
+	regionLabel    = "region"
+	tagsLabel      = "tags"
+	vpcLabel       = "vpc"
+)
+
+// DropletMetadataLabels are the labels the droplet metadata enricher can add to exported series
+var DropletMetadataLabels = []string{dropletIDLabel, regionLabel, tagsLabel, vpcLabel}
+
+// dropletInfoCounter is the counter of the do_droplet_info metric, carrying all metadata labels with the constant value 1
+// - added by the agent, hence, like the dcgm-exporter added counters, uses an id outside the range of dcgm fields
+var dropletInfoCounter = dcgmexporter.Counter{
+	FieldID:   dcgm.Short(9100),
+	FieldName: "do_droplet_info",
+	PromType:  "gauge",
+	Help:      "Metadata of the droplet (droplet_id, region, tags, vpc). Always 1.",
+}
+
+// dropletMetadata is the subset of the droplet metadata API response the agent uses
+type dropletMetadata struct {
+	DropletID  int64    `json:"droplet_id"`
+	Region     string   `json:"region"`
+	Tags       []string `json:"tags"`
+	Interfaces struct {
+		Private []struct {
+			IPv4 struct {
+				IPAddress string `json:"ip_address"`
+				Netmask   string `json:"netmask"`
+			} `json:"ipv4"`
+		} `json:"private"`
+	} `json:"interfaces"`
+}
+
+// labels returns all metadata labels
+// - the vpc label is the network (CIDR) of the private interface, which is the droplet's VPC network
+func (m *dropletMetadata) labels() map[string]string {
+	labels := map[string]string{
+		dropletIDLabel: fmt.Sprintf("%d", m.DropletID),
+		regionLabel:    m.Region,
+		tagsLabel:      strings.Join(m.Tags, ","),
+		vpcLabel:       "",
+	}
+
+	if len(m.Interfaces.Private) > 0 {
+		private := m.Interfaces.Private[0].IPv4
+		ip := net.ParseIP(private.IPAddress)
+		mask := net.ParseIP(private.Netmask)
+		if ip != nil && mask != nil && ip.To4() != nil && mask.To4() != nil {
+			network := net.IPNet{IP: ip.To4().Mask(net.IPMask(mask.To4())), Mask: net.IPMask(mask.To4())}
+			labels[vpcLabel] = network.String()
+		}
+	}
+
+	return labels
+}
+
+// dropletMetadataEnricher fetches the droplet metadata at startup and on a refresh interval, and
+// - adds the configured metadata labels to exported series (as dcgmexporter.Transform)
+// - exports the do_droplet_info metric (as dcgmexporter.Collector)
+// If the metadata service is unavailable, the last successfully fetched metadata is used, and fetching is retried every dropletMetadataRetryInterval.
+type dropletMetadataEnricher struct {
+	client          httpclient.HTTPClient
+	url             string
+	labelNames      []string
+	refreshInterval time.Duration
+
+	mtx      sync.RWMutex
+	metadata *dropletMetadata
+}
+
+// newDropletMetadataEnricher creates a dropletMetadataEnricher querying the metadata service at baseURL
+func newDropletMetadataEnricher(client httpclient.HTTPClient, baseURL string, labelNames []string, refreshInterval time.Duration) (*dropletMetadataEnricher, error) {
+	for _, name := range labelNames {
+		if !slices.Contains(DropletMetadataLabels, name) {
+			return nil, errors.Errorf("unsupported droplet metadata label %q, must be one of: %s", name, strings.Join(DropletMetadataLabels, ", "))
+		}
+	}
+
+	if refreshInterval <= 0 {
+		refreshInterval = defaultDropletMetadataRefreshInterval
+	}
+
+	return &dropletMetadataEnricher{
+		client:          client,
+		url:             fmt.Sprintf("%s/%s", baseURL, dropletMetadataPath),
+		labelNames:      labelNames,
+		refreshInterval: refreshInterval,
+	}, nil
+}
+
+// Run refreshes the metadata until stop is closed
+func (e *dropletMetadataEnricher) Run(stop chan interface{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	interval := e.refreshInterval
+	if err := e.refresh(); err != nil {
+		logrus.Warnf("Failed to fetch droplet metadata, retrying in %s: %s", dropletMetadataRetryInterval, err)
+		interval = dropletMetadataRetryInterval
+	}
+
+	t := time.NewTimer(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			interval = e.refreshInterval
+			if err := e.refresh(); err != nil {
+				logrus.Warnf("Failed to refresh droplet metadata, retrying in %s: %s", dropletMetadataRetryInterval, err)
+				interval = dropletMetadataRetryInterval
+			}
+			t.Reset(interval)
+		}
+	}
+}
+
+// refresh fetches the droplet metadata, and caches it on success
+func (e *dropletMetadataEnricher) refresh() error {
+	req, err := http.NewRequest("GET", e.url, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to construct GET request to droplet metadata service")
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to query droplet metadata service")
+	}
+	defer func(res *http.Response) {
+		if res.Body != nil {
+			res.Body.Close()
+		}
+	}(resp)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("failed to query droplet metadata service. Got status: %d(%q)", resp.StatusCode, resp.Status)
+	}
+
+	metadata := &dropletMetadata{}
+	if err := json.NewDecoder(resp.Body).Decode(metadata); err != nil {
+		return errors.Wrap(err, "failed to decode droplet metadata")
+	}
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if e.metadata == nil {
+		logrus.Infof("Droplet metadata: droplet_id=%d region=%s", metadata.DropletID, metadata.Region)
+	}
+	e.metadata = metadata
+
+	return nil
+}
+
+// currentLabels returns all metadata labels of the cached metadata, or nil if the metadata has never been fetched
+func (e *dropletMetadataEnricher) currentLabels() map[string]string {
+	e.mtx.RLock()
+	defer e.mtx.RUnlock()
+
+	if e.metadata == nil {
+		return nil
+	}
+	return e.metadata.labels()
+}
+
+func (e *dropletMetadataEnricher) Name() string {
+	return "dropletMetadataEnricher"
+}
+
+// Process adds the configured metadata labels to all metrics
+func (e *dropletMetadataEnricher) Process(metrics dcgmexporter.MetricsByCounter, _ dcgmexporter.SystemInfo) error {
+	labels := e.currentLabels()
+	if labels == nil || len(e.labelNames) == 0 {
+		return nil
+	}
+
+	for counter := range metrics {
+		for i := range metrics[counter] {
+			attributes := maps.Clone(metrics[counter][i].Attributes)
+			if attributes == nil {
+				attributes = map[string]string{}
+			}
+			for _, name := range e.labelNames {
+				attributes[name] = labels[name]
+			}
+			metrics[counter][i].Attributes = attributes
+		}
+	}
+
+	return nil
+}
+
+// GetMetrics returns the do_droplet_info metric
+func (e *dropletMetadataEnricher) GetMetrics() (dcgmexporter.MetricsByCounter, error) {
+	labels := e.currentLabels()
+	if labels == nil {
+		return dcgmexporter.MetricsByCounter{}, nil
+	}
+
+	return dcgmexporter.MetricsByCounter{
+		dropletInfoCounter: {
+			{
+				Counter:    dropletInfoCounter,
+				Value:      "1",
+				Attributes: labels,
+			},
+		},
+	}, nil
+}
+
+func (e *dropletMetadataEnricher) Cleanup() {}
@@ -0,0 +1,130 @@
+package pkg
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	httpclient "github.com/digitalocean/do-dcgm-exporter/pkg/client"
+)
+
+const testDropletMetadata = `{
+  "droplet_id": 2756294,
+  "hostname": "gpu-h100x8",
+  "region": "tor1",
+  "tags": ["training", "team-a"],
+  "interfaces": {
+    "private": [{"ipv4": {"ip_address": "10.118.0.2", "netmask": "255.255.240.0", "gateway": "10.118.0.1"}, "type": "private"}],
+    "public": [{"ipv4": {"ip_address": "203.0.113.10", "netmask": "255.255.240.0", "gateway": "203.0.113.1"}, "type": "public"}]
+  }
+}`
+
+// newFakeMetadataService serves the droplet metadata, until failing is set
+func newFakeMetadataService(t *testing.T, failing *atomic.Bool) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metadata/v1.json" {
+			t.Errorf("expected path to be /metadata/v1.json, but got: %s", r.URL.Path)
+		}
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(testDropletMetadata))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDropletMetadataEnricher(t *testing.T) {
+	var failing atomic.Bool
+	server := newFakeMetadataService(t, &failing)
+
+	enricher, err := newDropletMetadataEnricher(httpclient.NewHTTP(time.Second), server.URL, []string{dropletIDLabel, regionLabel}, time.Minute)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	counter := dcgmexporter.Counter{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge"}
+	newMetrics := func() dcgmexporter.MetricsByCounter {
+		return dcgmexporter.MetricsByCounter{
+			counter: {{Counter: counter, Value: "40", GPU: "0", Attributes: map[string]string{"err_code": "0"}}},
+		}
+	}
+
+	// before the first refresh, metrics are not modified
+	metrics := newMetrics()
+	if err := enricher.Process(metrics, dcgmexporter.SystemInfo{}); err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	if !reflect.DeepEqual(metrics, newMetrics()) {
+		t.Errorf("expected metrics to be unchanged before the metadata is fetched, but got: %+v", metrics)
+	}
+
+	if err := enricher.refresh(); err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	// an outage of the metadata service keeps the cached metadata
+	failing.Store(true)
+	if err := enricher.refresh(); err == nil {
+		t.Errorf("expected an error from the failing metadata service")
+	}
+
+	metrics = newMetrics()
+	if err := enricher.Process(metrics, dcgmexporter.SystemInfo{}); err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	expectedAttributes := map[string]string{"err_code": "0", dropletIDLabel: "2756294", regionLabel: "tor1"}
+	if !reflect.DeepEqual(metrics[counter][0].Attributes, expectedAttributes) {
+		t.Errorf("expected attributes %+v, but got: %+v", expectedAttributes, metrics[counter][0].Attributes)
+	}
+
+	info, err := enricher.GetMetrics()
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	expectedInfoAttributes := map[string]string{dropletIDLabel: "2756294", regionLabel: "tor1", tagsLabel: "training,team-a", vpcLabel: "10.118.0.0/20"}
+	if len(info[dropletInfoCounter]) != 1 || !reflect.DeepEqual(info[dropletInfoCounter][0].Attributes, expectedInfoAttributes) {
+		t.Errorf("expected do_droplet_info with attributes %+v, but got: %+v", expectedInfoAttributes, info)
+	}
+}
+
+func TestNewDropletMetadataEnricherInvalidLabel(t *testing.T) {
+	_, err := newDropletMetadataEnricher(&httpclient.FakeHTTPClient{}, "http://169.254.169.254:80", []string{"image"}, time.Minute)
+	if err == nil {
+		t.Errorf("expected an error for an unsupported label")
+	}
+}
+
+func TestRenderRegistryMetricsDropletInfo(t *testing.T) {
+	temp := dcgmexporter.Counter{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge", Help: "GPU temperature (in C)."}
+	metrics := dcgmexporter.MetricsByCounter{
+		dropletInfoCounter: {{Counter: dropletInfoCounter, Value: "1", Attributes: map[string]string{dropletIDLabel: "2756294", regionLabel: "tor1"}}},
+		temp:               {{Counter: temp, Value: "40", UUID: "UUID", GPU: "0", GPUUUID: "GPU-0", GPUDevice: "nvidia0", Hostname: "gpu-droplet"}},
+	}
+
+	rendered, err := renderRegistryMetrics(metrics)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	for _, expected := range []string{
+		`do_droplet_info{droplet_id="2756294",region="tor1"} 1`,
+		`DCGM_FI_DEV_GPU_TEMP{gpu="0",UUID="GPU-0",pci_bus_id="",device="nvidia0",modelName="",Hostname="gpu-droplet"} 40`,
+	} {
+		if !strings.Contains(rendered, expected) {
+			t.Errorf("expected the metrics to contain %s, but got:\n%s", expected, rendered)
+		}
+	}
+	if err := writeMetrics(&bytes.Buffer{}, CollectFormatJSON, []string{rendered}); err != nil {
+		t.Errorf("expected valid prometheus metrics, but got: %s", err.Error())
+	}
+}
@@ -2,22 +2,23 @@ package pkg
 
 import (
 	"bytes"
-	"fmt"
+	"context"
 	"net/http"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
-func (a GPUMetricsAgent) forwardMetricsToProxy(requestBody *bytes.Buffer) error {
-	// "http://169.254.169.254:80/v1/gpu_metrics"
-	url := fmt.Sprintf("%s:%d/%s", internalProxyURL, internalProxyPort, internalProxyPath)
-
-	req, err := http.NewRequest("POST", url, bytes.NewReader(requestBody.Bytes()))
+func (a GPUMetricsAgent) forwardMetricsToProxy(ctx context.Context, requestBody *bytes.Buffer) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", a.proxyURL, bytes.NewReader(requestBody.Bytes()))
 	if err != nil {
 		return errors.Wrap(err, "failed to construct POST request to proxy")
 	}
 
+	if err := a.pushAuth.apply(req); err != nil {
+		return errors.Wrap(err, "failed to authenticate POST request to proxy")
+	}
+
 	resp, err := a.ProxyClient.Do(req)
 	if err != nil {
 		return errors.Wrap(err, "failed to forward metrics to proxy")
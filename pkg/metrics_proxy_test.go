@@ -2,6 +2,7 @@ package pkg
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -61,9 +62,10 @@ func TestForwardMetricsToProxy(t *testing.T) {
 		t.Run(testname, func(t *testing.T) {
 			agent := GPUMetricsAgent{
 				ProxyClient: &httpclient.FakeHTTPClient{DoFunc: tt.clientDo},
+				proxyURL:    "http://169.254.169.254:80/v1/gpu_metrics",
 			}
 
-			err := agent.forwardMetricsToProxy(&testBuffer)
+			err := agent.forwardMetricsToProxy(context.Background(), &testBuffer)
 			if err != nil {
 				if tt.returnError == false {
 					t.Errorf("expected no error, but got: %s", err.Error())
@@ -0,0 +1,236 @@
+package pkg
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+	With MIG enabled, the dcgm-exporter collectors (GPUDevices.Flex) report a series per GPU instance (labels GPU_I_PROFILE, GPU_I_ID),
+	and no series of the parent GPU. The migAggregator adds a series of the parent GPU for the fields in migAggregations:
+	- the frame buffer fields are the sum over the instances
+	- the temperatures and the power usage are the maximum over the instances, as DCGM reports the values of the parent GPU for every instance
+	- the profiling fields are relative to the slices of the instance, hence the mean over the instances weighted by their slices (e.g. 3 for 3g.40gb)
+	- the frame buffer usage in percent is relative to the memory of the instance, hence the mean weighted by their memory (e.g. 40 GB for 3g.40gb)
+	The parent series have the labels of the GPU, and the label mig_aggregation naming the aggregation.
+
+	The MIG layout is read once the collection is set up. If it changes at runtime (e.g. nvidia-smi mig -cgi), the watched entities are stale.
+	Hence, the discoveryReconciler compares the GPU instance hierarchy (migLayout) periodically, and rebuilds the GPU collectors on a change (see rediscovery.go).
+*/
+
+const (
+	migAggregationSum               = "sum"
+	migAggregationMax               = "max"
+	migAggregationSliceWeightedMean = "slice_weighted_mean"
+	// migAggregationMemoryWeightedMean is the mean weighted by the memory of the instances
+	// - the unpartitioned memory of the GPU isn't part of the mean
+	migAggregationMemoryWeightedMean = "memory_weighted_mean"
+
+	// migAggregationLabel is the label of the parent GPU series, naming the aggregation
+	migAggregationLabel = "mig_aggregation"
+)
+
+// migAggregations are the aggregations of the fields, for which a series of the parent GPU is added
+var migAggregations = map[string]string{
+	"DCGM_FI_DEV_FB_USED":     migAggregationSum,
+	"DCGM_FI_DEV_FB_FREE":     migAggregationSum,
+	"DCGM_FI_DEV_FB_TOTAL":    migAggregationSum,
+	"DCGM_FI_DEV_FB_RESERVED": migAggregationSum,
+	// the default frame buffer field
+	"DCGM_FI_DEV_FB_USED_PERCENT": migAggregationMemoryWeightedMean,
+
+	"DCGM_FI_DEV_GPU_TEMP":    migAggregationMax,
+	"DCGM_FI_DEV_MEMORY_TEMP": migAggregationMax,
+	"DCGM_FI_DEV_POWER_USAGE": migAggregationMax,
+
+	"DCGM_FI_PROF_GR_ENGINE_ACTIVE":   migAggregationSliceWeightedMean,
+	"DCGM_FI_PROF_SM_ACTIVE":          migAggregationSliceWeightedMean,
+	"DCGM_FI_PROF_SM_OCCUPANCY":       migAggregationSliceWeightedMean,
+	"DCGM_FI_PROF_PIPE_TENSOR_ACTIVE": migAggregationSliceWeightedMean,
+	"DCGM_FI_PROF_DRAM_ACTIVE":        migAggregationSliceWeightedMean,
+}
+
+// migProfileSlices returns the number of compute slices of the MIG profile, e.g. 3 for 3g.40gb. 1 if unknown
+func migProfileSlices(profile string) uint {
+	prefix, _, found := strings.Cut(profile, "g.")
+	if !found {
+		return 1
+	}
+	// e.g. 1c.3g.40gb is a compute instance profile
+	if _, after, found := strings.Cut(prefix, "."); found {
+		prefix = after
+	}
+	count, err := strconv.ParseUint(prefix, 10, 32)
+	if err != nil || count == 0 {
+		return 1
+	}
+	return uint(count)
+}
+
+// migProfileMemory returns the memory of the MIG profile in GB, e.g. 40 for 3g.40gb. 1 if unknown
+func migProfileMemory(profile string) uint {
+	_, memory, found := strings.Cut(profile, "g.")
+	if !found {
+		return 1
+	}
+	// e.g. 1g.20gb+me is a profile with a media extension
+	memory, _, _ = strings.Cut(memory, "+")
+	count, err := strconv.ParseUint(strings.TrimSuffix(memory, "gb"), 10, 32)
+	if err != nil || count == 0 {
+		return 1
+	}
+	return uint(count)
+}
+
+// migAggregator adds a series of the parent GPU to the series of its GPU instances, implementing dcgmexporter.Transform
+type migAggregator struct{}
+
+func newMIGAggregator() *migAggregator {
+	return &migAggregator{}
+}
+
+func (*migAggregator) Name() string {
+	return "migAggregator"
+}
+
+// Process adds the series of the parent GPUs, in the order of their first instance
+func (*migAggregator) Process(metrics dcgmexporter.MetricsByCounter, sysInfo dcgmexporter.SystemInfo) error {
+	if sysInfo.InfoType != dcgm.FE_GPU {
+		return nil
+	}
+
+	// the slices of the GPU instances, by GPU and GPU instance id
+	instanceSlices := map[string]uint{}
+	for i := uint(0); i < sysInfo.GPUCount; i++ {
+		gpu := sysInfo.GPUs[i]
+		for _, instance := range gpu.GPUInstances {
+			count := instance.Info.NvmlProfileSlices
+			if count == 0 {
+				count = migProfileSlices(instance.ProfileName)
+			}
+			instanceSlices[fmt.Sprintf("%d/%d", gpu.DeviceInfo.GPU, instance.Info.NvmlInstanceId)] = count
+		}
+	}
+
+	for counter, counterMetrics := range metrics {
+		aggregation, exists := migAggregations[counter.FieldName]
+		if !exists {
+			continue
+		}
+
+		var gpus []string
+		instances := map[string][]dcgmexporter.Metric{}
+		for _, metric := range counterMetrics {
+			if metric.GPUInstanceID == "" {
+				continue
+			}
+			if _, exists := instances[metric.GPU]; !exists {
+				gpus = append(gpus, metric.GPU)
+			}
+			instances[metric.GPU] = append(instances[metric.GPU], metric)
+		}
+
+		for _, gpu := range gpus {
+			parent, err := aggregateMIG(instances[gpu], aggregation, instanceSlices)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{logFieldGPU: gpu, logFieldField: counter.FieldName}).Debugf("Not aggregating the MIG instances: %s", err)
+				continue
+			}
+			metrics[counter] = append(metrics[counter], parent)
+		}
+	}
+
+	return nil
+}
+
+// aggregateMIG returns the series of the parent GPU of the instances, with the labels of the first instance
+func aggregateMIG(instances []dcgmexporter.Metric, aggregation string, instanceSlices map[string]uint) (dcgmexporter.Metric, error) {
+	var value string
+	switch aggregation {
+	case migAggregationSum:
+		var sum float64
+		for _, instance := range instances {
+			v, err := strconv.ParseFloat(instance.Value, 64)
+			if err != nil {
+				return dcgmexporter.Metric{}, fmt.Errorf("invalid value %q of GPU instance %s", instance.Value, instance.GPUInstanceID)
+			}
+			sum += v
+		}
+		value = strconv.FormatFloat(sum, 'f', -1, 64)
+	case migAggregationMax:
+		var maximum float64
+		for i, instance := range instances {
+			v, err := strconv.ParseFloat(instance.Value, 64)
+			if err != nil {
+				return dcgmexporter.Metric{}, fmt.Errorf("invalid value %q of GPU instance %s", instance.Value, instance.GPUInstanceID)
+			}
+			// keep the formatting of the value
+			if i == 0 || v > maximum {
+				maximum = v
+				value = instance.Value
+			}
+		}
+	case migAggregationSliceWeightedMean, migAggregationMemoryWeightedMean:
+		var weighted float64
+		var total uint
+		for _, instance := range instances {
+			v, err := strconv.ParseFloat(instance.Value, 64)
+			if err != nil {
+				return dcgmexporter.Metric{}, fmt.Errorf("invalid value %q of GPU instance %s", instance.Value, instance.GPUInstanceID)
+			}
+			var weight uint
+			if aggregation == migAggregationMemoryWeightedMean {
+				weight = migProfileMemory(instance.MigProfile)
+			} else {
+				count, exists := instanceSlices[instance.GPU+"/"+instance.GPUInstanceID]
+				if !exists {
+					count = migProfileSlices(instance.MigProfile)
+				}
+				weight = count
+			}
+			weighted += v * float64(weight)
+			total += weight
+		}
+		value = fmt.Sprintf("%f", weighted/float64(total))
+	default:
+		return dcgmexporter.Metric{}, fmt.Errorf("unknown aggregation %q", aggregation)
+	}
+
+	parent := instances[0]
+	parent.Value = value
+	parent.MigProfile = ""
+	parent.GPUInstanceID = ""
+	parent.Labels = maps.Clone(parent.Labels)
+	if parent.Labels == nil {
+		parent.Labels = map[string]string{}
+	}
+	parent.Labels[migAggregationLabel] = aggregation
+	parent.Attributes = maps.Clone(parent.Attributes)
+
+	return parent, nil
+}
+
+// migLayout describes the GPU and compute instances of the hierarchy, independent of their order
+func migLayout(hierarchy dcgm.MigHierarchy_v2) string {
+	var entities []string
+	for i := uint(0); i < hierarchy.Count && i < uint(len(hierarchy.EntityList)); i++ {
+		entity := hierarchy.EntityList[i]
+		switch entity.Entity.EntityGroupId {
+		case dcgm.FE_GPU_I:
+			entities = append(entities, fmt.Sprintf("GPU %d instance %d (%d slices, profile %d)",
+				entity.Info.NvmlGpuIndex, entity.Info.NvmlInstanceId, entity.Info.NvmlProfileSlices, entity.Info.NvmlMigProfileId))
+		case dcgm.FE_GPU_CI:
+			entities = append(entities, fmt.Sprintf("GPU %d instance %d compute instance %d",
+				entity.Info.NvmlGpuIndex, entity.Info.NvmlInstanceId, entity.Info.NvmlComputeInstanceId))
+		}
+	}
+	slices.Sort(entities)
+	return strings.Join(entities, ", ")
+}
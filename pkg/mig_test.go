@@ -0,0 +1,185 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+)
+
+func TestMIGProfileSlices(t *testing.T) {
+	var tests = []struct {
+		profile  string
+		expected uint
+	}{
+		{"1g.10gb", 1},
+		{"3g.40gb", 3},
+		{"7g.80gb", 7},
+		{"1g.20gb+me", 1},
+		{"1c.3g.40gb", 3},
+		{"", 1},
+		{"unknown", 1},
+	}
+
+	for _, tt := range tests {
+		if got := migProfileSlices(tt.profile); got != tt.expected {
+			t.Errorf("%q: expected %d slices, but got: %d", tt.profile, tt.expected, got)
+		}
+	}
+}
+
+func TestMIGProfileMemory(t *testing.T) {
+	var tests = []struct {
+		profile  string
+		expected uint
+	}{
+		{"1g.10gb", 10},
+		{"3g.40gb", 40},
+		{"7g.80gb", 80},
+		{"1g.20gb+me", 20},
+		{"1c.3g.40gb", 40},
+		{"", 1},
+		{"unknown", 1},
+	}
+
+	for _, tt := range tests {
+		if got := migProfileMemory(tt.profile); got != tt.expected {
+			t.Errorf("%q: expected %d GB, but got: %d", tt.profile, tt.expected, got)
+		}
+	}
+}
+
+func TestMIGAggregator(t *testing.T) {
+	var sysInfo dcgmexporter.SystemInfo
+	sysInfo.InfoType = dcgm.FE_GPU
+	sysInfo.GPUCount = 2
+	sysInfo.GPUs[1] = dcgmexporter.GPUInfo{
+		DeviceInfo: dcgm.Device{GPU: 1},
+		MigEnabled: true,
+		GPUInstances: []dcgmexporter.GPUInstanceInfo{
+			{Info: dcgm.MigEntityInfo{NvmlInstanceId: 1, NvmlProfileSlices: 4}, ProfileName: "4g.40gb"},
+			{Info: dcgm.MigEntityInfo{NvmlInstanceId: 5}, ProfileName: "2g.20gb"},
+			{Info: dcgm.MigEntityInfo{NvmlInstanceId: 6}, ProfileName: "1g.10gb"},
+		},
+	}
+
+	instance := func(id, profile, value string) dcgmexporter.Metric {
+		return dcgmexporter.Metric{GPU: "1", GPUUUID: "GPU-1", MigProfile: profile, GPUInstanceID: id, Value: value, Labels: map[string]string{"DCGM_FI_DRIVER_VERSION": "550.90.07"}}
+	}
+	gpu := func(value string) dcgmexporter.Metric {
+		return dcgmexporter.Metric{GPU: "0", GPUUUID: "GPU-0", Value: value, Labels: map[string]string{}}
+	}
+
+	var tests = []struct {
+		field    string
+		metrics  []dcgmexporter.Metric
+		expected map[string]string
+	}{
+		{"DCGM_FI_DEV_FB_USED", []dcgmexporter.Metric{gpu("100"), instance("1", "4g.40gb", "1000"), instance("5", "2g.20gb", "500"), instance("6", "1g.10gb", "0")},
+			map[string]string{"0": "100", "1/1": "1000", "1/5": "500", "1/6": "0", "1": "1500 sum"}},
+		{"DCGM_FI_DEV_GPU_TEMP", []dcgmexporter.Metric{instance("1", "4g.40gb", "34"), instance("5", "2g.20gb", "41"), instance("6", "1g.10gb", "38")},
+			map[string]string{"1/1": "34", "1/5": "41", "1/6": "38", "1": "41 max"}},
+		// (0.5*4 + 0.2*2 + 0.6*1) / 7
+		{"DCGM_FI_PROF_GR_ENGINE_ACTIVE", []dcgmexporter.Metric{instance("1", "4g.40gb", "0.500000"), instance("5", "2g.20gb", "0.200000"), instance("6", "1g.10gb", "0.600000")},
+			map[string]string{"1/1": "0.500000", "1/5": "0.200000", "1/6": "0.600000", "1": "0.428571 slice_weighted_mean"}},
+		// not an instance of the system info, the slices of the profile are used: (0.5*4 + 1.0*3) / 7
+		{"DCGM_FI_PROF_SM_ACTIVE", []dcgmexporter.Metric{instance("1", "4g.40gb", "0.500000"), instance("9", "3g.40gb", "1.000000")},
+			map[string]string{"1/1": "0.500000", "1/9": "1.000000", "1": "0.714286 slice_weighted_mean"}},
+		// (0.5*40 + 0.2*20 + 0.8*10) / 70
+		{"DCGM_FI_DEV_FB_USED_PERCENT", []dcgmexporter.Metric{instance("1", "4g.40gb", "0.500000"), instance("5", "2g.20gb", "0.200000"), instance("6", "1g.10gb", "0.800000")},
+			map[string]string{"1/1": "0.500000", "1/5": "0.200000", "1/6": "0.800000", "1": "0.457143 memory_weighted_mean"}},
+		{"DCGM_FI_DEV_POWER_MGMT_LIMIT", []dcgmexporter.Metric{instance("1", "4g.40gb", "700"), instance("5", "2g.20gb", "700")},
+			map[string]string{"1/1": "700", "1/5": "700"}},
+		{"DCGM_FI_DEV_FB_USED", []dcgmexporter.Metric{gpu("100")},
+			map[string]string{"0": "100"}},
+		{"DCGM_FI_DEV_FB_USED", []dcgmexporter.Metric{instance("1", "4g.40gb", "1000"), instance("5", "2g.20gb", "N/A")},
+			map[string]string{"1/1": "1000", "1/5": "N/A"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			counter := dcgmexporter.Counter{FieldName: tt.field}
+			metrics := dcgmexporter.MetricsByCounter{counter: tt.metrics}
+			if err := newMIGAggregator().Process(metrics, sysInfo); err != nil {
+				t.Fatalf("expected no error, but got: %s", err.Error())
+			}
+
+			got := map[string]string{}
+			for _, metric := range metrics[counter] {
+				key, value := metric.GPU, metric.Value
+				if metric.GPUInstanceID != "" {
+					key += "/" + metric.GPUInstanceID
+				}
+				if aggregation, exists := metric.Labels[migAggregationLabel]; exists {
+					value += " " + aggregation
+					if metric.MigProfile != "" || metric.Labels["DCGM_FI_DRIVER_VERSION"] != "550.90.07" {
+						t.Errorf("expected the labels of the parent GPU, but got: %+v", metric)
+					}
+				}
+				got[key] = value
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %v, but got: %v", tt.expected, got)
+			}
+		})
+	}
+
+	// the labels of the instances are not modified
+	metrics := dcgmexporter.MetricsByCounter{{FieldName: "DCGM_FI_DEV_GPU_TEMP"}: {instance("1", "4g.40gb", "34")}}
+	if err := newMIGAggregator().Process(metrics, sysInfo); err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	for _, metric := range metrics[dcgmexporter.Counter{FieldName: "DCGM_FI_DEV_GPU_TEMP"}] {
+		if metric.GPUInstanceID != "" && metric.Labels[migAggregationLabel] != "" {
+			t.Errorf("expected the instance without the %s label, but got: %v", migAggregationLabel, metric.Labels)
+		}
+	}
+}
+
+func TestMIGLayout(t *testing.T) {
+	var tests = []struct {
+		name      string
+		gpu       uint
+		instances []scenarioGPUInstance
+		expected  bool
+	}{
+		{"unchanged", 1, []scenarioGPUInstance{{Profile: "3g.40gb", ComputeInstances: 1}, {Profile: "3g.40gb", ComputeInstances: 1}}, false},
+		{"instance added", 1, []scenarioGPUInstance{{Profile: "3g.40gb", ComputeInstances: 1}, {Profile: "3g.40gb", ComputeInstances: 1}, {Profile: "1g.10gb", ComputeInstances: 1}}, true},
+		{"profile changed", 1, []scenarioGPUInstance{{Profile: "3g.40gb", ComputeInstances: 1}, {Profile: "2g.20gb", ComputeInstances: 1}}, true},
+		{"compute instance added", 1, []scenarioGPUInstance{{Profile: "3g.40gb", ComputeInstances: 1}, {Profile: "3g.40gb", ComputeInstances: 2}}, true},
+		{"MIG enabled", 0, []scenarioGPUInstance{{Profile: "7g.80gb", ComputeInstances: 1}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, err := loadSimulatedProvider(testScenario)
+			if err != nil {
+				t.Fatalf("expected no error, but got: %s", err.Error())
+			}
+			layout := func() string {
+				hierarchy, err := provider.GetGpuInstanceHierarchy()
+				if err != nil {
+					t.Fatalf("expected no error, but got: %s", err.Error())
+				}
+				return migLayout(hierarchy)
+			}
+
+			before := layout()
+			if err := provider.reconfigureMIG(tt.gpu, tt.instances); err != nil {
+				t.Fatalf("expected no error, but got: %s", err.Error())
+			}
+			if got := layout() != before; got != tt.expected {
+				t.Errorf("expected changed %t, but got: %t (%s)", tt.expected, got, layout())
+			}
+		})
+	}
+
+	provider, err := loadSimulatedProvider(testScenario)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	if err := provider.reconfigureMIG(1, []scenarioGPUInstance{{}}); err == nil {
+		t.Errorf("expected an error for an instance without profile, but got none")
+	}
+}
@@ -0,0 +1,164 @@
+package pkg
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+	With a Type=notify systemd unit, the agent notifies systemd about its state via sd_notify:
+	- READY=1 once DCGM is connected and the first collection succeeded, again after every reload
+	- STATUS= with the current state (connecting, collecting, push failing)
+	- RELOADING=1 on SIGHUP reloads, STOPPING=1 on termination
+	- WATCHDOG=1 only while the pipeline is producing data, so systemd restarts a wedged agent (WatchdogSec=)
+	Without systemd (NOTIFY_SOCKET unset), all notifications are no-ops.
+*/
+
+const (
+	statusConnecting  = "Connecting to DCGM"
+	statusCollecting  = "Collecting"
+	statusPushFailing = "Push failing"
+
+	// watchdogCollectIntervals is the number of collect intervals without a successful collection after which the watchdog is not pinged anymore
+	watchdogCollectIntervals = 3
+)
+
+// systemdNotifier notifies systemd about the state of the agent
+type systemdNotifier struct {
+	// notify sends the state to systemd
+	notify func(state string) (bool, error)
+	now    func() time.Time
+
+	mtx            sync.Mutex
+	ready          bool
+	status         string
+	lastCollection time.Time
+}
+
+// newSystemdNotifier creates a systemdNotifier notifying systemd via the NOTIFY_SOCKET
+func newSystemdNotifier() *systemdNotifier {
+	return &systemdNotifier{
+		notify: func(state string) (bool, error) {
+			return daemon.SdNotify(false, state)
+		},
+		now: time.Now,
+	}
+}
+
+// send sends the state, logging failures
+func (n *systemdNotifier) send(state string) {
+	if _, err := n.notify(state); err != nil {
+		logrus.Warnf("Failed to notify systemd: %s", err)
+	}
+}
+
+// setStatus sends the status, if it changed
+// - must be called with the lock held
+func (n *systemdNotifier) setStatus(status string) {
+	if n.status == status {
+		return
+	}
+	n.status = status
+	n.send("STATUS=" + status)
+}
+
+// connecting notifies that the agent (re-)connects to DCGM, before the first collection
+func (n *systemdNotifier) connecting() {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	n.ready = false
+	n.lastCollection = time.Time{}
+	n.setStatus(statusConnecting)
+}
+
+// collected notifies a successful collection. The first collection after connecting notifies readiness
+func (n *systemdNotifier) collected() {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	n.lastCollection = n.now()
+	if !n.ready {
+		n.ready = true
+		n.send("READY=1")
+		n.setStatus(statusCollecting)
+	}
+}
+
+// pushed notifies the result of a push
+func (n *systemdNotifier) pushed(err error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	if !n.ready {
+		return
+	}
+
+	if err != nil {
+		n.setStatus(fmt.Sprintf("%s: %s", statusPushFailing, err))
+		return
+	}
+	n.setStatus(statusCollecting)
+}
+
+// reloading notifies a reload on SIGHUP
+func (n *systemdNotifier) reloading() {
+	n.send("RELOADING=1")
+}
+
+// stopping notifies the termination of the agent
+func (n *systemdNotifier) stopping() {
+	n.send("STOPPING=1")
+}
+
+// watchdog pings the systemd watchdog, if the last successful collection is at most maxAge old
+func (n *systemdNotifier) watchdog(maxAge time.Duration) {
+	n.mtx.Lock()
+	lastCollection := n.lastCollection
+	n.mtx.Unlock()
+
+	// not pinged before the first collection either, so systemd restarts an agent that never collects
+	if lastCollection.IsZero() {
+		return
+	}
+
+	if n.now().Sub(lastCollection) > maxAge {
+		logrus.Warnf("Not pinging the systemd watchdog, no successful collection since %s", lastCollection.Format(time.RFC3339))
+		return
+	}
+
+	n.send("WATCHDOG=1")
+}
+
+// watchdogInterval returns how often the systemd watchdog must be pinged, or 0 if the watchdog is disabled
+// - pinged at half the watchdog timeout, as recommended by sd_watchdog_enabled(3)
+func (n *systemdNotifier) watchdogInterval() time.Duration {
+	timeout, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		logrus.Warnf("Failed to determine the systemd watchdog timeout: %s", err)
+		return 0
+	}
+	return timeout / 2
+}
+
+// RunWatchdog pings the systemd watchdog every interval, until stop is closed
+// - maxAge is how old the last successful collection may be to still ping the watchdog
+func (n *systemdNotifier) RunWatchdog(ticker clock, interval, maxAge time.Duration, stop chan interface{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticks, stopTicker := ticker.NewTicker(interval)
+	defer stopTicker()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticks:
+			n.watchdog(maxAge)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package pkg
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSystemdNotifier(t *testing.T) {
+	now := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+	var sent []string
+	n := &systemdNotifier{
+		notify: func(state string) (bool, error) {
+			sent = append(sent, state)
+			return true, nil
+		},
+		now: func() time.Time { return now },
+	}
+
+	var tests = []struct {
+		name     string
+		action   func()
+		expected []string
+	}{
+		{"connecting", n.connecting, []string{"STATUS=Connecting to DCGM"}},
+		{"no watchdog before the first collection", func() { n.watchdog(time.Minute) }, nil},
+		{"push before the first collection", func() { n.pushed(nil) }, nil},
+		{"first collection", n.collected, []string{"READY=1", "STATUS=Collecting"}},
+		{"second collection", n.collected, nil},
+		{"push failing", func() { n.pushed(errors.New("connection refused")) }, []string{"STATUS=Push failing: connection refused"}},
+		{"push still failing", func() { n.pushed(errors.New("connection refused")) }, nil},
+		{"push recovered", func() { n.pushed(nil) }, []string{"STATUS=Collecting"}},
+		{"watchdog while collecting", func() { n.watchdog(time.Minute) }, []string{"WATCHDOG=1"}},
+		{"no watchdog without recent collection", func() {
+			now = now.Add(2 * time.Minute)
+			n.watchdog(time.Minute)
+		}, nil},
+		{"reloading", n.reloading, []string{"RELOADING=1"}},
+		{"reconnecting", n.connecting, []string{"STATUS=Connecting to DCGM"}},
+		{"first collection after reconnecting", n.collected, []string{"READY=1", "STATUS=Collecting"}},
+		{"stopping", n.stopping, []string{"STOPPING=1"}},
+	}
+
+	// the steps depend on each other, and run in order
+	for _, tt := range tests {
+		sent = nil
+		tt.action()
+		if !reflect.DeepEqual(sent, tt.expected) {
+			t.Errorf("%s: expected notifications %q, but got: %q", tt.name, tt.expected, sent)
+		}
+	}
+}
+
+func TestSystemdNotifierSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", socket)
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "")
+
+	n := newSystemdNotifier()
+	if interval := n.watchdogInterval(); interval != 15*time.Second {
+		t.Errorf("expected the watchdog to be pinged every 15s, but got: %s", interval)
+	}
+
+	n.connecting()
+	n.collected()
+
+	var received []string
+	buf := make([]byte, 1024)
+	for i := 0; i < 3; i++ {
+		if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		size, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("expected a notification, but got: %s", err.Error())
+		}
+		received = append(received, string(buf[:size]))
+	}
+
+	if expected := []string{"STATUS=Connecting to DCGM", "READY=1", "STATUS=Collecting"}; !reflect.DeepEqual(received, expected) {
+		t.Errorf("expected notifications %q, but got: %q", expected, received)
+	}
+}
@@ -0,0 +1,137 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+	The agent runs as the unprivileged do-dcgm-exporter user. It only needs TCP access to the nv-hostengine (localhost:5555),
+	the push destination and its listen ports. Some optional features require more permissions:
+	- process attribution reads /proc/<pid>/fd of processes of other users (CAP_SYS_PTRACE), and docker container names from /var/lib/docker (CAP_DAC_READ_SEARCH)
+	- Kubernetes pod mapping connects to the kubelet pod-resources socket, which is only writable by root
+	- HPC job mapping reads the job mapping directory
+	- the push spool is written to the spool directory
+	Missing permissions are reported at startup. The features degrade, but the agent keeps running.
+*/
+
+const (
+	// capDACReadSearch bypasses file read and directory search permission checks
+	capDACReadSearch = 2
+	// capSysPtrace allows reading /proc/<pid>/fd of processes of other users
+	capSysPtrace = 19
+
+	// accessWrite, accessRead and accessExecute are the modes of the access(2) syscall
+	accessExecute = 0x1
+	accessWrite   = 0x2
+	accessRead    = 0x4
+)
+
+// effectiveCapabilities returns the effective capabilities of the agent's process, read from /proc/self/status
+func effectiveCapabilities(root string) (uint64, error) {
+	status, err := os.ReadFile(filepath.Join(root, "proc", "self", "status"))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read process status")
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(status))
+	for scanner.Scan() {
+		value, found := strings.CutPrefix(scanner.Text(), "CapEff:")
+		if !found {
+			continue
+		}
+
+		caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to parse effective capabilities")
+		}
+		return caps, nil
+	}
+
+	return 0, errors.New("effective capabilities not found in process status")
+}
+
+// hasCapability returns whether the capability is in the set of capabilities
+func hasCapability(caps uint64, capability uint) bool {
+	return caps&(1<<capability) != 0
+}
+
+// checkAccess returns an error if the agent can not access path with the mode of the access(2) syscall
+// - a missing path is not an error, as its absence is reported where it is used
+func checkAccess(path string, mode uint32) error {
+	err := syscall.Access(path, mode)
+	if err == nil || errors.Is(err, syscall.ENOENT) {
+		return nil
+	}
+	return err
+}
+
+// checkPermissions returns a description of every permission missing for the enabled features
+func (a GPUMetricsAgent) checkPermissions() []string {
+	var missing []string
+
+	if a.Options.ProcessAttribution {
+		caps, err := effectiveCapabilities(a.root)
+		switch {
+		case err != nil:
+			missing = append(missing, fmt.Sprintf("process attribution: cannot determine capabilities: %s", err))
+		default:
+			if !hasCapability(caps, capSysPtrace) {
+				missing = append(missing, "process attribution: missing CAP_SYS_PTRACE to read /proc/<pid>/fd of processes of other users. Only processes of the agent's user are attributed")
+			}
+			if !hasCapability(caps, capDACReadSearch) {
+				missing = append(missing, "process attribution: missing CAP_DAC_READ_SEARCH to read /var/lib/docker. Docker container names are not resolved")
+			}
+		}
+	}
+
+	if a.Options.Kubernetes {
+		socket := a.DcgmExporterConfig.PodResourcesKubeletSocket
+		if err := checkAccess(socket, accessWrite); err != nil {
+			missing = append(missing, fmt.Sprintf("Kubernetes pod mapping: cannot connect to kubelet pod-resources socket %q: %s. Metrics are exported without pod labels", socket, err))
+		}
+	}
+
+	if a.Options.HPCJobMappingDir != "" {
+		if err := checkAccess(a.Options.HPCJobMappingDir, accessRead|accessExecute); err != nil {
+			missing = append(missing, fmt.Sprintf("HPC job mapping: cannot read job mapping directory %q: %s. Metrics are exported without hpc_job labels", a.Options.HPCJobMappingDir, err))
+		}
+	}
+
+	if a.Options.PushSpoolDir != "" {
+		if err := checkAccess(a.Options.PushSpoolDir, accessWrite|accessExecute); err != nil {
+			missing = append(missing, fmt.Sprintf("push spool: cannot write to spool directory %q: %s. Metrics that could not be pushed on shutdown are dropped", a.Options.PushSpoolDir, err))
+		}
+	}
+
+	return missing
+}
+
+// logPermissions logs the user the agent runs as, and the permissions missing for the enabled features
+func (a GPUMetricsAgent) logPermissions() {
+	name := strconv.Itoa(os.Geteuid())
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+
+	missing := a.checkPermissions()
+	if len(missing) == 0 {
+		logrus.Infof("Running as user %s with all permissions required by the enabled features", name)
+		return
+	}
+
+	for _, m := range missing {
+		logrus.Warnf("Missing permission: %s", m)
+	}
+	logrus.Warnf("Running as user %s with %d missing permissions, see the warnings above", name, len(missing))
+}
@@ -0,0 +1,57 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckPermissions(t *testing.T) {
+	var tests = []struct {
+		name            string
+		capEff          string
+		expectedMissing []string
+	}{
+		{"root", "000001ffffffffff", nil},
+		{"CAP_SYS_PTRACE and CAP_DAC_READ_SEARCH", "0000000000080004", nil},
+		{"CAP_SYS_PTRACE only", "0000000000080000", []string{"CAP_DAC_READ_SEARCH"}},
+		{"no capabilities", "0000000000000000", []string{"CAP_SYS_PTRACE", "CAP_DAC_READ_SEARCH"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(root, "proc", "self"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			status := "Name:\tdo-dcgm-exporte\nCapInh:\t0000000000000000\nCapPrm:\t" + tt.capEff + "\nCapEff:\t" + tt.capEff + "\n"
+			if err := os.WriteFile(filepath.Join(root, "proc", "self", "status"), []byte(status), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			agent := GPUMetricsAgent{
+				Options: Options{ProcessAttribution: true, HPCJobMappingDir: filepath.Join(root, "missing")},
+				root:    root,
+			}
+
+			// a missing job mapping directory is not a missing permission
+			var missing []string
+			for _, m := range agent.checkPermissions() {
+				capability := m[strings.Index(m, "CAP_"):]
+				missing = append(missing, capability[:strings.IndexAny(capability, " ")])
+			}
+			if !reflect.DeepEqual(missing, tt.expectedMissing) {
+				t.Errorf("expected missing capabilities %v, but got: %v", tt.expectedMissing, missing)
+			}
+		})
+	}
+
+	t.Run("unreadable process status", func(t *testing.T) {
+		agent := GPUMetricsAgent{Options: Options{ProcessAttribution: true}, root: t.TempDir()}
+		if missing := agent.checkPermissions(); len(missing) != 1 {
+			t.Errorf("expected the capabilities to be reported as undeterminable, but got: %v", missing)
+		}
+	})
+}
@@ -0,0 +1,286 @@
+package pkg
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+	The dcgm-exporter MetricsPipeline decides on its transformations (kubernetes pod mapping, HPC job mapping) internally,
+	without a way to register additional ones from outside the dcgm-exporter module.
+	Hence, the agent drives the exported dcgm-exporter collectors through its own pipeline, which accepts any dcgmexporter.Transform.
+*/
+
+// switchMetricsFormat, linkMetricsFormat, cpuMetricsFormat and cpuCoreMetricsFormat are the go templates to render plaintext prometheus metrics
+// for the non-GPU entity groups. GPU metrics are rendered with expMetricsFormat.
+// copied from: https://github.com/NVIDIA/dcgm-exporter/blob/402a10fd8bb4a36be7cc5b2c703cf8f1322d1ef0/pkg/dcgmexporter/pipeline.go#L343
+// - reason: not exported
+var switchMetricsFormat = `
+{{- range $counter, $metrics := . -}}
+# HELP {{ $counter.FieldName }} {{ $counter.Help }}
+# TYPE {{ $counter.FieldName }} {{ $counter.PromType }}
+{{- range $metric := $metrics }}
+{{ $counter.FieldName }}{nvswitch="{{ $metric.GPU }}"{{if $metric.Hostname }},Hostname="{{ $metric.Hostname }}"{{end}}
+
+{{- range $k, $v := $metric.Labels -}}
+	,{{ $k }}="{{ $v }}"
+{{- end -}}
+} {{ $metric.Value -}}
+{{- end }}
+{{ end }}`
+
+var linkMetricsFormat = `
+{{- range $counter, $metrics := . -}}
+# HELP {{ $counter.FieldName }} {{ $counter.Help }}
+# TYPE {{ $counter.FieldName }} {{ $counter.PromType }}
+{{- range $metric := $metrics }}
+{{ $counter.FieldName }}{nvlink="{{ $metric.GPU }}",nvswitch="{{ $metric.GPUDevice }}"{{if $metric.Hostname }},Hostname="{{ $metric.Hostname }}"{{end}}
+
+{{- range $k, $v := $metric.Labels -}}
+	,{{ $k }}="{{ $v }}"
+{{- end -}}
+} {{ $metric.Value -}}
+{{- end }}
+{{ end }}`
+
+var cpuMetricsFormat = `
+{{- range $counter, $metrics := . -}}
+# HELP {{ $counter.FieldName }} {{ $counter.Help }}
+# TYPE {{ $counter.FieldName }} {{ $counter.PromType }}
+{{- range $metric := $metrics }}
+{{ $counter.FieldName }}{cpu="{{ $metric.GPU }}"{{if $metric.Hostname }},Hostname="{{ $metric.Hostname }}"{{end}}
+
+{{- range $k, $v := $metric.Labels -}}
+	,{{ $k }}="{{ $v }}"
+{{- end -}}
+} {{ $metric.Value -}}
+{{- end }}
+{{ end }}`
+
+var cpuCoreMetricsFormat = `
+{{- range $counter, $metrics := . -}}
+# HELP {{ $counter.FieldName }} {{ $counter.Help }}
+# TYPE {{ $counter.FieldName }} {{ $counter.PromType }}
+{{- range $metric := $metrics }}
+{{ $counter.FieldName }}{cpucore="{{ $metric.GPU }}",cpu="{{ $metric.GPUDevice }}"{{if $metric.Hostname }},Hostname="{{ $metric.Hostname }}"{{end}}
+
+{{- range $k, $v := $metric.Labels -}}
+	,{{ $k }}="{{ $v }}"
+{{- end -}}
+} {{ $metric.Value -}}
+{{- end }}
+{{ end }}`
+
+// pipelineCollector is a dcgm-exporter collector for a single entity group type, together with the template its metrics are rendered with
+type pipelineCollector struct {
+	entityType dcgm.Field_Entity_Group
+	collector  entityCollector
+	format     *template.Template
+	// cleanup releases the field watches and groups of the collector
+	cleanup func()
+}
+
+// metricsPipeline periodically collects metrics from all pipelineCollectors, applies the transformations to the GPU metrics,
+// and renders everything into the prometheus plaintext format
+type metricsPipeline struct {
+	provider        dcgmProvider
+	config          *dcgmexporter.Config
+	counters        []dcgmexporter.Counter
+	hostname        string
+	formats         map[dcgm.Field_Entity_Group]*template.Template
+	transformations []dcgmexporter.Transform
+	// clock ticks every config.CollectInterval
+	clock clock
+	// failures logs the failing collections rate-limited
+	failures *failureLog
+	// rediscover is called before every collection, and rebuilds the collectors of changed entities (see rediscovery.go). Nil if disabled
+	rediscover func()
+
+	// mtx is held while collecting, so that the collectors are not cleaned up during a collection
+	mtx        sync.Mutex
+	collectors []pipelineCollector
+}
+
+// newMetricsPipeline creates a collector for every entity group type that has fields to watch
+// - adapted from: https://github.com/NVIDIA/dcgm-exporter/blob/402a10fd8bb4a36be7cc5b2c703cf8f1322d1ef0/pkg/dcgmexporter/pipeline.go#L30
+func newMetricsPipeline(provider dcgmProvider,
+	config *dcgmexporter.Config,
+	counters []dcgmexporter.Counter,
+	hostname string,
+	groups entityGroups,
+	transformations []dcgmexporter.Transform,
+) (*metricsPipeline, func(), error) {
+	formats := map[dcgm.Field_Entity_Group]*template.Template{
+		dcgm.FE_GPU:      getExpMetricTemplate(),
+		dcgm.FE_SWITCH:   template.Must(template.New("switchMetrics").Parse(switchMetricsFormat)),
+		dcgm.FE_LINK:     template.Must(template.New("linkMetrics").Parse(linkMetricsFormat)),
+		dcgm.FE_CPU:      template.Must(template.New("cpuMetrics").Parse(cpuMetricsFormat)),
+		dcgm.FE_CPU_CORE: template.Must(template.New("cpuCoreMetrics").Parse(cpuCoreMetricsFormat)),
+	}
+
+	pipeline := &metricsPipeline{
+		provider:        provider,
+		config:          config,
+		counters:        counters,
+		hostname:        hostname,
+		formats:         formats,
+		transformations: transformations,
+		clock:           realClock{},
+		failures:        newFailureLog("collection", nil, failureLogInterval),
+	}
+
+	for _, egt := range dcgmexporter.FieldEntityGroupTypeToMonitor {
+		item, exists := groups[egt]
+		if !exists {
+			continue
+		}
+
+		if c, ok := pipeline.newCollector(egt, item); ok {
+			pipeline.collectors = append(pipeline.collectors, c)
+		}
+	}
+
+	return pipeline, func() {
+		pipeline.mtx.Lock()
+		defer pipeline.mtx.Unlock()
+		for _, c := range pipeline.collectors {
+			c.cleanup()
+		}
+		pipeline.collectors = nil
+	}, nil
+}
+
+// newCollector creates the collector of the entity group type. Logged and false if it cannot be created
+func (m *metricsPipeline) newCollector(egt dcgm.Field_Entity_Group, item dcgmexporter.FieldEntityGroupTypeSystemInfoItem) (pipelineCollector, bool) {
+	collector, cleanup, err := m.provider.NewCollector(m.counters, m.hostname, m.config, item)
+	if err != nil {
+		logrus.Warnf("Cannot create DCGMCollector for %s: %s", egt.String(), err)
+		cleanup()
+		return pipelineCollector{}, false
+	}
+
+	return pipelineCollector{
+		entityType: egt,
+		collector:  collector,
+		format:     m.formats[egt],
+		cleanup:    cleanup,
+	}, true
+}
+
+// rebuild replaces the collector of the entity group type by a collector of the entities of item, or removes it if item is nil
+// - the collectors of the other entity group types are kept
+func (m *metricsPipeline) rebuild(egt dcgm.Field_Entity_Group, item *dcgmexporter.FieldEntityGroupTypeSystemInfoItem) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.collectors = slices.DeleteFunc(m.collectors, func(c pipelineCollector) bool {
+		if c.entityType != egt {
+			return false
+		}
+		c.cleanup()
+		return true
+	})
+
+	if item == nil {
+		return
+	}
+	if c, ok := m.newCollector(egt, *item); ok {
+		m.collectors = append(m.collectors, c)
+	}
+
+	// collect in the order of the dcgm-exporter
+	slices.SortStableFunc(m.collectors, func(a, b pipelineCollector) int {
+		return slices.Index(dcgmexporter.FieldEntityGroupTypeToMonitor, a.entityType) - slices.Index(dcgmexporter.FieldEntityGroupTypeToMonitor, b.entityType)
+	})
+}
+
+// Run collects metrics every config.CollectInterval and sends them to out, until stop is closed
+// - copied from: https://github.com/NVIDIA/dcgm-exporter/blob/402a10fd8bb4a36be7cc5b2c703cf8f1322d1ef0/pkg/dcgmexporter/pipeline.go#L146
+func (m *metricsPipeline) Run(out chan string, stop chan interface{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	logrus.Info("Pipeline starting")
+
+	ticks, stopTicker := m.clock.NewTicker(time.Millisecond * time.Duration(m.config.CollectInterval))
+	defer stopTicker()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticks:
+			if m.rediscover != nil {
+				m.rediscover()
+			}
+
+			o, err := m.run()
+			m.failures.observe(err)
+			if err != nil {
+				/* flush output rather than output stale data */
+				out <- ""
+				continue
+			}
+
+			if len(out) == cap(out) {
+				logrus.Errorf("Channel is full skipping.")
+			} else {
+				out <- o
+			}
+		}
+	}
+}
+
+// run collects and renders the metrics of all collectors once
+func (m *metricsPipeline) run() (string, error) {
+	rendered, err := m.collect()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join(rendered, ""), nil
+}
+
+// collect collects the metrics of all collectors once, rendered separately per collector
+func (m *metricsPipeline) collect() ([]string, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var rendered []string
+
+	for _, c := range m.collectors {
+		metrics, err := c.collector.GetMetrics()
+		if err != nil {
+			return nil, fmt.Errorf("failed to collect %s metrics; err: %w", c.entityType.String(), err)
+		}
+
+		// like the dcgm-exporter, only GPU metrics can be attributed to pods, jobs, or processes
+		if c.entityType == dcgm.FE_GPU {
+			for _, transform := range m.transformations {
+				if err := transform.Process(metrics, c.collector.SystemInfo()); err != nil {
+					return nil, fmt.Errorf("failed to transform metrics for transform '%s'; err: %w", transform.Name(), err)
+				}
+			}
+		}
+
+		if len(metrics) == 0 {
+			continue
+		}
+
+		f, err := dcgmexporter.FormatMetrics(c.format, metrics)
+		if err != nil {
+			return nil, fmt.Errorf("failed to format %s metrics; err: %w", c.entityType.String(), err)
+		}
+
+		rendered = append(rendered, f)
+	}
+
+	return rendered, nil
+}
@@ -0,0 +1,225 @@
+package pkg
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+	The agent talks to DCGM only through a dcgmProvider, so that it can run without GPUs (and without libdcgm.so).
+
+	- dcgmLibProvider: the go-dcgm bindings and the dcgm-exporter collectors, talking to the nv-hostengine
+	- simulatedProvider: a pure-Go fake replaying a scenario file (see simulate.go), used by --simulate and the tests
+
+	The mocking hooks of the dcgm-exporter are unexported, and the fake entities of go-dcgm require a running nv-hostengine.
+	Hence, the boundary is drawn around the dcgm-exporter collectors, instead of around the go-dcgm bindings.
+*/
+
+// dcgmProvider is everything the agent needs from DCGM
+type dcgmProvider interface {
+	topologySource
+
+	// Connect connects to the nv-hostengine and loads the field metadata
+	// - the returned cleanup function is never nil, and must be called even on error
+	Connect(config *dcgmexporter.Config) (func(), error)
+	// FieldMeta returns the metadata (type, entity level) of the field, false if unknown. Requires a connection
+	FieldMeta(field dcgm.Short) (fieldMeta, bool)
+	// GetSupportedMetricGroups returns the profiling metric groups supported by the GPU
+	GetSupportedMetricGroups(gpu uint) ([]dcgm.MetricGroup, error)
+	// GetGpuInstanceHierarchy returns the MIG GPU and compute instances of all GPUs
+	GetGpuInstanceHierarchy() (dcgm.MigHierarchy_v2, error)
+	// GetSystemInfo discovers the entities of the entity group type
+	GetSystemInfo(config *dcgmexporter.Config, entityType dcgm.Field_Entity_Group) (*dcgmexporter.SystemInfo, error)
+	// NewDeviceFields returns the fields of the counters that are watched for the entity group type
+	NewDeviceFields(counters []dcgmexporter.Counter, entityType dcgm.Field_Entity_Group) []dcgm.Short
+	// NewCollector watches the fields of the entity group, and returns a collector reading their latest values
+	NewCollector(counters []dcgmexporter.Counter, hostname string, config *dcgmexporter.Config, item dcgmexporter.FieldEntityGroupTypeSystemInfoItem) (entityCollector, func(), error)
+	// NewXIDCollector returns the collector of DCGM_EXP_XID_ERRORS_COUNT
+	NewXIDCollector(counters []dcgmexporter.Counter, hostname string, config *dcgmexporter.Config, item dcgmexporter.FieldEntityGroupTypeSystemInfoItem) (dcgmexporter.Collector, error)
+	// NewClockEventsCollector returns the collector of DCGM_EXP_CLOCK_EVENTS_COUNT
+	NewClockEventsCollector(counters []dcgmexporter.Counter, hostname string, config *dcgmexporter.Config, item dcgmexporter.FieldEntityGroupTypeSystemInfoItem) (dcgmexporter.Collector, error)
+	// WatchSamples watches the fields of the entities every updateFreq, keeping the samples for maxKeepAge, and returns a sampleWatch reading the samples
+	// - the returned cleanup function is never nil, and must be called even on error
+	WatchSamples(entities []dcgm.GroupEntityPair, fields []dcgm.Short, updateFreq time.Duration, maxKeepAge time.Duration) (sampleWatch, func(), error)
+	// UpdateAllFields forces an update of all watched fields
+	UpdateAllFields() error
+	// RunDiag runs the DCGM diagnostic of the level on the GPUs (all GPUs, if empty)
+	RunDiag(level int, gpus []uint) (dcgm.DiagResults, error)
+	// Introspect returns the memory and CPU usage of the nv-hostengine
+	Introspect() (dcgm.DcgmStatus, error)
+}
+
+// entityCollector collects the metrics of the entities of a single entity group type
+type entityCollector interface {
+	dcgmexporter.Collector
+	// SystemInfo returns the entities the collector collects metrics for
+	SystemInfo() dcgmexporter.SystemInfo
+}
+
+// sampleWatch reads the samples of watched fields
+type sampleWatch interface {
+	// GetValuesSince returns the samples since the time, and the time to read the next samples since
+	GetValuesSince(since time.Time) ([]dcgm.FieldValue_v2, time.Time, error)
+}
+
+// dcgmLibProvider is a dcgmProvider backed by the go-dcgm bindings, talking to the nv-hostengine
+type dcgmLibProvider struct {
+	dcgmTopologySource
+}
+
+func (dcgmLibProvider) Connect(config *dcgmexporter.Config) (func(), error) {
+	cleanup, err := connectToRemoteDCGM(config)
+	if cleanup == nil {
+		cleanup = func() {}
+	}
+	if err != nil {
+		return cleanup, errors.Wrap(err, "failed to connect to remote dcgm (nv-hostengine)")
+	}
+
+	dcgm.FieldsInit()
+
+	return func() {
+		dcgm.FieldsTerm()
+		cleanup()
+	}, nil
+}
+
+func (dcgmLibProvider) FieldMeta(field dcgm.Short) (fieldMeta, bool) {
+	meta := dcgm.FieldGetById(field)
+	name, known := fieldTypeNames[uint(meta.FieldType)]
+	if !known {
+		return fieldMeta{}, false
+	}
+	return fieldMeta{Type: name, EntityLevel: meta.EntityLevel}, true
+}
+
+func (dcgmLibProvider) GetSupportedMetricGroups(gpu uint) ([]dcgm.MetricGroup, error) {
+	return dcgm.GetSupportedMetricGroups(gpu)
+}
+
+func (dcgmLibProvider) GetGpuInstanceHierarchy() (dcgm.MigHierarchy_v2, error) {
+	return dcgm.GetGpuInstanceHierarchy()
+}
+
+func (dcgmLibProvider) GetSystemInfo(config *dcgmexporter.Config, entityType dcgm.Field_Entity_Group) (*dcgmexporter.SystemInfo, error) {
+	return dcgmexporter.GetSystemInfo(config, entityType)
+}
+
+func (dcgmLibProvider) NewDeviceFields(counters []dcgmexporter.Counter, entityType dcgm.Field_Entity_Group) []dcgm.Short {
+	return dcgmexporter.NewDeviceFields(counters, entityType)
+}
+
+func (dcgmLibProvider) NewCollector(counters []dcgmexporter.Counter, hostname string, config *dcgmexporter.Config, item dcgmexporter.FieldEntityGroupTypeSystemInfoItem) (entityCollector, func(), error) {
+	collector, cleanup, err := dcgmexporter.NewDCGMCollector(counters, hostname, config, item)
+	if err != nil {
+		return nil, cleanup, err
+	}
+	return dcgmCollector{collector}, cleanup, nil
+}
+
+func (dcgmLibProvider) NewXIDCollector(counters []dcgmexporter.Counter, hostname string, config *dcgmexporter.Config, item dcgmexporter.FieldEntityGroupTypeSystemInfoItem) (dcgmexporter.Collector, error) {
+	return dcgmexporter.NewXIDCollector(counters, hostname, config, item)
+}
+
+func (dcgmLibProvider) NewClockEventsCollector(counters []dcgmexporter.Counter, hostname string, config *dcgmexporter.Config, item dcgmexporter.FieldEntityGroupTypeSystemInfoItem) (dcgmexporter.Collector, error) {
+	return dcgmexporter.NewClockEventsCollector(counters, hostname, config, item)
+}
+
+func (dcgmLibProvider) WatchSamples(entities []dcgm.GroupEntityPair, fields []dcgm.Short, updateFreq time.Duration, maxKeepAge time.Duration) (sampleWatch, func(), error) {
+	var cleanups []func()
+	cleanup := func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+	}
+
+	name := fmt.Sprintf("do-dcgm-exporter-samples-%d", time.Now().UnixNano())
+	group, err := dcgm.CreateGroup(name)
+	if err != nil {
+		return nil, cleanup, errors.Wrap(err, "failed to create the group of the sampled entities")
+	}
+	cleanups = append(cleanups, func() {
+		if err := dcgm.DestroyGroup(group); err != nil {
+			logrus.Warnf("Failed to destroy the group of the sampled entities: %s", err)
+		}
+	})
+
+	for _, entity := range entities {
+		if err := dcgm.AddEntityToGroup(group, entity.EntityGroupId, entity.EntityId); err != nil {
+			return nil, cleanup, errors.Wrapf(err, "failed to add the %s %d to the group of the sampled entities", entity.EntityGroupId.String(), entity.EntityId)
+		}
+	}
+
+	fieldGroup, err := dcgm.FieldGroupCreate(name, fields)
+	if err != nil {
+		return nil, cleanup, errors.Wrap(err, "failed to create the field group of the sampled fields")
+	}
+	cleanups = append(cleanups, func() {
+		if err := dcgm.FieldGroupDestroy(fieldGroup); err != nil {
+			logrus.Warnf("Failed to destroy the field group of the sampled fields: %s", err)
+		}
+	})
+
+	// no limit of the number of samples, they are limited by their age
+	if err := dcgm.WatchFieldsWithGroupEx(fieldGroup, group, updateFreq.Microseconds(), maxKeepAge.Seconds(), 0); err != nil {
+		return nil, cleanup, errors.Wrap(err, "failed to watch the sampled fields")
+	}
+
+	return dcgmSampleWatch{group: group, fieldGroup: fieldGroup}, cleanup, nil
+}
+
+func (dcgmLibProvider) UpdateAllFields() error {
+	return dcgm.UpdateAllFields()
+}
+
+func (dcgmLibProvider) RunDiag(level int, gpus []uint) (dcgm.DiagResults, error) {
+	group := dcgm.GroupAllGPUs()
+	if len(gpus) > 0 {
+		var err error
+		group, err = dcgm.CreateGroup(fmt.Sprintf("do-dcgm-exporter-diag-%d", time.Now().UnixNano()))
+		if err != nil {
+			return dcgm.DiagResults{}, errors.Wrap(err, "failed to create GPU group for the diagnostic")
+		}
+		defer func() {
+			if err := dcgm.DestroyGroup(group); err != nil {
+				logrus.Warnf("Failed to destroy GPU group of the diagnostic: %s", err)
+			}
+		}()
+
+		for _, gpu := range gpus {
+			if err := dcgm.AddToGroup(group, gpu); err != nil {
+				return dcgm.DiagResults{}, errors.Wrap(err, "failed to add GPU to the diagnostic group")
+			}
+		}
+	}
+
+	return dcgm.RunDiag(dcgm.DiagType(level), group)
+}
+
+func (dcgmLibProvider) Introspect() (dcgm.DcgmStatus, error) {
+	return dcgm.Introspect()
+}
+
+// dcgmCollector is an entityCollector wrapping a dcgm-exporter collector
+type dcgmCollector struct {
+	*dcgmexporter.DCGMCollector
+}
+
+func (c dcgmCollector) SystemInfo() dcgmexporter.SystemInfo {
+	return c.SysInfo
+}
+
+// dcgmSampleWatch is a sampleWatch reading the samples cached by the nv-hostengine
+type dcgmSampleWatch struct {
+	group      dcgm.GroupHandle
+	fieldGroup dcgm.FieldHandle
+}
+
+func (w dcgmSampleWatch) GetValuesSince(since time.Time) ([]dcgm.FieldValue_v2, time.Time, error) {
+	return dcgm.GetValuesSince(w.group, w.fieldGroup, since)
+}
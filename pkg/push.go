@@ -0,0 +1,226 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	By default, the metrics are pushed to the droplet-local DO proxy via plaintext HTTP.
+	Outside of droplets (e.g. bare-metal or other clouds), the metrics can be pushed to any URL, optionally
+	- via TLS with a custom CA, a client certificate (mTLS) and a server name (SNI)
+	- authenticated with a bearer token or basic auth, read from a file that is re-read when it changes, so credentials can be rotated without restarting the agent
+	- with static headers
+*/
+
+// DefaultPushURL is the URL of the DO proxy endpoint receiving GPU metrics
+const DefaultPushURL = "http://169.254.169.254:80/v1/gpu_metrics"
+
+// validatePushOptions validates the push URL and the TLS and auth settings
+func validatePushOptions(options Options) error {
+	u, err := url.Parse(options.PushURL)
+	if err != nil {
+		return errors.Wrap(err, "invalid push URL")
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.Errorf("invalid push URL %q: the scheme must be http or https", options.PushURL)
+	}
+
+	if u.Host == "" {
+		return errors.Errorf("invalid push URL %q: missing host", options.PushURL)
+	}
+
+	tlsConfigured := options.PushCAFile != "" || options.PushClientCertFile != "" || options.PushClientKeyFile != "" || options.PushServerName != ""
+	if tlsConfigured && u.Scheme != "https" {
+		return errors.Errorf("the push TLS settings require a https push URL, but got: %q", options.PushURL)
+	}
+
+	if (options.PushClientCertFile == "") != (options.PushClientKeyFile == "") {
+		return errors.New("the push client certificate and key must be configured together")
+	}
+
+	if options.PushBearerTokenFile != "" && options.PushBasicAuthFile != "" {
+		return errors.New("only one of the push bearer token file and basic auth file can be configured")
+	}
+
+	return nil
+}
+
+// newPushTLSConfig returns the TLS config to push metrics with, or nil to use the default TLS config
+func newPushTLSConfig(options Options) (*tls.Config, error) {
+	if options.PushCAFile == "" && options.PushClientCertFile == "" && options.PushServerName == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		ServerName: options.PushServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if options.PushCAFile != "" {
+		pem, err := os.ReadFile(options.PushCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read push CA file")
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("push CA file %q contains no PEM encoded certificates", options.PushCAFile)
+		}
+	}
+
+	if options.PushClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.PushClientCertFile, options.PushClientKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load push client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// parsePushHeaders parses the static headers in the format "Name: value"
+func parsePushHeaders(headers []string) (http.Header, error) {
+	parsed := http.Header{}
+	for _, header := range headers {
+		name, value, found := strings.Cut(header, ":")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, errors.Errorf("invalid push header %q: expected the format \"Name: value\"", header)
+		}
+		parsed.Add(name, strings.TrimSpace(value))
+	}
+
+	return parsed, nil
+}
+
+// pushAuth adds the static headers and the credentials to the requests pushing metrics
+type pushAuth struct {
+	headers http.Header
+	// bearerToken is the file containing the bearer token. Nil if not configured
+	bearerToken *credentialFile
+	// basicAuth is the file containing the basic auth credentials as "username:password". Nil if not configured
+	basicAuth *credentialFile
+}
+
+// newPushAuth creates a pushAuth, and reads the configured credentials once to fail early
+func newPushAuth(options Options) (*pushAuth, error) {
+	headers, err := parsePushHeaders(options.PushHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := &pushAuth{headers: headers}
+
+	if options.PushBearerTokenFile != "" {
+		auth.bearerToken = &credentialFile{path: options.PushBearerTokenFile}
+		if _, err := auth.bearerToken.read(); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.PushBasicAuthFile != "" {
+		auth.basicAuth = &credentialFile{path: options.PushBasicAuthFile}
+		if _, err := auth.basicAuthorization(); err != nil {
+			return nil, err
+		}
+	}
+
+	return auth, nil
+}
+
+// apply adds the static headers and the credentials to the request
+// - the credentials overwrite a static Authorization header
+func (p *pushAuth) apply(req *http.Request) error {
+	if p == nil {
+		return nil
+	}
+
+	for name, values := range p.headers {
+		req.Header[name] = values
+	}
+
+	if p.bearerToken != nil {
+		token, err := p.bearerToken.read()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	if p.basicAuth != nil {
+		authorization, err := p.basicAuthorization()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", authorization)
+	}
+
+	return nil
+}
+
+// basicAuthorization returns the basic auth Authorization header value of the credentials in the basic auth file
+func (p *pushAuth) basicAuthorization() (string, error) {
+	credentials, err := p.basicAuth.read()
+	if err != nil {
+		return "", err
+	}
+
+	if username, _, found := strings.Cut(credentials, ":"); !found || username == "" {
+		return "", errors.Errorf("basic auth file %q must contain \"username:password\"", p.basicAuth.path)
+	}
+
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)), nil
+}
+
+// credentialFile is a file containing a credential, re-read when its modification time or size changes
+type credentialFile struct {
+	path string
+
+	mtx     sync.Mutex
+	modTime time.Time
+	size    int64
+	value   string
+}
+
+// read returns the credential, trimmed of surrounding whitespace
+func (f *credentialFile) read() (string, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read credential file")
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.value != "" && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.value, nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read credential file")
+	}
+
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", errors.Errorf("credential file %q is empty", f.path)
+	}
+
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	f.value = value
+
+	return value, nil
+}
@@ -0,0 +1,214 @@
+package pkg
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+	The collected metrics are pushed by a single worker, fed by a bounded queue.
+	- a slow or hung push destination delays the following pushes, instead of piling up goroutines and buffers
+	- the batches are pushed in the order they were collected
+	- if the queue is full, the overflow policy decides which batches are dropped
+	- on shutdown, the queued batches are flushed until the grace period expired. The batches that could not be pushed are left for the spool
+*/
+
+const (
+	// PushOverflowDropOldest drops the oldest queued batch to make room for the new batch
+	PushOverflowDropOldest = "drop-oldest"
+	// PushOverflowDropNewest drops the new batch, keeping the queued batches
+	PushOverflowDropNewest = "drop-newest"
+	// PushOverflowLatest drops all queued batches, only keeping the new batch
+	PushOverflowLatest = "latest"
+
+	// defaultPushQueueSize is the number of batches queued, if not configured
+	defaultPushQueueSize = 10
+)
+
+// PushOverflowPolicies are the supported overflow policies of the push queue
+var PushOverflowPolicies = []string{PushOverflowDropOldest, PushOverflowDropNewest, PushOverflowLatest}
+
+// validatePushOverflowPolicy returns an error if the overflow policy is not supported
+func validatePushOverflowPolicy(policy string) error {
+	for _, p := range PushOverflowPolicies {
+		if policy == p {
+			return nil
+		}
+	}
+	return errors.Errorf("unsupported push queue overflow policy %q, must be one of: %s", policy, strings.Join(PushOverflowPolicies, ", "))
+}
+
+// pushQueue is a bounded queue of metric batches, pushed in order by a single worker
+type pushQueue struct {
+	size   int
+	policy string
+
+	mtx     sync.Mutex
+	cond    *sync.Cond
+	batches [][]byte
+	closed  bool
+	// dropped is the number of batches dropped by the overflow policy
+	dropped int
+	// droppedClosed is the number of batches dropped, as they were queued after closing the queue
+	droppedClosed int
+	// flushed is the number of batches pushed after closing the queue
+	flushed int
+	// unflushed are the batches that failed to be pushed, or were not pushed before the flush timeout expired, after closing the queue
+	unflushed [][]byte
+
+	// failures logs the failing pushes rate-limited
+	failures *failureLog
+
+	// ctx is cancelled when the flush timeout expired after closing the queue, aborting the push in flight
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newPushQueue creates a pushQueue holding up to size batches
+func newPushQueue(size int, policy string) *pushQueue {
+	q := &pushQueue{
+		size:     size,
+		policy:   policy,
+		failures: newFailureLog("push", logrus.Fields{logFieldSink: "push"}, failureLogInterval),
+	}
+	q.cond = sync.NewCond(&q.mtx)
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	return q
+}
+
+// enqueue adds the batch to the queue, applying the overflow policy if the queue is full
+func (q *pushQueue) enqueue(batch []byte) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.closed {
+		q.droppedClosed++
+		logrus.WithField(logFieldSink, "push").Debug("Push queue is closed, dropping the batch")
+		return
+	}
+
+	if len(q.batches) >= q.size {
+		switch q.policy {
+		case PushOverflowDropNewest:
+			q.dropped++
+			logrus.WithField(logFieldSink, "push").Warnf("Push queue is full (%d batches), dropping the newest batch", len(q.batches))
+			return
+		case PushOverflowLatest:
+			q.dropped += len(q.batches)
+			logrus.WithField(logFieldSink, "push").Warnf("Push queue is full (%d batches), dropping all queued batches", len(q.batches))
+			q.batches = nil
+		default:
+			q.dropped++
+			logrus.WithField(logFieldSink, "push").Warnf("Push queue is full (%d batches), dropping the oldest batch", len(q.batches))
+			q.batches = q.batches[1:]
+		}
+	}
+
+	q.batches = append(q.batches, batch)
+	q.cond.Signal()
+}
+
+// next returns the oldest batch, waiting for a batch to be queued
+// - returns false once the queue is closed and flushed
+func (q *pushQueue) next() ([]byte, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	for len(q.batches) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+
+	if len(q.batches) == 0 {
+		return nil, false
+	}
+
+	batch := q.batches[0]
+	q.batches = q.batches[1:]
+	return batch, true
+}
+
+// close stops accepting batches, and aborts flushing the queued batches after flushTimeout
+func (q *pushQueue) close(flushTimeout time.Duration) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.cond.Broadcast()
+
+	time.AfterFunc(flushTimeout, q.cancel)
+}
+
+// Run pushes the queued batches in order until the queue is closed and flushed, or the flush timeout expired
+// - after closing the queue, the batches that are not pushed are kept as unflushed
+func (q *pushQueue) Run(push func(ctx context.Context, batch []byte) error, done chan interface{}) {
+	defer close(done)
+	defer q.cancel()
+
+	for {
+		batch, ok := q.next()
+		if !ok {
+			return
+		}
+
+		if q.ctx.Err() != nil {
+			q.mtx.Lock()
+			q.unflushed = append(append(q.unflushed, batch), q.batches...)
+			q.batches = nil
+			q.mtx.Unlock()
+			return
+		}
+
+		err := push(q.ctx, batch)
+
+		q.mtx.Lock()
+		if q.closed {
+			if err != nil {
+				q.unflushed = append(q.unflushed, batch)
+			} else {
+				q.flushed++
+			}
+		}
+		q.mtx.Unlock()
+
+		q.failures.observe(err)
+		if err == nil {
+			logrus.WithField(logFieldSink, "push").Debug("Successfully forwarded metrics")
+		}
+	}
+}
+
+// state returns the size, policy and current depth of the queue, for debugging
+func (q *pushQueue) state() DebugQueueState {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	bytes := 0
+	for _, batch := range q.batches {
+		bytes += len(batch)
+	}
+
+	return DebugQueueState{
+		Size:    q.size,
+		Policy:  q.policy,
+		Depth:   len(q.batches),
+		Bytes:   bytes,
+		Dropped: q.dropped,
+	}
+}
+
+// flushResult returns the number of batches pushed after closing the queue, the batches that were not, the number of batches dropped
+// by the overflow policy, and the number of batches dropped as they were queued after closing the queue
+// - must only be called after Run returned
+func (q *pushQueue) flushResult() (int, [][]byte, int, int) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.flushed, q.unflushed, q.dropped, q.droppedClosed
+}
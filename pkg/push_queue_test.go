@@ -0,0 +1,139 @@
+package pkg
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPushQueueOverflow(t *testing.T) {
+	var tests = []struct {
+		policy          string
+		expectedBatches []string
+		expectedDropped int
+	}{
+		{PushOverflowDropOldest, []string{"3", "4"}, 2},
+		{PushOverflowDropNewest, []string{"1", "2"}, 2},
+		{PushOverflowLatest, []string{"3", "4"}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			q := newPushQueue(2, tt.policy)
+			for _, batch := range []string{"1", "2", "3", "4"} {
+				q.enqueue([]byte(batch))
+			}
+
+			var batches []string
+			for _, batch := range q.batches {
+				batches = append(batches, string(batch))
+			}
+
+			if !reflect.DeepEqual(batches, tt.expectedBatches) {
+				t.Errorf("expected batches %v, but got: %v", tt.expectedBatches, batches)
+			}
+			if q.dropped != tt.expectedDropped {
+				t.Errorf("expected %d dropped batches, but got: %d", tt.expectedDropped, q.dropped)
+			}
+		})
+	}
+
+	if err := validatePushOverflowPolicy("drop-random"); err == nil {
+		t.Errorf("expected an error for an unsupported policy, but got none")
+	}
+}
+
+func TestPushQueueFlush(t *testing.T) {
+	q := newPushQueue(10, PushOverflowDropOldest)
+
+	// block the worker on the first batch, so the others are queued
+	release := make(chan interface{})
+	var mtx sync.Mutex
+	var pushed []string
+	push := func(ctx context.Context, batch []byte) error {
+		if string(batch) == "1" {
+			<-release
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		pushed = append(pushed, string(batch))
+		return nil
+	}
+
+	done := make(chan interface{})
+	go q.Run(push, done)
+
+	for _, batch := range []string{"1", "2", "3"} {
+		q.enqueue([]byte(batch))
+	}
+
+	// the queued batches are pushed in order after closing the queue
+	q.close(10 * time.Second)
+	q.enqueue([]byte("closed"))
+	close(release)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the queue to be flushed")
+	}
+
+	if expected := []string{"1", "2", "3"}; !reflect.DeepEqual(pushed, expected) {
+		t.Errorf("expected pushed batches %v, but got: %v", expected, pushed)
+	}
+
+	// the batch in flight when closing the queue is counted as flushed as well
+	flushed, unflushed, _, droppedClosed := q.flushResult()
+	if flushed != 3 || len(unflushed) != 0 {
+		t.Errorf("expected 3 flushed and no unflushed batches, but got: %d flushed, %d unflushed", flushed, len(unflushed))
+	}
+	// the batch queued after closing the queue is counted as dropped
+	if droppedClosed != 1 {
+		t.Errorf("expected 1 batch dropped after closing the queue, but got: %d", droppedClosed)
+	}
+}
+
+func TestPushQueueFlushTimeout(t *testing.T) {
+	q := newPushQueue(10, PushOverflowDropOldest)
+
+	// the push hangs until it is aborted
+	var pushes int
+	push := func(ctx context.Context, batch []byte) error {
+		pushes++
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	done := make(chan interface{})
+	go q.Run(push, done)
+
+	for _, batch := range []string{"1", "2", "3"} {
+		q.enqueue([]byte(batch))
+	}
+	q.close(50 * time.Millisecond)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the flush to be aborted after the flush timeout")
+	}
+
+	if pushes != 1 {
+		t.Errorf("expected the remaining batches not to be pushed after the aborted push, but got %d pushes", pushes)
+	}
+
+	// the aborted batch and the remaining batches are kept in order, to be persisted
+	flushed, unflushed, _, _ := q.flushResult()
+	var batches []string
+	for _, batch := range unflushed {
+		batches = append(batches, string(batch))
+	}
+	if expected := []string{"1", "2", "3"}; !reflect.DeepEqual(batches, expected) {
+		t.Errorf("expected unflushed batches %v, but got: %v", expected, batches)
+	}
+	if flushed != 0 {
+		t.Errorf("expected no flushed batches, but got: %d", flushed)
+	}
+}
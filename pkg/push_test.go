@@ -0,0 +1,269 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidatePushOptions(t *testing.T) {
+	var tests = []struct {
+		name    string
+		options Options
+		wantErr bool
+	}{
+		{"default", Options{PushURL: DefaultPushURL}, false},
+		{"https with mTLS", Options{PushURL: "https://metrics.example.com/push", PushCAFile: "ca.pem", PushClientCertFile: "cert.pem", PushClientKeyFile: "key.pem", PushServerName: "metrics"}, false},
+		{"bearer token", Options{PushURL: "https://metrics.example.com/push", PushBearerTokenFile: "token"}, false},
+		{"unsupported scheme", Options{PushURL: "ftp://metrics.example.com/push"}, true},
+		{"missing host", Options{PushURL: "http:///push"}, true},
+		{"TLS settings with http", Options{PushURL: "http://metrics.example.com/push", PushCAFile: "ca.pem"}, true},
+		{"client cert without key", Options{PushURL: "https://metrics.example.com/push", PushClientCertFile: "cert.pem"}, true},
+		{"bearer token and basic auth", Options{PushURL: "https://metrics.example.com/push", PushBearerTokenFile: "token", PushBasicAuthFile: "basic"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePushOptions(tt.options)
+			if tt.wantErr && err == nil {
+				t.Errorf("expected an error, but got none")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("expected no error, but got: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestParsePushHeaders(t *testing.T) {
+	headers, err := parsePushHeaders([]string{"X-Scope-OrgID: gpu-fleet", "X-Env:prod", "X-Env: staging"})
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	if got := headers.Get("X-Scope-OrgID"); got != "gpu-fleet" {
+		t.Errorf("expected header value %q, but got: %q", "gpu-fleet", got)
+	}
+	if got := headers.Values("X-Env"); len(got) != 2 || got[0] != "prod" || got[1] != "staging" {
+		t.Errorf("expected header values [prod staging], but got: %v", got)
+	}
+
+	for _, header := range []string{"X-Env", ": value"} {
+		if _, err := parsePushHeaders([]string{header}); err == nil {
+			t.Errorf("expected an error for header %q, but got none", header)
+		}
+	}
+}
+
+func TestPushAuthReload(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	basicFile := filepath.Join(dir, "basic")
+	writeFile := func(path, content string, modTime time.Time) {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+
+	authorization := func(auth *pushAuth) string {
+		req, _ := http.NewRequest("POST", "http://localhost/push", nil)
+		if err := auth.apply(req); err != nil {
+			t.Fatalf("expected no error, but got: %s", err.Error())
+		}
+		return req.Header.Get("Authorization")
+	}
+
+	t.Run("bearer token", func(t *testing.T) {
+		writeFile(tokenFile, "first\n", start)
+		auth, err := newPushAuth(Options{PushBearerTokenFile: tokenFile, PushHeaders: []string{"Authorization: static", "X-Env: prod"}})
+		if err != nil {
+			t.Fatalf("expected no error, but got: %s", err.Error())
+		}
+		if got := authorization(auth); got != "Bearer first" {
+			t.Errorf("expected %q, but got: %q", "Bearer first", got)
+		}
+
+		writeFile(tokenFile, "second", start.Add(time.Minute))
+		if got := authorization(auth); got != "Bearer second" {
+			t.Errorf("expected the rotated token %q, but got: %q", "Bearer second", got)
+		}
+
+		// an unreadable token fails the push, instead of pushing without credentials
+		writeFile(tokenFile, "", start.Add(2*time.Minute))
+		req, _ := http.NewRequest("POST", "http://localhost/push", nil)
+		if err := auth.apply(req); err == nil {
+			t.Errorf("expected an error for an empty token file, but got none")
+		}
+	})
+
+	t.Run("basic auth", func(t *testing.T) {
+		writeFile(basicFile, "agent:secret", start)
+		auth, err := newPushAuth(Options{PushBasicAuthFile: basicFile})
+		if err != nil {
+			t.Fatalf("expected no error, but got: %s", err.Error())
+		}
+		if got := authorization(auth); got != "Basic YWdlbnQ6c2VjcmV0" {
+			t.Errorf("expected %q, but got: %q", "Basic YWdlbnQ6c2VjcmV0", got)
+		}
+
+		writeFile(basicFile, "no-password-separator", start)
+		if _, err := newPushAuth(Options{PushBasicAuthFile: basicFile}); err == nil {
+			t.Errorf("expected an error for malformed basic auth credentials, but got none")
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		if _, err := newPushAuth(Options{PushBearerTokenFile: filepath.Join(dir, "missing")}); err == nil {
+			t.Errorf("expected an error for a missing token file, but got none")
+		}
+	})
+}
+
+// writeTestCertificate writes a PEM encoded certificate and key signed by parent (self-signed if nil) to dir
+func writeTestCertificate(t *testing.T, dir, name string, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestForwardMetricsToProxyMTLS(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+
+	ca := writeTestCertificate(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil)
+	server := writeTestCertificate(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "metrics.internal"},
+		DNSNames:     []string{"metrics.internal"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	writeTestCertificate(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "gpu-droplet"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+
+	type push struct {
+		clientCN string
+		header   http.Header
+	}
+	pushes := make(chan push, 1)
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushes <- push{clientCN: r.TLS.PeerCertificates[0].Subject.CommonName, header: r.Header}
+	}))
+	proxy.TLS = &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	proxy.StartTLS()
+	t.Cleanup(proxy.Close)
+
+	options := Options{
+		// the server certificate is only valid for metrics.internal, not for the address of the test server
+		PushURL:             proxy.URL + "/v1/gpu_metrics",
+		PushCAFile:          filepath.Join(dir, "ca.pem"),
+		PushClientCertFile:  filepath.Join(dir, "client.pem"),
+		PushClientKeyFile:   filepath.Join(dir, "client-key.pem"),
+		PushServerName:      "metrics.internal",
+		PushBearerTokenFile: tokenFile,
+		PushHeaders:         []string{"X-Scope-OrgID: gpu-fleet"},
+	}
+
+	agent, err := NewGPUMetricsAgent(options)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	if err := agent.forwardMetricsToProxy(context.Background(), bytes.NewBufferString("DCGM_FI_DEV_GPU_TEMP 42\n")); err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	got := <-pushes
+	if got.clientCN != "gpu-droplet" {
+		t.Errorf("expected the client certificate %q, but got: %q", "gpu-droplet", got.clientCN)
+	}
+	if auth := got.header.Get("Authorization"); auth != "Bearer secret" {
+		t.Errorf("expected Authorization %q, but got: %q", "Bearer secret", auth)
+	}
+	if orgID := got.header.Get("X-Scope-OrgID"); orgID != "gpu-fleet" {
+		t.Errorf("expected X-Scope-OrgID %q, but got: %q", "gpu-fleet", orgID)
+	}
+
+	// without the server name, the server certificate does not match the address of the test server
+	options.PushServerName = ""
+	agent, err = NewGPUMetricsAgent(options)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	if err := agent.forwardMetricsToProxy(context.Background(), bytes.NewBufferString("DCGM_FI_DEV_GPU_TEMP 42\n")); err == nil {
+		t.Errorf("expected a TLS verification error without the server name, but got none")
+	}
+}
@@ -0,0 +1,315 @@
+package pkg
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+	The entities (GPUs, NVSwitches, NVLinks, CPUs) are discovered once the collection is set up, like the dcgm-exporter does at startup.
+	The discoveryReconciler re-discovers them every --rediscovery-interval before a collection of the pipeline, to notice at runtime:
+	- GPUs hot-added or removed via passthrough, or falling off the bus (XID 79)
+	- a changed MIG layout (GPU or compute instances created or destroyed)
+	- NVSwitch links the fabric manager brings up late
+	Only the collectors of the entity group types whose entities changed are rebuilt, without reconnecting to DCGM:
+	- the pipeline collector of the entity group type
+	- for GPUs, also the XID errors and clock events collectors, and the GPU topology is read again
+	The GPUs seen since the start are exported as do_dcgm_gpu_present (0 once lost), and logged with the event field when lost or added.
+*/
+
+const (
+	// DefaultRediscoveryInterval is how often the entities are re-discovered by default
+	DefaultRediscoveryInterval = time.Minute
+
+	// events of the GPU presence, logged in the logFieldEvent field
+	eventGPULost  = "gpu_lost"
+	eventGPUAdded = "gpu_added"
+)
+
+// gpuPresentCounter is the counter of the GPU presence metric
+// - labeled like the GPU metrics (gpu, UUID, pci_bus_id, device, modelName), to join them
+// - added by the agent, hence, like the dcgm-exporter added counters, use ids outside the range of dcgm fields
+var gpuPresentCounter = dcgmexporter.Counter{
+	FieldID:   dcgm.Short(9106),
+	FieldName: "do_dcgm_gpu_present",
+	PromType:  "gauge",
+	Help:      "1 if the GPU is discovered, 0 if it was lost since the agent started (e.g. fell off the bus or was removed).",
+}
+
+// knownGPU is a GPU discovered since the agent started
+type knownGPU struct {
+	device  dcgm.Device
+	present bool
+}
+
+// discoveryReconciler re-discovers the entities periodically, and rebuilds the collectors of the entity group types whose entities changed
+// - a dcgmexporter.Collector exporting the presence of the GPUs
+type discoveryReconciler struct {
+	provider dcgmProvider
+	config   *dcgmexporter.Config
+	hostname string
+	interval time.Duration
+	now      func() time.Time
+	// selection selects the watched GPUs, NVSwitches and NVLinks. All if nil
+	selection *deviceSelection
+
+	pipeline     *metricsPipeline
+	gpuCollector *transformingCollector
+	topology     *topologyCollector
+	// newGPURegistry creates the registry of the XID errors and clock events collectors of the discovered GPUs
+	newGPURegistry func(groups entityGroups) (*dcgmexporter.Registry, error)
+
+	// deviceFields are the watched fields of the entity group types with fields to watch
+	deviceFields map[dcgm.Field_Entity_Group][]dcgm.Short
+	// entities describe the entities the collectors were built for, by entity group type. Empty if none
+	entities map[dcgm.Field_Entity_Group]string
+	// migLayout is whether the MIG layout is compared, i.e. the GPU instance hierarchy is available
+	migLayout bool
+	lastRun   time.Time
+
+	// mtx guards the GPUs, read when the registry is gathered
+	mtx  sync.Mutex
+	gpus []*knownGPU
+}
+
+// newDiscoveryReconciler creates a discoveryReconciler for the entities the collection was set up with
+func (a GPUMetricsAgent) newDiscoveryReconciler(cs *dcgmexporter.CounterSet, groups entityGroups, hostname string, pipeline *metricsPipeline, gpuCollector *transformingCollector, topology *topologyCollector) *discoveryReconciler {
+	r := &discoveryReconciler{
+		provider:     a.provider,
+		config:       a.DcgmExporterConfig,
+		hostname:     hostname,
+		interval:     a.Options.RediscoveryInterval,
+		now:          a.clock.Now,
+		selection:    a.selection,
+		pipeline:     pipeline,
+		gpuCollector: gpuCollector,
+		topology:     topology,
+		newGPURegistry: func(groups entityGroups) (*dcgmexporter.Registry, error) {
+			return a.newGPURegistry(cs, groups, hostname)
+		},
+		deviceFields: map[dcgm.Field_Entity_Group][]dcgm.Short{},
+		entities:     map[dcgm.Field_Entity_Group]string{},
+	}
+	r.lastRun = r.now()
+
+	hierarchy, err := r.provider.GetGpuInstanceHierarchy()
+	if err != nil {
+		logrus.Debugf("Not re-discovering the MIG layout: %s", err)
+	}
+	r.migLayout = err == nil
+
+	for _, egt := range dcgmexporter.FieldEntityGroupTypeToMonitor {
+		deviceFields := r.provider.NewDeviceFields(cs.DCGMCounters, egt)
+		if !dcgmexporter.ShouldMonitorDeviceType(deviceFields, egt) {
+			continue
+		}
+		r.deviceFields[egt] = deviceFields
+
+		item, exists := groups[egt]
+		if !exists {
+			continue
+		}
+		entities := describeEntities(item.SystemInfo)
+		if entities != "" && egt == dcgm.FE_GPU && r.migLayout {
+			entities += "; MIG: " + migLayout(hierarchy)
+		}
+		r.entities[egt] = entities
+	}
+
+	r.observeGPUs(false)
+
+	return r
+}
+
+// reconcile re-discovers the entities if due, and rebuilds the collectors of the entity group types whose entities changed
+// - called by the pipeline before collecting, hence never concurrently with a collection of the pipeline
+func (r *discoveryReconciler) reconcile() {
+	now := r.now()
+	if now.Sub(r.lastRun) < r.interval {
+		return
+	}
+	r.lastRun = now
+
+	r.observeGPUs(true)
+
+	for _, egt := range dcgmexporter.FieldEntityGroupTypeToMonitor {
+		deviceFields, watched := r.deviceFields[egt]
+		if !watched {
+			continue
+		}
+
+		item, entities, err := r.discover(egt, deviceFields)
+		if err != nil {
+			logrus.Debugf("Failed to re-discover the %s entities: %s", egt.String(), err)
+			continue
+		}
+		if entities == r.entities[egt] {
+			continue
+		}
+
+		logrus.Infof("%s entities changed from [%s] to [%s], rebuilding the %s collectors", egt.String(), r.entities[egt], entities, egt.String())
+		r.entities[egt] = entities
+		r.pipeline.rebuild(egt, item)
+		if egt == dcgm.FE_GPU {
+			r.rebuildGPUCollectors(item)
+		}
+	}
+}
+
+// discover discovers the entities of the entity group type, and describes them. The item is nil if there are none
+// - a failure to discover the GPUs is an error, as the GPUs would be considered lost. Other entity group types have no entities on failure, e.g. "no switches to monitor"
+func (r *discoveryReconciler) discover(egt dcgm.Field_Entity_Group, deviceFields []dcgm.Short) (*dcgmexporter.FieldEntityGroupTypeSystemInfoItem, string, error) {
+	sysInfo, err := r.provider.GetSystemInfo(r.config, egt)
+	if err != nil {
+		if egt == dcgm.FE_GPU {
+			return nil, "", err
+		}
+		return nil, "", nil
+	}
+
+	// the selectors are resolved again, e.g. a GPU selected by UUID may have a new index
+	r.selection.apply(sysInfo, nil)
+	entities := describeEntities(*sysInfo)
+	if entities == "" {
+		return nil, "", nil
+	}
+
+	if egt == dcgm.FE_GPU && r.migLayout {
+		hierarchy, err := r.provider.GetGpuInstanceHierarchy()
+		if err != nil {
+			return nil, "", err
+		}
+		entities += "; MIG: " + migLayout(hierarchy)
+	}
+
+	return &dcgmexporter.FieldEntityGroupTypeSystemInfoItem{
+		SystemInfo:   *sysInfo,
+		DeviceFields: deviceFields,
+	}, entities, nil
+}
+
+// rebuildGPUCollectors replaces the XID errors and clock events collectors by collectors of the discovered GPUs, and reads the topology again
+func (r *discoveryReconciler) rebuildGPUCollectors(item *dcgmexporter.FieldEntityGroupTypeSystemInfoItem) {
+	groups := entityGroups{}
+	var sysInfo dcgmexporter.SystemInfo
+	if item != nil {
+		groups[dcgm.FE_GPU] = *item
+		sysInfo = item.SystemInfo
+	}
+
+	registry, err := r.newGPURegistry(groups)
+	if err != nil {
+		logrus.Errorf("Failed to rebuild the GPU collectors of the registry: %s", err)
+		registry = dcgmexporter.NewRegistry()
+	}
+	r.gpuCollector.replace(registry, sysInfo)
+	r.topology.reset()
+}
+
+// observeGPUs records the presence of the selected GPUs, and logs the GPUs lost or added, if log is set
+// - a GPU whose device info can't be read (e.g. fell off the bus) is not present
+func (r *discoveryReconciler) observeGPUs(log bool) {
+	gpus, err := r.provider.GetSupportedDevices()
+	if err != nil {
+		logrus.Debugf("Failed to re-discover the supported GPUs: %s", err)
+		return
+	}
+
+	var discovered []dcgm.Device
+	for _, gpu := range gpus {
+		device, err := r.provider.GetDeviceInfo(gpu)
+		if err != nil {
+			logrus.WithField(logFieldGPU, gpu).Debugf("Failed to get device info of GPU %d: %s", gpu, err)
+			continue
+		}
+		if !r.selection.selectsGPU(device) {
+			continue
+		}
+		discovered = append(discovered, device)
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for _, known := range r.gpus {
+		i := slices.IndexFunc(discovered, func(device dcgm.Device) bool { return device.UUID == known.device.UUID })
+		present := i >= 0
+		if present {
+			known.device = discovered[i]
+		}
+
+		if log && known.present && !present {
+			logrus.WithFields(logrus.Fields{logFieldEvent: eventGPULost, logFieldGPU: known.device.GPU}).Errorf("GPU %d (%s) is lost, it is not discovered anymore", known.device.GPU, known.device.UUID)
+		}
+		if log && !known.present && present {
+			logrus.WithFields(logrus.Fields{logFieldEvent: eventGPUAdded, logFieldGPU: known.device.GPU}).Infof("GPU %d (%s) is discovered again", known.device.GPU, known.device.UUID)
+		}
+		known.present = present
+	}
+
+	for _, device := range discovered {
+		if slices.ContainsFunc(r.gpus, func(known *knownGPU) bool { return known.device.UUID == device.UUID }) {
+			continue
+		}
+		if log {
+			logrus.WithFields(logrus.Fields{logFieldEvent: eventGPUAdded, logFieldGPU: device.GPU}).Infof("GPU %d (%s) was added", device.GPU, device.UUID)
+		}
+		r.gpus = append(r.gpus, &knownGPU{device: device, present: true})
+	}
+}
+
+// GetMetrics returns do_dcgm_gpu_present of the GPUs discovered since the agent started
+func (r *discoveryReconciler) GetMetrics() (dcgmexporter.MetricsByCounter, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	metrics := dcgmexporter.MetricsByCounter{}
+	for _, known := range r.gpus {
+		value := "0"
+		if known.present {
+			value = "1"
+		}
+		metrics[gpuPresentCounter] = append(metrics[gpuPresentCounter], newGPUMetric(gpuPresentCounter, known.device, r.hostname, value, nil))
+	}
+	return metrics, nil
+}
+
+func (r *discoveryReconciler) Cleanup() {}
+
+// describeEntities describes the entities of the system info, independent of their order. Empty if there are none
+// - GPUs by UUID with their MIG instances, NVSwitches with the state of their links, and CPUs with their cores
+func describeEntities(sysInfo dcgmexporter.SystemInfo) string {
+	var entities []string
+
+	for i := uint(0); i < sysInfo.GPUCount && i < uint(len(sysInfo.GPUs)); i++ {
+		gpu := sysInfo.GPUs[i]
+		entities = append(entities, fmt.Sprintf("GPU %d %s", gpu.DeviceInfo.GPU, gpu.DeviceInfo.UUID))
+		for _, instance := range gpu.GPUInstances {
+			entities = append(entities, fmt.Sprintf("GPU %d instance %d %s", gpu.DeviceInfo.GPU, instance.EntityId, instance.ProfileName))
+			for _, computeInstance := range instance.ComputeInstances {
+				entities = append(entities, fmt.Sprintf("GPU %d instance %d compute instance %d", gpu.DeviceInfo.GPU, instance.EntityId, computeInstance.EntityId))
+			}
+		}
+	}
+
+	for _, sw := range sysInfo.Switches {
+		entities = append(entities, fmt.Sprintf("NVSwitch %d", sw.EntityId))
+		for _, link := range sw.NvLinks {
+			entities = append(entities, fmt.Sprintf("NVSwitch %d link %d %s", sw.EntityId, link.Index, linkStateNames[link.State]))
+		}
+	}
+
+	for _, cpu := range sysInfo.CPUs {
+		entities = append(entities, fmt.Sprintf("CPU %d cores %v", cpu.EntityId, cpu.Cores))
+	}
+
+	slices.Sort(entities)
+	return strings.Join(entities, ", ")
+}
@@ -0,0 +1,182 @@
+package pkg
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	httpclient "github.com/digitalocean/do-dcgm-exporter/pkg/client"
+	"github.com/sirupsen/logrus"
+)
+
+func TestDiscoveryReconcilerGPUPresence(t *testing.T) {
+	hook := recordLogs(t)
+
+	provider, err := loadSimulatedProvider(testScenario)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	r := &discoveryReconciler{provider: provider, hostname: "gpu-droplet"}
+
+	presence := func() map[string]string {
+		metrics, err := r.GetMetrics()
+		if err != nil {
+			t.Fatalf("expected no error, but got: %s", err.Error())
+		}
+		got := map[string]string{}
+		for _, metric := range metrics[gpuPresentCounter] {
+			got[metric.GPUUUID] = metric.Value
+		}
+		return got
+	}
+
+	var tests = []struct {
+		name          string
+		lost          bool
+		expected      string
+		expectedEvent string
+	}{
+		{"present", false, "1", ""},
+		{"fell off the bus", true, "0", eventGPULost},
+		{"still lost", true, "0", ""},
+		{"back", false, "1", eventGPUAdded},
+	}
+
+	r.observeGPUs(false)
+	uuid := provider.scenario.GPUs[0].UUID
+
+	// the steps depend on each other, and run in order
+	for _, tt := range tests {
+		hook.entries = nil
+		if err := provider.setGPULost(0, tt.lost); err != nil {
+			t.Fatalf("expected no error, but got: %s", err.Error())
+		}
+		r.observeGPUs(true)
+
+		got := presence()
+		if len(got) != 2 || got[uuid] != tt.expected {
+			t.Errorf("%s: expected GPU %s present %s of 2 GPUs, but got: %v", tt.name, uuid, tt.expected, got)
+		}
+
+		var events []string
+		for _, entry := range hook.entries {
+			if event, exists := entry.Data[logFieldEvent]; exists {
+				events = append(events, event.(string))
+			}
+		}
+		if tt.expectedEvent == "" && len(events) != 0 {
+			t.Errorf("%s: expected no event, but got: %v", tt.name, events)
+		}
+		if tt.expectedEvent != "" && (len(events) != 1 || events[0] != tt.expectedEvent) {
+			t.Errorf("%s: expected the event %s, but got: %v", tt.name, tt.expectedEvent, events)
+		}
+		if tt.expectedEvent == eventGPULost && hook.entries[0].Level != logrus.ErrorLevel {
+			t.Errorf("%s: expected the lost GPU to be logged as error, but got: %s", tt.name, hook.entries[0].Level)
+		}
+	}
+}
+
+func TestRunRediscovery(t *testing.T) {
+	t.Setenv("NODE_NAME", "gpu-droplet")
+
+	pushes := make(chan string, 10)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		pushes <- string(body)
+	}))
+	t.Cleanup(proxy.Close)
+
+	agent, err := NewGPUMetricsAgent(Options{SimulateScenario: testScenario, RediscoveryInterval: 20 * time.Second})
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	simulated := agent.provider.(*simulatedProvider)
+
+	clock := newTickingClock()
+	provider := &recordingProvider{dcgmProvider: agent.provider}
+	agent.ProxyClient = httpclient.NewHTTP(5 * time.Second)
+	agent.proxyURL = proxy.URL + "/v1/gpu_metrics"
+	agent.clock = clock
+	agent.signals = make(chan os.Signal, 1)
+	agent.provider = provider
+	agent.root = t.TempDir()
+	agent.Options.Addresses = []string{freeAddress(t)}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- agent.Run()
+	}()
+
+	// collect returns the metrics pushed after the next tick, which re-discovers the entities before collecting
+	collect := func() string {
+		clock.tick(t, 20*time.Second)
+		select {
+		case push := <-pushes:
+			return push
+		case err := <-done:
+			t.Fatalf("expected the agent to keep running, but it returned: %v", err)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("expected metrics to be pushed")
+		}
+		return ""
+	}
+
+	var tests = []struct {
+		name        string
+		change      func() error
+		expected    []string
+		notExpected []string
+	}{
+		{"discovered at start", func() error { return nil },
+			[]string{`do_dcgm_gpu_present{gpu="0"`, `do_dcgm_gpu_present{gpu="1"`, `GPU_I_PROFILE="3g.40gb"`, `nvlink="1",nvswitch="nvswitch0"`},
+			[]string{`nvlink="2",nvswitch="nvswitch0"`}},
+		{"MIG reconfigured", func() error {
+			return simulated.reconfigureMIG(1, []scenarioGPUInstance{{Profile: "7g.80gb", ComputeInstances: 1}})
+		},
+			[]string{`DCGM_FI_DEV_GPU_TEMP{gpu="1",UUID="GPU-7c4b2a1d-8e3f-4a9b-b0c1-3d2e1f0a9b81",pci_bus_id="00000000:2A:00.0",device="nvidia1",modelName="NVIDIA H100 80GB HBM3",GPU_I_PROFILE="7g.80gb"`,
+				`DCGM_EXP_XID_ERRORS_COUNT{gpu="1",UUID="GPU-7c4b2a1d-8e3f-4a9b-b0c1-3d2e1f0a9b81",pci_bus_id="00000000:2A:00.0",device="nvidia1",modelName="NVIDIA H100 80GB HBM3",GPU_I_PROFILE="7g.80gb"`},
+			[]string{`GPU_I_PROFILE="3g.40gb"`}},
+		{"GPU fell off the bus", func() error { return simulated.setGPULost(0, true) },
+			[]string{`do_dcgm_gpu_present{gpu="0",UUID="GPU-5a3e1f0c-6d2b-4b8e-9f3a-2c1d0e9b8a70"`, `"} 0`},
+			[]string{`DCGM_FI_DEV_GPU_TEMP{gpu="0"`, `DCGM_EXP_XID_ERRORS_COUNT{gpu="0"`, `do_dcgm_gpu_nvlinks_active{gpu="0"`}},
+		{"NVSwitch links up late", func() error { return simulated.setSwitchLinks(0, 4) },
+			[]string{`nvlink="3",nvswitch="nvswitch0"`, `DCGM_FI_DEV_GPU_TEMP{gpu="1"`},
+			nil},
+	}
+
+	// the steps depend on each other, and run in order
+	for _, tt := range tests {
+		if err := tt.change(); err != nil {
+			t.Fatalf("%s: expected no error, but got: %s", tt.name, err.Error())
+		}
+		push := collect()
+		for _, expected := range tt.expected {
+			if !strings.Contains(push, expected) {
+				t.Errorf("%s: expected the push to contain %s, but got:\n%s", tt.name, expected, push)
+			}
+		}
+		for _, notExpected := range tt.notExpected {
+			if strings.Contains(push, notExpected) {
+				t.Errorf("%s: expected the push not to contain %s, but got:\n%s", tt.name, notExpected, push)
+			}
+		}
+	}
+
+	agent.signals <- syscall.SIGTERM
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected the agent to terminate without error, but got: %s", err.Error())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the agent to terminate on SIGTERM")
+	}
+
+	// only the affected collectors are rebuilt, without reconnecting to DCGM
+	provider.waitForEvents(t, "connect", "disconnect")
+}
@@ -0,0 +1,305 @@
+package pkg
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+	Every collection exports the latest value of a field, hence a spike or a drop shorter than the collection interval (20s) is invisible.
+	The sampleStatsCollector watches the fields configured with --sample-stats at a fast DCGM update frequency (--sample-interval),
+	reads every sample DCGM cached since the last collection (dcgmGetValuesSince), and exports statistics of the samples of every GPU:
+	- <field>_min, <field>_max and <field>_avg
+	- <field>_p<quantile> (e.g. DCGM_FI_DEV_POWER_USAGE_p95), interpolated linearly between the closest samples
+	The fields are configured with the statistics to export, e.g. DCGM_FI_DEV_POWER_USAGE=max,avg,p95. Defaults to min, max and avg.
+	Consecutive collections read consecutive windows, as DCGM returns the timestamp to read the next samples since.
+	The GPUs are watched, not their MIG instances, hence only fields supported on the GPU level are sampled with MIG enabled.
+*/
+
+const (
+	// DefaultSampleInterval is how often the sampled fields are updated by DCGM by default
+	DefaultSampleInterval = time.Second
+
+	// minSampleInterval is the fastest update frequency of the sampled fields
+	minSampleInterval = 100 * time.Millisecond
+)
+
+// defaultSampleStats are the statistics exported for a sampled field without statistics
+var defaultSampleStats = []sampleStat{{name: "min"}, {name: "max"}, {name: "avg"}}
+
+// sampleStat is a statistic of the samples of a field in a collection window
+type sampleStat struct {
+	// name is the suffix of the metric, e.g. p95
+	name string
+	// quantile is the quantile of a quantile statistic in (0, 1], e.g. 0.95 for p95. 0 for min, max and avg
+	quantile float64
+}
+
+// describe describes the statistic in the help of the metric
+func (s sampleStat) describe() string {
+	switch s.name {
+	case "min":
+		return "Minimum"
+	case "max":
+		return "Maximum"
+	case "avg":
+		return "Average"
+	}
+	return fmt.Sprintf("%s quantile", strconv.FormatFloat(s.quantile, 'f', -1, 64))
+}
+
+// parseSampleStat parses min, max, avg, or p<quantile> (e.g. p95, p99.9)
+func parseSampleStat(name string) (sampleStat, error) {
+	switch name {
+	case "min", "max", "avg":
+		return sampleStat{name: name}, nil
+	}
+
+	if percentile, found := strings.CutPrefix(name, "p"); found {
+		p, err := strconv.ParseFloat(percentile, 64)
+		if err == nil && p > 0 && p <= 100 {
+			return sampleStat{name: name, quantile: p / 100}, nil
+		}
+	}
+
+	return sampleStat{}, errors.Errorf("unknown statistic %q: expected min, max, avg or p<percentile> (e.g. p95)", name)
+}
+
+// sampledField is a field whose samples are aggregated into statistics
+type sampledField struct {
+	field Field
+	stats []sampleStat
+}
+
+// parseSampledFields parses the sampled fields, each <field name>[=<statistic>,...]
+// - the fields must be fields of the embedded field table
+// - whether they are numeric GPU fields is only known to DCGM, hence, checked by newSampleStatsCollector
+func parseSampledFields(specs []string) ([]sampledField, error) {
+	fields, err := loadFields()
+	if err != nil {
+		return nil, err
+	}
+
+	var sampled []sampledField
+	for _, spec := range specs {
+		name, statNames, hasStats := strings.Cut(strings.TrimSpace(spec), "=")
+
+		i := slices.IndexFunc(fields, func(f Field) bool { return f.Name == name })
+		if i < 0 {
+			return nil, errors.Errorf("invalid sampled field %q: unknown field %q", spec, name)
+		}
+		field := fields[i]
+		if slices.ContainsFunc(sampled, func(s sampledField) bool { return s.field.ID == field.ID }) {
+			return nil, errors.Errorf("invalid sampled field %q: %s is sampled twice", spec, name)
+		}
+
+		stats := defaultSampleStats
+		if hasStats {
+			stats = nil
+			for _, statName := range strings.Split(statNames, ",") {
+				stat, err := parseSampleStat(strings.TrimSpace(statName))
+				if err != nil {
+					return nil, errors.Wrapf(err, "invalid sampled field %q", spec)
+				}
+				if !slices.Contains(stats, stat) {
+					stats = append(stats, stat)
+				}
+			}
+		}
+
+		sampled = append(sampled, sampledField{field: field, stats: stats})
+	}
+
+	return sampled, nil
+}
+
+// computeSampleStats returns the statistics of the samples, in the order of the statistics
+// - the samples must not be empty
+func computeSampleStats(samples []float64, stats []sampleStat) []float64 {
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+
+	var sum float64
+	for _, sample := range sorted {
+		sum += sample
+	}
+
+	values := make([]float64, 0, len(stats))
+	for _, stat := range stats {
+		switch stat.name {
+		case "min":
+			values = append(values, sorted[0])
+		case "max":
+			values = append(values, sorted[len(sorted)-1])
+		case "avg":
+			values = append(values, sum/float64(len(sorted)))
+		default:
+			values = append(values, quantile(sorted, stat.quantile))
+		}
+	}
+	return values
+}
+
+// quantile returns the quantile of the sorted samples, interpolated linearly between the closest ranks
+// - like quantile_over_time of Prometheus: the rank of the quantile q of n samples is q*(n-1)
+func quantile(sorted []float64, q float64) float64 {
+	rank := q * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	weight := rank - float64(lower)
+	return sorted[lower]*(1-weight) + sorted[upper]*weight
+}
+
+// sampleValue returns the value of the sample, false if it's blank (e.g. not supported)
+func sampleValue(fv dcgm.FieldValue_v2) (float64, bool) {
+	if fv.Status != 0 {
+		return 0, false
+	}
+
+	switch fv.FieldType {
+	case dcgm.DCGM_FT_DOUBLE:
+		v := fv.Float64()
+		return v, v < dcgm.DCGM_FT_FP64_BLANK
+	case dcgm.DCGM_FT_INT64:
+		v := fv.Int64()
+		if v >= dcgm.DCGM_FT_INT64_BLANK || (v >= dcgm.DCGM_FT_INT32_BLANK && v <= dcgm.DCGM_FT_INT32_NOT_PERMISSIONED) {
+			return 0, false
+		}
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// sampleStatsCollector is a dcgmexporter.Collector exporting statistics of the samples of the sampled fields, per GPU and collection window
+type sampleStatsCollector struct {
+	fields   []sampledField
+	hostname string
+	// counters are the counters of the statistics, by field id and statistic
+	counters map[dcgm.Short][]dcgmexporter.Counter
+	devices  map[uint]dcgm.Device
+
+	watch   sampleWatch
+	cleanup func()
+
+	mtx sync.Mutex
+	// since is the time the samples of the next collection window are read since
+	since time.Time
+}
+
+// newSampleStatsCollector watches the sampled fields of the discovered GPUs every interval, and reads their samples since now
+// - the samples are kept for two collection windows, to not miss samples of a delayed collection
+// - fails for fields that aren't numeric GPU fields
+func newSampleStatsCollector(provider dcgmProvider, fields []sampledField, item dcgmexporter.FieldEntityGroupTypeSystemInfoItem, hostname string, interval, window time.Duration, now time.Time) (*sampleStatsCollector, error) {
+	c := &sampleStatsCollector{
+		fields:   fields,
+		hostname: hostname,
+		counters: map[dcgm.Short][]dcgmexporter.Counter{},
+		devices:  map[uint]dcgm.Device{},
+		since:    now,
+	}
+
+	var ids []dcgm.Short
+	for _, sampled := range fields {
+		meta, known := provider.FieldMeta(sampled.field.ID)
+		if !known {
+			return nil, errors.Errorf("invalid sampled field %s: unknown to DCGM", sampled.field.Name)
+		}
+		if meta.Type != "double" && meta.Type != "int64" {
+			return nil, errors.Errorf("invalid sampled field %s: %s fields can't be aggregated", sampled.field.Name, meta.Type)
+		}
+		if meta.EntityLevel != dcgm.FE_GPU {
+			return nil, errors.Errorf("invalid sampled field %s: only GPU fields are sampled, but it is a %s field", sampled.field.Name, meta.EntityLevel.String())
+		}
+
+		ids = append(ids, sampled.field.ID)
+		for _, stat := range sampled.stats {
+			c.counters[sampled.field.ID] = append(c.counters[sampled.field.ID], dcgmexporter.Counter{
+				FieldID:   sampled.field.ID,
+				FieldName: sampled.field.Name + "_" + stat.name,
+				PromType:  "gauge",
+				Help:      fmt.Sprintf("%s of the samples of %s in the collection window, sampled every %s.", stat.describe(), sampled.field.Name, interval),
+			})
+		}
+	}
+
+	var entities []dcgm.GroupEntityPair
+	for i := uint(0); i < item.SystemInfo.GPUCount && i < uint(len(item.SystemInfo.GPUs)); i++ {
+		device := item.SystemInfo.GPUs[i].DeviceInfo
+		c.devices[device.GPU] = device
+		entities = append(entities, dcgm.GroupEntityPair{EntityGroupId: dcgm.FE_GPU, EntityId: device.GPU})
+	}
+
+	watch, cleanup, err := provider.WatchSamples(entities, ids, interval, 2*window)
+	c.cleanup = cleanup
+	if err != nil {
+		cleanup()
+		return nil, errors.Wrap(err, "failed to watch the sampled fields")
+	}
+	c.watch = watch
+
+	return c, nil
+}
+
+// GetMetrics returns the statistics of the samples since the last collection
+// - a GPU without samples in the window has no statistics, e.g. a field not supported by the GPU
+func (c *sampleStatsCollector) GetMetrics() (dcgmexporter.MetricsByCounter, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	values, next, err := c.watch.GetValuesSince(c.since)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the samples of the sampled fields")
+	}
+	if !next.IsZero() {
+		c.since = next
+	}
+
+	// the samples by GPU and field
+	samples := map[uint]map[dcgm.Short][]float64{}
+	for _, fv := range values {
+		if fv.EntityGroupId != dcgm.FE_GPU {
+			continue
+		}
+		v, ok := sampleValue(fv)
+		if !ok {
+			continue
+		}
+		if samples[fv.EntityId] == nil {
+			samples[fv.EntityId] = map[dcgm.Short][]float64{}
+		}
+		samples[fv.EntityId][dcgm.Short(fv.FieldId)] = append(samples[fv.EntityId][dcgm.Short(fv.FieldId)], v)
+	}
+
+	metrics := dcgmexporter.MetricsByCounter{}
+	for _, gpu := range slices.Sorted(maps.Keys(c.devices)) {
+		for _, sampled := range c.fields {
+			fieldSamples := samples[gpu][sampled.field.ID]
+			if len(fieldSamples) == 0 {
+				logrus.WithFields(logrus.Fields{logFieldGPU: gpu, logFieldField: sampled.field.Name}).Debugf("No samples of %s in the collection window", sampled.field.Name)
+				continue
+			}
+
+			for i, value := range computeSampleStats(fieldSamples, sampled.stats) {
+				counter := c.counters[sampled.field.ID][i]
+				metrics[counter] = append(metrics[counter], newGPUMetric(counter, c.devices[gpu], c.hostname, fmt.Sprintf("%f", value), nil))
+			}
+		}
+	}
+
+	return metrics, nil
+}
+
+func (c *sampleStatsCollector) Cleanup() {
+	c.cleanup()
+}
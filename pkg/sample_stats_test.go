@@ -0,0 +1,280 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+)
+
+func TestParseSampledFields(t *testing.T) {
+	var tests = []struct {
+		name          string
+		specs         []string
+		expectedStats map[string][]string
+		expectedErr   string
+	}{
+		{"none", nil, map[string][]string{}, ""},
+		{"default statistics", []string{"DCGM_FI_DEV_POWER_USAGE"}, map[string][]string{"DCGM_FI_DEV_POWER_USAGE": {"min", "max", "avg"}}, ""},
+		{"statistics", []string{"DCGM_FI_DEV_POWER_USAGE=max, p95,p99.9,max", "DCGM_FI_PROF_SM_ACTIVE=min"},
+			map[string][]string{"DCGM_FI_DEV_POWER_USAGE": {"max", "p95", "p99.9"}, "DCGM_FI_PROF_SM_ACTIVE": {"min"}}, ""},
+		{"unknown field", []string{"DCGM_FI_DEV_POWER"}, nil, `unknown field "DCGM_FI_DEV_POWER"`},
+		{"sampled twice", []string{"DCGM_FI_DEV_GPU_TEMP", "DCGM_FI_DEV_GPU_TEMP=max"}, nil, "DCGM_FI_DEV_GPU_TEMP is sampled twice"},
+		{"unknown statistic", []string{"DCGM_FI_DEV_GPU_TEMP=median"}, nil, `unknown statistic "median"`},
+		{"percentile out of range", []string{"DCGM_FI_DEV_GPU_TEMP=p101"}, nil, `unknown statistic "p101"`},
+		{"no percentile", []string{"DCGM_FI_DEV_GPU_TEMP=p0"}, nil, `unknown statistic "p0"`},
+		{"no statistics", []string{"DCGM_FI_DEV_GPU_TEMP="}, nil, `unknown statistic ""`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sampled, err := parseSampledFields(tt.specs)
+			if tt.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedErr) {
+					t.Errorf("expected error %q, but got: %v", tt.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, but got: %s", err.Error())
+			}
+
+			got := map[string][]string{}
+			for _, s := range sampled {
+				var stats []string
+				for _, stat := range s.stats {
+					stats = append(stats, stat.name)
+				}
+				got[s.field.Name] = stats
+			}
+			if !reflect.DeepEqual(got, tt.expectedStats) {
+				t.Errorf("expected %v, but got: %v", tt.expectedStats, got)
+			}
+		})
+	}
+}
+
+func TestComputeSampleStats(t *testing.T) {
+	stats := func(names ...string) []sampleStat {
+		var parsed []sampleStat
+		for _, name := range names {
+			stat, err := parseSampleStat(name)
+			if err != nil {
+				t.Fatalf("expected no error, but got: %s", err.Error())
+			}
+			parsed = append(parsed, stat)
+		}
+		return parsed
+	}
+
+	var tests = []struct {
+		name     string
+		samples  []float64
+		stats    []sampleStat
+		expected []float64
+	}{
+		{"single sample", []float64{42}, stats("min", "max", "avg", "p95"), []float64{42, 42, 42, 42}},
+		// a 2 second spike to 700W in a 20s window
+		{"spike", []float64{72, 72, 700, 700, 72, 72, 72, 72, 72, 72}, stats("min", "max", "avg"), []float64{72, 700, 197.6}},
+		{"unsorted", []float64{3, 1, 2}, stats("max", "min"), []float64{3, 1}},
+		{"median of odd count", []float64{5, 1, 3}, stats("p50"), []float64{3}},
+		// rank 0.5*(4-1) = 1.5, between 2 and 3
+		{"median of even count", []float64{4, 1, 3, 2}, stats("p50"), []float64{2.5}},
+		// rank 0.95*(3-1) = 1.9, 310.25 + 0.9*(698-310.25)
+		{"interpolated quantile", []float64{72.5, 310.25, 698}, stats("p95"), []float64{659.225}},
+		{"p100 is the maximum", []float64{1, 9, 5}, stats("p100"), []float64{9}},
+		{"negative", []float64{-1, -3}, stats("min", "avg"), []float64{-3, -2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples := append([]float64{}, tt.samples...)
+			got := computeSampleStats(tt.samples, tt.stats)
+			if len(got) != len(tt.expected) {
+				t.Fatalf("expected %v, but got: %v", tt.expected, got)
+			}
+			for i := range got {
+				if math.Abs(got[i]-tt.expected[i]) > 1e-9 {
+					t.Errorf("expected %s %v, but got: %v", tt.stats[i].name, tt.expected[i], got[i])
+				}
+			}
+			if !reflect.DeepEqual(tt.samples, samples) {
+				t.Errorf("expected the samples to be unmodified %v, but got: %v", samples, tt.samples)
+			}
+		})
+	}
+}
+
+func TestSampleValue(t *testing.T) {
+	double := func(v float64) dcgm.FieldValue_v2 {
+		fv := dcgm.FieldValue_v2{FieldType: dcgm.DCGM_FT_DOUBLE}
+		binary.NativeEndian.PutUint64(fv.Value[:8], math.Float64bits(v))
+		return fv
+	}
+	integer := func(v int64) dcgm.FieldValue_v2 {
+		fv := dcgm.FieldValue_v2{FieldType: dcgm.DCGM_FT_INT64}
+		binary.NativeEndian.PutUint64(fv.Value[:8], uint64(v))
+		return fv
+	}
+	failed := integer(1)
+	failed.Status = -1
+
+	var tests = []struct {
+		name          string
+		value         dcgm.FieldValue_v2
+		expected      float64
+		expectedValid bool
+	}{
+		{"double", double(310.25), 310.25, true},
+		{"double blank", double(dcgm.DCGM_FT_FP64_BLANK), 0, false},
+		{"double not supported", double(dcgm.DCGM_FT_FP64_NOT_SUPPORTED), 0, false},
+		{"integer", integer(-7), -7, true},
+		{"int32 blank", integer(dcgm.DCGM_FT_INT32_BLANK), 0, false},
+		{"int32 not permissioned", integer(dcgm.DCGM_FT_INT32_NOT_PERMISSIONED), 0, false},
+		{"int64 not found", integer(dcgm.DCGM_FT_INT64_NOT_FOUND), 0, false},
+		{"failed", failed, 0, false},
+		{"string", dcgm.FieldValue_v2{FieldType: dcgm.DCGM_FT_STRING}, 0, false},
+	}
+
+	for _, tt := range tests {
+		got, valid := sampleValue(tt.value)
+		if valid != tt.expectedValid || (valid && got != tt.expected) {
+			t.Errorf("%s: expected %v (valid %t), but got: %v (valid %t)", tt.name, tt.expected, tt.expectedValid, got, valid)
+		}
+	}
+}
+
+func TestSampleStatsCollector(t *testing.T) {
+	provider, err := loadSimulatedProvider(testScenario)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	sysInfo, err := provider.GetSystemInfo(nil, dcgm.FE_GPU)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	fields, err := parseSampledFields([]string{"DCGM_FI_DEV_POWER_USAGE=max,p95", "DCGM_FI_DEV_MEMORY_TEMP"})
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	start := time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)
+	collector, err := newSampleStatsCollector(provider, fields, dcgmexporter.FieldEntityGroupTypeSystemInfoItem{SystemInfo: *sysInfo}, "gpu-droplet", time.Second, 20*time.Second, start)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	t.Cleanup(collector.Cleanup)
+
+	collect := func() map[string]string {
+		metrics, err := collector.GetMetrics()
+		if err != nil {
+			t.Fatalf("expected no error, but got: %s", err.Error())
+		}
+		got := map[string]string{}
+		for counter, counterMetrics := range metrics {
+			for _, metric := range counterMetrics {
+				got[counter.FieldName+"/"+metric.GPU] = metric.Value
+				if metric.GPUUUID == "" || metric.Hostname != "gpu-droplet" {
+					t.Errorf("expected the labels of the GPU, but got: %+v", metric)
+				}
+			}
+		}
+		return got
+	}
+
+	// the scenario has no values of DCGM_FI_DEV_MEMORY_TEMP
+	expected := map[string]string{
+		"DCGM_FI_DEV_POWER_USAGE_max/0": "698.000000",
+		"DCGM_FI_DEV_POWER_USAGE_max/1": "698.000000",
+		"DCGM_FI_DEV_POWER_USAGE_p95/0": "659.225000",
+		"DCGM_FI_DEV_POWER_USAGE_p95/1": "659.225000",
+	}
+	if got := collect(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, but got: %v", expected, got)
+	}
+	// the next window starts after the last sample of the previous window
+	if expectedSince := start.Add(3 * time.Second); !collector.since.Equal(expectedSince) {
+		t.Errorf("expected the next window to start at %s, but got: %s", expectedSince, collector.since)
+	}
+
+	if err := provider.setGPULost(0, true); err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	expected = map[string]string{
+		"DCGM_FI_DEV_POWER_USAGE_max/1": "698.000000",
+		"DCGM_FI_DEV_POWER_USAGE_p95/1": "659.225000",
+	}
+	if got := collect(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected no statistics of the lost GPU %v, but got: %v", expected, got)
+	}
+}
+
+func TestSampleStatsCollectorFieldMeta(t *testing.T) {
+	provider, err := loadSimulatedProvider(testScenario)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	sysInfo, err := provider.GetSystemInfo(nil, dcgm.FE_GPU)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	// the scenario scripts the field metadata DCGM would report
+	var tests = []struct {
+		name        string
+		spec        string
+		expectedErr string
+	}{
+		{"string field", "DCGM_FI_DRIVER_VERSION", "string fields can't be aggregated"},
+		{"NVSwitch field", "DCGM_FI_DEV_NVSWITCH_TEMPERATURE_CURRENT", "only GPU fields are sampled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, err := parseSampledFields([]string{tt.spec})
+			if err != nil {
+				t.Fatalf("expected no error, but got: %s", err.Error())
+			}
+
+			_, err = newSampleStatsCollector(provider, fields, dcgmexporter.FieldEntityGroupTypeSystemInfoItem{SystemInfo: *sysInfo}, "gpu-droplet", time.Second, 20*time.Second, time.Now())
+			if err == nil || !strings.Contains(err.Error(), tt.expectedErr) {
+				t.Errorf("expected error %q, but got: %v", tt.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestNewGPUMetricsAgentSampleInterval(t *testing.T) {
+	var tests = []struct {
+		interval    time.Duration
+		expected    time.Duration
+		expectedErr bool
+	}{
+		{0, DefaultSampleInterval, false},
+		{100 * time.Millisecond, 100 * time.Millisecond, false},
+		{10 * time.Millisecond, 0, true},
+		{20 * time.Second, 0, true},
+	}
+
+	for _, tt := range tests {
+		agent, err := NewGPUMetricsAgent(Options{SampleInterval: tt.interval, SampleStats: []string{"DCGM_FI_DEV_POWER_USAGE"}})
+		if tt.expectedErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, but got none", tt.interval)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected no error, but got: %s", tt.interval, err.Error())
+			continue
+		}
+		if agent.Options.SampleInterval != tt.expected {
+			t.Errorf("%s: expected the sample interval %s, but got: %s", tt.interval, tt.expected, agent.Options.SampleInterval)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package pkg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/pkg/errors"
+)
+
+/*
+	By default, all GPUs, NVSwitches and NVLinks discovered via DCGM are watched (dcgmexporter.DeviceOptions Flex).
+	The deviceSelection selects or excludes some of them, e.g. a GPU dedicated to a display or passed through to a VM:
+	- GPUs by index (the DCGM GPU id), UUID (GPU-...) or PCI bus id (e.g. 00000000:2A:00.0, or 0000:2a:00.0 like lspci)
+	- NVSwitches by index (the DCGM entity id)
+	- NVSwitch links by <NVSwitch index>/<link index>, or by link index on all NVSwitches
+	The indices may change across reboots. Hence, the selectors are resolved to the DCGM ids whenever the entities are discovered (at startup and on re-discovery).
+
+	The DeviceOptions MajorRange and MinorRange are not used, as with MIG they would watch the parent GPUs, and the GPU instances of all GPUs (see dcgmexporter.GetMonitoredEntities).
+	Instead, the entities not selected are removed from the discovered system info, which the collectors watch.
+	A selector matching nothing at startup is an error, e.g. a typo in a UUID.
+*/
+
+// selectors are the values selecting or excluding entities of a kind
+type selectors struct {
+	// kind names the selectors in errors, e.g. "excluded GPU"
+	kind   string
+	values []string
+}
+
+// deviceSelection selects the watched GPUs, NVSwitches and NVLinks
+// - a nil deviceSelection selects all entities
+type deviceSelection struct {
+	gpus, excludedGPUs         selectors
+	switches, excludedSwitches selectors
+	links, excludedLinks       selectors
+}
+
+// newDeviceSelection validates the selectors of the options. Nil if none are configured
+func newDeviceSelection(options Options) (*deviceSelection, error) {
+	s := &deviceSelection{
+		gpus:             selectors{kind: "GPU", values: options.GPUs},
+		excludedGPUs:     selectors{kind: "excluded GPU", values: options.ExcludeGPUs},
+		switches:         selectors{kind: "NVSwitch", values: options.NVSwitches},
+		excludedSwitches: selectors{kind: "excluded NVSwitch", values: options.ExcludeNVSwitches},
+		links:            selectors{kind: "NVLink", values: options.NVLinks},
+		excludedLinks:    selectors{kind: "excluded NVLink", values: options.ExcludeNVLinks},
+	}
+
+	configured := false
+	for _, list := range s.all() {
+		for _, value := range list.values {
+			configured = true
+
+			var err error
+			switch list {
+			case &s.gpus, &s.excludedGPUs:
+				if strings.TrimSpace(value) == "" {
+					err = errors.New("expected an index, UUID or PCI bus id")
+				}
+			case &s.switches, &s.excludedSwitches:
+				if _, parseErr := strconv.ParseUint(value, 10, 32); parseErr != nil {
+					err = errors.New("expected the index of the NVSwitch")
+				}
+			case &s.links, &s.excludedLinks:
+				if _, _, parseErr := parseLinkSelector(value); parseErr != nil {
+					err = parseErr
+				}
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid %s selector %q", list.kind, value)
+			}
+		}
+	}
+	if !configured {
+		return nil, nil
+	}
+
+	return s, nil
+}
+
+// all returns the selectors in the order they are reported in
+func (s *deviceSelection) all() []*selectors {
+	return []*selectors{&s.gpus, &s.excludedGPUs, &s.switches, &s.excludedSwitches, &s.links, &s.excludedLinks}
+}
+
+// selectsGPU returns whether the GPU is watched
+func (s *deviceSelection) selectsGPU(device dcgm.Device) bool {
+	if s == nil {
+		return true
+	}
+	return s.selects(&s.gpus, &s.excludedGPUs, func(selector string) bool { return matchesGPU(selector, device) }, nil)
+}
+
+// selectsSwitch returns whether the NVSwitch is watched
+func (s *deviceSelection) selectsSwitch(sw uint) bool {
+	if s == nil {
+		return true
+	}
+	return s.selects(&s.switches, &s.excludedSwitches, func(selector string) bool { return matchesSwitch(selector, sw) }, nil)
+}
+
+// selectsLink returns whether the link of the NVSwitch is watched
+func (s *deviceSelection) selectsLink(sw uint, link uint) bool {
+	if s == nil {
+		return true
+	}
+	return s.selectsSwitch(sw) && s.selects(&s.links, &s.excludedLinks, func(selector string) bool { return matchesLink(selector, sw, link) }, nil)
+}
+
+// apply removes the GPUs, NVSwitches and NVLinks not selected from the system info
+// - the selectors matching an entity are recorded in matched, if not nil
+func (s *deviceSelection) apply(sysInfo *dcgmexporter.SystemInfo, matched map[string]bool) {
+	if s == nil {
+		return
+	}
+
+	var count uint
+	for i := uint(0); i < sysInfo.GPUCount && i < uint(len(sysInfo.GPUs)); i++ {
+		device := sysInfo.GPUs[i].DeviceInfo
+		if !s.selects(&s.gpus, &s.excludedGPUs, func(selector string) bool { return matchesGPU(selector, device) }, matched) {
+			continue
+		}
+		sysInfo.GPUs[count] = sysInfo.GPUs[i]
+		count++
+	}
+	for i := count; i < sysInfo.GPUCount && i < uint(len(sysInfo.GPUs)); i++ {
+		sysInfo.GPUs[i] = dcgmexporter.GPUInfo{}
+	}
+	sysInfo.GPUCount = count
+
+	var switches []dcgmexporter.SwitchInfo
+	for _, sw := range sysInfo.Switches {
+		if !s.selects(&s.switches, &s.excludedSwitches, func(selector string) bool { return matchesSwitch(selector, sw.EntityId) }, matched) {
+			continue
+		}
+
+		var links []dcgm.NvLinkStatus
+		for _, link := range sw.NvLinks {
+			if s.selects(&s.links, &s.excludedLinks, func(selector string) bool { return matchesLink(selector, sw.EntityId, link.Index) }, matched) {
+				links = append(links, link)
+			}
+		}
+		sw.NvLinks = links
+		switches = append(switches, sw)
+	}
+	sysInfo.Switches = switches
+}
+
+// selects returns whether an entity is selected, i.e. matches any of the selected (if any), and none of the excluded
+// - all selectors are matched, to record every matching selector
+func (s *deviceSelection) selects(selected, excluded *selectors, matches func(selector string) bool, matched map[string]bool) bool {
+	isSelected := len(selected.values) == 0
+	for _, value := range selected.values {
+		if matches(value) {
+			isSelected = true
+			selected.record(value, matched)
+		}
+	}
+	for _, value := range excluded.values {
+		if matches(value) {
+			isSelected = false
+			excluded.record(value, matched)
+		}
+	}
+	return isSelected
+}
+
+// record records the selector as matching an entity
+func (l *selectors) record(value string, matched map[string]bool) {
+	if matched != nil {
+		matched[l.describe(value)] = true
+	}
+}
+
+// describe names the selector, e.g. excluded GPU "GPU-5a3e1f0c-..."
+func (l *selectors) describe(value string) string {
+	return fmt.Sprintf("%s %q", l.kind, value)
+}
+
+// check returns an error naming the selectors that matched no entity
+func (s *deviceSelection) check(matched map[string]bool) error {
+	if s == nil {
+		return nil
+	}
+
+	var unmatched []string
+	for _, list := range s.all() {
+		for _, value := range list.values {
+			if !matched[list.describe(value)] {
+				unmatched = append(unmatched, list.describe(value))
+			}
+		}
+	}
+	if len(unmatched) > 0 {
+		return errors.Errorf("the selectors %s match no discovered entity", strings.Join(unmatched, ", "))
+	}
+	return nil
+}
+
+// matchesGPU returns whether the selector is the index, UUID or PCI bus id of the GPU
+func matchesGPU(selector string, device dcgm.Device) bool {
+	selector = strings.TrimSpace(selector)
+	if index, err := strconv.ParseUint(selector, 10, 32); err == nil {
+		return uint(index) == device.GPU
+	}
+	if strings.EqualFold(selector, device.UUID) {
+		return true
+	}
+	return strings.Contains(selector, ":") && normalizePCIBusID(selector) == normalizePCIBusID(device.PCI.BusID)
+}
+
+// normalizePCIBusID returns the PCI bus id in lower case, with the domain shortened, e.g. 0:2a:00.0 for 00000000:2A:00.0
+// - nvidia-smi reports an 8 digit domain, lspci a 4 digit domain, and the domain may be omitted (2a:00.0)
+func normalizePCIBusID(busID string) string {
+	busID = strings.ToLower(strings.TrimSpace(busID))
+	parts := strings.Split(busID, ":")
+	if len(parts) == 2 {
+		parts = append([]string{"0"}, parts...)
+	}
+	if len(parts) != 3 {
+		return busID
+	}
+	if domain, err := strconv.ParseUint(parts[0], 16, 32); err == nil {
+		parts[0] = strconv.FormatUint(domain, 16)
+	}
+	return strings.Join(parts, ":")
+}
+
+// matchesSwitch returns whether the selector is the index of the NVSwitch
+func matchesSwitch(selector string, sw uint) bool {
+	index, err := strconv.ParseUint(selector, 10, 32)
+	return err == nil && uint(index) == sw
+}
+
+// matchesLink returns whether the selector is the link of the NVSwitch
+func matchesLink(selector string, sw uint, link uint) bool {
+	selectorSwitch, selectorLink, err := parseLinkSelector(selector)
+	if err != nil {
+		return false
+	}
+	return selectorLink == link && (selectorSwitch < 0 || uint(selectorSwitch) == sw)
+}
+
+// parseLinkSelector parses <NVSwitch index>/<link index>, or <link index>. The NVSwitch index is -1 if omitted
+func parseLinkSelector(selector string) (int, uint, error) {
+	invalid := errors.New("expected <NVSwitch index>/<link index> or <link index>")
+
+	sw := -1
+	swPart, linkPart, found := strings.Cut(selector, "/")
+	if found {
+		index, err := strconv.ParseUint(swPart, 10, 31)
+		if err != nil {
+			return 0, 0, invalid
+		}
+		sw = int(index)
+	} else {
+		linkPart = swPart
+	}
+
+	link, err := strconv.ParseUint(linkPart, 10, 32)
+	if err != nil {
+		return 0, 0, invalid
+	}
+	return sw, uint(link), nil
+}
@@ -0,0 +1,189 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+)
+
+func TestNewDeviceSelection(t *testing.T) {
+	var tests = []struct {
+		name        string
+		options     Options
+		expectedNil bool
+		expectedErr string
+	}{
+		{"none", Options{}, true, ""},
+		{"GPUs", Options{GPUs: []string{"0", "GPU-5a3e1f0c-6d2b-4b8e-9f3a-2c1d0e9b8a70", "0000:2a:00.0"}}, false, ""},
+		{"empty GPU", Options{ExcludeGPUs: []string{" "}}, false, `invalid excluded GPU selector " "`},
+		{"NVSwitch", Options{NVSwitches: []string{"1"}}, false, ""},
+		{"NVSwitch UUID", Options{ExcludeNVSwitches: []string{"nvswitch0"}}, false, `invalid excluded NVSwitch selector "nvswitch0"`},
+		{"links", Options{NVLinks: []string{"0/3", "4"}}, false, ""},
+		{"link without switch", Options{ExcludeNVLinks: []string{"/3"}}, false, `invalid excluded NVLink selector "/3"`},
+		{"link without index", Options{NVLinks: []string{"0/"}}, false, `invalid NVLink selector "0/"`},
+	}
+
+	for _, tt := range tests {
+		selection, err := newDeviceSelection(tt.options)
+		if tt.expectedErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.expectedErr) {
+				t.Errorf("%s: expected error %q, but got: %v", tt.name, tt.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected no error, but got: %s", tt.name, err.Error())
+			continue
+		}
+		if (selection == nil) != tt.expectedNil {
+			t.Errorf("%s: expected nil selection %t, but got: %+v", tt.name, tt.expectedNil, selection)
+		}
+	}
+}
+
+func TestMatchesGPU(t *testing.T) {
+	device := dcgm.Device{GPU: 1, UUID: "GPU-7c4b2a1d-8e3f-4a9b-b0c1-3d2e1f0a9b81", PCI: dcgm.PCIInfo{BusID: "00000000:2A:00.0"}}
+
+	var tests = []struct {
+		selector string
+		expected bool
+	}{
+		{"1", true},
+		{"0", false},
+		{"GPU-7c4b2a1d-8e3f-4a9b-b0c1-3d2e1f0a9b81", true},
+		{"gpu-7c4b2a1d-8e3f-4a9b-b0c1-3d2e1f0a9b81", true},
+		{"GPU-5a3e1f0c-6d2b-4b8e-9f3a-2c1d0e9b8a70", false},
+		{"00000000:2A:00.0", true},
+		{"0000:2a:00.0", true},
+		{"2a:00.0", true},
+		{"0000:18:00.0", false},
+		{"0001:2a:00.0", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchesGPU(tt.selector, device); got != tt.expected {
+			t.Errorf("%q: expected match %t, but got: %t", tt.selector, tt.expected, got)
+		}
+	}
+}
+
+func TestDeviceSelectionApply(t *testing.T) {
+	provider, err := loadSimulatedProvider(testScenario)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	if err := provider.setSwitchLinks(0, 4); err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	var tests = []struct {
+		name              string
+		options           Options
+		expectedGPUs      []string
+		expectedSwitches  []string
+		expectedUnmatched string
+	}{
+		{"select by UUID", Options{GPUs: []string{"GPU-7c4b2a1d-8e3f-4a9b-b0c1-3d2e1f0a9b81"}},
+			[]string{"1 GPU-7c4b2a1d-8e3f-4a9b-b0c1-3d2e1f0a9b81 (2 instances)"}, []string{"0 links [0 1 2 3]"}, ""},
+		{"exclude by PCI bus id", Options{ExcludeGPUs: []string{"0000:2a:00.0"}},
+			[]string{"0 GPU-5a3e1f0c-6d2b-4b8e-9f3a-2c1d0e9b8a70 (0 instances)"}, []string{"0 links [0 1 2 3]"}, ""},
+		{"select and exclude by index", Options{GPUs: []string{"0", "1"}, ExcludeGPUs: []string{"0"}},
+			[]string{"1 GPU-7c4b2a1d-8e3f-4a9b-b0c1-3d2e1f0a9b81 (2 instances)"}, []string{"0 links [0 1 2 3]"}, ""},
+		{"links", Options{NVLinks: []string{"0/1", "3"}, ExcludeNVLinks: []string{"3"}},
+			[]string{"0 GPU-5a3e1f0c-6d2b-4b8e-9f3a-2c1d0e9b8a70 (0 instances)", "1 GPU-7c4b2a1d-8e3f-4a9b-b0c1-3d2e1f0a9b81 (2 instances)"}, []string{"0 links [1]"}, ""},
+		{"excluded NVSwitch", Options{ExcludeNVSwitches: []string{"0"}},
+			[]string{"0 GPU-5a3e1f0c-6d2b-4b8e-9f3a-2c1d0e9b8a70 (0 instances)", "1 GPU-7c4b2a1d-8e3f-4a9b-b0c1-3d2e1f0a9b81 (2 instances)"}, nil, ""},
+		{"unmatched", Options{GPUs: []string{"0", "GPU-00000000-0000-0000-0000-000000000000"}, ExcludeNVSwitches: []string{"1"}, NVLinks: []string{"0/40"}},
+			[]string{"0 GPU-5a3e1f0c-6d2b-4b8e-9f3a-2c1d0e9b8a70 (0 instances)"}, []string{"0 links []"},
+			`the selectors GPU "GPU-00000000-0000-0000-0000-000000000000", excluded NVSwitch "1", NVLink "0/40" match no discovered entity`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selection, err := newDeviceSelection(tt.options)
+			if err != nil {
+				t.Fatalf("expected no error, but got: %s", err.Error())
+			}
+
+			matched := map[string]bool{}
+
+			gpuInfo, err := provider.GetSystemInfo(nil, dcgm.FE_GPU)
+			if err != nil {
+				t.Fatalf("expected no error, but got: %s", err.Error())
+			}
+			selection.apply(gpuInfo, matched)
+			var gpus []string
+			for i := uint(0); i < gpuInfo.GPUCount; i++ {
+				gpu := gpuInfo.GPUs[i]
+				gpus = append(gpus, fmt.Sprintf("%d %s (%d instances)", gpu.DeviceInfo.GPU, gpu.DeviceInfo.UUID, len(gpu.GPUInstances)))
+			}
+			if !reflect.DeepEqual(gpus, tt.expectedGPUs) {
+				t.Errorf("expected the GPUs %v, but got: %v", tt.expectedGPUs, gpus)
+			}
+
+			linkInfo, err := provider.GetSystemInfo(nil, dcgm.FE_LINK)
+			if err != nil {
+				t.Fatalf("expected no error, but got: %s", err.Error())
+			}
+			selection.apply(linkInfo, matched)
+			var switches []string
+			for _, sw := range linkInfo.Switches {
+				var links []uint
+				for _, link := range sw.NvLinks {
+					links = append(links, link.Index)
+				}
+				switches = append(switches, fmt.Sprintf("%d links %v", sw.EntityId, links))
+			}
+			if !reflect.DeepEqual(switches, tt.expectedSwitches) {
+				t.Errorf("expected the NVSwitches %v, but got: %v", tt.expectedSwitches, switches)
+			}
+
+			err = selection.check(matched)
+			if tt.expectedUnmatched == "" && err != nil {
+				t.Errorf("expected no error, but got: %s", err.Error())
+			}
+			if tt.expectedUnmatched != "" && (err == nil || err.Error() != tt.expectedUnmatched) {
+				t.Errorf("expected error %q, but got: %v", tt.expectedUnmatched, err)
+			}
+		})
+	}
+}
+
+func TestCollectOnceSelection(t *testing.T) {
+	t.Setenv("NODE_NAME", "gpu-droplet")
+
+	agent, err := NewGPUMetricsAgent(Options{SimulateScenario: testScenario, ExcludeGPUs: []string{"GPU-5a3e1f0c-6d2b-4b8e-9f3a-2c1d0e9b8a70"}, NVLinks: []string{"0/1"}})
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	agent.root = t.TempDir()
+
+	var out bytes.Buffer
+	if err := agent.CollectOnce(&out, CollectFormatProm, false); err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	for _, expected := range []string{`DCGM_FI_DEV_GPU_TEMP{gpu="1"`, `nvlink="1",nvswitch="nvswitch0"`, `do_dcgm_gpu_cpu_affinity_info{gpu="1"`} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected the metrics to contain %s, but got:\n%s", expected, out.String())
+		}
+	}
+	for _, notExpected := range []string{`{gpu="0"`, `nvlink="0",nvswitch="nvswitch0"`, `gpu_a="0"`} {
+		if strings.Contains(out.String(), notExpected) {
+			t.Errorf("expected the metrics not to contain %s, but got:\n%s", notExpected, out.String())
+		}
+	}
+
+	agent, err = NewGPUMetricsAgent(Options{SimulateScenario: testScenario, GPUs: []string{"2"}})
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	agent.root = t.TempDir()
+	if err := agent.CollectOnce(&out, CollectFormatProm, false); err == nil || !strings.Contains(err.Error(), `GPU "2"`) {
+		t.Errorf("expected an error naming the unmatched selector, but got: %v", err)
+	}
+}
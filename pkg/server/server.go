@@ -0,0 +1,328 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/exporter-toolkit/web"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+	The dcgm-exporter MetricsServer serves fixed routes with hardcoded timeouts on a single address, and terminates the process if listening fails.
+	Hence, the agent serves its endpoints with its own Server, that
+	- serves the handlers registered via Handle on multiple addresses, or the sockets passed by systemd socket activation
+	- secures the endpoints with an exporter-toolkit web config file (TLS, basic auth, client certificates), like the dcgm-exporter
+	- logs and counts every request
+	- returns listen and serve errors to the caller
+*/
+
+// Options are the settings of a Server
+type Options struct {
+	// Name identifies the server in logs and metrics, e.g. "metrics"
+	Name string
+	// Addresses are the addresses to listen on
+	Addresses []string
+	// SystemdSocket listens on the sockets passed by systemd socket activation instead of Addresses
+	SystemdSocket bool
+	// WebConfigFile is the path to an exporter-toolkit web config file. Plain HTTP without authentication if empty
+	WebConfigFile string
+	// ReadHeaderTimeout is how long reading the request headers may take
+	ReadHeaderTimeout time.Duration
+	// WriteTimeout is how long handling a request and writing the response may take. No timeout if 0
+	WriteTimeout time.Duration
+}
+
+// Server serves HTTP handlers on multiple addresses
+type Server struct {
+	options Options
+	mux     *http.ServeMux
+	metrics *requestMetrics
+
+	// listeners are the listeners of the addresses, opened by Listen
+	listeners []net.Listener
+}
+
+// New creates a Server without handlers
+func New(options Options) *Server {
+	return &Server{
+		options: options,
+		mux:     http.NewServeMux(),
+		metrics: newRequestMetrics(options.Name),
+	}
+}
+
+// Handle registers the handler for the pattern (e.g. "GET /metrics"), see http.ServeMux
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// HandleFunc registers the handler function for the pattern (e.g. "GET /metrics"), see http.ServeMux
+func (s *Server) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	s.mux.HandleFunc(pattern, handler)
+}
+
+// ServeHTTP serves the request with the handler registered for it, logging and counting the request
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+	s.mux.ServeHTTP(recorder, r)
+
+	// the pattern is set by the mux, and empty if no handler matched
+	pattern := r.Pattern
+	if pattern == "" {
+		pattern = "unmatched"
+	}
+	duration := time.Since(start)
+	s.metrics.observe(pattern, recorder.status, duration)
+
+	logrus.Debugf("%s server: HTTP %s %s from %s [%d] in %s", s.options.Name, r.Method, r.URL.Path, r.RemoteAddr, recorder.status, duration)
+}
+
+// WriteMetrics writes the request metrics of the server in prometheus plaintext format
+func (s *Server) WriteMetrics(w io.Writer) error {
+	return s.metrics.write(w)
+}
+
+// Listen opens the listeners of all addresses, or takes the sockets passed by systemd socket activation
+// - returns an error if any address can not be listened on, closing the listeners opened so far
+func (s *Server) Listen() error {
+	if s.options.SystemdSocket {
+		listeners, err := activation.Listeners()
+		if err != nil {
+			return errors.Wrapf(err, "failed to take the systemd socket activation listeners of the %s server", s.options.Name)
+		}
+		if len(listeners) == 0 {
+			return errors.Errorf("no systemd socket activation listeners passed for the %s server", s.options.Name)
+		}
+		s.listeners = listeners
+	} else {
+		if len(s.options.Addresses) == 0 {
+			return errors.Errorf("no addresses configured for the %s server", s.options.Name)
+		}
+
+		for _, address := range s.options.Addresses {
+			listener, err := net.Listen("tcp", address)
+			if err != nil {
+				s.closeListeners()
+				return errors.Wrapf(err, "failed to listen on %s for the %s server", address, s.options.Name)
+			}
+			s.listeners = append(s.listeners, listener)
+		}
+	}
+
+	for _, listener := range s.listeners {
+		logrus.Infof("%s server listening on %s", s.options.Name, listener.Addr())
+	}
+
+	return nil
+}
+
+// closeListeners closes the listeners opened by Listen
+func (s *Server) closeListeners() {
+	for _, listener := range s.listeners {
+		_ = listener.Close()
+	}
+	s.listeners = nil
+}
+
+// Serve serves on the listeners opened by Listen until stop is closed
+// - returns an error if serving failed before stop was closed
+func (s *Server) Serve(stop chan interface{}) error {
+	server := &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: s.options.ReadHeaderTimeout,
+		WriteTimeout:      s.options.WriteTimeout,
+	}
+
+	flags := &web.FlagConfig{
+		WebListenAddresses: &s.options.Addresses,
+		WebSystemdSocket:   &s.options.SystemdSocket,
+		WebConfigFile:      &s.options.WebConfigFile,
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- web.ServeMultiple(s.listeners, server, flags, newLogrusLogger())
+	}()
+
+	select {
+	case err := <-served:
+		s.closeListeners()
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return errors.Wrapf(err, "%s server failed", s.options.Name)
+	case <-stop:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logrus.Warnf("Failed to shut down the %s server gracefully: %s", s.options.Name, err)
+	}
+	<-served
+	s.listeners = nil
+
+	return nil
+}
+
+// Run listens and serves until stop is closed
+func (s *Server) Run(stop chan interface{}) error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	return s.Serve(stop)
+}
+
+// statusRecorder records the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap returns the wrapped ResponseWriter, for http.ResponseController
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// requestKey identifies the requests counted together
+type requestKey struct {
+	pattern string
+	status  int
+}
+
+// requestStats are the number and total duration of requests
+type requestStats struct {
+	count   uint64
+	seconds float64
+}
+
+// requestMetrics counts the requests of a server by pattern and status code
+type requestMetrics struct {
+	name string
+
+	mtx   sync.Mutex
+	stats map[requestKey]*requestStats
+}
+
+func newRequestMetrics(name string) *requestMetrics {
+	return &requestMetrics{
+		name:  name,
+		stats: map[requestKey]*requestStats{},
+	}
+}
+
+func (m *requestMetrics) observe(pattern string, status int, duration time.Duration) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	key := requestKey{pattern: pattern, status: status}
+	stats, exists := m.stats[key]
+	if !exists {
+		stats = &requestStats{}
+		m.stats[key] = stats
+	}
+	stats.count++
+	stats.seconds += duration.Seconds()
+}
+
+// write writes the request metrics in prometheus plaintext format, sorted by pattern and status code
+func (m *requestMetrics) write(w io.Writer) error {
+	m.mtx.Lock()
+	keys := make([]requestKey, 0, len(m.stats))
+	stats := make(map[requestKey]requestStats, len(m.stats))
+	for key, s := range m.stats {
+		keys = append(keys, key)
+		stats[key] = *s
+	}
+	m.mtx.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].pattern != keys[j].pattern {
+			return keys[i].pattern < keys[j].pattern
+		}
+		return keys[i].status < keys[j].status
+	})
+
+	if _, err := fmt.Fprint(w, "# HELP do_dcgm_exporter_http_requests_total Number of HTTP requests served by the agent, by server, handler and status code.\n"+
+		"# TYPE do_dcgm_exporter_http_requests_total counter\n"); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, err := fmt.Fprintf(w, "do_dcgm_exporter_http_requests_total{server=%q,handler=%q,code=\"%d\"} %d\n", m.name, key.pattern, key.status, stats[key].count); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fmt.Fprint(w, "# HELP do_dcgm_exporter_http_request_duration_seconds Duration of the HTTP requests served by the agent, by server, handler and status code.\n"+
+		"# TYPE do_dcgm_exporter_http_request_duration_seconds summary\n"); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		labels := fmt.Sprintf("server=%q,handler=%q,code=\"%d\"", m.name, key.pattern, key.status)
+		if _, err := fmt.Fprintf(w, "do_dcgm_exporter_http_request_duration_seconds_sum{%s} %g\ndo_dcgm_exporter_http_request_duration_seconds_count{%s} %d\n",
+			labels, stats[key].seconds, labels, stats[key].count); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// logrusLogger logs the go-kit log entries of the exporter-toolkit via logrus
+// adapted from: https://github.com/NVIDIA/dcgm-exporter/blob/402a10fd8bb4a36be7cc5b2c703cf8f1322d1ef0/internal/pkg/logging/logrus_adapter.go
+// - reason: internal package
+type logrusLogger struct{}
+
+func newLogrusLogger() log.Logger {
+	return logrusLogger{}
+}
+
+// Log logs the key-value pairs, using the "msg" value as message and the "level" value as log level
+func (logrusLogger) Log(keyvals ...interface{}) error {
+	if len(keyvals)%2 != 0 {
+		keyvals = append(keyvals, "MISSING")
+	}
+
+	fields := logrus.Fields{}
+	for i := 0; i < len(keyvals); i += 2 {
+		key, ok := keyvals[i].(string)
+		if !ok {
+			key = "missing_key"
+		}
+		fields[key] = keyvals[i+1]
+	}
+
+	msg := fields["msg"]
+	delete(fields, "msg")
+
+	lvl, exists := fields["level"]
+	if !exists {
+		lvl = level.InfoValue()
+	}
+	delete(fields, "level")
+	parsedLvl, err := logrus.ParseLevel(fmt.Sprint(lvl))
+	if err != nil {
+		parsedLvl = logrus.InfoLevel
+	}
+
+	logrus.WithFields(fields).Log(parsedLvl, msg)
+	return nil
+}
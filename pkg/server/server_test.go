@@ -0,0 +1,114 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freeAddress returns a local address that is free to listen on
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestListenError(t *testing.T) {
+	used, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer used.Close()
+
+	free := freeAddress(t)
+	s := New(Options{Name: "test", Addresses: []string{free, used.Addr().String()}})
+	if err := s.Run(make(chan interface{})); err == nil {
+		t.Fatalf("expected an error for an address in use, but got none")
+	}
+
+	// the listener of the free address is closed again
+	l, err := net.Listen("tcp", free)
+	if err != nil {
+		t.Errorf("expected the listeners opened before the error to be closed, but got: %s", err.Error())
+	} else {
+		l.Close()
+	}
+
+	if err := New(Options{Name: "test"}).Listen(); err == nil {
+		t.Errorf("expected an error without addresses, but got none")
+	}
+}
+
+func TestServe(t *testing.T) {
+	addresses := []string{freeAddress(t), freeAddress(t)}
+	s := New(Options{Name: "test", Addresses: addresses, ReadHeaderTimeout: time.Second})
+	s.HandleFunc("GET /hello", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+	if err := s.Listen(); err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	stop := make(chan interface{})
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(stop)
+	}()
+
+	get := func(url string) (int, string) {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("expected no error, but got: %s", err.Error())
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("expected no error, but got: %s", err.Error())
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	// every address serves the handlers
+	for _, address := range addresses {
+		if status, body := get("http://" + address + "/hello"); status != http.StatusOK || body != "hello" {
+			t.Errorf("expected %s to serve hello, but got: %d %q", address, status, body)
+		}
+	}
+	if status, _ := get("http://" + addresses[0] + "/missing"); status != http.StatusNotFound {
+		t.Errorf("expected status %d for an unknown path, but got: %d", http.StatusNotFound, status)
+	}
+
+	var metrics strings.Builder
+	if err := s.WriteMetrics(&metrics); err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	for _, expected := range []string{
+		`do_dcgm_exporter_http_requests_total{server="test",handler="GET /hello",code="200"} 2`,
+		`do_dcgm_exporter_http_requests_total{server="test",handler="unmatched",code="404"} 1`,
+		`do_dcgm_exporter_http_request_duration_seconds_count{server="test",handler="GET /hello",code="200"} 2`,
+	} {
+		if !strings.Contains(metrics.String(), expected) {
+			t.Errorf("expected the request metrics to contain %q, but got:\n%s", expected, metrics.String())
+		}
+	}
+
+	close(stop)
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("expected no error, but got: %s", err.Error())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the server to stop")
+	}
+
+	if _, err := http.Get("http://" + addresses[1] + "/hello"); err == nil {
+		t.Errorf("expected the server to be stopped")
+	}
+}
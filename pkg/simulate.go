@@ -0,0 +1,986 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+	The simulated provider replays a scenario file instead of talking to the nv-hostengine, so the agent runs on hosts without GPUs.
+
+	- the GPUs (with MIG instances), NVSwitches and NVLinks of the scenario are discovered instead of the hardware
+	- the hardware can be changed at runtime, to test the re-discovery: the MIG instances (reconfigureMIG), GPUs falling off the bus (setGPULost)
+	  and the NVSwitch links that are up (setSwitchLinks)
+	- the field metadata isn't embedded (see fields.go), hence, it's taken from the scenario: the entity level of the scripted values (level, default gpu),
+	  and the type of the values (int64 if all values are integers, double if all are numbers, string otherwise, e.g. 698.0 is a double).
+	  Fields without scripted values are simulated as GPU fields
+	- every collection plays the next scripted value of a field, and the last value is repeated once the script is exhausted
+	- fields without a scripted value aren't reported, like fields not supported by a GPU
+	- DCGM_EXP_XID_ERRORS_COUNT and DCGM_EXP_CLOCK_EVENTS_COUNT count the values of DCGM_FI_DEV_XID_ERRORS and DCGM_FI_DEV_CLOCK_THROTTLE_REASONS
+	  of the last GPU collection, as if every collection covered a window. A value of 0 is no XID error or clock event
+	- the samples of the sampled fields (see sample_stats.go) are all scripted values of a field, as if every collection window sampled the whole script
+	- diagnostics always pass
+
+	Example scenario: testdata/scenario.yaml
+*/
+
+// defaultSimulatedModel is the model of simulated GPUs without a model
+const defaultSimulatedModel = "NVIDIA H100 80GB HBM3"
+
+// scenario is a scenario file of the simulated provider
+type scenario struct {
+	GPUs     []scenarioGPU    `yaml:"gpus"`
+	Switches []scenarioSwitch `yaml:"switches"`
+	Values   []scenarioValues `yaml:"values"`
+}
+
+// scenarioGPU is a simulated GPU. The GPU index is the position in the scenario
+type scenarioGPU struct {
+	UUID     string `yaml:"uuid"`
+	Model    string `yaml:"model"`
+	PCIBusID string `yaml:"pci_bus_id"`
+	// NVLinks is the number of NVLinks of the GPU that are up
+	NVLinks int `yaml:"nvlinks"`
+	// MIG are the GPU instances. MIG is disabled if empty
+	MIG []scenarioGPUInstance `yaml:"mig"`
+}
+
+// scenarioGPUInstance is a MIG GPU instance of a simulated GPU
+type scenarioGPUInstance struct {
+	Profile          string `yaml:"profile"`
+	ComputeInstances int    `yaml:"compute_instances"`
+}
+
+// scenarioSwitch is a simulated NVSwitch. The NVSwitch index is the position in the scenario
+type scenarioSwitch struct {
+	// Links is the number of NVLinks of the NVSwitch that are up
+	Links int `yaml:"links"`
+}
+
+// scenarioValues are the scripted values of a field
+type scenarioValues struct {
+	Field string `yaml:"field"`
+	// Level is the entity level of the field: global, gpu, switch, link, cpu or cpu_core. Default gpu
+	Level string `yaml:"level"`
+	// Entities are the GPU, NVSwitch or NVLink indexes the values are reported for, depending on the entity level of the field. All entities if empty
+	// - MIG GPU instances report the values of their GPU
+	Entities []uint `yaml:"entities"`
+	// Values are played one per collection
+	Values []string `yaml:"values"`
+}
+
+// scriptedValues are the encoded values of a scenarioValues
+type scriptedValues struct {
+	entities map[uint]bool
+	values   []dcgm.FieldValue_v1
+}
+
+// simulatedProvider is a dcgmProvider replaying a scenario
+type simulatedProvider struct {
+	path     string
+	scenario scenario
+	// meta is the metadata of the fields of the embedded field table, taken from the scripted values
+	meta map[dcgm.Short]fieldMeta
+	// scripts are the scripted values by field. Later scripts take precedence
+	scripts map[dcgm.Short][]scriptedValues
+
+	mtx sync.Mutex
+	// gpuStep is the step of the last GPU collection, the XID errors and clock events are counted at
+	gpuStep int
+	// mig are the GPU instances by GPU, initially the ones of the scenario. Reconfigured by reconfigureMIG
+	mig [][]scenarioGPUInstance
+	// lost are the GPUs that fell off the bus, set by setGPULost
+	lost map[uint]bool
+	// switchLinks are the number of NVLinks that are up by NVSwitch, initially the ones of the scenario. Set by setSwitchLinks
+	switchLinks []int
+}
+
+// loadSimulatedProvider loads and validates the scenario file at path
+func loadSimulatedProvider(path string) (*simulatedProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the scenario file")
+	}
+
+	var s scenario
+	if err := yaml.Unmarshal(data, &s); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse the scenario file %s", path)
+	}
+
+	provider, err := newSimulatedProvider(s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid scenario file %s", path)
+	}
+	provider.path = path
+
+	return provider, nil
+}
+
+// newSimulatedProvider creates a simulatedProvider replaying the scenario
+func newSimulatedProvider(s scenario) (*simulatedProvider, error) {
+	if uint(len(s.GPUs)) > dcgm.MAX_NUM_DEVICES {
+		return nil, errors.Errorf("at most %d GPUs can be simulated, but got: %d", dcgm.MAX_NUM_DEVICES, len(s.GPUs))
+	}
+
+	for i := range s.GPUs {
+		gpu := &s.GPUs[i]
+		if gpu.UUID == "" {
+			gpu.UUID = fmt.Sprintf("GPU-00000000-0000-0000-0000-%012d", i)
+		}
+		if gpu.Model == "" {
+			gpu.Model = defaultSimulatedModel
+		}
+		if gpu.PCIBusID == "" {
+			gpu.PCIBusID = fmt.Sprintf("00000000:%02X:00.0", i+1)
+		}
+		for j, instance := range gpu.MIG {
+			if instance.Profile == "" {
+				return nil, errors.Errorf("GPU %d: MIG instance %d has no profile", i, j)
+			}
+		}
+	}
+
+	fields, err := loadFields()
+	if err != nil {
+		return nil, err
+	}
+
+	provider := &simulatedProvider{
+		scenario: s,
+		meta:     map[dcgm.Short]fieldMeta{},
+		scripts:  map[dcgm.Short][]scriptedValues{},
+	}
+	for _, gpu := range s.GPUs {
+		provider.mig = append(provider.mig, gpu.MIG)
+	}
+	provider.lost = map[uint]bool{}
+	for _, sw := range s.Switches {
+		provider.switchLinks = append(provider.switchLinks, sw.Links)
+	}
+
+	byName := map[string]Field{}
+	for _, field := range fields {
+		byName[field.Name] = field
+		provider.meta[field.ID] = fieldMeta{Type: "int64", EntityLevel: dcgm.FE_GPU}
+	}
+
+	scripted := map[dcgm.Short]int{}
+	for i, v := range s.Values {
+		field, exists := byName[v.Field]
+		if !exists {
+			return nil, errors.Errorf("values %d: unknown field %q", i, v.Field)
+		}
+		if len(v.Values) == 0 {
+			return nil, errors.Errorf("values %d: no values for field %s", i, v.Field)
+		}
+
+		levelName := v.Level
+		if levelName == "" {
+			levelName = "gpu"
+		}
+		level, exists := fieldEntityLevels[levelName]
+		if !exists {
+			return nil, errors.Errorf("values %d: field %s: unknown level %q", i, v.Field, v.Level)
+		}
+
+		meta := fieldMeta{Type: scriptedType(v.Values), EntityLevel: level}
+		if previous, exists := scripted[field.ID]; exists {
+			// the values of the previous scripts are encoded already
+			if meta.Type != provider.meta[field.ID].Type || meta.EntityLevel != provider.meta[field.ID].EntityLevel {
+				return nil, errors.Errorf("values %d: field %s: the level or type of the values differ from values %d", i, v.Field, previous)
+			}
+		}
+		scripted[field.ID] = i
+		provider.meta[field.ID] = meta
+
+		script := scriptedValues{entities: map[uint]bool{}}
+		for _, entity := range v.Entities {
+			switch level {
+			case dcgm.FE_GPU:
+				if entity >= uint(len(s.GPUs)) {
+					return nil, errors.Errorf("values %d: field %s: GPU %d doesn't exist", i, v.Field, entity)
+				}
+			case dcgm.FE_SWITCH:
+				if entity >= uint(len(s.Switches)) {
+					return nil, errors.Errorf("values %d: field %s: NVSwitch %d doesn't exist", i, v.Field, entity)
+				}
+			}
+			script.entities[entity] = true
+		}
+
+		for _, value := range v.Values {
+			fv, err := newFieldValue(field, meta.Type, value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "values %d", i)
+			}
+			script.values = append(script.values, fv)
+		}
+
+		provider.scripts[field.ID] = append(provider.scripts[field.ID], script)
+	}
+
+	return provider, nil
+}
+
+// scriptedType returns the field type of the scripted values: int64 if all values are integers, double if all are numbers, string otherwise
+func scriptedType(values []string) string {
+	fieldType := "int64"
+	for _, value := range values {
+		if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+			continue
+		}
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return "string"
+		}
+		fieldType = "double"
+	}
+	return fieldType
+}
+
+// newFieldValue encodes the value of the field of the type like go-dcgm returns it
+func newFieldValue(field Field, fieldType string, value string) (dcgm.FieldValue_v1, error) {
+	fv := dcgm.FieldValue_v1{
+		FieldId: uint(field.ID),
+	}
+
+	switch fieldType {
+	case "double":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fv, errors.Errorf("field %s: invalid double %q", field.Name, value)
+		}
+		fv.FieldType = dcgm.DCGM_FT_DOUBLE
+		binary.NativeEndian.PutUint64(fv.Value[:8], math.Float64bits(f))
+	case "int64", "timestamp":
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fv, errors.Errorf("field %s: invalid integer %q", field.Name, value)
+		}
+		fv.FieldType = dcgm.DCGM_FT_INT64
+		binary.NativeEndian.PutUint64(fv.Value[:8], uint64(i))
+	case "string":
+		// NUL-terminated
+		if len(value) >= len(fv.Value) {
+			return fv, errors.Errorf("field %s: string of %d bytes is too long", field.Name, len(value))
+		}
+		fv.FieldType = dcgm.DCGM_FT_STRING
+		copy(fv.Value[:], value)
+	default:
+		return fv, errors.Errorf("field %s: values of type %s can't be simulated", field.Name, fieldType)
+	}
+
+	return fv, nil
+}
+
+// value returns the scripted value of the field for the entity at the step (the number of previous collections), if any
+func (p *simulatedProvider) value(field dcgm.Short, entity uint, step int) (dcgm.FieldValue_v1, bool) {
+	scripts := p.scripts[field]
+	for i := len(scripts) - 1; i >= 0; i-- {
+		script := scripts[i]
+		if len(script.entities) > 0 && !script.entities[entity] {
+			continue
+		}
+		return script.values[min(step, len(script.values)-1)], true
+	}
+	return dcgm.FieldValue_v1{}, false
+}
+
+// samples returns all scripted values of the field for the entity, if any
+func (p *simulatedProvider) samples(field dcgm.Short, entity uint) []dcgm.FieldValue_v1 {
+	scripts := p.scripts[field]
+	for i := len(scripts) - 1; i >= 0; i-- {
+		if len(scripts[i].entities) > 0 && !scripts[i].entities[entity] {
+			continue
+		}
+		return scripts[i].values
+	}
+	return nil
+}
+
+// setGPUStep records the step of the last GPU collection
+func (p *simulatedProvider) setGPUStep(step int) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.gpuStep = step
+}
+
+// getGPUStep returns the step of the last GPU collection
+func (p *simulatedProvider) getGPUStep() int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.gpuStep
+}
+
+// migInstances returns the current GPU instances of the GPU
+func (p *simulatedProvider) migInstances(gpu int) []scenarioGPUInstance {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.mig[gpu]
+}
+
+// reconfigureMIG replaces the GPU instances of the GPU, like reconfiguring MIG at runtime. MIG is disabled if empty
+func (p *simulatedProvider) reconfigureMIG(gpu uint, instances []scenarioGPUInstance) error {
+	if gpu >= uint(len(p.scenario.GPUs)) {
+		return errors.Errorf("GPU %d doesn't exist", gpu)
+	}
+	for j, instance := range instances {
+		if instance.Profile == "" {
+			return errors.Errorf("GPU %d: MIG instance %d has no profile", gpu, j)
+		}
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.mig[gpu] = slices.Clone(instances)
+	return nil
+}
+
+// isLost returns whether the GPU fell off the bus
+func (p *simulatedProvider) isLost(gpu uint) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.lost[gpu]
+}
+
+// setGPULost makes the GPU fall off the bus (e.g. XID 79), or come back
+// - a lost GPU is not discovered anymore, like a GPU removed via passthrough
+func (p *simulatedProvider) setGPULost(gpu uint, lost bool) error {
+	if gpu >= uint(len(p.scenario.GPUs)) {
+		return errors.Errorf("GPU %d doesn't exist", gpu)
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.lost[gpu] = lost
+	return nil
+}
+
+// links returns the number of NVLinks of the NVSwitch that are up
+func (p *simulatedProvider) links(sw int) int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.switchLinks[sw]
+}
+
+// setSwitchLinks sets the number of NVLinks of the NVSwitch that are up, like the fabric manager bringing links up
+func (p *simulatedProvider) setSwitchLinks(sw uint, links int) error {
+	if sw >= uint(len(p.scenario.Switches)) {
+		return errors.Errorf("NVSwitch %d doesn't exist", sw)
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.switchLinks[sw] = links
+	return nil
+}
+
+func (p *simulatedProvider) Connect(_ *dcgmexporter.Config) (func(), error) {
+	logrus.Infof("Simulating DCGM with %d GPUs and %d NVSwitches from scenario %s", len(p.scenario.GPUs), len(p.scenario.Switches), p.path)
+	return func() {}, nil
+}
+
+// FieldMeta returns the metadata of the field, taken from the scripted values
+func (p *simulatedProvider) FieldMeta(field dcgm.Short) (fieldMeta, bool) {
+	meta, exists := p.meta[field]
+	return meta, exists
+}
+
+// GetSupportedMetricGroups returns a single metric group with all profiling fields, so that all profiling fields can be watched
+func (p *simulatedProvider) GetSupportedMetricGroups(gpu uint) ([]dcgm.MetricGroup, error) {
+	if gpu >= uint(len(p.scenario.GPUs)) {
+		return nil, errors.Errorf("GPU %d doesn't exist", gpu)
+	}
+
+	group := dcgm.MetricGroup{}
+	for id := range p.meta {
+		for _, profilingGroup := range profilingGroups {
+			if id >= profilingGroup.min && id <= profilingGroup.max {
+				group.FieldIds = append(group.FieldIds, uint(id))
+			}
+		}
+	}
+	return []dcgm.MetricGroup{group}, nil
+}
+
+func (p *simulatedProvider) GetSystemInfo(_ *dcgmexporter.Config, entityType dcgm.Field_Entity_Group) (*dcgmexporter.SystemInfo, error) {
+	sysInfo := &dcgmexporter.SystemInfo{InfoType: entityType}
+
+	switch entityType {
+	case dcgm.FE_GPU:
+		// like DCGM, the entity ids of GPU and compute instances are unique across all GPUs
+		var instanceID, computeInstanceID uint
+		for i := range p.scenario.GPUs {
+			if p.isLost(uint(i)) {
+				continue
+			}
+
+			device, _ := p.GetDeviceInfo(uint(i))
+			gpu := dcgmexporter.GPUInfo{
+				DeviceInfo: device,
+				MigEnabled: len(p.migInstances(i)) > 0,
+			}
+
+			for j, instance := range p.migInstances(i) {
+				gpuInstance := dcgmexporter.GPUInstanceInfo{
+					Info: dcgm.MigEntityInfo{
+						GpuUuid:           device.UUID,
+						NvmlGpuIndex:      uint(i),
+						NvmlInstanceId:    uint(j),
+						NvmlProfileSlices: migProfileSlices(instance.Profile),
+					},
+					ProfileName: instance.Profile,
+					EntityId:    instanceID,
+				}
+				instanceID++
+
+				for k := 0; k < instance.ComputeInstances; k++ {
+					gpuInstance.ComputeInstances = append(gpuInstance.ComputeInstances, dcgmexporter.ComputeInstanceInfo{
+						InstanceInfo: dcgm.MigEntityInfo{
+							GpuUuid:               device.UUID,
+							NvmlGpuIndex:          uint(i),
+							NvmlInstanceId:        uint(j),
+							NvmlComputeInstanceId: uint(k),
+						},
+						ProfileName: instance.Profile,
+						EntityId:    computeInstanceID,
+					})
+					computeInstanceID++
+				}
+
+				gpu.GPUInstances = append(gpu.GPUInstances, gpuInstance)
+			}
+
+			sysInfo.GPUs[sysInfo.GPUCount] = gpu
+			sysInfo.GPUCount++
+		}
+	case dcgm.FE_SWITCH, dcgm.FE_LINK:
+		for i := range p.scenario.Switches {
+			switchInfo := dcgmexporter.SwitchInfo{EntityId: uint(i)}
+			for j := 0; j < p.links(i); j++ {
+				switchInfo.NvLinks = append(switchInfo.NvLinks, dcgm.NvLinkStatus{
+					ParentId:   uint(i),
+					ParentType: dcgm.FE_SWITCH,
+					State:      dcgm.LS_UP,
+					Index:      uint(j),
+				})
+			}
+			sysInfo.Switches = append(sysInfo.Switches, switchInfo)
+		}
+	default:
+		return nil, errors.Errorf("%s entities can't be simulated", entityType.String())
+	}
+
+	return sysInfo, nil
+}
+
+// GetGpuInstanceHierarchy returns the current GPU instances and their compute instances
+// - the entity ids are the ones of GetSystemInfo
+func (p *simulatedProvider) GetGpuInstanceHierarchy() (dcgm.MigHierarchy_v2, error) {
+	hierarchy := dcgm.MigHierarchy_v2{Version: 2}
+
+	add := func(entry dcgm.MigHierarchyInfo_v2) error {
+		if hierarchy.Count >= uint(len(hierarchy.EntityList)) {
+			return errors.Errorf("more than %d MIG instances can't be simulated", len(hierarchy.EntityList))
+		}
+		hierarchy.EntityList[hierarchy.Count] = entry
+		hierarchy.Count++
+		return nil
+	}
+
+	var instanceID, computeInstanceID uint
+	for i, gpu := range p.scenario.GPUs {
+		if p.isLost(uint(i)) {
+			continue
+		}
+		for j, instance := range p.migInstances(i) {
+			info := dcgm.MigEntityInfo{
+				GpuUuid:           gpu.UUID,
+				NvmlGpuIndex:      uint(i),
+				NvmlInstanceId:    uint(j),
+				NvmlProfileSlices: migProfileSlices(instance.Profile),
+			}
+			if err := add(dcgm.MigHierarchyInfo_v2{
+				Entity: dcgm.GroupEntityPair{EntityGroupId: dcgm.FE_GPU_I, EntityId: instanceID},
+				Parent: dcgm.GroupEntityPair{EntityGroupId: dcgm.FE_GPU, EntityId: uint(i)},
+				Info:   info,
+			}); err != nil {
+				return hierarchy, err
+			}
+
+			for k := 0; k < instance.ComputeInstances; k++ {
+				info.NvmlComputeInstanceId = uint(k)
+				if err := add(dcgm.MigHierarchyInfo_v2{
+					Entity: dcgm.GroupEntityPair{EntityGroupId: dcgm.FE_GPU_CI, EntityId: computeInstanceID},
+					Parent: dcgm.GroupEntityPair{EntityGroupId: dcgm.FE_GPU_I, EntityId: instanceID},
+					Info:   info,
+				}); err != nil {
+					return hierarchy, err
+				}
+				computeInstanceID++
+			}
+			instanceID++
+		}
+	}
+
+	return hierarchy, nil
+}
+
+// NewDeviceFields returns the fields watched for the entity group type, resolving the entity level of the fields from the scenario
+// - copied from: https://github.com/NVIDIA/dcgm-exporter/blob/402a10fd8bb4a36be7cc5b2c703cf8f1322d1ef0/pkg/dcgmexporter/dcgm.go#L41
+// - reason: resolves the entity level via dcgm.FieldGetById, which requires the DCGM library
+func (p *simulatedProvider) NewDeviceFields(counters []dcgmexporter.Counter, entityType dcgm.Field_Entity_Group) []dcgm.Short {
+	var deviceFields []dcgm.Short
+	for _, f := range counters {
+		meta, exists := p.meta[f.FieldID]
+		if !exists {
+			continue
+		}
+		level := meta.EntityLevel
+
+		if level == entityType || level == dcgm.FE_NONE {
+			deviceFields = append(deviceFields, f.FieldID)
+		} else if entityType == dcgm.FE_GPU && (level == dcgm.FE_GPU_CI || level == dcgm.FE_GPU_I || level == dcgm.FE_VGPU) {
+			deviceFields = append(deviceFields, f.FieldID)
+		} else if entityType == dcgm.FE_CPU && (level == dcgm.FE_CPU || level == dcgm.FE_CPU_CORE) {
+			deviceFields = append(deviceFields, f.FieldID)
+		}
+	}
+
+	return deviceFields
+}
+
+func (p *simulatedProvider) NewCollector(counters []dcgmexporter.Counter, hostname string, config *dcgmexporter.Config, item dcgmexporter.FieldEntityGroupTypeSystemInfoItem) (entityCollector, func(), error) {
+	if len(item.DeviceFields) == 0 {
+		return nil, func() {}, errors.New("fieldEntityGroupTypeSystemInfo is empty")
+	}
+
+	collector := &simulatedCollector{
+		provider:     p,
+		counters:     counters,
+		deviceFields: item.DeviceFields,
+		sysInfo:      item.SystemInfo,
+		hostname:     hostname,
+	}
+	if config != nil {
+		collector.useOldNamespace = config.UseOldNamespace
+		collector.replaceBlanksInModelName = config.ReplaceBlanksInModelName
+	}
+
+	return collector, collector.Cleanup, nil
+}
+
+func (p *simulatedProvider) NewXIDCollector(counters []dcgmexporter.Counter, hostname string, config *dcgmexporter.Config, item dcgmexporter.FieldEntityGroupTypeSystemInfoItem) (dcgmexporter.Collector, error) {
+	if !dcgmexporter.IsDCGMExpXIDErrorsCountEnabled(counters) {
+		return nil, errors.Errorf("%s collector is disabled", dcgmexporter.DCGMXIDErrorsCount.String())
+	}
+
+	collector := newSimulatedExpCollector(p, counters, dcgmexporter.DCGMXIDErrorsCount.String(), dcgm.DCGM_FI_DEV_XID_ERRORS, hostname, config, item)
+	collector.windowSize = config.XIDCountWindowSize
+	collector.labelFiller = func(labels map[string]string, value int64) {
+		labels["xid"] = fmt.Sprint(value)
+	}
+
+	return collector, nil
+}
+
+func (p *simulatedProvider) NewClockEventsCollector(counters []dcgmexporter.Counter, hostname string, config *dcgmexporter.Config, item dcgmexporter.FieldEntityGroupTypeSystemInfoItem) (dcgmexporter.Collector, error) {
+	if !dcgmexporter.IsDCGMExpClockEventsCountEnabled(counters) {
+		return nil, errors.Errorf("%s collector is disabled", dcgmexporter.DCGMClockEventsCount.String())
+	}
+
+	collector := newSimulatedExpCollector(p, counters, dcgmexporter.DCGMClockEventsCount.String(), dcgm.DCGM_FI_DEV_CLOCK_THROTTLE_REASONS, hostname, config, item)
+	collector.windowSize = config.ClockEventsCountWindowSize
+	collector.labelFiller = func(labels map[string]string, value int64) {
+		labels["clock_event"] = clockEventNames[value]
+	}
+	// the value is a bitmask of clock events
+	collector.fieldValueParser = func(value int64) []int64 {
+		var events []int64
+		for event := range clockEventNames {
+			if value&event != 0 {
+				events = append(events, event)
+			}
+		}
+		return events
+	}
+
+	return collector, nil
+}
+
+// WatchSamples returns a sampleWatch reading the scripted values of the fields as samples
+func (p *simulatedProvider) WatchSamples(entities []dcgm.GroupEntityPair, fields []dcgm.Short, updateFreq time.Duration, _ time.Duration) (sampleWatch, func(), error) {
+	for _, entity := range entities {
+		if entity.EntityGroupId != dcgm.FE_GPU {
+			return nil, func() {}, errors.Errorf("only GPUs can be sampled, but got: %s", entity.EntityGroupId.String())
+		}
+	}
+	return &simulatedSampleWatch{provider: p, entities: entities, fields: fields, interval: updateFreq}, func() {}, nil
+}
+
+func (p *simulatedProvider) UpdateAllFields() error {
+	return nil
+}
+
+// RunDiag returns passing results for the software tests, and the GPU tests of the level
+func (p *simulatedProvider) RunDiag(level int, gpus []uint) (dcgm.DiagResults, error) {
+	if len(gpus) == 0 {
+		for i := range p.scenario.GPUs {
+			gpus = append(gpus, uint(i))
+		}
+	}
+
+	results := dcgm.DiagResults{
+		Software: []dcgm.DiagResult{{Status: diagStatusPass, TestName: "software"}},
+	}
+
+	var tests []string
+	if dcgm.DiagType(level) >= dcgm.DiagMedium {
+		tests = append(tests, "pcie", "memory")
+	}
+	if dcgm.DiagType(level) >= dcgm.DiagLong {
+		tests = append(tests, "diagnostic", "targeted_stress", "targeted_power")
+	}
+
+	for _, gpu := range gpus {
+		if gpu >= uint(len(p.scenario.GPUs)) {
+			return dcgm.DiagResults{}, errors.Errorf("GPU %d doesn't exist", gpu)
+		}
+
+		gpuResult := dcgm.GpuResult{GPU: gpu}
+		for _, test := range tests {
+			gpuResult.DiagResults = append(gpuResult.DiagResults, dcgm.DiagResult{Status: diagStatusPass, TestName: test})
+		}
+		results.PerGpu = append(results.PerGpu, gpuResult)
+	}
+
+	return results, nil
+}
+
+func (p *simulatedProvider) Introspect() (dcgm.DcgmStatus, error) {
+	return dcgm.DcgmStatus{}, nil
+}
+
+func (p *simulatedProvider) GetSupportedDevices() ([]uint, error) {
+	gpus := make([]uint, 0, len(p.scenario.GPUs))
+	for i := range p.scenario.GPUs {
+		if !p.isLost(uint(i)) {
+			gpus = append(gpus, uint(i))
+		}
+	}
+	return gpus, nil
+}
+
+func (p *simulatedProvider) GetDeviceInfo(gpu uint) (dcgm.Device, error) {
+	if gpu >= uint(len(p.scenario.GPUs)) {
+		return dcgm.Device{}, errors.Errorf("GPU %d doesn't exist", gpu)
+	}
+	if p.isLost(gpu) {
+		return dcgm.Device{}, errors.Errorf("GPU %d is lost", gpu)
+	}
+
+	scenarioGPU := p.scenario.GPUs[gpu]
+	return dcgm.Device{
+		GPU:           gpu,
+		DCGMSupported: "Yes",
+		UUID:          scenarioGPU.UUID,
+		PCI:           dcgm.PCIInfo{BusID: scenarioGPU.PCIBusID},
+		Identifiers: dcgm.DeviceIdentifiers{
+			Brand: "NVIDIA",
+			Model: scenarioGPU.Model,
+		},
+	}, nil
+}
+
+// GetNvLinkLinkStatus returns the NVLinks of the GPUs and NVSwitches that are up
+func (p *simulatedProvider) GetNvLinkLinkStatus() ([]dcgm.NvLinkStatus, error) {
+	var links []dcgm.NvLinkStatus
+	for i, gpu := range p.scenario.GPUs {
+		if p.isLost(uint(i)) {
+			continue
+		}
+		for j := 0; j < gpu.NVLinks; j++ {
+			links = append(links, dcgm.NvLinkStatus{ParentId: uint(i), ParentType: dcgm.FE_GPU, State: dcgm.LS_UP, Index: uint(j)})
+		}
+	}
+	for i := range p.scenario.Switches {
+		for j := 0; j < p.links(i); j++ {
+			links = append(links, dcgm.NvLinkStatus{ParentId: uint(i), ParentType: dcgm.FE_SWITCH, State: dcgm.LS_UP, Index: uint(j)})
+		}
+	}
+	return links, nil
+}
+
+// simulatedCollector is an entityCollector reading the scripted values of a simulatedProvider
+// - adapted from: https://github.com/NVIDIA/dcgm-exporter/blob/402a10fd8bb4a36be7cc5b2c703cf8f1322d1ef0/pkg/dcgmexporter/gpu_collector.go#L104
+type simulatedCollector struct {
+	provider                 *simulatedProvider
+	counters                 []dcgmexporter.Counter
+	deviceFields             []dcgm.Short
+	sysInfo                  dcgmexporter.SystemInfo
+	hostname                 string
+	useOldNamespace          bool
+	replaceBlanksInModelName bool
+
+	mtx sync.Mutex
+	// step is the number of previous collections
+	step int
+}
+
+func (c *simulatedCollector) GetMetrics() (dcgmexporter.MetricsByCounter, error) {
+	c.mtx.Lock()
+	step := c.step
+	c.step++
+	c.mtx.Unlock()
+
+	if c.sysInfo.InfoType == dcgm.FE_GPU {
+		c.provider.setGPUStep(step)
+	}
+
+	metrics := make(dcgmexporter.MetricsByCounter)
+
+	for _, mi := range c.monitoringInfo() {
+		// GPU instances report the values of their GPU
+		entity := mi.Entity.EntityId
+		if c.sysInfo.InfoType == dcgm.FE_GPU {
+			entity = mi.DeviceInfo.GPU
+		}
+
+		var vals []dcgm.FieldValue_v1
+		for _, field := range c.deviceFields {
+			if val, exists := c.provider.value(field, entity, step); exists {
+				vals = append(vals, val)
+			}
+		}
+
+		if c.sysInfo.InfoType == dcgm.FE_SWITCH || c.sysInfo.InfoType == dcgm.FE_LINK {
+			dcgmexporter.ToSwitchMetric(metrics, vals, c.counters, mi, c.useOldNamespace, c.hostname)
+		} else {
+			dcgmexporter.ToMetric(metrics,
+				vals,
+				c.counters,
+				mi.DeviceInfo,
+				mi.InstanceInfo,
+				c.useOldNamespace,
+				c.hostname,
+				c.replaceBlanksInModelName)
+		}
+	}
+
+	return metrics, nil
+}
+
+// monitoringInfo returns the entities of the collector
+// - like dcgmexporter.GetMonitoredEntities with flexible device options, which can't be set from outside dcgm-exporter
+func (c *simulatedCollector) monitoringInfo() []dcgmexporter.MonitoringInfo {
+	var monitoring []dcgmexporter.MonitoringInfo
+
+	switch c.sysInfo.InfoType {
+	case dcgm.FE_SWITCH:
+		for _, sw := range c.sysInfo.Switches {
+			monitoring = append(monitoring, dcgmexporter.MonitoringInfo{
+				Entity:   dcgm.GroupEntityPair{EntityGroupId: dcgm.FE_SWITCH, EntityId: sw.EntityId},
+				ParentId: dcgmexporter.PARENT_ID_IGNORED,
+			})
+		}
+	case dcgm.FE_LINK:
+		for _, sw := range c.sysInfo.Switches {
+			for _, link := range sw.NvLinks {
+				monitoring = append(monitoring, dcgmexporter.MonitoringInfo{
+					Entity:   dcgm.GroupEntityPair{EntityGroupId: dcgm.FE_LINK, EntityId: link.Index},
+					ParentId: link.ParentId,
+				})
+			}
+		}
+	default:
+		monitoring = dcgmexporter.AddAllGPUInstances(c.sysInfo, true)
+	}
+
+	return monitoring
+}
+
+func (c *simulatedCollector) SystemInfo() dcgmexporter.SystemInfo {
+	return c.sysInfo
+}
+
+func (c *simulatedCollector) Cleanup() {}
+
+// clockEventNames are the names of the clock events by bit of DCGM_FI_DEV_CLOCK_THROTTLE_REASONS
+// - copied from: https://github.com/NVIDIA/dcgm-exporter/blob/402a10fd8bb4a36be7cc5b2c703cf8f1322d1ef0/pkg/dcgmexporter/clock_events_collector.go#L58
+// - reason: not exported
+var clockEventNames = map[int64]string{
+	0x0000000000000001: "gpu_idle",
+	0x0000000000000002: "clocks_setting",
+	0x0000000000000004: "power_cap",
+	0x0000000000000008: "hw_slowdown",
+	0x0000000000000010: "sync_boost",
+	0x0000000000000020: "sw_thermal",
+	0x0000000000000040: "hw_thermal",
+	0x0000000000000080: "hw_power_brake",
+	0x0000000000000100: "display_clocks",
+}
+
+// simulatedExpCollector is a dcgmexporter.Collector counting the scripted values of a field per GPU, like the XID and clock events collectors
+// - adapted from: https://github.com/NVIDIA/dcgm-exporter/blob/402a10fd8bb4a36be7cc5b2c703cf8f1322d1ef0/pkg/dcgmexporter/expcollector.go#L96
+// - the values are counted at the step of the last GPU collection, instead of over a time window
+type simulatedExpCollector struct {
+	provider                 *simulatedProvider
+	counter                  dcgmexporter.Counter
+	field                    dcgm.Short
+	labelsCounters           []dcgmexporter.Counter
+	sysInfo                  dcgmexporter.SystemInfo
+	hostname                 string
+	useOldNamespace          bool
+	replaceBlanksInModelName bool
+	windowSize               int
+	fieldValueParser         func(value int64) []int64
+	labelFiller              func(labels map[string]string, value int64)
+}
+
+// newSimulatedExpCollector creates a simulatedExpCollector of the counter named counterName, counting the values of the field
+func newSimulatedExpCollector(p *simulatedProvider, counters []dcgmexporter.Counter, counterName string, field dcgm.Short, hostname string, config *dcgmexporter.Config, item dcgmexporter.FieldEntityGroupTypeSystemInfoItem) *simulatedExpCollector {
+	collector := &simulatedExpCollector{
+		provider:                 p,
+		field:                    field,
+		sysInfo:                  item.SystemInfo,
+		hostname:                 hostname,
+		useOldNamespace:          config.UseOldNamespace,
+		replaceBlanksInModelName: config.ReplaceBlanksInModelName,
+		fieldValueParser: func(value int64) []int64 {
+			return []int64{value}
+		},
+		labelFiller: func(map[string]string, int64) {},
+	}
+
+	for _, counter := range counters {
+		if counter.FieldName == counterName {
+			collector.counter = counter
+		}
+		if counter.PromType == "label" {
+			collector.labelsCounters = append(collector.labelsCounters, counter)
+		}
+	}
+
+	return collector
+}
+
+func (c *simulatedExpCollector) GetMetrics() (dcgmexporter.MetricsByCounter, error) {
+	step := c.provider.getGPUStep()
+
+	uuid := "UUID"
+	if c.useOldNamespace {
+		uuid = "uuid"
+	}
+
+	metrics := make(dcgmexporter.MetricsByCounter)
+
+	for _, mi := range dcgmexporter.AddAllGPUInstances(c.sysInfo, true) {
+		labels := map[string]string{"window_size_in_ms": fmt.Sprint(c.windowSize)}
+		for _, counter := range c.labelsCounters {
+			if val, exists := c.provider.value(counter.FieldID, mi.DeviceInfo.GPU, step); exists {
+				labels[counter.FieldName] = dcgmexporter.ToString(val)
+			}
+		}
+
+		var values []int64
+		if val, exists := c.provider.value(c.field, mi.DeviceInfo.GPU, step); exists && val.Int64() != 0 {
+			values = c.fieldValueParser(val.Int64())
+		}
+
+		// like the dcgm-exporter, GPUs without values are reported with a count of 0
+		if len(values) == 0 {
+			metrics[c.counter] = append(metrics[c.counter], c.newMetric(labels, mi, uuid, 0))
+			continue
+		}
+
+		slices.Sort(values)
+		for _, value := range values {
+			valueLabels := maps.Clone(labels)
+			c.labelFiller(valueLabels, value)
+			metrics[c.counter] = append(metrics[c.counter], c.newMetric(valueLabels, mi, uuid, 1))
+		}
+	}
+
+	return metrics, nil
+}
+
+// newMetric creates the metric of the entity
+// - copied from: https://github.com/NVIDIA/dcgm-exporter/blob/402a10fd8bb4a36be7cc5b2c703cf8f1322d1ef0/pkg/dcgmexporter/expcollector.go#L163
+// - reason: not exported
+func (c *simulatedExpCollector) newMetric(labels map[string]string, mi dcgmexporter.MonitoringInfo, uuid string, val int) dcgmexporter.Metric {
+	gpuModel := mi.DeviceInfo.Identifiers.Model
+	if c.replaceBlanksInModelName {
+		gpuModel = strings.ReplaceAll(strings.Join(strings.Fields(gpuModel), " "), " ", "-")
+	}
+
+	m := dcgmexporter.Metric{
+		Counter:      c.counter,
+		Value:        fmt.Sprint(val),
+		UUID:         uuid,
+		GPU:          fmt.Sprintf("%d", mi.DeviceInfo.GPU),
+		GPUUUID:      mi.DeviceInfo.UUID,
+		GPUDevice:    fmt.Sprintf("nvidia%d", mi.DeviceInfo.GPU),
+		GPUModelName: gpuModel,
+		GPUPCIBusID:  mi.DeviceInfo.PCI.BusID,
+		Hostname:     c.hostname,
+
+		Labels:     labels,
+		Attributes: map[string]string{},
+	}
+	if mi.InstanceInfo != nil {
+		m.MigProfile = mi.InstanceInfo.ProfileName
+		m.GPUInstanceID = fmt.Sprintf("%d", mi.InstanceInfo.Info.NvmlInstanceId)
+	}
+	return m
+}
+
+func (c *simulatedExpCollector) Cleanup() {}
+
+// simulatedSampleWatch is a sampleWatch of a simulatedProvider
+// - every window sampled all scripted values of a field, one every interval
+type simulatedSampleWatch struct {
+	provider *simulatedProvider
+	entities []dcgm.GroupEntityPair
+	fields   []dcgm.Short
+	interval time.Duration
+}
+
+func (w *simulatedSampleWatch) GetValuesSince(since time.Time) ([]dcgm.FieldValue_v2, time.Time, error) {
+	next := since
+	var values []dcgm.FieldValue_v2
+	for _, entity := range w.entities {
+		if w.provider.isLost(entity.EntityId) {
+			continue
+		}
+		for _, field := range w.fields {
+			for i, sample := range w.provider.samples(field, entity.EntityId) {
+				ts := since.Add(time.Duration(i+1) * w.interval)
+				values = append(values, dcgm.FieldValue_v2{
+					EntityGroupId: entity.EntityGroupId,
+					EntityId:      entity.EntityId,
+					FieldId:       sample.FieldId,
+					FieldType:     sample.FieldType,
+					Ts:            ts.UnixMicro(),
+					Value:         sample.Value,
+				})
+				if ts.After(next) {
+					next = ts
+				}
+			}
+		}
+	}
+	return values, next, nil
+}
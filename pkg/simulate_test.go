@@ -0,0 +1,203 @@
+package pkg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+)
+
+const testScenario = "testdata/scenario.yaml"
+
+// simulatedValues returns the values of the metrics of the field, keyed by GPU (and GPU instance) or NVSwitch
+func simulatedValues(metrics dcgmexporter.MetricsByCounter, fieldName string) map[string]string {
+	got := map[string]string{}
+	for counter, counterMetrics := range metrics {
+		if counter.FieldName != fieldName {
+			continue
+		}
+		for _, metric := range counterMetrics {
+			key := metric.GPU
+			if metric.GPUInstanceID != "" {
+				key += "/" + metric.GPUInstanceID
+			}
+			got[key] = metric.Value
+		}
+	}
+	return got
+}
+
+func TestNewSimulatedProvider(t *testing.T) {
+	var tests = []struct {
+		name     string
+		scenario scenario
+		err      string
+	}{
+		{"valid", scenario{
+			GPUs:   []scenarioGPU{{}, {MIG: []scenarioGPUInstance{{Profile: "1g.10gb"}}}},
+			Values: []scenarioValues{{Field: "DCGM_FI_DEV_GPU_TEMP", Entities: []uint{1}, Values: []string{"34"}}},
+		}, ""},
+		{"unknown field", scenario{
+			Values: []scenarioValues{{Field: "DCGM_FI_DEV_GPU_TEMPERATURE", Values: []string{"34"}}},
+		}, `unknown field "DCGM_FI_DEV_GPU_TEMPERATURE"`},
+		{"no values", scenario{
+			Values: []scenarioValues{{Field: "DCGM_FI_DEV_GPU_TEMP"}},
+		}, "no values for field DCGM_FI_DEV_GPU_TEMP"},
+		{"unknown level", scenario{
+			Values: []scenarioValues{{Field: "DCGM_FI_DEV_GPU_TEMP", Level: "board", Values: []string{"34"}}},
+		}, `unknown level "board"`},
+		{"different types", scenario{
+			GPUs: []scenarioGPU{{}, {}},
+			Values: []scenarioValues{
+				{Field: "DCGM_FI_DEV_GPU_TEMP", Entities: []uint{0}, Values: []string{"34"}},
+				{Field: "DCGM_FI_DEV_GPU_TEMP", Entities: []uint{1}, Values: []string{"34.5"}},
+			},
+		}, "the level or type of the values differ from values 0"},
+		{"unknown GPU", scenario{
+			GPUs:   []scenarioGPU{{}},
+			Values: []scenarioValues{{Field: "DCGM_FI_DEV_GPU_TEMP", Entities: []uint{1}, Values: []string{"34"}}},
+		}, "GPU 1 doesn't exist"},
+		{"unknown NVSwitch", scenario{
+			Values: []scenarioValues{{Field: "DCGM_FI_DEV_NVSWITCH_TEMPERATURE_CURRENT", Level: "switch", Entities: []uint{0}, Values: []string{"45"}}},
+		}, "NVSwitch 0 doesn't exist"},
+		{"MIG instance without profile", scenario{
+			GPUs: []scenarioGPU{{MIG: []scenarioGPUInstance{{ComputeInstances: 1}}}},
+		}, "MIG instance 0 has no profile"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newSimulatedProvider(tt.scenario)
+			if tt.err == "" && err != nil {
+				t.Errorf("expected no error, but got: %s", err.Error())
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("expected error containing %q, but got: %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestScriptedType(t *testing.T) {
+	var tests = []struct {
+		values   []string
+		expected string
+	}{
+		{[]string{"34", "-1"}, "int64"},
+		{[]string{"72.5", "310.25"}, "double"},
+		{[]string{"0", "698.0"}, "double"},
+		{[]string{"550.90.07"}, "string"},
+		{[]string{"1", "high"}, "string"},
+	}
+
+	for _, tt := range tests {
+		if got := scriptedType(tt.values); got != tt.expected {
+			t.Errorf("%v: expected %s, but got: %s", tt.values, tt.expected, got)
+		}
+	}
+}
+
+func TestSimulatedProviderDefaults(t *testing.T) {
+	provider, err := newSimulatedProvider(scenario{GPUs: []scenarioGPU{{}, {}}})
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	device, err := provider.GetDeviceInfo(1)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	if device.UUID != "GPU-00000000-0000-0000-0000-000000000001" || device.PCI.BusID != "00000000:02:00.0" || device.Identifiers.Model != defaultSimulatedModel {
+		t.Errorf("expected the defaults of GPU 1, but got: %+v", device)
+	}
+
+	if _, err := provider.GetDeviceInfo(2); err == nil {
+		t.Errorf("expected an error for a GPU that doesn't exist")
+	}
+}
+
+func TestSimulatedPipeline(t *testing.T) {
+	provider, err := loadSimulatedProvider(testScenario)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	config := &dcgmexporter.Config{CollectDCP: true}
+	fillProfilingConfigMetricGroups(provider, config)
+
+	cs, err := getCounters(config)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	groups, err := getEntityGroups(provider, cs, config, nil)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	for _, egt := range []dcgm.Field_Entity_Group{dcgm.FE_GPU, dcgm.FE_SWITCH, dcgm.FE_LINK} {
+		if _, exists := groups[egt]; !exists {
+			t.Errorf("expected %s entities to be monitored", egt.String())
+		}
+	}
+	if _, exists := groups[dcgm.FE_CPU]; exists {
+		t.Errorf("expected no CPU entities to be monitored without fields to watch")
+	}
+
+	pipeline, cleanup, err := newMetricsPipeline(provider, config, cs.DCGMCounters, "gpu-droplet", groups, nil)
+	defer cleanup()
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	collectGPUs := func() dcgmexporter.MetricsByCounter {
+		metrics, err := pipeline.collectors[0].collector.GetMetrics()
+		if err != nil {
+			t.Fatalf("expected no error, but got: %s", err.Error())
+		}
+		return metrics
+	}
+
+	// every collection plays the next value, and repeats the last one
+	for _, expected := range []string{"34", "35", "37", "41", "41"} {
+		metrics := collectGPUs()
+
+		got := simulatedValues(metrics, "DCGM_FI_DEV_GPU_TEMP")
+		if want := map[string]string{"0": expected, "1/0": expected, "1/1": expected}; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %v, but got: %v", want, got)
+		}
+	}
+
+	// unscripted fields aren't reported, like unsupported fields
+	if got := simulatedValues(collectGPUs(), "DCGM_FI_DEV_SM_CLOCK"); len(got) != 0 {
+		t.Errorf("expected no values of an unscripted field, but got: %v", got)
+	}
+
+	// values scripted per GPU, and MIG instances report the values of their GPU
+	gpuMetrics := collectGPUs()
+	if got, want := simulatedValues(gpuMetrics, "DCGM_FI_PROF_GR_ENGINE_ACTIVE"), map[string]string{"0": "0.970000", "1/0": "0.000000", "1/1": "0.000000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, but got: %v", want, got)
+	}
+	for _, metric := range gpuMetrics[defaultCounters[dcgm.DCGM_FI_DEV_GPU_TEMP]] {
+		if metric.GPU == "1" && metric.MigProfile != "3g.40gb" {
+			t.Errorf("expected the MIG profile of GPU 1, but got: %+v", metric)
+		}
+		if metric.Labels["DCGM_FI_DRIVER_VERSION"] != "550.90.07" {
+			t.Errorf("expected the driver version label, but got: %+v", metric.Labels)
+		}
+	}
+
+	rendered, err := pipeline.collect()
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	for _, line := range []string{
+		`DCGM_FI_DEV_NVSWITCH_TEMPERATURE_CURRENT{nvswitch="0",Hostname="gpu-droplet",DCGM_FI_DRIVER_VERSION="550.90.07"} 45`,
+		`DCGM_FI_DEV_NVSWITCH_LINK_STATUS{nvlink="1",nvswitch="nvswitch0",Hostname="gpu-droplet",DCGM_FI_DRIVER_VERSION="550.90.07"} 1`,
+	} {
+		if !strings.Contains(strings.Join(rendered, ""), line) {
+			t.Errorf("expected the metrics to contain %q, but got: %s", line, strings.Join(rendered, ""))
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// spoolFileSuffix is the suffix of the files in the spool directory, each containing one batch of prometheus plaintext metrics
+const spoolFileSuffix = ".prom"
+
+// spool persists the metric batches that could not be pushed on shutdown, to push them after the next start
+type spool struct {
+	dir string
+}
+
+// newSpool creates a spool in dir, creating the directory if it does not exist
+func newSpool(dir string) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create push spool directory")
+	}
+
+	return &spool{dir: dir}, nil
+}
+
+// persist writes the batches to the spool, in order
+// - the file names sort in the order the batches were persisted, also across restarts
+func (s *spool) persist(batches [][]byte, now int64) (int, error) {
+	for i, batch := range batches {
+		path := filepath.Join(s.dir, fmt.Sprintf("%020d-%06d%s", now, i, spoolFileSuffix))
+		if err := os.WriteFile(path, batch, 0600); err != nil {
+			return i, errors.Wrap(err, "failed to persist metrics to the push spool")
+		}
+	}
+
+	return len(batches), nil
+}
+
+// replay reads and removes the persisted batches, in the order they were persisted
+func (s *spool) replay() ([][]byte, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read push spool directory")
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), spoolFileSuffix) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var batches [][]byte
+	for _, name := range names {
+		path := filepath.Join(s.dir, name)
+
+		batch, err := os.ReadFile(path)
+		if err != nil {
+			return batches, errors.Wrap(err, "failed to read persisted metrics from the push spool")
+		}
+
+		if err := os.Remove(path); err != nil {
+			logrus.Warnf("Failed to remove %s from the push spool, it may be pushed again: %s", path, err)
+		}
+
+		batches = append(batches, batch)
+	}
+
+	return batches, nil
+}
@@ -0,0 +1,58 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spool")
+	s, err := newSpool(dir)
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	// persisted on two shutdowns, the second with more than 10 batches, to check the file names sort numerically
+	if n, err := s.persist([][]byte{[]byte("a"), []byte("b")}, 1000); err != nil || n != 2 {
+		t.Fatalf("expected 2 persisted batches, but got: %d, %v", n, err)
+	}
+	var later [][]byte
+	var expected []string
+	for i := 0; i < 12; i++ {
+		later = append(later, []byte{byte('c' + i)})
+	}
+	if _, err := s.persist(later, 2000); err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(dir, "unrelated.txt"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = append(expected, "a", "b")
+	for _, batch := range later {
+		expected = append(expected, string(batch))
+	}
+
+	batches, err := s.replay()
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	var got []string
+	for _, batch := range batches {
+		got = append(got, string(batch))
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the batches in the order they were persisted %v, but got: %v", expected, got)
+	}
+
+	// replayed batches are removed from the spool
+	batches, err = s.replay()
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	if len(batches) != 0 {
+		t.Errorf("expected no batches after replaying, but got: %d", len(batches))
+	}
+}
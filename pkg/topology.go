@@ -0,0 +1,325 @@
+package pkg
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// attributes of the topology metrics
+	gpuAAttribute        = "gpu_a"
+	gpuBAttribute        = "gpu_b"
+	linkTypeAttribute    = "link_type"
+	numaNodeAttribute    = "numa_node"
+	cpuAffinityAttribute = "cpu_affinity"
+
+	// pciDevicesDir is the location of the PCI devices in sysfs relative to the host root
+	pciDevicesDir = "sys/bus/pci/devices"
+)
+
+// counters of the topology metrics
+// - added by the agent, hence, like the dcgm-exporter added counters, use ids outside the range of dcgm fields
+var (
+	p2pLinkCounter = dcgmexporter.Counter{
+		FieldID:   dcgm.Short(9101),
+		FieldName: "do_dcgm_gpu_p2p_link",
+		PromType:  "gauge",
+		Help:      "P2P link type (link_type, e.g. NV18, PIX, SYS) between the GPUs gpu_a and gpu_b. Always 1.",
+	}
+	cpuAffinityCounter = dcgmexporter.Counter{
+		FieldID:   dcgm.Short(9102),
+		FieldName: "do_dcgm_gpu_cpu_affinity_info",
+		PromType:  "gauge",
+		Help:      "NUMA node (numa_node) and CPUs (cpu_affinity) closest to the GPU. Always 1.",
+	}
+	nvLinksActiveCounter = dcgmexporter.Counter{
+		FieldID:   dcgm.Short(9103),
+		FieldName: "do_dcgm_gpu_nvlinks_active",
+		PromType:  "gauge",
+		Help:      "Number of NVLinks of the GPU that are up.",
+	}
+	nvLinksExpectedCounter = dcgmexporter.Counter{
+		FieldID:   dcgm.Short(9104),
+		FieldName: "do_dcgm_gpu_nvlinks_expected",
+		PromType:  "gauge",
+		Help:      "Number of NVLinks the GPU model is expected to have up.",
+	}
+	nvLinkDegradedCounter = dcgmexporter.Counter{
+		FieldID:   dcgm.Short(9105),
+		FieldName: "do_dcgm_gpu_nvlink_degraded",
+		PromType:  "gauge",
+		Help:      "1 if fewer NVLinks of the GPU are up than expected for the GPU model (e.g. a mis-seated HGX baseboard), 0 otherwise.",
+	}
+)
+
+// expectedNVLinksByModel is the number of NVLinks that are up on a healthy HGX/DGX baseboard, by GPU model name
+// - matched as substring of the model name reported by the driver (e.g. "NVIDIA H100 80GB HBM3"), the first match wins
+// - GPU models not listed (e.g. PCIe GPUs) are not checked for a degraded NVLink mesh, unless configured with --expected-nvlinks
+var expectedNVLinksByModel = []struct {
+	model string
+	links int
+}{
+	{"H100 80GB HBM3", 18}, // H100 SXM5
+	{"H200", 18},
+	{"B200", 18},
+	{"A100-SXM", 12},
+	{"V100-SXM2", 6},
+}
+
+// expectedNVLinks returns the number of NVLinks expected to be up for the GPU model, or 0 if unknown
+func expectedNVLinks(model string) int {
+	for _, sku := range expectedNVLinksByModel {
+		if strings.Contains(model, sku.model) {
+			return sku.links
+		}
+	}
+	return 0
+}
+
+// topologySource is the subset of dcgm used to read the GPU topology
+type topologySource interface {
+	GetSupportedDevices() ([]uint, error)
+	GetDeviceInfo(gpu uint) (dcgm.Device, error)
+	GetNvLinkLinkStatus() ([]dcgm.NvLinkStatus, error)
+}
+
+// dcgmTopologySource is a topologySource backed by the go-dcgm bindings
+type dcgmTopologySource struct{}
+
+func (dcgmTopologySource) GetSupportedDevices() ([]uint, error) {
+	return dcgm.GetSupportedDevices()
+}
+
+func (dcgmTopologySource) GetDeviceInfo(gpu uint) (dcgm.Device, error) {
+	return dcgm.GetDeviceInfo(gpu)
+}
+
+func (dcgmTopologySource) GetNvLinkLinkStatus() ([]dcgm.NvLinkStatus, error) {
+	return dcgm.GetNvLinkLinkStatus()
+}
+
+// topologyCollector is a dcgmexporter.Collector exporting the GPU topology
+// - do_dcgm_gpu_p2p_link: the P2P link type between every pair of GPUs
+// - do_dcgm_gpu_cpu_affinity_info: the NUMA node and CPU affinity of every GPU
+// - do_dcgm_gpu_nvlinks_active, do_dcgm_gpu_nvlinks_expected, do_dcgm_gpu_nvlink_degraded: the NVLink state of every GPU
+// The topology is static and only read once (again after a reset), the NVLink state is read on every collection.
+type topologyCollector struct {
+	source   topologySource
+	fs       hostFS
+	hostname string
+	// expectedLinks overwrites the number of NVLinks expected per GPU, if > 0
+	expectedLinks int
+	// selection selects the GPUs exported. All GPUs if nil
+	selection *deviceSelection
+
+	mtx      sync.Mutex
+	devices  []dcgm.Device
+	degraded map[uint]bool
+}
+
+// newTopologyCollector creates a topologyCollector reading the topology from the source, and the NUMA nodes from the sysfs mounted at root
+func newTopologyCollector(source topologySource, hostname string, root string, expectedLinks int) *topologyCollector {
+	return &topologyCollector{
+		source:        source,
+		fs:            osFS{root: root},
+		hostname:      hostname,
+		expectedLinks: expectedLinks,
+		degraded:      map[uint]bool{},
+	}
+}
+
+// reset reads the device info again on the next collection, e.g. after GPUs were added or lost
+func (c *topologyCollector) reset() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.devices = nil
+}
+
+// loadDevices reads the device info (including the topology) of all selected GPUs, once
+func (c *topologyCollector) loadDevices() ([]dcgm.Device, error) {
+	if c.devices != nil {
+		return c.devices, nil
+	}
+
+	gpus, err := c.source.GetSupportedDevices()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get supported GPUs")
+	}
+
+	devices := make([]dcgm.Device, 0, len(gpus))
+	for _, gpu := range gpus {
+		device, err := c.source.GetDeviceInfo(gpu)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get device info of GPU %d", gpu)
+		}
+		if !c.selection.selectsGPU(device) {
+			continue
+		}
+		devices = append(devices, device)
+	}
+
+	c.devices = devices
+	return devices, nil
+}
+
+// GetMetrics returns the topology metrics
+// - errors are logged instead of returned, to not fail the collection of the other registry collectors
+func (c *topologyCollector) GetMetrics() (dcgmexporter.MetricsByCounter, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	metrics := dcgmexporter.MetricsByCounter{}
+
+	devices, err := c.loadDevices()
+	if err != nil {
+		logrus.Warnf("Failed to read GPU topology: %s", err)
+		return metrics, nil
+	}
+
+	// the NVLink state is read before the P2P links, as the link type of NVSwitch systems is derived from it
+	links, linksErr := c.source.GetNvLinkLinkStatus()
+	if linksErr != nil {
+		logrus.Warnf("Failed to read NVLink status: %s", linksErr)
+	}
+
+	activeLinks := map[uint]int{}
+	for _, link := range links {
+		if link.ParentType == dcgm.FE_GPU && link.State == dcgm.LS_UP {
+			activeLinks[link.ParentId]++
+		}
+	}
+
+	byGPU := make(map[uint]dcgm.Device, len(devices))
+	for _, device := range devices {
+		byGPU[device.GPU] = device
+	}
+
+	for _, device := range devices {
+		// every pair of GPUs is only exported once, from the GPU with the lower id
+		for _, link := range device.Topology {
+			if link.GPU <= device.GPU {
+				continue
+			}
+			if _, exists := byGPU[link.GPU]; !exists {
+				continue
+			}
+
+			metrics[p2pLinkCounter] = append(metrics[p2pLinkCounter], c.newMetric(p2pLinkCounter, device, "1", map[string]string{
+				gpuAAttribute:     fmt.Sprintf("%d", device.GPU),
+				gpuBAttribute:     fmt.Sprintf("%d", link.GPU),
+				linkTypeAttribute: p2pLinkType(link.Link, activeLinks[device.GPU], activeLinks[link.GPU]),
+			}))
+		}
+
+		metrics[cpuAffinityCounter] = append(metrics[cpuAffinityCounter], c.newMetric(cpuAffinityCounter, device, "1", map[string]string{
+			numaNodeAttribute:    c.numaNode(device.PCI.BusID),
+			cpuAffinityAttribute: device.CPUAffinity,
+		}))
+	}
+
+	if linksErr != nil {
+		return metrics, nil
+	}
+
+	for _, device := range devices {
+		active := activeLinks[device.GPU]
+		metrics[nvLinksActiveCounter] = append(metrics[nvLinksActiveCounter], c.newMetric(nvLinksActiveCounter, device, fmt.Sprintf("%d", active), nil))
+
+		expected := c.expectedLinks
+		if expected <= 0 {
+			expected = expectedNVLinks(device.Identifiers.Model)
+		}
+		if expected <= 0 {
+			continue
+		}
+
+		degraded := active < expected
+		if degraded && !c.degraded[device.GPU] {
+			logrus.WithField(logFieldGPU, device.GPU).Warnf("NVLink mesh of GPU %d (%s) is degraded: %d of %d expected NVLinks are up", device.GPU, device.UUID, active, expected)
+		}
+		c.degraded[device.GPU] = degraded
+
+		degradedValue := "0"
+		if degraded {
+			degradedValue = "1"
+		}
+
+		metrics[nvLinksExpectedCounter] = append(metrics[nvLinksExpectedCounter], c.newMetric(nvLinksExpectedCounter, device, fmt.Sprintf("%d", expected), nil))
+		metrics[nvLinkDegradedCounter] = append(metrics[nvLinkDegradedCounter], c.newMetric(nvLinkDegradedCounter, device, degradedValue, nil))
+	}
+
+	return metrics, nil
+}
+
+// p2pLinkType returns the link type between two GPUs, as reported by `nvidia-smi topo -m` (e.g. NV18, PIX, SYS)
+// - go-dcgm only decodes paths that are exactly one of NVLINK1-4 or a single PCI path, and reports any other path as unknown,
+// e.g. the NVLINK18 path of the GPUs of an H100/H200 NVSwitch baseboard, or NVLink paths combined with a PCI path
+// - go-dcgm doesn't expose the bitmask of the path, so the NVLinks of an unknown path are taken from the NVLinks that are up:
+// on NVSwitch systems, every GPU reaches every other GPU via all of its NVLinks, which are the NVLinks up on both GPUs
+// - N/A if neither go-dcgm nor the NVLink state know the path
+func p2pLinkType(link dcgm.P2PLinkType, activeLinksA int, activeLinksB int) string {
+	if link != dcgm.P2PLinkUnknown {
+		return link.PCIPaths()
+	}
+
+	if links := min(activeLinksA, activeLinksB); links > 0 {
+		return fmt.Sprintf("NV%d", links)
+	}
+	return link.PCIPaths()
+}
+
+// newMetric creates a metric of the GPU, labeled like the metrics of the dcgm-exporter GPU collector
+func (c *topologyCollector) newMetric(counter dcgmexporter.Counter, device dcgm.Device, value string, attributes map[string]string) dcgmexporter.Metric {
+	return newGPUMetric(counter, device, c.hostname, value, attributes)
+}
+
+// newGPUMetric creates a metric of the GPU, labeled like the metrics of the dcgm-exporter GPU collector
+func newGPUMetric(counter dcgmexporter.Counter, device dcgm.Device, hostname string, value string, attributes map[string]string) dcgmexporter.Metric {
+	if attributes == nil {
+		attributes = map[string]string{}
+	}
+
+	return dcgmexporter.Metric{
+		Counter:      counter,
+		Value:        value,
+		UUID:         "UUID",
+		GPU:          fmt.Sprintf("%d", device.GPU),
+		GPUUUID:      device.UUID,
+		GPUDevice:    fmt.Sprintf("nvidia%d", device.GPU),
+		GPUModelName: device.Identifiers.Model,
+		GPUPCIBusID:  device.PCI.BusID,
+		Hostname:     hostname,
+		Labels:       map[string]string{},
+		Attributes:   attributes,
+	}
+}
+
+// numaNode returns the NUMA node of the PCI device from sysfs, or an empty string if unknown
+// - dcgm reports the PCI bus id with an 8 digit domain (e.g. 00000000:18:00.0), sysfs uses a 4 digit domain (e.g. 0000:18:00.0)
+func (c *topologyCollector) numaNode(busID string) string {
+	busID = strings.ToLower(busID)
+	if domain, rest, found := strings.Cut(busID, ":"); found && len(domain) > 4 {
+		busID = domain[len(domain)-4:] + ":" + rest
+	}
+
+	data, err := c.fs.ReadFile(path.Join(pciDevicesDir, busID, "numa_node"))
+	if err != nil {
+		return ""
+	}
+
+	node := strings.TrimSpace(string(data))
+	// -1 if the platform doesn't report NUMA information
+	if node == "-1" {
+		return ""
+	}
+	return node
+}
+
+func (c *topologyCollector) Cleanup() {}
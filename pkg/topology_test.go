@@ -0,0 +1,193 @@
+package pkg
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+)
+
+// fakeTopologySource is a topologySource with an HGX H100 baseboard: eight H100 SXM GPUs connected via NVSwitches
+// - go-dcgm reports the NVLINK18 path between the GPUs as unknown
+// - all GPUs have 18 NVLinks up, except GPU 1 with only 17
+type fakeTopologySource struct{}
+
+func (fakeTopologySource) GetSupportedDevices() ([]uint, error) {
+	return []uint{0, 1, 2, 3, 4, 5, 6, 7}, nil
+}
+
+func (fakeTopologySource) GetDeviceInfo(gpu uint) (dcgm.Device, error) {
+	device := dcgm.Device{
+		GPU:         gpu,
+		UUID:        fmt.Sprintf("GPU-%d", gpu),
+		PCI:         dcgm.PCIInfo{BusID: []string{"00000000:18:00.0", "00000000:2A:00.0", "00000000:3A:00.0", "00000000:5D:00.0", "00000000:9A:00.0", "00000000:AB:00.0", "00000000:BA:00.0", "00000000:DB:00.0"}[gpu]},
+		Identifiers: dcgm.DeviceIdentifiers{Model: "NVIDIA H100 80GB HBM3"},
+		CPUAffinity: []string{"0-47", "48-95"}[gpu/4],
+	}
+
+	for other := uint(0); other < 8; other++ {
+		if other != gpu {
+			device.Topology = append(device.Topology, dcgm.P2PLink{GPU: other, Link: dcgm.P2PLinkUnknown})
+		}
+	}
+
+	return device, nil
+}
+
+func (fakeTopologySource) GetNvLinkLinkStatus() ([]dcgm.NvLinkStatus, error) {
+	var links []dcgm.NvLinkStatus
+	for gpu := uint(0); gpu < 8; gpu++ {
+		for i := uint(0); i < 18; i++ {
+			state := dcgm.LS_UP
+			if gpu == 1 && i == 17 {
+				state = dcgm.LS_DOWN
+			}
+			links = append(links, dcgm.NvLinkStatus{ParentId: gpu, ParentType: dcgm.FE_GPU, State: state, Index: i})
+		}
+	}
+	// links of NVSwitches are not counted
+	links = append(links, dcgm.NvLinkStatus{ParentId: 0, ParentType: dcgm.FE_SWITCH, State: dcgm.LS_UP, Index: 0})
+	return links, nil
+}
+
+func newTestTopologyCollector(expectedLinks int) *topologyCollector {
+	files := fstest.MapFS{}
+	for gpu := uint(0); gpu < 7; gpu++ {
+		device, _ := fakeTopologySource{}.GetDeviceInfo(gpu)
+		busID := strings.ToLower(device.PCI.BusID[4:])
+		files["sys/bus/pci/devices/"+busID+"/numa_node"] = &fstest.MapFile{Data: []byte(fmt.Sprintf("%d\n", gpu/4))}
+	}
+	// the platform doesn't report the NUMA node of GPU 7
+	files["sys/bus/pci/devices/0000:db:00.0/numa_node"] = &fstest.MapFile{Data: []byte("-1\n")}
+
+	return &topologyCollector{
+		source:        fakeTopologySource{},
+		fs:            fixtureFS{MapFS: files},
+		expectedLinks: expectedLinks,
+		degraded:      map[uint]bool{},
+	}
+}
+
+// topologyValues returns the value and attributes of the metrics of the counter, keyed by GPU
+func topologyValues(metrics dcgmexporter.MetricsByCounter, counter dcgmexporter.Counter) map[string][]string {
+	got := map[string][]string{}
+	for _, metric := range metrics[counter] {
+		got[metric.GPU] = append(got[metric.GPU], metric.Value)
+		for _, name := range []string{gpuAAttribute, gpuBAttribute, linkTypeAttribute, numaNodeAttribute, cpuAffinityAttribute} {
+			if value, exists := metric.Attributes[name]; exists {
+				got[metric.GPU] = append(got[metric.GPU], name+"="+value)
+			}
+		}
+	}
+	return got
+}
+
+func TestTopologyCollector(t *testing.T) {
+	metrics, err := newTestTopologyCollector(0).GetMetrics()
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	// every pair of GPUs once, via the 18 NVLinks of the GPUs, or the 17 NVLinks up on GPU 1
+	expectedP2PLinks := map[string][]string{}
+	for a := 0; a < 8; a++ {
+		for b := a + 1; b < 8; b++ {
+			linkType := "NV18"
+			if a == 1 || b == 1 {
+				linkType = "NV17"
+			}
+			gpu := fmt.Sprintf("%d", a)
+			expectedP2PLinks[gpu] = append(expectedP2PLinks[gpu], "1", fmt.Sprintf("gpu_a=%d", a), fmt.Sprintf("gpu_b=%d", b), "link_type="+linkType)
+		}
+	}
+
+	var tests = []struct {
+		counter  dcgmexporter.Counter
+		expected map[string][]string
+	}{
+		{p2pLinkCounter, expectedP2PLinks},
+		{cpuAffinityCounter, map[string][]string{
+			"0": {"1", "numa_node=0", "cpu_affinity=0-47"},
+			"1": {"1", "numa_node=0", "cpu_affinity=0-47"},
+			"2": {"1", "numa_node=0", "cpu_affinity=0-47"},
+			"3": {"1", "numa_node=0", "cpu_affinity=0-47"},
+			"4": {"1", "numa_node=1", "cpu_affinity=48-95"},
+			"5": {"1", "numa_node=1", "cpu_affinity=48-95"},
+			"6": {"1", "numa_node=1", "cpu_affinity=48-95"},
+			"7": {"1", "numa_node=", "cpu_affinity=48-95"},
+		}},
+		{nvLinksActiveCounter, map[string][]string{"0": {"18"}, "1": {"17"}, "2": {"18"}, "3": {"18"}, "4": {"18"}, "5": {"18"}, "6": {"18"}, "7": {"18"}}},
+		{nvLinksExpectedCounter, map[string][]string{"0": {"18"}, "1": {"18"}, "2": {"18"}, "3": {"18"}, "4": {"18"}, "5": {"18"}, "6": {"18"}, "7": {"18"}}},
+		{nvLinkDegradedCounter, map[string][]string{"0": {"0"}, "1": {"1"}, "2": {"0"}, "3": {"0"}, "4": {"0"}, "5": {"0"}, "6": {"0"}, "7": {"0"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.counter.FieldName, func(t *testing.T) {
+			got := topologyValues(metrics, tt.counter)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %+v, but got: %+v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestTopologyCollectorExpectedLinksOverride(t *testing.T) {
+	metrics, err := newTestTopologyCollector(17).GetMetrics()
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	expected := map[string][]string{"0": {"0"}, "1": {"0"}, "2": {"0"}, "3": {"0"}, "4": {"0"}, "5": {"0"}, "6": {"0"}, "7": {"0"}}
+	if got := topologyValues(metrics, nvLinkDegradedCounter); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %+v, but got: %+v", expected, got)
+	}
+}
+
+func TestP2PLinkType(t *testing.T) {
+	var tests = []struct {
+		name         string
+		link         dcgm.P2PLinkType
+		activeLinksA int
+		activeLinksB int
+		expected     string
+	}{
+		{"decoded by go-dcgm", dcgm.FourNVLINKLinks, 12, 12, "NV4"},
+		{"PCI path", dcgm.P2PLinkCrossCPU, 0, 0, "SYS"},
+		{"NVSwitch", dcgm.P2PLinkUnknown, 18, 18, "NV18"},
+		{"NVSwitch with a link down", dcgm.P2PLinkUnknown, 18, 17, "NV17"},
+		{"unknown", dcgm.P2PLinkUnknown, 18, 0, "N/A"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p2pLinkType(tt.link, tt.activeLinksA, tt.activeLinksB); got != tt.expected {
+				t.Errorf("expected %s, but got: %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestExpectedNVLinks(t *testing.T) {
+	var tests = []struct {
+		model    string
+		expected int
+	}{
+		{"NVIDIA H100 80GB HBM3", 18},
+		{"NVIDIA H200", 18},
+		{"NVIDIA A100-SXM4-80GB", 12},
+		{"NVIDIA H100 PCIe", 0},
+		{"NVIDIA L40S", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			if got := expectedNVLinks(tt.model); got != tt.expected {
+				t.Errorf("expected %d, but got: %d", tt.expected, got)
+			}
+		})
+	}
+}
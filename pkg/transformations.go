@@ -0,0 +1,197 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultPodResourcesKubeletSocket is the default location of the kubelet pod-resources API socket
+	DefaultPodResourcesKubeletSocket = "/var/lib/kubelet/pod-resources/kubelet.sock"
+
+	// optionalTransformBackoff is how long an optional transformation is skipped after it failed
+	// - an attempt may block the collection, e.g. the pod mapping dials the kubelet with a timeout of 10s
+	optionalTransformBackoff = time.Minute
+)
+
+// getTransformations returns the transformations applied to the GPU metrics of the pipeline and of the registry collectors
+// - the transformations of the dcgm-exporter (Kubernetes pod mapping, HPC job mapping) are applied by the agent and not the dcgm-exporter,
+// hence they are not enabled in the dcgmexporter.Config
+// - the MIG parent GPU series are added first, so that the other transformations label them like the GPU instance series
+func (a GPUMetricsAgent) getTransformations() []dcgmexporter.Transform {
+	transformations := []dcgmexporter.Transform{newMIGAggregator()}
+
+	if a.Options.Kubernetes {
+		podMapper, err := dcgmexporter.NewPodMapper(a.DcgmExporterConfig)
+		if err != nil {
+			logrus.Warnf("Could not enable kubernetes metric collection: %v", err)
+		} else {
+			socket := a.DcgmExporterConfig.PodResourcesKubeletSocket
+			transformations = append(transformations, newOptionalTransform(podMapper, func() error { return socketAvailable(socket) }, a.clock.Now))
+		}
+	}
+
+	if a.Options.HPCJobMappingDir != "" {
+		transformations = append(transformations, newHPCMapper(a.Options.HPCJobMappingDir))
+	}
+
+	if a.Options.ProcessAttribution {
+		transformations = append(transformations, newGPUProcessMapper("/"))
+	}
+
+	if a.dropletMetadata != nil {
+		transformations = append(transformations, a.dropletMetadata)
+	}
+
+	return transformations
+}
+
+// logTransformationDiagnostics logs at startup whether the sources of the configured transformations are available
+func (a GPUMetricsAgent) logTransformationDiagnostics() {
+	if a.Options.Kubernetes {
+		socket := a.DcgmExporterConfig.PodResourcesKubeletSocket
+		info, err := os.Stat(socket)
+		switch {
+		case os.IsNotExist(err):
+			logrus.Warnf("Kubernetes pod mapping: kubelet pod-resources socket %q does not exist. Metrics are exported without pod labels until it appears", socket)
+		case err != nil:
+			logrus.Warnf("Kubernetes pod mapping: cannot access kubelet pod-resources socket %q: %s", socket, err)
+		case info.Mode()&os.ModeSocket == 0:
+			logrus.Warnf("Kubernetes pod mapping: %q is not a socket", socket)
+		default:
+			logrus.Infof("Kubernetes pod mapping: using kubelet pod-resources socket %q with GPU id type %q", socket, a.DcgmExporterConfig.KubernetesGPUIdType)
+		}
+	}
+
+	if a.Options.HPCJobMappingDir != "" {
+		if _, err := os.Stat(a.Options.HPCJobMappingDir); err != nil {
+			logrus.Warnf("HPC job mapping: cannot access job mapping directory %q: %s. Metrics are exported without hpc_job labels until it appears", a.Options.HPCJobMappingDir, err)
+		} else {
+			logrus.Infof("HPC job mapping: using job mapping directory %q", a.Options.HPCJobMappingDir)
+		}
+	}
+}
+
+// validateKubernetesGPUIdType returns an error for GPU id types not supported by the dcgm-exporter pod mapping
+func validateKubernetesGPUIdType(idType string) error {
+	switch dcgmexporter.KubernetesGPUIDType(idType) {
+	case dcgmexporter.GPUUID, dcgmexporter.DeviceName:
+		return nil
+	}
+	return fmt.Errorf("unsupported kubernetes GPU id type %q, must be one of: %s, %s", idType, dcgmexporter.GPUUID, dcgmexporter.DeviceName)
+}
+
+// optionalTransform wraps a transformation whose source might be temporarily unavailable (e.g. the kubelet is restarting).
+// Instead of failing the whole collection, the metrics are exported without the labels of the transformation.
+// - the source is checked cheaply before every attempt (e.g. whether the kubelet socket exists), as an attempt may block the collection
+// - after a failure, the transformation is skipped for optionalTransformBackoff
+// - shared by the pipeline and the registry collectors, hence, the attempts are serialized
+type optionalTransform struct {
+	dcgmexporter.Transform
+	// available returns an error if the source is unavailable. Always available if nil
+	available func() error
+	now       func() time.Time
+	failures  *failureLog
+
+	mtx     sync.Mutex
+	retryAt time.Time
+}
+
+func newOptionalTransform(transform dcgmexporter.Transform, available func() error, now func() time.Time) *optionalTransform {
+	failures := newFailureLog(fmt.Sprintf("Transform '%s' (exporting metrics without its labels)", transform.Name()), logrus.Fields{}, failureLogInterval)
+	failures.now = now
+	return &optionalTransform{
+		Transform: transform,
+		available: available,
+		now:       now,
+		failures:  failures,
+	}
+}
+
+func (t *optionalTransform) Process(metrics dcgmexporter.MetricsByCounter, sysInfo dcgmexporter.SystemInfo) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	now := t.now()
+	if now.Before(t.retryAt) {
+		return nil
+	}
+
+	var err error
+	if t.available != nil {
+		err = t.available()
+	}
+	if err == nil {
+		err = t.Transform.Process(metrics, sysInfo)
+	}
+
+	t.failures.observe(err)
+	if err != nil {
+		t.retryAt = now.Add(optionalTransformBackoff)
+	}
+	return nil
+}
+
+// socketAvailable returns an error if the path is not a socket
+func socketAvailable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return errors.Errorf("%s is not a socket", path)
+	}
+	return nil
+}
+
+// transformingCollector applies transformations to the metrics gathered from a dcgm-exporter registry.
+// - used for the registry collectors (XID errors, clock events), which are not part of the pipeline
+type transformingCollector struct {
+	transformations []dcgmexporter.Transform
+
+	// mtx guards the registry, which is replaced when the GPUs changed
+	mtx      sync.Mutex
+	registry *dcgmexporter.Registry
+	sysInfo  dcgmexporter.SystemInfo
+}
+
+// replace replaces the registry and the GPUs it collects metrics for, and cleans up the previous registry
+func (c *transformingCollector) replace(registry *dcgmexporter.Registry, sysInfo dcgmexporter.SystemInfo) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.registry.Cleanup()
+	c.registry = registry
+	c.sysInfo = sysInfo
+}
+
+func (c *transformingCollector) GetMetrics() (dcgmexporter.MetricsByCounter, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	metrics, err := c.registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, transform := range c.transformations {
+		if err := transform.Process(metrics, c.sysInfo); err != nil {
+			return nil, fmt.Errorf("failed to transform metrics for transform '%s'; err: %w", transform.Name(), err)
+		}
+	}
+
+	return metrics, nil
+}
+
+func (c *transformingCollector) Cleanup() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.registry.Cleanup()
+}
@@ -0,0 +1,189 @@
+package pkg
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
+)
+
+// fakeTransform adds a static attribute to every metric, or fails
+type fakeTransform struct {
+	err   error
+	calls int
+}
+
+func (f *fakeTransform) Name() string {
+	return "fakeTransform"
+}
+
+func (f *fakeTransform) Process(metrics dcgmexporter.MetricsByCounter, _ dcgmexporter.SystemInfo) error {
+	f.calls++
+	if f.err != nil {
+		return f.err
+	}
+	for counter := range metrics {
+		for i := range metrics[counter] {
+			metrics[counter][i].Attributes["fake"] = "true"
+		}
+	}
+	return nil
+}
+
+// fakeCollector returns a static set of metrics
+type fakeCollector struct {
+	metrics dcgmexporter.MetricsByCounter
+}
+
+func (f *fakeCollector) GetMetrics() (dcgmexporter.MetricsByCounter, error) {
+	return f.metrics, nil
+}
+
+func (f *fakeCollector) Cleanup() {}
+
+func TestOptionalTransform(t *testing.T) {
+	counter := dcgmexporter.Counter{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge"}
+	newMetrics := func() dcgmexporter.MetricsByCounter {
+		return dcgmexporter.MetricsByCounter{
+			counter: {{Counter: counter, Value: "40", GPU: "0", Attributes: map[string]string{}}},
+		}
+	}
+
+	clock := &fakeClock{now: time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)}
+	fake := &fakeTransform{err: errors.New("kubelet unavailable")}
+	var unavailable error
+	transform := newOptionalTransform(fake, func() error { return unavailable }, clock.Now)
+
+	var tests = []struct {
+		name          string
+		advance       time.Duration
+		err           error
+		unavailable   error
+		expectedCalls int
+		expectedLabel bool
+	}{
+		{"failing", 0, errors.New("kubelet unavailable"), nil, 1, false},
+		{"skipped after a failure", 30 * time.Second, nil, nil, 1, false},
+		{"retried after the backoff", optionalTransformBackoff, nil, nil, 2, true},
+		{"source unavailable", 0, nil, os.ErrNotExist, 2, false},
+		{"skipped while the source is unavailable", 30 * time.Second, nil, nil, 2, false},
+		{"source available again", optionalTransformBackoff, nil, nil, 3, true},
+	}
+
+	for _, tt := range tests {
+		clock.Advance(tt.advance)
+		fake.err = tt.err
+		unavailable = tt.unavailable
+
+		metrics := newMetrics()
+		if err := transform.Process(metrics, dcgmexporter.SystemInfo{}); err != nil {
+			t.Errorf("%s: expected no error, but got: %s", tt.name, err.Error())
+		}
+		if fake.calls != tt.expectedCalls {
+			t.Errorf("%s: expected %d calls of the transformation, but got: %d", tt.name, tt.expectedCalls, fake.calls)
+		}
+		if labeled := metrics[counter][0].Attributes["fake"] == "true"; labeled != tt.expectedLabel || len(metrics[counter]) != 1 {
+			t.Errorf("%s: expected the metrics to be labeled %t, but got: %+v", tt.name, tt.expectedLabel, metrics[counter])
+		}
+	}
+}
+
+func TestSocketAvailable(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "kubelet.sock")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	if err := socketAvailable(filepath.Join(dir, "missing.sock")); !os.IsNotExist(err) {
+		t.Errorf("expected a not exist error, but got: %v", err)
+	}
+	if err := socketAvailable(file); err == nil || !strings.Contains(err.Error(), "is not a socket") {
+		t.Errorf("expected a not a socket error, but got: %v", err)
+	}
+}
+
+func TestTransformingCollector(t *testing.T) {
+	counter := dcgmexporter.Counter{FieldID: 9001, FieldName: "DCGM_EXP_XID_ERRORS_COUNT", PromType: "gauge"}
+
+	registry := dcgmexporter.NewRegistry()
+	registry.Register(&fakeCollector{metrics: dcgmexporter.MetricsByCounter{
+		counter: {{Counter: counter, Value: "0", GPU: "0", Attributes: map[string]string{}}},
+	}})
+
+	collector := &transformingCollector{
+		registry:        registry,
+		transformations: []dcgmexporter.Transform{&fakeTransform{}},
+	}
+
+	metrics, err := collector.GetMetrics()
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	if metrics[counter][0].Attributes["fake"] != "true" {
+		t.Errorf("expected transformation to be applied, but got: %+v", metrics[counter][0])
+	}
+
+	collector.transformations = []dcgmexporter.Transform{&fakeTransform{err: errors.New("failure")}}
+	if _, err := collector.GetMetrics(); err == nil {
+		t.Errorf("expected an error from a failing transformation")
+	}
+}
+
+func TestHPCMapper(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "0"), []byte("job1\njob2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "not-a-gpu"), []byte("job3\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	counter := dcgmexporter.Counter{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge"}
+	metrics := dcgmexporter.MetricsByCounter{
+		counter: {
+			{Counter: counter, Value: "40", GPU: "0", Attributes: map[string]string{}},
+			{Counter: counter, Value: "41", GPU: "1", Attributes: map[string]string{}},
+		},
+	}
+
+	if err := newHPCMapper(dir).Process(metrics, dcgmexporter.SystemInfo{}); err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+
+	var got []map[string]string
+	for _, metric := range metrics[counter] {
+		got = append(got, metric.Attributes)
+	}
+
+	expected := []map[string]string{{hpcJobAttribute: "job1"}, {hpcJobAttribute: "job2"}, {}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected attributes %+v, but got: %+v", expected, got)
+	}
+}
+
+func TestValidateKubernetesGPUIdType(t *testing.T) {
+	var tests = []struct {
+		idType      string
+		returnError bool
+	}{
+		{"uid", false},
+		{"device-name", false},
+		{"index", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.idType, func(t *testing.T) {
+			err := validateKubernetesGPUIdType(tt.idType)
+			if (err != nil) != tt.returnError {
+				t.Errorf("expected error: %v, but got: %v", tt.returnError, err)
+			}
+		})
+	}
+}
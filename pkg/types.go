@@ -1,6 +1,9 @@
 package pkg
 
 import (
+	"os"
+	"time"
+
 	"github.com/NVIDIA/dcgm-exporter/pkg/dcgmexporter"
 	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
 	httpclient "github.com/digitalocean/do-dcgm-exporter/pkg/client"
@@ -14,6 +17,195 @@ type GPUMetricsAgent struct {
 
 	// DcgmExporterConfig is the configuration of the underlying DCGM exporter
 	DcgmExporterConfig *dcgmexporter.Config
+
+	// Options are the user-provided settings the agent was created with
+	Options Options
+
+	// dropletMetadata adds droplet metadata to exported series. Nil if disabled
+	dropletMetadata *dropletMetadataEnricher
+
+	// provider is how the agent talks to DCGM, either via the nv-hostengine or simulated
+	provider dcgmProvider
+
+	// history keeps the recent pushes and logged errors of the running agent
+	history *history
+
+	// diagnostics runs DCGM diagnostics via the connection of the current collection, and keeps the last report across reloads
+	diagnostics *diagnostics
+
+	// diagScheduler runs scheduled diagnostics, and keeps the schedule across reloads. Nil if disabled
+	diagScheduler *diagScheduler
+
+	// selection selects the watched GPUs, NVSwitches and NVLinks. Nil if all are watched
+	selection *deviceSelection
+
+	// sampledFields are the fields exported as statistics of their samples. Empty if none
+	sampledFields []sampledField
+
+	// proxyURL is the URL the metrics are pushed to, by default the DO proxy endpoint
+	proxyURL string
+
+	// notifier notifies systemd about the state of the agent
+	notifier *systemdNotifier
+
+	// spool persists the metrics that could not be pushed on shutdown. Nil if disabled
+	spool *spool
+
+	// pushAuth adds the configured headers and credentials to the pushes. Nil if none are configured
+	pushAuth *pushAuth
+
+	// clock is the source of time of the collection and the pushes
+	clock clock
+
+	// signals delivers the OS signals terminating (SIGINT, SIGTERM, SIGQUIT) or reloading (SIGHUP) the running agent.
+	// The signals of the process are watched if nil
+	signals chan os.Signal
+
+	// root is the host root the sysfs is read from
+	root string
+}
+
+// Options are the user-provided settings of the GPUMetricsAgent
+type Options struct {
+	// AdditionalFieldsPath is the path to a file containing additional DCGM fields to monitor
+	AdditionalFieldsPath string
+
+	// Debug enables debug logs, a shorthand for LogLevel "debug"
+	Debug bool
+
+	// LogFormat is the format of the logs. One of LogFormats
+	LogFormat string
+
+	// LogLevel is the minimum level of the logs (e.g. "warning"). Defaults to "info"
+	LogLevel string
+
+	// ProcessAttribution labels GPU metrics with the systemd units and containers that hold the GPU open
+	// - requires permissions to read the file descriptors of all processes in /proc
+	ProcessAttribution bool
+
+	// Kubernetes labels GPU metrics with the pod, namespace and container the GPU is allocated to, obtained from the kubelet
+	Kubernetes bool
+
+	// KubernetesGPUIdType is the type of GPU id ("uid" or "device-name") the kubelet device plugin reports GPUs with
+	KubernetesGPUIdType string
+
+	// PodResourcesKubeletSocket is the path to the kubelet pod-resources API socket
+	PodResourcesKubeletSocket string
+
+	// NvidiaResourceNames are additional Kubernetes resource names (besides nvidia.com/gpu) that map to GPUs
+	NvidiaResourceNames []string
+
+	// HPCJobMappingDir is the directory containing one file per GPU index listing the HPC jobs (e.g. Slurm jobs) using the GPU
+	HPCJobMappingDir string
+
+	// DropletMetadata enables fetching the droplet metadata to export the do_droplet_info metric
+	DropletMetadata bool
+
+	// DropletMetadataLabels are the droplet metadata labels (droplet_id, region, tags, vpc) added to every exported series
+	DropletMetadataLabels []string
+
+	// DropletMetadataRefreshInterval is how often the droplet metadata is refreshed
+	DropletMetadataRefreshInterval time.Duration
+
+	// ExpectedNVLinks is the number of NVLinks expected to be up per GPU. If 0, it is derived from the GPU model
+	ExpectedNVLinks int
+
+	// GPUs are the GPUs watched, by index, UUID or PCI bus id. All GPUs if empty
+	GPUs []string
+
+	// ExcludeGPUs are the GPUs not watched, by index, UUID or PCI bus id
+	ExcludeGPUs []string
+
+	// NVSwitches are the NVSwitches watched, by index. All NVSwitches if empty
+	NVSwitches []string
+
+	// ExcludeNVSwitches are the NVSwitches not watched, by index
+	ExcludeNVSwitches []string
+
+	// NVLinks are the NVSwitch links watched, by <NVSwitch index>/<link index> or link index. All links if empty
+	NVLinks []string
+
+	// ExcludeNVLinks are the NVSwitch links not watched, by <NVSwitch index>/<link index> or link index
+	ExcludeNVLinks []string
+
+	// APIAddress is the address of the API server serving operational endpoints (e.g. POST /diag). The API server is disabled if empty
+	APIAddress string
+
+	// APITokenFile is the path to the file containing the bearer token required by the API server
+	// - redacted in support bundles, as it points to a credential
+	APITokenFile string `redact:"true"`
+
+	// SampleStats are the GPU fields sampled at SampleInterval, exported as statistics of their samples per collection window. Each <field name>[=<statistic>,...]
+	// - the statistics are min, max, avg and p<percentile> (e.g. p95). Defaults to min, max and avg
+	SampleStats []string
+
+	// SampleInterval is how often the sampled fields are updated by DCGM
+	SampleInterval time.Duration
+
+	// RediscoveryInterval is how often the GPUs, NVSwitches, NVLinks and CPUs are re-discovered, to rebuild the collectors of changed entities. Disabled if 0
+	RediscoveryInterval time.Duration
+
+	// DiagInterval is how often a quick DCGM diagnostic (level 1) is run in the background. Disabled if 0
+	DiagInterval time.Duration
+
+	// DiagIdleLookback is how long all GPUs must have been idle before a scheduled diagnostic runs
+	DiagIdleLookback time.Duration
+
+	// PushURL is the URL the metrics are pushed to. Defaults to the DO proxy endpoint
+	PushURL string `redact:"userinfo"`
+
+	// PushCAFile is the path to the PEM encoded CA certificates verifying the push server. The system CAs are used if empty
+	PushCAFile string
+
+	// PushClientCertFile and PushClientKeyFile are the paths to the PEM encoded client certificate and key authenticating the agent via mTLS
+	PushClientCertFile string
+	PushClientKeyFile  string `redact:"true"`
+
+	// PushServerName is the server name (SNI) used to verify the push server. Derived from the push URL if empty
+	PushServerName string
+
+	// PushBearerTokenFile is the path to the file containing the bearer token the pushes are authenticated with
+	// - re-read when it changes
+	PushBearerTokenFile string `redact:"true"`
+
+	// PushBasicAuthFile is the path to the file containing the "username:password" the pushes are authenticated with
+	// - re-read when it changes
+	PushBasicAuthFile string `redact:"true"`
+
+	// PushHeaders are static headers ("Name: value") added to the pushes
+	// - redacted in support bundles, as they may contain credentials
+	PushHeaders []string `redact:"true"`
+
+	// Addresses are the addresses the /metrics endpoint listens on. Defaults to localhost:9401
+	Addresses []string
+
+	// WebConfigFile is the path to the exporter-toolkit web config file, configuring TLS and authentication of the /metrics endpoint
+	WebConfigFile string
+
+	// WebSystemdSocket serves /metrics on the sockets passed by systemd socket activation, instead of listening on --address
+	WebSystemdSocket bool
+
+	// DebugAddress is the address of the debug server serving pprof, expvar and the internal state. The debug server is disabled if empty
+	DebugAddress string
+
+	// DebugAllowRemote allows the debug server to listen on a non-loopback address
+	DebugAllowRemote bool
+
+	// PushQueueSize is the number of collected metric batches queued to be pushed
+	PushQueueSize int
+
+	// PushQueueOverflow is the policy deciding which batches are dropped if the push queue is full. One of PushOverflowPolicies
+	PushQueueOverflow string
+
+	// PushSpoolDir is the directory the metrics that could not be pushed on shutdown are persisted to, and pushed from after the next start
+	// - the metrics are dropped on shutdown if empty
+	PushSpoolDir string
+
+	// ShutdownGracePeriod is how long the agent takes to stop collecting, flush the queued metrics and disconnect from DCGM at most
+	ShutdownGracePeriod time.Duration
+
+	// SimulateScenario is the path to a scenario file of simulated GPUs, replacing DCGM. DCGM is used if empty
+	SimulateScenario string
 }
 
 var (
@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/exporter-toolkit/web"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+	The /metrics endpoint exposes the GPU models and utilization of the droplet. Hence, it listens on localhost by default.
+	To be scraped from other hosts, it can listen on another address (e.g. the VPC interface), and be secured with an exporter-toolkit web config file:
+	- TLS, with the certificate re-read on every new connection, so renewed certificates are picked up without restarting
+	- basic auth users with bcrypt hashed passwords
+	- mTLS (client_auth_type: RequireAndVerifyClientCert)
+	See https://github.com/prometheus/exporter-toolkit/blob/master/docs/web-configuration.md
+*/
+
+// DefaultAddress is the address the /metrics endpoint listens on by default
+const DefaultAddress = "localhost:9401"
+
+// cgnatNetwork is the shared address space (RFC 6598), which is not reachable publicly
+var cgnatNetwork = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// webConfig are the settings of an exporter-toolkit web config file, that authenticate clients
+type webConfig struct {
+	TLSServerConfig struct {
+		ClientAuthType string `yaml:"client_auth_type"`
+	} `yaml:"tls_server_config"`
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+}
+
+// validateWebConfigFile validates the web config file, including the certificates it refers to
+func validateWebConfigFile(path string) error {
+	if err := web.Validate(path); err != nil {
+		return errors.Wrapf(err, "invalid web config file %q", path)
+	}
+	return nil
+}
+
+// webConfigAuthenticates returns whether the web config file authenticates clients, via basic auth or client certificates
+func webConfigAuthenticates(path string) (bool, error) {
+	if path == "" {
+		return false, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read web config file")
+	}
+
+	var config webConfig
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return false, errors.Wrap(err, "failed to parse web config file")
+	}
+
+	return len(config.BasicAuthUsers) > 0 || config.TLSServerConfig.ClientAuthType == "RequireAndVerifyClientCert", nil
+}
+
+// isPublicIP returns whether the IP is reachable from the internet
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsUnspecified() && !cgnatNetwork.Contains(ip)
+}
+
+// publicIPs returns the public IPs that a server listening on address is reachable on
+// - listening on all interfaces (e.g. ":9401", "0.0.0.0:9401") is reachable on the IPs of all interfaces
+func publicIPs(address string, interfaceAddrs func() ([]net.Addr, error)) ([]net.IP, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid address %q", address)
+	}
+
+	var ips []net.IP
+	switch ip := net.ParseIP(host); {
+	case host == "" || (ip != nil && ip.IsUnspecified()):
+		addrs, err := interfaceAddrs()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list the addresses of the network interfaces")
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			// 0.0.0.0 only listens on IPv4 addresses, "" and :: on both
+			if ip != nil && ip.To4() != nil && ipNet.IP.To4() == nil {
+				continue
+			}
+			ips = append(ips, ipNet.IP)
+		}
+	case ip != nil:
+		ips = append(ips, ip)
+	default:
+		resolved, err := net.LookupIP(host)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to resolve %q", host)
+		}
+		ips = append(ips, resolved...)
+	}
+
+	var public []net.IP
+	for _, ip := range ips {
+		if isPublicIP(ip) {
+			public = append(public, ip)
+		}
+	}
+
+	return public, nil
+}
+
+// warnPublicMetrics warns if the /metrics endpoint is reachable on a public IP without authentication
+func (a GPUMetricsAgent) warnPublicMetrics() {
+	if a.Options.WebSystemdSocket {
+		return
+	}
+
+	authenticates, err := webConfigAuthenticates(a.Options.WebConfigFile)
+	if err != nil {
+		logrus.Warnf("Cannot determine whether /metrics requires authentication: %s", err)
+		return
+	}
+	if authenticates {
+		return
+	}
+
+	var addresses []string
+	for _, address := range a.Options.Addresses {
+		ips, err := publicIPs(address, net.InterfaceAddrs)
+		if err != nil {
+			logrus.Warnf("Cannot determine whether /metrics is served on a public IP: %s", err)
+			continue
+		}
+		for _, ip := range ips {
+			addresses = append(addresses, ip.String())
+		}
+	}
+	if len(addresses) == 0 {
+		return
+	}
+
+	logrus.Warnf("/metrics is served on the public IPs %s without authentication, exposing the GPU models and utilization. "+
+		"Configure basic auth or client certificates with --web-config-file, or listen on localhost or the VPC interface with --address",
+		strings.Join(addresses, ", "))
+}
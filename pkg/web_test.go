@@ -0,0 +1,137 @@
+package pkg
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	var tests = []struct {
+		ip       string
+		expected bool
+	}{
+		{"127.0.0.1", false},
+		{"10.116.0.2", false},
+		{"172.16.0.5", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"::1", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"164.90.128.10", true},
+		{"2604:a880:400:d1::1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := isPublicIP(net.ParseIP(tt.ip)); got != tt.expected {
+				t.Errorf("expected %v, but got: %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestPublicIPs(t *testing.T) {
+	interfaceAddrs := func() ([]net.Addr, error) {
+		var addrs []net.Addr
+		for _, cidr := range []string{"127.0.0.1/8", "164.90.128.10/20", "10.116.0.2/20", "2604:a880:400:d1::1/64", "fe80::1/64"} {
+			ip, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ipNet.IP = ip
+			addrs = append(addrs, ipNet)
+		}
+		return addrs, nil
+	}
+
+	var tests = []struct {
+		address  string
+		expected []string
+	}{
+		{"localhost:9401", nil},
+		{"10.116.0.2:9401", nil},
+		{"164.90.128.10:9401", []string{"164.90.128.10"}},
+		{":9401", []string{"164.90.128.10", "2604:a880:400:d1::1"}},
+		{"0.0.0.0:9401", []string{"164.90.128.10"}},
+		{"[::]:9401", []string{"164.90.128.10", "2604:a880:400:d1::1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			ips, err := publicIPs(tt.address, interfaceAddrs)
+			if err != nil {
+				t.Fatalf("expected no error, but got: %s", err.Error())
+			}
+
+			var got []string
+			for _, ip := range ips {
+				got = append(got, ip.String())
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected public IPs %v, but got: %v", tt.expected, got)
+			}
+		})
+	}
+
+	if _, err := publicIPs("9401", interfaceAddrs); err == nil {
+		t.Errorf("expected an error for an address without port, but got none")
+	}
+}
+
+func TestWebConfigAuthenticates(t *testing.T) {
+	var tests = []struct {
+		name     string
+		config   string
+		expected bool
+	}{
+		{"empty", "", false},
+		{"TLS only", "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n", false},
+		{"basic auth", "basic_auth_users:\n  prometheus: $2y$10$X0h1gDsPszWURQaxFh.zoubFi6DXncSjhoQNJgRrnGs7EsimhC7zG\n", true},
+		{"client certificates", "tls_server_config:\n  client_auth_type: RequireAndVerifyClientCert\n  client_ca_file: ca.crt\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "web-config.yml")
+			if err := os.WriteFile(path, []byte(tt.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := webConfigAuthenticates(path)
+			if err != nil {
+				t.Fatalf("expected no error, but got: %s", err.Error())
+			}
+			if got != tt.expected {
+				t.Errorf("expected %v, but got: %v", tt.expected, got)
+			}
+		})
+	}
+
+	if got, err := webConfigAuthenticates(""); got || err != nil {
+		t.Errorf("expected no authentication without web config file, but got: %v, %v", got, err)
+	}
+}
+
+func TestNewGPUMetricsAgentWebConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "web-config.yml")
+	if err := os.WriteFile(path, []byte("tls_server_config:\n  cert_file: missing.crt\n  key_file: missing.key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewGPUMetricsAgent(Options{WebConfigFile: path}); err == nil {
+		t.Errorf("expected an error for a web config file referring to missing certificates, but got none")
+	}
+
+	agent, err := NewGPUMetricsAgent(Options{})
+	if err != nil {
+		t.Fatalf("expected no error, but got: %s", err.Error())
+	}
+	if !reflect.DeepEqual(agent.Options.Addresses, []string{DefaultAddress}) {
+		t.Errorf("expected the /metrics endpoint to listen on %q by default, but got: %q", DefaultAddress, agent.Options.Addresses)
+	}
+}